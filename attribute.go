@@ -3,8 +3,6 @@ package conntrack
 import (
 	"encoding/binary"
 	"log"
-	"net"
-	"time"
 
 	"github.com/florianl/go-conntrack/internal/unix"
 
@@ -127,173 +125,42 @@ const (
 	ctaNatV6MaxIP = 5
 )
 
+const (
+	ctaProtoNatPortMin = 1
+	ctaProtoNatPortMax = 2
+)
+
 const nlafNested = (1 << 15)
 
-func extractSecCtx(v *SecCtx, logger *log.Logger, data []byte) error {
-	ad, err := netlink.NewAttributeDecoder(data)
-	if err != nil {
-		return err
-	}
-	ad.ByteOrder = binary.BigEndian
-	for ad.Next() {
-		switch ad.Type() {
-		case ctaSecCtxName:
-			tmp := ad.String()
-			v.Name = &tmp
-		default:
-			logger.Printf("extractSecCtx(): %d | %d\t %v", ad.Type(), ad.Type()&0xFF, ad.Bytes())
-		}
-	}
-	return ad.Err()
-}
+func marshalSeqAdj(logger *log.Logger, v *SeqAdj) ([]byte, error) {
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
 
-func extractTimestamp(v *Timestamp, logger *log.Logger, data []byte) error {
-	ad, err := netlink.NewAttributeDecoder(data)
-	if err != nil {
-		return err
+	if v.CorrectionPos != nil {
+		ae.Uint32(ctaSeqAdjCorrPos, *v.CorrectionPos)
 	}
-	ad.ByteOrder = binary.BigEndian
-	for ad.Next() {
-		switch ad.Type() {
-		case ctaTimestampStart:
-			tmp := ad.Uint64()
-			ts := time.Unix(0, int64(tmp))
-			v.Start = &ts
-		case ctaTimestampStop:
-			tmp := ad.Uint64()
-			ts := time.Unix(0, int64(tmp))
-			v.Stop = &ts
-		default:
-			logger.Printf("extractTimestamp(): %d | %d\t %v", ad.Type(), ad.Type()&0xFF, ad.Bytes())
-		}
-	}
-	return ad.Err()
-}
-
-func extractCounter(v *Counter, logger *log.Logger, data []byte) error {
-	ad, err := netlink.NewAttributeDecoder(data)
-	if err != nil {
-		return err
+	if v.OffsetBefore != nil {
+		ae.Uint32(ctaSeqAdjOffsetBefore, *v.OffsetBefore)
 	}
-	ad.ByteOrder = binary.BigEndian
-	for ad.Next() {
-		switch ad.Type() {
-		case ctaCounterPackets:
-			tmp := ad.Uint64()
-			v.Packets = &tmp
-		case ctaCounterBytes:
-			tmp := ad.Uint64()
-			v.Bytes = &tmp
-		case ctaCounter32Packets:
-			tmp := ad.Uint32()
-			v.Packets32 = &tmp
-		case ctaCounter32Bytes:
-			tmp := ad.Uint32()
-			v.Bytes32 = &tmp
-		default:
-			logger.Printf("extractCounter(): %d | %d\t %v", ad.Type(), ad.Type()&0xFF, ad.Bytes())
-		}
+	if v.OffsetAfter != nil {
+		ae.Uint32(ctaSeqAdjOffsetAfter, *v.OffsetAfter)
 	}
-	return ad.Err()
-}
 
-func extractDCCPInfo(v *DCCPInfo, logger *log.Logger, data []byte) error {
-	ad, err := netlink.NewAttributeDecoder(data)
-	if err != nil {
-		return err
-	}
-	ad.ByteOrder = binary.BigEndian
-	for ad.Next() {
-		switch ad.Type() {
-		case ctaProtoinfoDCCPState:
-			tmp := ad.Uint8()
-			v.State = &tmp
-		case ctaProtoinfoDCCPRole:
-			tmp := ad.Uint8()
-			v.Role = &tmp
-		case ctaProtoinfoDCCPHandshakeSeq:
-			tmp := ad.Uint64()
-			v.HandshakeSeq = &tmp
-		default:
-			logger.Printf("extractDCCPInfo(): %d | %d\t %v", ad.Type(), ad.Type()&0xFF, ad.Bytes())
-		}
-	}
-	return ad.Err()
+	return ae.Encode()
 }
 
-func extractSCTPInfo(v *SCTPInfo, logger *log.Logger, data []byte) error {
-	ad, err := netlink.NewAttributeDecoder(data)
-	if err != nil {
-		return err
-	}
-	ad.ByteOrder = binary.BigEndian
-	for ad.Next() {
-		switch ad.Type() {
-		case ctaProtoinfoSCTPState:
-			tmp := ad.Uint8()
-			v.State = &tmp
-		case ctaProtoinfoSCTPVTagOriginal:
-			tmp := ad.Uint32()
-			v.VTagOriginal = &tmp
-		case ctaProtoinfoSCTPVTagReply:
-			tmp := ad.Uint32()
-			v.VTagReply = &tmp
-		default:
-			logger.Printf("extractSCTPInfo(): %d | %d\t %v", ad.Type(), ad.Type()&0xFF, ad.Bytes())
-		}
-	}
-	return ad.Err()
-}
+func marshalProtoNat(logger *log.Logger, v *ProtoTuple) ([]byte, error) {
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
 
-func extractSeqAdj(v *SeqAdj, logger *log.Logger, data []byte) error {
-	ad, err := netlink.NewAttributeDecoder(data)
-	if err != nil {
-		return err
+	if v.SrcPort != nil {
+		ae.Uint16(ctaProtoNatPortMin, *v.SrcPort)
 	}
-	ad.ByteOrder = binary.BigEndian
-	for ad.Next() {
-		switch ad.Type() {
-		case ctaSeqAdjCorrPos:
-			tmp := ad.Uint32()
-			v.CorrectionPos = &tmp
-		case ctaSeqAdjOffsetBefore:
-			tmp := ad.Uint32()
-			v.OffsetBefore = &tmp
-		case ctaSeqAdjOffsetAfter:
-			tmp := ad.Uint32()
-			v.OffsetAfter = &tmp
-		default:
-			logger.Printf("extractSeqAdj(): %d | %d\t %v", ad.Type(), ad.Type()&0xFF, ad.Bytes())
-		}
+	if v.DstPort != nil {
+		ae.Uint16(ctaProtoNatPortMax, *v.DstPort)
 	}
-	return ad.Err()
-}
 
-func extractNat(v *Nat, logger *log.Logger, data []byte) error {
-	ad, err := netlink.NewAttributeDecoder(data)
-	if err != nil {
-		return err
-	}
-	ad.ByteOrder = binary.BigEndian
-	for ad.Next() {
-		switch ad.Type() {
-		case ctaNatV4MinIP:
-			tmp := net.IP(ad.Bytes())
-			v.IPMin = &tmp
-		case ctaNatV4MaxIP:
-			tmp := net.IP(ad.Bytes())
-			v.IPMax = &tmp
-		case ctaNatV6MinIP:
-			tmp := net.IP(ad.Bytes())
-			v.IPMin = &tmp
-		case ctaNatV6MaxIP:
-			tmp := net.IP(ad.Bytes())
-			v.IPMax = &tmp
-		default:
-			logger.Printf("extractNat(): %d | %d\t %v", ad.Type(), ad.Type()&0xFF, ad.Bytes())
-		}
-	}
-	return ad.Err()
+	return ae.Encode()
 }
 
 func marshalNat(logger *log.Logger, v *Nat) ([]byte, error) {
@@ -315,51 +182,14 @@ func marshalNat(logger *log.Logger, v *Nat) ([]byte, error) {
 			ae.Bytes(ctaNatV4MaxIP, tmp)
 		}
 	}
-	return ae.Encode()
-}
-
-func extractTCPInfo(v *TCPInfo, logger *log.Logger, data []byte) error {
-	ad, err := netlink.NewAttributeDecoder(data)
-	if err != nil {
-		return err
-	}
-	ad.ByteOrder = binary.BigEndian
-	for ad.Next() {
-		switch ad.Type() {
-		case ctaProtoinfoTCPState:
-			tmp := ad.Uint8()
-			v.State = &tmp
-		case ctaProtoinfoTCPWScaleOrig:
-			tmp := ad.Uint8()
-			v.WScaleOrig = &tmp
-		case ctaProtoinfoTCPWScaleRepl:
-			tmp := ad.Uint8()
-			v.WScaleRepl = &tmp
-		case ctaProtoinfoTCPFlagsOrig:
-			flags := &TCPFlags{}
-			tmp := ad.Bytes()
-			if len(tmp) > 0 {
-				flags.Flags = &tmp[0]
-			}
-			if len(tmp) > 1 {
-				flags.Mask = &tmp[1]
-			}
-			v.FlagsOrig = flags
-		case ctaProtoinfoTCPFlagsRepl:
-			flags := &TCPFlags{}
-			tmp := ad.Bytes()
-			if len(tmp) > 0 {
-				flags.Flags = &tmp[0]
-			}
-			if len(tmp) > 1 {
-				flags.Mask = &tmp[1]
-			}
-			v.FlagsReply = flags
-		default:
-			logger.Printf("extractTCPInfo(): %d | %d\t %v", ad.Type(), ad.Type()&0xFF, ad.Bytes())
+	if v.Proto != nil {
+		data, err := marshalProtoNat(logger, v.Proto)
+		if err != nil {
+			return []byte{}, err
 		}
+		ae.Bytes(ctaNatProto|nlafNested, data)
 	}
-	return ad.Err()
+	return ae.Encode()
 }
 
 func marshalTCPInfo(logger *log.Logger, v *TCPInfo) ([]byte, error) {
@@ -404,39 +234,6 @@ func marshalTCPInfo(logger *log.Logger, v *TCPInfo) ([]byte, error) {
 	return ae.Encode()
 }
 
-func extractProtoInfo(v *ProtoInfo, logger *log.Logger, data []byte) error {
-	ad, err := netlink.NewAttributeDecoder(data)
-	if err != nil {
-		return err
-	}
-	ad.ByteOrder = nativeEndian
-	for ad.Next() {
-		switch ad.Type() {
-		case ctaProtoinfoTCP:
-			tcp := &TCPInfo{}
-			if err := extractTCPInfo(tcp, logger, ad.Bytes()); err != nil {
-				return err
-			}
-			v.TCP = tcp
-		case ctaProtoinfoDCCP:
-			dccp := &DCCPInfo{}
-			if err := extractDCCPInfo(dccp, logger, ad.Bytes()); err != nil {
-				return err
-			}
-			v.DCCP = dccp
-		case ctaProtoinfoSCTP:
-			sctp := &SCTPInfo{}
-			if err := extractSCTPInfo(sctp, logger, ad.Bytes()); err != nil {
-				return err
-			}
-			v.SCTP = sctp
-		default:
-			logger.Printf("extractProtoInfo(): %d | %d\t %v", ad.Type(), ad.Type()&0xFF, ad.Bytes())
-		}
-	}
-	return ad.Err()
-}
-
 func marshalProtoInfo(logger *log.Logger, v *ProtoInfo) ([]byte, error) {
 	ae := netlink.NewAttributeEncoder()
 
@@ -451,27 +248,6 @@ func marshalProtoInfo(logger *log.Logger, v *ProtoInfo) ([]byte, error) {
 	return ae.Encode()
 }
 
-func extractHelper(v *Helper, logger *log.Logger, data []byte) error {
-	ad, err := netlink.NewAttributeDecoder(data)
-	if err != nil {
-		return err
-	}
-	ad.ByteOrder = binary.BigEndian
-	for ad.Next() {
-		switch ad.Type() {
-		case ctaHelpName:
-			tmp := ad.String()
-			v.Name = &tmp
-		case ctaHelpInfo:
-			tmp := ad.String()
-			v.Info = &tmp
-		default:
-			logger.Printf("extractHelper(): %d | %d\t %v", ad.Type(), ad.Type()&0xFF, ad.Bytes())
-		}
-	}
-	return ad.Err()
-}
-
 func marshalHelper(logger *log.Logger, v *Helper) ([]byte, error) {
 	ae := netlink.NewAttributeEncoder()
 
@@ -485,49 +261,6 @@ func marshalHelper(logger *log.Logger, v *Helper) ([]byte, error) {
 	return ae.Encode()
 }
 
-func extractProtoTuple(logger *log.Logger, data []byte) (ProtoTuple, error) {
-	var proto ProtoTuple
-	ad, err := netlink.NewAttributeDecoder(data)
-	if err != nil {
-		return proto, err
-	}
-	ad.ByteOrder = binary.BigEndian
-	for ad.Next() {
-		switch ad.Type() {
-		case ctaProtoNum:
-			tmp := ad.Uint8()
-			proto.Number = &tmp
-		case ctaProtoSrcPort:
-			tmp := ad.Uint16()
-			proto.SrcPort = &tmp
-		case ctaProtoDstPort:
-			tmp := ad.Uint16()
-			proto.DstPort = &tmp
-		case ctaProtoIcmpID:
-			tmp := ad.Uint16()
-			proto.IcmpID = &tmp
-		case ctaProtoIcmpType:
-			tmp := ad.Uint8()
-			proto.IcmpType = &tmp
-		case ctaProtoIcmpCode:
-			tmp := ad.Uint8()
-			proto.IcmpCode = &tmp
-		case ctaProtoIcmpv6ID:
-			tmp := ad.Uint16()
-			proto.Icmpv6ID = &tmp
-		case ctaProtoIcmpv6Type:
-			tmp := ad.Uint8()
-			proto.Icmpv6Type = &tmp
-		case ctaProtoIcmpv6Code:
-			tmp := ad.Uint8()
-			proto.Icmpv6Code = &tmp
-		default:
-			logger.Printf("extractProtoTuple(): %d | %d\t %v", ad.Type(), ad.Type()&0xFF, ad.Bytes())
-		}
-	}
-	return proto, ad.Err()
-}
-
 func marshalProtoTuple(logger *log.Logger, v *ProtoTuple) ([]byte, error) {
 	ae := netlink.NewAttributeEncoder()
 	ae.ByteOrder = binary.BigEndian
@@ -562,30 +295,6 @@ func marshalProtoTuple(logger *log.Logger, v *ProtoTuple) ([]byte, error) {
 	return ae.Encode()
 }
 
-func extractIP(logger *log.Logger, data []byte) (net.IP, net.IP, error) {
-	var src, dst net.IP
-	ad, err := netlink.NewAttributeDecoder(data)
-	if err != nil {
-		return src, dst, err
-	}
-	ad.ByteOrder = nativeEndian
-	for ad.Next() {
-		switch ad.Type() {
-		case ctaIPv4Src:
-			src = net.IP(ad.Bytes())
-		case ctaIPv4Dst:
-			dst = net.IP(ad.Bytes())
-		case ctaIPv6Src:
-			src = net.IP(ad.Bytes())
-		case ctaIPv6Dst:
-			dst = net.IP(ad.Bytes())
-		default:
-			logger.Printf("extractIP(): %d | %d\t %v", ad.Type(), ad.Type()&0xFF, ad.Bytes())
-		}
-	}
-	return src, dst, ad.Err()
-}
-
 func marshalIP(logger *log.Logger, v *IPTuple) ([]byte, error) {
 	ae := netlink.NewAttributeEncoder()
 
@@ -610,39 +319,6 @@ func marshalIP(logger *log.Logger, v *IPTuple) ([]byte, error) {
 	return ae.Encode()
 }
 
-func extractIPTuple(v *IPTuple, logger *log.Logger, data []byte) error {
-	ad, err := netlink.NewAttributeDecoder(data)
-	if err != nil {
-		return err
-	}
-	ad.ByteOrder = nativeEndian
-	for ad.Next() {
-		switch ad.Type() {
-		case ctaTupleIP:
-			src, dst, err := extractIP(logger, ad.Bytes())
-			if err != nil {
-				return err
-			}
-			v.Src = &src
-			v.Dst = &dst
-		case ctaTupleProto:
-			proto, err := extractProtoTuple(logger, ad.Bytes())
-			if err != nil {
-				return err
-			}
-			v.Proto = &proto
-		case ctaTupleZone:
-			ad.ByteOrder = binary.BigEndian
-			zone := ad.Uint16()
-			v.Zone = &zone
-			ad.ByteOrder = nativeEndian
-		default:
-			logger.Printf("extractIPTuple(): %d | %d\t %v", ad.Type(), ad.Type()&0xFF, ad.Bytes())
-		}
-	}
-	return ad.Err()
-}
-
 func marshalIPTuple(logger *log.Logger, v *IPTuple) ([]byte, error) {
 	ae := netlink.NewAttributeEncoder()
 
@@ -665,130 +341,14 @@ func marshalIPTuple(logger *log.Logger, v *IPTuple) ([]byte, error) {
 	return ae.Encode()
 }
 
-func extractAttribute(c *Con, logger *log.Logger, data []byte) error {
-	ad, err := netlink.NewAttributeDecoder(data)
-	if err != nil {
+// extractIPTuple decodes the tuple in data into v.
+func extractIPTuple(v *IPTuple, data []byte) error {
+	var t Tuple
+	if err := t.decode(data); err != nil {
 		return err
 	}
-	for ad.Next() {
-		switch ad.Type() {
-		case ctaTupleOrig:
-			tuple := &IPTuple{}
-			if err := extractIPTuple(tuple, logger, ad.Bytes()); err != nil {
-				return err
-			}
-			c.Origin = tuple
-		case ctaTupleReply:
-			tuple := &IPTuple{}
-			if err := extractIPTuple(tuple, logger, ad.Bytes()); err != nil {
-				return err
-			}
-			c.Reply = tuple
-		case ctaProtoinfo:
-			protoInfo := &ProtoInfo{}
-			if err := extractProtoInfo(protoInfo, logger, ad.Bytes()); err != nil {
-				return err
-			}
-			c.ProtoInfo = protoInfo
-		case ctaHelp:
-			help := &Helper{}
-			if err := extractHelper(help, logger, ad.Bytes()); err != nil {
-				return err
-			}
-			c.Helper = help
-		case ctaID:
-			ad.ByteOrder = binary.BigEndian
-			tmp := ad.Uint32()
-			c.ID = &tmp
-			ad.ByteOrder = nativeEndian
-		case ctaStatus:
-			ad.ByteOrder = binary.BigEndian
-			tmp := ad.Uint32()
-			c.Status = &tmp
-			ad.ByteOrder = nativeEndian
-		case ctaUse:
-			ad.ByteOrder = binary.BigEndian
-			tmp := ad.Uint32()
-			c.Use = &tmp
-			ad.ByteOrder = nativeEndian
-		case ctaMark:
-			ad.ByteOrder = binary.BigEndian
-			tmp := ad.Uint32()
-			c.Mark = &tmp
-			ad.ByteOrder = nativeEndian
-		case ctaMarkMask:
-			ad.ByteOrder = binary.BigEndian
-			tmp := ad.Uint32()
-			c.MarkMask = &tmp
-			ad.ByteOrder = nativeEndian
-		case ctaTimeout:
-			ad.ByteOrder = binary.BigEndian
-			tmp := ad.Uint32()
-			c.Timeout = &tmp
-			ad.ByteOrder = nativeEndian
-		case ctaCountersOrig:
-			orig := &Counter{}
-			if err := extractCounter(orig, logger, ad.Bytes()); err != nil {
-				return err
-			}
-			c.CounterOrigin = orig
-		case ctaCountersReply:
-			reply := &Counter{}
-			if err := extractCounter(reply, logger, ad.Bytes()); err != nil {
-				return err
-			}
-			c.CounterReply = reply
-		case ctaSeqAdjOrig:
-			orig := &SeqAdj{}
-			if err := extractSeqAdj(orig, logger, ad.Bytes()); err != nil {
-				return err
-			}
-			c.SeqAdjOrig = orig
-		case ctaSeqAdjRepl:
-			reply := &SeqAdj{}
-			if err := extractSeqAdj(reply, logger, ad.Bytes()); err != nil {
-				return err
-			}
-			c.SeqAdjRepl = reply
-		case ctaZone:
-			ad.ByteOrder = binary.BigEndian
-			zone := ad.Uint16()
-			c.Zone = &zone
-			ad.ByteOrder = nativeEndian
-		case ctaSecCtx:
-			secCtx := &SecCtx{}
-			if err := extractSecCtx(secCtx, logger, ad.Bytes()); err != nil {
-				return err
-			}
-			c.SecCtx = secCtx
-		case ctaTimestamp:
-			ts := &Timestamp{}
-			if err := extractTimestamp(ts, logger, ad.Bytes()); err != nil {
-				return err
-			}
-			c.Timestamp = ts
-		case ctaNatSrc:
-			nat := &Nat{}
-			if err := extractNat(nat, logger, ad.Bytes()); err != nil {
-				return err
-			}
-			c.NatSrc = nat
-		case ctaLables:
-			label := ad.Bytes()
-			c.Label = &label
-		case ctaLablesMask:
-			labelMask := ad.Bytes()
-			c.LabelMask = &labelMask
-		case ctaStatusMask:
-			ad.ByteOrder = binary.BigEndian
-			tmp := ad.Uint32()
-			c.StatusMask = &tmp
-			ad.ByteOrder = nativeEndian
-		default:
-			logger.Printf("extractAttribute() - Unknown attribute: %d %d %v\n", ad.Type()&0xFF, ad.Type(), ad.Bytes())
-		}
-	}
-	return ad.Err()
+	*v = *t.ipTuple()
+	return nil
 }
 
 func checkHeader(data []byte) int {
@@ -799,9 +359,21 @@ func checkHeader(data []byte) int {
 }
 
 func extractAttributes(logger *log.Logger, c *Con, msg []byte) error {
-	offset := checkHeader(msg[:2])
-	if err := extractAttribute(c, logger, msg[offset:]); err != nil {
+	return extractMaskedAttributes(logger, c, msg, FieldAll)
+}
+
+// extractMaskedAttributes extracts only the attributes selected by mask and
+// keeps a copy of msg in c.Raw, if FieldRaw is set and not all attributes are
+// selected.
+func extractMaskedAttributes(logger *log.Logger, c *Con, msg []byte, mask Field) error {
+	var e Entry
+	if err := e.DecodeFields(msg, mask); err != nil {
 		return err
 	}
+	*c = e.Con()
+	if mask&FieldRaw != 0 && mask&FieldAll != FieldAll {
+		raw := append([]byte(nil), msg...)
+		c.Raw = &raw
+	}
 	return nil
 }
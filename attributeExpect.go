@@ -43,7 +43,7 @@ func extractNatInfo(v *NatInfo, logger *log.Logger, data []byte) error {
 			ad.ByteOrder = nativeEndian
 		case ctaExpNatTuple:
 			tuple := &IPTuple{}
-			if err := extractIPTuple(tuple, logger, ad.Bytes()); err != nil {
+			if err := extractIPTuple(tuple, ad.Bytes()); err != nil {
 				return err
 			}
 			v.Tuple = tuple
@@ -85,19 +85,19 @@ func extractAttributeExpect(c *Con, logger *log.Logger, data []byte) error {
 		switch ad.Type() {
 		case ctaExpMaster:
 			tuple := &IPTuple{}
-			if err := extractIPTuple(tuple, logger, ad.Bytes()); err != nil {
+			if err := extractIPTuple(tuple, ad.Bytes()); err != nil {
 				return err
 			}
 			c.Origin = tuple
 		case ctaExpTuple:
 			tuple := &IPTuple{}
-			if err := extractIPTuple(tuple, logger, ad.Bytes()); err != nil {
+			if err := extractIPTuple(tuple, ad.Bytes()); err != nil {
 				return err
 			}
 			c.Exp.Tuple = tuple
 		case ctaExpMask:
 			tuple := &IPTuple{}
-			if err := extractIPTuple(tuple, logger, ad.Bytes()); err != nil {
+			if err := extractIPTuple(tuple, ad.Bytes()); err != nil {
 				return err
 			}
 			c.Exp.Mask = tuple
@@ -24,6 +24,12 @@ const (
 	ctaStatsSearchRestart
 )
 
+const (
+	ctaStatsGlobalUnspec = iota
+	ctaStatsGlobalEntries
+	ctaStatsGlobalMaxEntries
+)
+
 const (
 	ctaStatsExpUnspec = iota
 	ctaStatsExpNew
@@ -104,3 +110,25 @@ func extractExpCPUStats(s *CPUStat, logger *log.Logger, data []byte) error {
 	}
 	return ad.Err()
 }
+
+func extractGlobalStats(s *GlobalStats, logger *log.Logger, data []byte) error {
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return err
+	}
+
+	ad.ByteOrder = binary.BigEndian
+	for ad.Next() {
+		switch ad.Type() {
+		case ctaStatsGlobalEntries:
+			tmp := ad.Uint32()
+			s.Entries = &tmp
+		case ctaStatsGlobalMaxEntries:
+			tmp := ad.Uint32()
+			s.MaxEntries = &tmp
+		default:
+			logger.Printf("extractGlobalStats()): %d | %d\t %v", ad.Type(), ad.Type()&0xFF, ad.Bytes())
+		}
+	}
+	return ad.Err()
+}
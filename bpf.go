@@ -33,6 +33,30 @@ type filterCheckStruct struct {
 	ct, len int
 	mask    bool
 	nest    []uint32
+	// off is the offset of the value within the attribute.
+	off int
+	// str is set for NUL terminated strings of variable length.
+	str bool
+	// status holds the bits of CTA_STATUS, that have to be set, so the
+	// attribute is considered to exist.
+	status Status
+	// family is set for the layer 3 protocol, that is taken from the header
+	// of the message, once the attribute exists.
+	family bool
+}
+
+// validLength reports whether data has the length of the attribute.
+func (check filterCheckStruct) validLength(data []byte) bool {
+	if check.str {
+		return len(data) > 0
+	}
+	return len(data) == check.len
+}
+
+// compiled reports whether the attribute can only be filtered with the
+// compiler of filter expressions.
+func (check filterCheckStruct) compiled() bool {
+	return check.off != 0 || check.str || check.status != 0 || check.family
 }
 
 var filterCheck = map[ConnAttrType]filterCheckStruct{
@@ -54,15 +78,15 @@ var filterCheck = map[ConnAttrType]filterCheckStruct{
 	AttrIcmpv6Type:              {ct: ctaProtoIcmpv6Type, len: 1, nest: []uint32{ctaTupleOrig, ctaTupleProto}},
 	AttrIcmpv6Code:              {ct: ctaProtoIcmpv6Code, len: 1, nest: []uint32{ctaTupleOrig, ctaTupleProto}},
 	AttrIcmpv6ID:                {ct: ctaProtoIcmpv6ID, len: 2, nest: []uint32{ctaTupleOrig, ctaTupleProto}},
-	AttrOrigL3Proto:             {ct: ctaUnspec},
-	AttrReplL3Proto:             {ct: ctaUnspec},
+	AttrOrigL3Proto:             {ct: ctaTupleOrig, len: 1, family: true},
+	AttrReplL3Proto:             {ct: ctaTupleReply, len: 1, family: true},
 	AttrOrigL4Proto:             {ct: ctaProtoNum, len: 1, nest: []uint32{ctaTupleOrig, ctaTupleProto}},
 	AttrReplL4Proto:             {ct: ctaProtoNum, len: 1, nest: []uint32{ctaTupleReply, ctaTupleProto}},
 	AttrTCPState:                {ct: ctaProtoinfoTCPState, len: 1, nest: []uint32{ctaProtoinfo, ctaProtoinfoTCP}},
-	AttrSNatIPv4:                {ct: ctaUnspec},
-	AttrDNatIPv4:                {ct: ctaUnspec},
-	AttrSNatPort:                {ct: ctaUnspec},
-	AttrDNatPort:                {ct: ctaUnspec},
+	AttrSNatIPv4:                {ct: ctaIPv4Dst, len: 4, mask: true, nest: []uint32{ctaTupleReply, ctaTupleIP}, status: StatusSrcNat},
+	AttrDNatIPv4:                {ct: ctaIPv4Src, len: 4, mask: true, nest: []uint32{ctaTupleReply, ctaTupleIP}, status: StatusDstNat},
+	AttrSNatPort:                {ct: ctaProtoDstPort, len: 2, nest: []uint32{ctaTupleReply, ctaTupleProto}, status: StatusSrcNat},
+	AttrDNatPort:                {ct: ctaProtoSrcPort, len: 2, nest: []uint32{ctaTupleReply, ctaTupleProto}, status: StatusDstNat},
 	AttrTimeout:                 {ct: ctaTimeout, len: 4},
 	AttrMark:                    {ct: ctaMark, len: 4, mask: true},
 	AttrMarkMask:                {ct: ctaMarkMask, len: 4},
@@ -75,16 +99,16 @@ var filterCheck = map[ConnAttrType]filterCheckStruct{
 	AttrStatus:                  {ct: ctaStatus, len: 4},
 	AttrTCPFlagsOrig:            {ct: ctaProtoinfoTCPFlagsOrig, len: 1, nest: []uint32{ctaProtoinfo, ctaProtoinfoTCP}},
 	AttrTCPFlagsRepl:            {ct: ctaProtoinfoTCPFlagsRepl, len: 1, nest: []uint32{ctaProtoinfo, ctaProtoinfoTCP}},
-	AttrTCPMaskOrig:             {ct: ctaUnspec},
-	AttrTCPMaskRepl:             {ct: ctaUnspec},
-	AttrMasterIPv4Src:           {ct: ctaUnspec},
-	AttrMasterIPv4Dst:           {ct: ctaUnspec},
-	AttrMasterIPv6Src:           {ct: ctaUnspec},
-	AttrMasterIPv6Dst:           {ct: ctaUnspec},
-	AttrMasterPortSrc:           {ct: ctaUnspec},
-	AttrMasterPortDst:           {ct: ctaUnspec},
-	AttrMasterL3Proto:           {ct: ctaUnspec},
-	AttrMasterL4Proto:           {ct: ctaUnspec},
+	AttrTCPMaskOrig:             {ct: ctaProtoinfoTCPFlagsOrig, len: 1, off: 1, nest: []uint32{ctaProtoinfo, ctaProtoinfoTCP}},
+	AttrTCPMaskRepl:             {ct: ctaProtoinfoTCPFlagsRepl, len: 1, off: 1, nest: []uint32{ctaProtoinfo, ctaProtoinfoTCP}},
+	AttrMasterIPv4Src:           {ct: ctaIPv4Src, len: 4, mask: true, nest: []uint32{ctaTupleMaster, ctaTupleIP}},
+	AttrMasterIPv4Dst:           {ct: ctaIPv4Dst, len: 4, mask: true, nest: []uint32{ctaTupleMaster, ctaTupleIP}},
+	AttrMasterIPv6Src:           {ct: ctaIPv6Src, len: 16, mask: true, nest: []uint32{ctaTupleMaster, ctaTupleIP}},
+	AttrMasterIPv6Dst:           {ct: ctaIPv6Dst, len: 16, mask: true, nest: []uint32{ctaTupleMaster, ctaTupleIP}},
+	AttrMasterPortSrc:           {ct: ctaProtoSrcPort, len: 2, nest: []uint32{ctaTupleMaster, ctaTupleProto}},
+	AttrMasterPortDst:           {ct: ctaProtoDstPort, len: 2, nest: []uint32{ctaTupleMaster, ctaTupleProto}},
+	AttrMasterL3Proto:           {ct: ctaTupleMaster, len: 1, family: true},
+	AttrMasterL4Proto:           {ct: ctaProtoNum, len: 1, nest: []uint32{ctaTupleMaster, ctaTupleProto}},
 	AttrSecmark:                 {ct: ctaSecmark, len: 4},
 	AttrOrigNatSeqCorrectionPos: {ct: ctaUnspec},
 	AttrOrigNatSeqOffsetBefore:  {ct: ctaUnspec},
@@ -95,21 +119,60 @@ var filterCheck = map[ConnAttrType]filterCheckStruct{
 	AttrSctpState:               {ct: ctaProtoinfoSCTPState, len: 1, nest: []uint32{ctaProtoinfo, ctaProtoinfoSCTP}},
 	AttrSctpVtagOrig:            {ct: ctaProtoinfoSCTPVTagOriginal, len: 4, nest: []uint32{ctaProtoinfo, ctaProtoinfoSCTP}},
 	AttrSctpVtagRepl:            {ct: ctaProtoinfoSCTPVTagReply, len: 4, nest: []uint32{ctaProtoinfo, ctaProtoinfoSCTP}},
+	AttrHelperName:              {ct: ctaHelpName, str: true, nest: []uint32{ctaHelp}},
 	AttrDccpState:               {ct: ctaProtoinfoDCCPState, len: 1, nest: []uint32{ctaProtoinfo, ctaProtoinfoDCCP}},
 	AttrDccpRole:                {ct: ctaProtoinfoDCCPRole, len: 1, nest: []uint32{ctaProtoinfo, ctaProtoinfoDCCP}},
 	AttrTCPWScaleOrig:           {ct: ctaProtoinfoTCPWScaleOrig, len: 1, nest: []uint32{ctaProtoinfo, ctaProtoinfoTCP}},
 	AttrTCPWScaleRepl:           {ct: ctaProtoinfoTCPWScaleRepl, len: 1, nest: []uint32{ctaProtoinfo, ctaProtoinfoTCP}},
 	AttrZone:                    {ct: ctaZone, len: 2},
-	AttrSecCtx:                  {ct: ctaUnspec},
+	AttrSecCtx:                  {ct: ctaSecCtxName, str: true, nest: []uint32{ctaSecCtx}},
 	AttrTimestampStart:          {ct: ctaTimestampStart, len: 8, nest: []uint32{ctaTimestamp}},
 	AttrTimestampStop:           {ct: ctaTimestampStop, len: 8, nest: []uint32{ctaTimestamp}},
 	AttrHelperInfo:              {ct: ctaUnspec},
-	AttrConnlabels:              {ct: ctaUnspec},
+	AttrConnlabels:              {ct: ctaLables, len: 16, mask: true},
 	AttrConnlabelsMask:          {ct: ctaUnspec},
 	AttrOrigzone:                {ct: ctaUnspec},
 	AttrReplzone:                {ct: ctaUnspec},
-	AttrSNatIPv6:                {ct: ctaUnspec},
-	AttrDNatIPv6:                {ct: ctaUnspec},
+	AttrSNatIPv6:                {ct: ctaIPv6Dst, len: 16, mask: true, nest: []uint32{ctaTupleReply, ctaTupleIP}, status: StatusSrcNat},
+	AttrDNatIPv6:                {ct: ctaIPv6Src, len: 16, mask: true, nest: []uint32{ctaTupleReply, ctaTupleIP}, status: StatusDstNat},
+}
+
+// expectFilterCheck is like filterCheck, but for events of the Expected table.
+// The attributes of the original tuple refer to the tuple of the expected
+// connection and the attributes of the master tuple to the original tuple of
+// its master.
+var expectFilterCheck = map[ConnAttrType]filterCheckStruct{
+	AttrOrigIPv4Src:   {ct: ctaIPv4Src, len: 4, mask: true, nest: []uint32{ctaExpTuple, ctaTupleIP}},
+	AttrOrigIPv4Dst:   {ct: ctaIPv4Dst, len: 4, mask: true, nest: []uint32{ctaExpTuple, ctaTupleIP}},
+	AttrOrigIPv6Src:   {ct: ctaIPv6Src, len: 16, mask: true, nest: []uint32{ctaExpTuple, ctaTupleIP}},
+	AttrOrigIPv6Dst:   {ct: ctaIPv6Dst, len: 16, mask: true, nest: []uint32{ctaExpTuple, ctaTupleIP}},
+	AttrOrigPortSrc:   {ct: ctaProtoSrcPort, len: 2, nest: []uint32{ctaExpTuple, ctaTupleProto}},
+	AttrOrigPortDst:   {ct: ctaProtoDstPort, len: 2, nest: []uint32{ctaExpTuple, ctaTupleProto}},
+	AttrOrigL3Proto:   {ct: ctaExpTuple, len: 1, family: true},
+	AttrOrigL4Proto:   {ct: ctaProtoNum, len: 1, nest: []uint32{ctaExpTuple, ctaTupleProto}},
+	AttrMasterIPv4Src: {ct: ctaIPv4Src, len: 4, mask: true, nest: []uint32{ctaExpMaster, ctaTupleIP}},
+	AttrMasterIPv4Dst: {ct: ctaIPv4Dst, len: 4, mask: true, nest: []uint32{ctaExpMaster, ctaTupleIP}},
+	AttrMasterIPv6Src: {ct: ctaIPv6Src, len: 16, mask: true, nest: []uint32{ctaExpMaster, ctaTupleIP}},
+	AttrMasterIPv6Dst: {ct: ctaIPv6Dst, len: 16, mask: true, nest: []uint32{ctaExpMaster, ctaTupleIP}},
+	AttrMasterPortSrc: {ct: ctaProtoSrcPort, len: 2, nest: []uint32{ctaExpMaster, ctaTupleProto}},
+	AttrMasterPortDst: {ct: ctaProtoDstPort, len: 2, nest: []uint32{ctaExpMaster, ctaTupleProto}},
+	AttrMasterL3Proto: {ct: ctaExpMaster, len: 1, family: true},
+	AttrMasterL4Proto: {ct: ctaProtoNum, len: 1, nest: []uint32{ctaExpMaster, ctaTupleProto}},
+	AttrTimeout:       {ct: ctaExpTimeout, len: 4},
+	AttrZone:          {ct: ctaExpZone, len: 2},
+	AttrHelperName:    {ct: ctaExpHelpName, str: true},
+	AttrExpID:         {ct: ctaExpID, len: 4},
+	AttrExpFlags:      {ct: ctaExpFlags, len: 4, mask: true},
+	AttrExpClass:      {ct: ctaExpClass, len: 4},
+	AttrExpNATDir:     {ct: ctaExpNatDir, len: 4, nest: []uint32{ctaExpNat}},
+}
+
+// filterChecks returns how attributes are found in events of subsys.
+func filterChecks(subsys Table) map[ConnAttrType]filterCheckStruct {
+	if subsys == Expected {
+		return expectFilterCheck
+	}
+	return filterCheck
 }
 
 func encodeValue(data []byte) (val uint32) {
@@ -254,6 +317,30 @@ func filterAttribute(filters []ConnAttr) []bpf.RawInstruction {
 	return raw
 }
 
+// filterExprAttribute returns the instructions, that reject an event, if it
+// does not match filters of the same type. The instructions are generated by
+// the compiler of filter expressions.
+func filterExprAttribute(filters []ConnAttr) ([]bpf.RawInstruction, error) {
+	exprs := make([]FilterExpr, len(filters))
+	for i := range filters {
+		exprs[i] = filters[i]
+	}
+	expr := Or(exprs...)
+	if filters[0].Negate {
+		expr = And(exprs...)
+	}
+
+	c := filterCompiler{checks: filterCheck}
+	pass, fail := c.prog.newLabel(), c.prog.newLabel()
+	if err := expr.compile(&c, pass, fail); err != nil {
+		return nil, err
+	}
+	c.prog.bind(fail)
+	c.prog.emit(bpf.RawInstruction{Op: unix.BPF_RET | unix.BPF_K, K: bpfVerdictReject})
+	c.prog.bind(pass)
+	return c.prog.assemble()
+}
+
 // create filter instructions, to check for the subsystem
 func filterSubsys(subsys uint32) []bpf.RawInstruction {
 	var raw []bpf.RawInstruction
@@ -285,13 +372,14 @@ func constructFilter(subsys Table, filters []ConnAttr) ([]bpf.RawInstruction, er
 	raw = append(raw, tmp...)
 
 	for _, filter := range filters {
-		if _, ok := filterCheck[filter.Type]; !ok {
+		check, ok := filterCheck[filter.Type]
+		if !ok {
 			return nil, ErrFilterAttributeNotImplemented
 		}
-		if len(filter.Data) != filterCheck[filter.Type].len {
+		if !check.validLength(filter.Data) {
 			return nil, ErrFilterAttributeLength
 		}
-		if filterCheck[filter.Type].mask && len(filter.Mask) != filterCheck[filter.Type].len {
+		if check.mask && len(filter.Mask) != check.len {
 			return nil, ErrFilterAttributeMaskLength
 		}
 		filterMap[filter.Type] = append(filterMap[filter.Type], filter)
@@ -308,9 +396,14 @@ func constructFilter(subsys Table, filters []ConnAttr) ([]bpf.RawInstruction, er
 	// We can not simple range over the map, because the order of selected items can vary
 	for key := 0; key <= int(attrMax); key++ {
 		if x, ok := filterMap[ConnAttrType(key)]; ok {
-			switch key {
-			case int(AttrMark):
+			switch {
+			case key == int(AttrMark):
 				tmp = filterMarkAttribute(x)
+			case filterCheck[ConnAttrType(key)].compiled():
+				var err error
+				if tmp, err = filterExprAttribute(x); err != nil {
+					return nil, err
+				}
 			default:
 				tmp = filterAttribute(x)
 			}
@@ -391,11 +484,7 @@ func filterMarkAttribute(filters []ConnAttr) []bpf.RawInstruction {
 	return raw
 }
 
-func (nfct *Nfct) attachFilter(subsys Table, filters []ConnAttr) error {
-	bpfFilters, err := constructFilter(subsys, filters)
-	if err != nil {
-		return err
-	}
+func (nfct *Nfct) attachFilter(bpfFilters []bpf.RawInstruction) error {
 	if nfct.debug {
 		fmtInstructions := fmtRawInstructions(bpfFilters)
 		nfct.logger.Println("---BPF filter start---")
@@ -439,6 +528,12 @@ func code2str(op uint16) string {
 		return "BPF_LD|BPF_B|BPF_ABS"
 	case unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K:
 		return "BPF_JMP|BPF_JEQ|BPF_K"
+	case unix.BPF_JMP | unix.BPF_JGT | unix.BPF_K:
+		return "BPF_JMP|BPF_JGT|BPF_K"
+	case unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K:
+		return "BPF_JMP|BPF_JGE|BPF_K"
+	case unix.BPF_JMP | unix.BPF_JSET | unix.BPF_K:
+		return "BPF_JMP|BPF_JSET|BPF_K"
 	case unix.BPF_ALU | unix.BPF_AND | unix.BPF_K:
 		return "BPF_ALU|BPF_AND|BPF_K"
 	case unix.BPF_JMP | unix.BPF_JA:
@@ -457,6 +552,10 @@ func code2str(op uint16) string {
 		return "BPF_LD|BPF_H|BPF_IND"
 	case unix.BPF_LD | unix.BPF_W | unix.BPF_IND:
 		return "BPF_LD|BPF_W|BPF_IND"
+	case unix.BPF_LD | unix.BPF_MEM:
+		return "BPF_LD|BPF_MEM"
+	case unix.BPF_ST:
+		return "BPF_ST"
 	}
 	return "UNKNOWN_INSTRUCTION"
 }
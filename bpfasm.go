@@ -0,0 +1,250 @@
+package conntrack
+
+import (
+	"errors"
+
+	"github.com/florianl/go-conntrack/internal/unix"
+	"golang.org/x/net/bpf"
+)
+
+// ErrFilterJump is returned, if a jump of a filter does not lead forward.
+var ErrFilterJump = errors.New("invalid jump in filter")
+
+// bpfLabel names a position within a bpfProgram. The zero value is no label.
+type bpfLabel int
+
+// bpfInstr is an instruction, of which the jumps refer to labels.
+type bpfInstr struct {
+	raw bpf.RawInstruction
+	// targets of a conditional jump
+	jt, jf bpfLabel
+	// target of an unconditional jump
+	ja bpfLabel
+}
+
+// bpfProgram collects instructions and resolves the jumps between them,
+// once the program is assembled.
+type bpfProgram struct {
+	instrs []bpfInstr
+	// index of the instruction, a label is bound to
+	labels []int
+}
+
+// newLabel returns a label, that is not yet bound to a position.
+func (p *bpfProgram) newLabel() bpfLabel {
+	p.labels = append(p.labels, -1)
+	return bpfLabel(len(p.labels))
+}
+
+// bind binds l to the position of the next instruction.
+func (p *bpfProgram) bind(l bpfLabel) {
+	p.labels[l-1] = len(p.instrs)
+}
+
+// emit appends instructions without jumps to labels.
+func (p *bpfProgram) emit(raw ...bpf.RawInstruction) {
+	for _, r := range raw {
+		p.instrs = append(p.instrs, bpfInstr{raw: r})
+	}
+}
+
+// jump appends a conditional jump, that compares A with k.
+func (p *bpfProgram) jump(op uint16, k uint32, t, f bpfLabel) {
+	p.instrs = append(p.instrs, bpfInstr{
+		raw: bpf.RawInstruction{Op: unix.BPF_JMP | op | unix.BPF_K, K: k},
+		jt:  t,
+		jf:  f,
+	})
+}
+
+// jumpTo appends an unconditional jump.
+func (p *bpfProgram) jumpTo(l bpfLabel) {
+	p.instrs = append(p.instrs, bpfInstr{
+		raw: bpf.RawInstruction{Op: unix.BPF_JMP | unix.BPF_JA},
+		ja:  l,
+	})
+}
+
+// assemble resolves the labels. Conditional jumps can only skip 255
+// instructions, so jumps to more distant labels lead to an unconditional jump,
+// that is inserted right after the conditional jump.
+func (p *bpfProgram) assemble() ([]bpf.RawInstruction, error) {
+	p.removeJumps()
+
+	// whether a jump is inserted for the true and false branch of an instruction
+	farT := make([]bool, len(p.instrs))
+	farF := make([]bool, len(p.instrs))
+	pos := make([]int, len(p.instrs)+1)
+
+	position := func(l bpfLabel) int {
+		return pos[p.labels[l-1]]
+	}
+
+	for changed := true; changed; {
+		changed = false
+		n := 0
+		for i := range p.instrs {
+			pos[i] = n
+			n++
+			if farT[i] {
+				n++
+			}
+			if farF[i] {
+				n++
+			}
+		}
+		pos[len(p.instrs)] = n
+
+		for i, ins := range p.instrs {
+			for _, l := range []bpfLabel{ins.jt, ins.jf, ins.ja} {
+				if l != 0 && (p.labels[l-1] < 0 || p.labels[l-1] <= i) {
+					return nil, ErrFilterJump
+				}
+			}
+			if ins.jt == 0 && ins.jf == 0 {
+				continue
+			}
+			if !farT[i] && position(ins.jt)-pos[i]-1 > 255 {
+				farT[i] = true
+				changed = true
+			}
+			if !farF[i] && position(ins.jf)-pos[i]-1 > 255 {
+				farF[i] = true
+				changed = true
+			}
+		}
+	}
+
+	raw := make([]bpf.RawInstruction, 0, pos[len(p.instrs)])
+	for i, ins := range p.instrs {
+		r := ins.raw
+		switch {
+		case ins.ja != 0:
+			r.K = uint32(position(ins.ja) - pos[i] - 1)
+		case ins.jt != 0 || ins.jf != 0:
+			next := pos[i] + 1
+			var far []bpf.RawInstruction
+			if farT[i] {
+				r.Jt = uint8(len(far))
+				far = append(far, bpf.RawInstruction{Op: unix.BPF_JMP | unix.BPF_JA})
+			} else {
+				r.Jt = uint8(position(ins.jt) - next)
+			}
+			if farF[i] {
+				r.Jf = uint8(len(far))
+				far = append(far, bpf.RawInstruction{Op: unix.BPF_JMP | unix.BPF_JA})
+			} else {
+				r.Jf = uint8(position(ins.jf) - next)
+			}
+			raw = append(raw, r)
+			for j := range far {
+				target := ins.jt
+				if farF[i] && (j == 1 || !farT[i]) {
+					target = ins.jf
+				}
+				far[j].K = uint32(position(target) - (next + j) - 1)
+			}
+			raw = append(raw, far...)
+			continue
+		}
+		raw = append(raw, r)
+	}
+	return raw, nil
+}
+
+// removeJumps removes redundant jumps. Conditional jumps with the same
+// targets become unconditional, jumps to unconditional jumps lead to their
+// target directly and unconditional jumps to the next instruction as well as
+// instructions, that are not reached, are removed.
+func (p *bpfProgram) removeJumps() {
+	for i := range p.instrs {
+		if ins := p.instrs[i]; ins.jt != 0 && ins.jt == ins.jf {
+			p.instrs[i] = bpfInstr{raw: bpf.RawInstruction{Op: unix.BPF_JMP | unix.BPF_JA}, ja: ins.jt}
+		}
+	}
+	// target returns the label, that a jump to l finally leads to.
+	target := func(l bpfLabel) bpfLabel {
+		for n := 0; l != 0 && n < len(p.instrs); n++ {
+			i := p.labels[l-1]
+			if i < 0 || i >= len(p.instrs) || p.instrs[i].ja == 0 {
+				break
+			}
+			l = p.instrs[i].ja
+		}
+		return l
+	}
+	for i := range p.instrs {
+		ins := &p.instrs[i]
+		ins.ja, ins.jt, ins.jf = target(ins.ja), target(ins.jt), target(ins.jf)
+	}
+
+	// Jumps, that are emitted without labels, skip a fixed number of
+	// instructions, so the instructions in between are kept.
+	reached := make([]bool, len(p.instrs)+1)
+	fixed := make([]bool, len(p.instrs)+1)
+	reach := func(l bpfLabel) {
+		if l != 0 && p.labels[l-1] >= 0 {
+			reached[p.labels[l-1]] = true
+		}
+	}
+	reached[0] = true
+	for i, ins := range p.instrs {
+		if !reached[i] && !fixed[i] {
+			continue
+		}
+		reached[i] = true
+		switch {
+		case ins.ja != 0:
+			reach(ins.ja)
+		case ins.jt != 0 || ins.jf != 0:
+			reach(ins.jt)
+			reach(ins.jf)
+		case ins.raw.Op&0x07 == unix.BPF_JMP:
+			skip := int(ins.raw.Jt)
+			if int(ins.raw.Jf) > skip {
+				skip = int(ins.raw.Jf)
+			}
+			if ins.raw.Op == unix.BPF_JMP|unix.BPF_JA {
+				skip = int(ins.raw.K)
+			}
+			for j := i + 1; j <= i+1+skip && j <= len(p.instrs); j++ {
+				fixed[j] = true
+			}
+		case ins.raw.Op&0x07 != unix.BPF_RET:
+			reached[i+1] = true
+		}
+	}
+
+	// kept[i] is the index of the first instruction from i on, that is kept.
+	kept := make([]int, len(p.instrs)+1)
+	kept[len(p.instrs)] = len(p.instrs)
+	for i := len(p.instrs) - 1; i >= 0; i-- {
+		kept[i] = i
+		if fixed[i] {
+			continue
+		}
+		if !reached[i] {
+			kept[i] = kept[i+1]
+		} else if l := p.instrs[i].ja; l != 0 {
+			if to := p.labels[l-1]; to > i && kept[to] == kept[i+1] {
+				kept[i] = kept[i+1]
+			}
+		}
+	}
+	// index of the instructions, once the jumps are removed
+	index := make([]int, len(p.instrs)+1)
+	instrs := p.instrs[:0]
+	for i := range p.instrs {
+		index[i] = len(instrs)
+		if kept[i] == i {
+			instrs = append(instrs, p.instrs[i])
+		}
+	}
+	index[len(p.instrs)] = len(instrs)
+	for l, i := range p.labels {
+		if i >= 0 {
+			p.labels[l] = index[i]
+		}
+	}
+	p.instrs = instrs
+}
@@ -0,0 +1,330 @@
+package conntrack
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+
+	"github.com/florianl/go-conntrack/internal/unix"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/net/bpf"
+)
+
+// ErrFilterInstruction is returned, if a filter can not be run in userspace.
+var ErrFilterInstruction = errors.New("unsupported instruction in filter")
+
+// FilterProgram is a BPF filter for events, as it is attached to the socket by
+// RegisterFiltered or RegisterFilterExpr. It can be run against events in
+// userspace, e.g. to test filters without privileges.
+type FilterProgram struct {
+	t      Table
+	filter eventFilter
+}
+
+// CompileFilter returns the program, that RegisterFiltered attaches for filters.
+func CompileFilter(t Table, filters []ConnAttr) (*FilterProgram, error) {
+	filter, err := buildAttrsFilter(t, filters)
+	if err != nil {
+		return nil, err
+	}
+	return &FilterProgram{t: t, filter: filter}, nil
+}
+
+// CompileFilterExpr returns the program, that RegisterFilterExpr attaches for
+// expr.
+func CompileFilterExpr(t Table, expr FilterExpr) (*FilterProgram, error) {
+	filter, err := buildEventFilter(t, expr)
+	if err != nil {
+		return nil, err
+	}
+	return &FilterProgram{t: t, filter: filter}, nil
+}
+
+// Instructions returns the instructions of the program, that are attached to
+// the socket.
+func (p *FilterProgram) Instructions() []bpf.RawInstruction {
+	return append([]bpf.RawInstruction{}, p.filter.kernel...)
+}
+
+// Coarse reports whether the filter exceeds the limit of instructions of the
+// kernel. Then the attached program accepts more events, than the filter,
+// and events are matched exactly in userspace.
+func (p *FilterProgram) Coarse() bool {
+	return p.filter.exact != nil
+}
+
+// String returns the disassembly of the program, as it is logged with
+// EnableDebug.
+func (p *FilterProgram) String() string {
+	return fmtRawInstructions(p.filter.kernel)
+}
+
+// Run runs the program against msg, the netlink message of an event, and
+// reports whether the event is accepted. If the program is coarse, the event
+// is matched exactly as well.
+func (p *FilterProgram) Run(msg []byte) (bool, error) {
+	for _, raw := range [][]bpf.RawInstruction{p.filter.kernel, p.filter.exact} {
+		if raw == nil {
+			continue
+		}
+		verdict, err := runFilter(raw, msg)
+		if err != nil || verdict == bpfVerdictReject {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Match runs the program against the event of the new entry c and reports
+// whether the event is accepted. For programs of the Expected table, c.Exp
+// holds the new expectation.
+func (p *FilterProgram) Match(f Family, c Con) (bool, error) {
+	var msg []byte
+	var err error
+	if p.t == Expected {
+		exp := Exp{}
+		if c.Exp != nil {
+			exp = *c.Exp
+		}
+		msg, err = ExpectEventMessage(f, exp)
+	} else {
+		msg, err = EventMessage(f, c)
+	}
+	if err != nil {
+		return false, err
+	}
+	return p.Run(msg)
+}
+
+// EventMessage returns the netlink message of the event of the new entry c,
+// as it is sent by the kernel.
+func EventMessage(f Family, c Con) ([]byte, error) {
+	data, err := MarshalAttributes(log.New(ioutil.Discard, "", 0), f, c)
+	if err != nil {
+		return nil, err
+	}
+	return newEventMessage(uint16(Conntrack)<<8|ipctnlMsgCtNew, data), nil
+}
+
+// ExpectEventMessage returns the netlink message of the event of the new
+// expectation exp, as it is sent by the kernel.
+func ExpectEventMessage(f Family, exp Exp) ([]byte, error) {
+	ae := netlink.NewAttributeEncoder()
+	if err := nestExpectedAttributes(log.New(ioutil.Discard, "", 0), ae, &exp); err != nil {
+		return nil, err
+	}
+	attrs, err := ae.Encode()
+	if err != nil {
+		return nil, err
+	}
+	data := putExtraHeader(uint8(f), unix.NFNETLINK_V0, unix.NFNL_SUBSYS_CTNETLINK_EXP)
+	return newEventMessage(uint16(Expected)<<8|ipctnlMsgExpNew, append(data, attrs...)), nil
+}
+
+// newEventMessage returns the netlink message of type typ with data.
+func newEventMessage(typ uint16, data []byte) []byte {
+	msg := make([]byte, NetlinkHeaderSize, NetlinkHeaderSize+len(data))
+	nlenc.PutUint32(msg[0:4], uint32(NetlinkHeaderSize+len(data)))
+	nlenc.PutUint16(msg[4:6], typ)
+	return append(msg, data...)
+}
+
+// findAttr returns the offset of the attribute of type typ within
+// data[start:end] or 0, like nla_find() of the kernel.
+func findAttr(data []byte, start, end int, typ uint32) uint32 {
+	for start+4 <= end {
+		l := int(nlenc.Uint16(data[start : start+2]))
+		if l < 4 || start+l > end {
+			return 0
+		}
+		if uint32(nlenc.Uint16(data[start+2:start+4])&0x3fff) == typ {
+			return uint32(start)
+		}
+		start += (l + 3) &^ 3
+	}
+	return 0
+}
+
+// runFilter runs raw against pkt like the classic BPF interpreter of the
+// kernel and returns the verdict. Loads outside of pkt reject the packet.
+func runFilter(raw []bpf.RawInstruction, pkt []byte) (uint32, error) {
+	var a, x uint32
+	var mem [16]uint32
+
+	load := func(off uint32, size int) (uint32, bool) {
+		if uint64(off)+uint64(size) > uint64(len(pkt)) {
+			return 0, false
+		}
+		switch size {
+		case 1:
+			return uint32(pkt[off]), true
+		case 2:
+			return uint32(binary.BigEndian.Uint16(pkt[off:])), true
+		}
+		return binary.BigEndian.Uint32(pkt[off:]), true
+	}
+
+	for pc := 0; pc < len(raw); pc++ {
+		switch ins := raw[pc].Disassemble().(type) {
+		case bpf.LoadConstant:
+			if ins.Dst == bpf.RegA {
+				a = ins.Val
+			} else {
+				x = ins.Val
+			}
+		case bpf.LoadScratch:
+			if ins.Dst == bpf.RegA {
+				a = mem[ins.N]
+			} else {
+				x = mem[ins.N]
+			}
+		case bpf.LoadAbsolute:
+			v, ok := load(ins.Off, ins.Size)
+			if !ok {
+				return bpfVerdictReject, nil
+			}
+			a = v
+		case bpf.LoadIndirect:
+			v, ok := load(x+ins.Off, ins.Size)
+			if !ok {
+				return bpfVerdictReject, nil
+			}
+			a = v
+		case bpf.LoadMemShift:
+			v, ok := load(ins.Off, 1)
+			if !ok {
+				return bpfVerdictReject, nil
+			}
+			x = (v & 0xf) << 2
+		case bpf.LoadExtension:
+			switch ins.Num {
+			case bpf.ExtLen:
+				a = uint32(len(pkt))
+			case bpf.ExtNetlinkAttr:
+				if uint64(a)+4 > uint64(len(pkt)) {
+					a = 0
+					break
+				}
+				a = findAttr(pkt, int(a), len(pkt), x)
+			case bpf.ExtNetlinkAttrNested:
+				if uint64(a)+4 > uint64(len(pkt)) {
+					a = 0
+					break
+				}
+				end := int(a) + int(nlenc.Uint16(pkt[a:a+2]))
+				if end > len(pkt) {
+					a = 0
+					break
+				}
+				a = findAttr(pkt, int(a)+4, end, x)
+			default:
+				return 0, fmt.Errorf("%w %d: %s", ErrFilterInstruction, pc, ins)
+			}
+		case bpf.StoreScratch:
+			if ins.Src == bpf.RegA {
+				mem[ins.N] = a
+			} else {
+				mem[ins.N] = x
+			}
+		case bpf.ALUOpConstant:
+			v, ok := aluOp(ins.Op, a, ins.Val)
+			if !ok {
+				return bpfVerdictReject, nil
+			}
+			a = v
+		case bpf.ALUOpX:
+			v, ok := aluOp(ins.Op, a, x)
+			if !ok {
+				return bpfVerdictReject, nil
+			}
+			a = v
+		case bpf.NegateA:
+			a = -a
+		case bpf.Jump:
+			pc += int(ins.Skip)
+		case bpf.JumpIf:
+			if jumpTest(ins.Cond, a, ins.Val) {
+				pc += int(ins.SkipTrue)
+			} else {
+				pc += int(ins.SkipFalse)
+			}
+		case bpf.JumpIfX:
+			if jumpTest(ins.Cond, a, x) {
+				pc += int(ins.SkipTrue)
+			} else {
+				pc += int(ins.SkipFalse)
+			}
+		case bpf.RetA:
+			return a, nil
+		case bpf.RetConstant:
+			return ins.Val, nil
+		case bpf.TAX:
+			x = a
+		case bpf.TXA:
+			a = x
+		default:
+			return 0, fmt.Errorf("%w %d: %s", ErrFilterInstruction, pc, fmtRawInstruction(raw[pc]))
+		}
+	}
+	return 0, fmt.Errorf("%w: filter does not return", ErrFilterInstruction)
+}
+
+// aluOp applies op to a and v. It reports false for a division by zero, that
+// rejects the packet.
+func aluOp(op bpf.ALUOp, a, v uint32) (uint32, bool) {
+	switch op {
+	case bpf.ALUOpAdd:
+		return a + v, true
+	case bpf.ALUOpSub:
+		return a - v, true
+	case bpf.ALUOpMul:
+		return a * v, true
+	case bpf.ALUOpDiv:
+		if v == 0 {
+			return 0, false
+		}
+		return a / v, true
+	case bpf.ALUOpMod:
+		if v == 0 {
+			return 0, false
+		}
+		return a % v, true
+	case bpf.ALUOpOr:
+		return a | v, true
+	case bpf.ALUOpAnd:
+		return a & v, true
+	case bpf.ALUOpShiftLeft:
+		return a << (v & 31), true
+	case bpf.ALUOpShiftRight:
+		return a >> (v & 31), true
+	case bpf.ALUOpXor:
+		return a ^ v, true
+	}
+	return 0, false
+}
+
+func jumpTest(cond bpf.JumpTest, a, v uint32) bool {
+	switch cond {
+	case bpf.JumpEqual:
+		return a == v
+	case bpf.JumpNotEqual:
+		return a != v
+	case bpf.JumpGreaterThan:
+		return a > v
+	case bpf.JumpLessThan:
+		return a < v
+	case bpf.JumpGreaterOrEqual:
+		return a >= v
+	case bpf.JumpLessOrEqual:
+		return a <= v
+	case bpf.JumpBitsSet:
+		return a&v != 0
+	case bpf.JumpBitsNotSet:
+		return a&v == 0
+	}
+	return false
+}
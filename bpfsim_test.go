@@ -0,0 +1,200 @@
+package conntrack
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/net/bpf"
+)
+
+func TestFilterProgram(t *testing.T) {
+	prog, err := CompileFilter(Conntrack, []ConnAttr{
+		{Type: AttrOrigPortDst, Data: be16(80)},
+		{Type: AttrOrigPortDst, Data: be16(443)},
+		{Type: AttrMark, Data: be32(1), Mask: be32(0xff), Negate: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(prog.String(), "BPF_RET|BPF_K") || len(prog.Instructions()) == 0 {
+		t.Fatalf("unexpected disassembly:\n%s", prog)
+	}
+
+	tests := []struct {
+		name string
+		port uint16
+		mark uint32
+		want bool
+	}{
+		{name: "port 80", port: 80, mark: 0x100, want: true},
+		{name: "port 443", port: 443, mark: 0, want: true},
+		{name: "port 22", port: 22, mark: 0, want: false},
+		{name: "masked mark", port: 80, mark: 0x101, want: false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := testCon(40000)
+			*c.Origin.Proto.DstPort = tc.port
+			c.Mark = &tc.mark
+			got, err := prog.Match(IPv4, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Fatalf("unexpected verdict %v, filter:\n%s", got, prog)
+			}
+		})
+	}
+
+	// events of other subsystems are accepted
+	msg := eventMessage(t, testCon(22))
+	nlenc.PutUint16(msg[4:6], uint16(Expected)<<8)
+	if ok, err := prog.Run(msg); err != nil || !ok {
+		t.Fatalf("unexpected verdict for expectation: %v (%v)", ok, err)
+	}
+}
+
+func TestRunFilter(t *testing.T) {
+	tests := []struct {
+		name  string
+		prog  []bpf.Instruction
+		want  uint32
+		error bool
+	}{
+		{name: "alu", prog: []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 0, Size: 2},
+			bpf.StoreScratch{Src: bpf.RegA, N: 3},
+			bpf.LoadConstant{Dst: bpf.RegX, Val: 3},
+			bpf.ALUOpX{Op: bpf.ALUOpMul},
+			bpf.ALUOpConstant{Op: bpf.ALUOpSub, Val: 1},
+			bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: 4},
+			bpf.ALUOpConstant{Op: bpf.ALUOpXor, Val: 0xf},
+			bpf.LoadScratch{Dst: bpf.RegX, N: 3},
+			bpf.JumpIfX{Cond: bpf.JumpGreaterThan, SkipTrue: 1},
+			bpf.RetConstant{Val: 1},
+			bpf.RetA{},
+		}, want: (0x1020*3-1)<<4 ^ 0xf},
+		{name: "length", prog: []bpf.Instruction{
+			bpf.LoadExtension{Num: bpf.ExtLen},
+			bpf.JumpIf{Cond: bpf.JumpLessThan, Val: 8, SkipTrue: 1},
+			bpf.RetConstant{Val: 1},
+			bpf.RetA{},
+		}, want: 6},
+		{name: "load outside of packet", prog: []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 4, Size: 4},
+			bpf.RetConstant{Val: 1},
+		}, want: 0},
+		{name: "division by zero", prog: []bpf.Instruction{
+			bpf.ALUOpX{Op: bpf.ALUOpDiv},
+			bpf.RetConstant{Val: 1},
+		}, want: 0},
+		{name: "unsupported extension", prog: []bpf.Instruction{
+			bpf.LoadExtension{Num: bpf.ExtRand},
+			bpf.RetA{},
+		}, error: true},
+		{name: "no return", prog: []bpf.Instruction{
+			bpf.Jump{Skip: 1},
+			bpf.RetA{},
+		}, error: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			raw, err := bpf.Assemble(tc.prog)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := runFilter(raw, []byte{0x10, 0x20, 0x30, 0x40, 0x50, 0x60})
+			if tc.error {
+				if !errors.Is(err, ErrFilterInstruction) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Fatalf("unexpected verdict %#x", got)
+			}
+		})
+	}
+}
+
+func TestFilterProgramExpected(t *testing.T) {
+	f, err := ParseFilter("helper sip and zone 3 and master.dport 5060 and orig.dport in 1024-65535 and exp.class 0 and exp.flags & 0x4 == 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog, err := CompileFilterExpr(Expected, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := f.ConnAttrs()
+	if err == nil {
+		t.Fatal("range is expressed by attributes")
+	}
+	attrs = []ConnAttr{
+		{Type: AttrHelperName, Data: []byte("sip")},
+		{Type: AttrZone, Data: be16(3)},
+		{Type: AttrExpClass, Data: be32(0)},
+	}
+	attrProg, err := CompileFilter(Expected, attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := func(helper string, zone, port uint16) Con {
+		src, dst := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+		proto, zero, master, class, flags := uint8(17), uint16(0), uint16(5060), uint32(0), uint32(1)
+		return Con{Exp: &Exp{
+			Master:     &IPTuple{Src: &src, Dst: &dst, Proto: &ProtoTuple{Number: &proto, SrcPort: &master, DstPort: &master}},
+			Tuple:      &IPTuple{Src: &src, Dst: &dst, Proto: &ProtoTuple{Number: &proto, SrcPort: &zero, DstPort: &port}},
+			Zone:       &zone,
+			HelperName: &helper,
+			Class:      &class,
+			Flags:      &flags,
+		}}
+	}
+	for _, tc := range []struct {
+		name string
+		c    Con
+		want bool
+	}{
+		{name: "sip", c: exp("sip", 3, 20000), want: true},
+		{name: "ftp", c: exp("ftp", 3, 20000), want: false},
+		{name: "zone", c: exp("sip", 4, 20000), want: false},
+		{name: "port", c: exp("sip", 3, 80), want: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := prog.Match(IPv4, tc.c)
+			if err != nil || got != tc.want {
+				t.Fatalf("unexpected verdict %v (%v), filter:\n%s", got, err, prog)
+			}
+			// the attributes do not check the port
+			got, err = attrProg.Match(IPv4, tc.c)
+			if err != nil || got != (tc.want || tc.name == "port") {
+				t.Fatalf("unexpected verdict of attributes %v (%v)", got, err)
+			}
+		})
+	}
+
+	// attributes, that expectations do not have
+	for _, expr := range []FilterExpr{
+		ConnAttr{Type: AttrMark, Data: be32(1)},
+		StatusAll(StatusAssured),
+		ConnAttr{Type: AttrReplPortDst, Data: be16(80)},
+	} {
+		if _, err := CompileFilterExpr(Expected, expr); !errors.Is(err, ErrFilterAttributeNotImplemented) {
+			t.Fatalf("unexpected error for %v: %v", expr, err)
+		}
+	}
+	if _, err := CompileFilter(Expected, []ConnAttr{
+		{Type: AttrZone, Data: be16(3)},
+		{Type: AttrZone, Data: be16(4), Negate: true},
+	}); err != ErrFilterAttributeNegateMix {
+		t.Fatalf("unexpected error for mixed negation: %v", err)
+	}
+}
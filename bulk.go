@@ -0,0 +1,372 @@
+package conntrack
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/florianl/go-conntrack/internal/unix"
+
+	"github.com/mdlayher/netlink"
+)
+
+// BulkResult is the outcome of a bulk operation.
+type BulkResult struct {
+	// Errors holds the result for every entry at the index of the entry.
+	// It is nil for entries, that were acknowledged by the kernel.
+	Errors []error
+
+	BulkStats
+}
+
+// BulkStats contains aggregated statistics of a bulk operation.
+type BulkStats struct {
+	// Entries is the number of entries passed to the bulk operation.
+	Entries int
+	// Succeeded is the number of entries, that were acknowledged without error.
+	Succeeded int
+	// Failed is the number of entries, that were rejected by the kernel, could
+	// not be marshalled or were not sent at all.
+	Failed int
+	// Batches is the number of datagrams, the entries were sent in.
+	Batches int
+}
+
+// CreateBulk creates entries in the conntrack subsystem. Multiple entries are
+// sent within a single datagram of up to MaxNetlinkMessageSize bytes and every
+// entry is acknowledged by the kernel. Failing entries do not stop the
+// operation, their errors are reported in the BulkResult. An error is only
+// returned, if the operation itself failed, e.g. as ctx was done. Entries,
+// that were not sent in this case, carry this error in the BulkResult.
+func (nfct *Nfct) CreateBulk(ctx context.Context, t Table, f Family, entries []Con) (BulkResult, error) {
+	if t != Conntrack && t != Expected {
+		return BulkResult{}, ErrUnknownCtTable
+	}
+	return nfct.bulk(ctx, entries, func(c Con) (netlink.Message, error) {
+		return nfct.createRequest(t, f, c)
+	})
+}
+
+// UpdateBulk updates existing entries of the conntrack subsystem. See
+// CreateBulk for the handling of errors.
+func (nfct *Nfct) UpdateBulk(ctx context.Context, t Table, f Family, entries []Con) (BulkResult, error) {
+	if t != Conntrack {
+		return BulkResult{}, ErrUnknownCtTable
+	}
+	return nfct.bulk(ctx, entries, func(c Con) (netlink.Message, error) {
+		return nfct.updateRequest(t, f, c)
+	})
+}
+
+// DeleteBulk deletes entries from the conntrack subsystem. See CreateBulk for
+// the handling of errors.
+func (nfct *Nfct) DeleteBulk(ctx context.Context, t Table, f Family, entries []Con) (BulkResult, error) {
+	if t != Conntrack && t != Expected {
+		return BulkResult{}, ErrUnknownCtTable
+	}
+	return nfct.bulk(ctx, entries, func(c Con) (netlink.Message, error) {
+		return nfct.deleteRequest(t, f, c)
+	})
+}
+
+// DeleteStats contains the statistics of DeleteMatching. Entries, that
+// vanished before they were deleted, are neither counted as deleted nor as
+// failed.
+type DeleteStats struct {
+	Matched int
+	Deleted int
+	Failed  int
+}
+
+// DeleteMatching deletes all entries of the conntrack table, that match p.
+// The table is dumped, while the kernel filters the entries as far as p
+// supports it, e.g. for ConnMatch or MatchAll. The matching entries are
+// deleted in batches of up to MaxNetlinkMessageSize bytes over a second
+// socket, while the dump is still in progress. An error is returned, if the
+// dump failed or ctx is done.
+func (nfct *Nfct) DeleteMatching(ctx context.Context, t Table, f Family, p Predicate) (DeleteStats, error) {
+	var stats DeleteStats
+	if t != Conntrack {
+		return stats, ErrUnknownCtTable
+	}
+	deleter, done, err := nfct.deleteConn()
+	if err != nil {
+		return stats, err
+	}
+	defer done()
+	// Without a second socket, the batches are deleted after the dump.
+	stream := deleter != nil
+	if !stream {
+		deleter = nfct
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// A single batch is deleted, while the next one is collected.
+	queue := make(chan deleteBatch, 1)
+	deleted := make(chan error, 1)
+	var deleteStats DeleteStats
+	go func() {
+		var err error
+		for batch := range queue {
+			if err != nil {
+				continue
+			}
+			if err = deleter.deleteEntries(ctx, t, batch, &deleteStats); err != nil {
+				// stop the dump
+				cancel()
+			}
+		}
+		deleted <- err
+	}()
+
+	var pending []deleteBatch
+	flush := func(batch deleteBatch) error {
+		if !stream {
+			pending = append(pending, batch)
+			return nil
+		}
+		select {
+		case queue <- batch:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	batches := map[Family]*deleteBatch{
+		IPv4: {family: IPv4},
+		IPv6: {family: IPv6},
+	}
+	dumpErr := nfct.dumpMatching(ctx, t, f, p, func(c Con) error {
+		if c.Origin == nil || c.Origin.Src == nil {
+			return nil
+		}
+		stats.Matched++
+		// The ID prevents the deletion of a new entry with the same tuple.
+		key := Con{Origin: c.Origin, Zone: c.Zone, ID: c.ID}
+		batch := batches[IPv4]
+		if c.Origin.Src.To4() == nil {
+			batch = batches[IPv6]
+		}
+		req, err := nfct.deleteRequest(t, batch.family, key)
+		if err != nil {
+			return err
+		}
+		l := (NetlinkHeaderSize + len(req.Data) + 3) &^ 3
+		if batch.size+l > MaxNetlinkMessageSize && len(batch.entries) > 0 {
+			if err := flush(*batch); err != nil {
+				return err
+			}
+			*batch = deleteBatch{family: batch.family}
+		}
+		batch.size += l
+		batch.entries = append(batch.entries, key)
+		return nil
+	})
+	if dumpErr == nil {
+		for _, family := range []Family{IPv4, IPv6} {
+			if len(batches[family].entries) > 0 {
+				pending = append(pending, *batches[family])
+			}
+		}
+		for _, batch := range pending {
+			queue <- batch
+		}
+	}
+	close(queue)
+	err = <-deleted
+	stats.Deleted, stats.Failed = deleteStats.Deleted, deleteStats.Failed
+	if err != nil {
+		return stats, err
+	}
+	return stats, dumpErr
+}
+
+// deleteBatch holds the keys of entries of a family, that are deleted within
+// a single datagram.
+type deleteBatch struct {
+	family  Family
+	entries []Con
+	size    int
+}
+
+// deleteConn returns the connection, entries are deleted over, while the
+// table is dumped. As the socket of a dump is busy until the dump is done, a
+// separate socket is opened, if the requests of nfct share a single socket.
+// It returns nil, if no second socket is available.
+func (nfct *Nfct) deleteConn() (*Nfct, func(), error) {
+	if cap(nfct.requestPool().slots) > 1 {
+		return nfct, func() {}, nil
+	}
+	if nfct.resyncOpen == nil {
+		return nil, func() {}, nil
+	}
+	deleter, err := nfct.resyncOpen()
+	if err != nil {
+		return nil, nil, err
+	}
+	return deleter, func() {
+		if err := deleter.Close(); err != nil {
+			nfct.logger.Printf("could not close socket for deletion: %v", err)
+		}
+	}, nil
+}
+
+// deleteEntries deletes the entries of batch and adds the results to stats.
+func (nfct *Nfct) deleteEntries(ctx context.Context, t Table, batch deleteBatch, stats *DeleteStats) error {
+	result, err := nfct.DeleteBulk(ctx, t, batch.family, batch.entries)
+	for _, e := range result.Errors {
+		switch {
+		case e == nil:
+			stats.Deleted++
+		case errors.Is(e, unix.ENOENT):
+		default:
+			stats.Failed++
+		}
+	}
+	return err
+}
+
+func (nfct *Nfct) bulk(ctx context.Context, entries []Con, build func(Con) (netlink.Message, error)) (BulkResult, error) {
+	result := BulkResult{Errors: make([]error, len(entries))}
+	result.Entries = len(entries)
+	resolved := make([]bool, len(entries))
+
+	err := ctx.Err()
+	if err == nil {
+		err = nfct.withConn(ctx, func(con *netlink.Conn) error {
+			w := nfct.watch(ctx, con)
+			defer w.stop()
+
+			b := bulkWindow{nfct: nfct, con: con, w: w, result: &result, resolved: resolved}
+			var size int
+			for i, entry := range entries {
+				req, err := build(entry)
+				if err != nil {
+					result.Errors[i] = err
+					resolved[i] = true
+					continue
+				}
+				l := (NetlinkHeaderSize + len(req.Data) + 3) &^ 3
+				if size+l > MaxNetlinkMessageSize && len(b.msgs) > 0 {
+					if err := b.flush(ctx); err != nil {
+						return err
+					}
+					size = 0
+				}
+				size += l
+				b.msgs = append(b.msgs, req)
+				b.index = append(b.index, i)
+			}
+			return b.flush(ctx)
+		})
+	}
+
+	for i := range entries {
+		if !resolved[i] {
+			result.Errors[i] = err
+		}
+		if result.Errors[i] == nil {
+			result.Succeeded++
+		} else {
+			result.Failed++
+		}
+	}
+	return result, err
+}
+
+// bulkWindow collects the requests of a bulk operation, that are sent within
+// a single datagram.
+type bulkWindow struct {
+	nfct *Nfct
+	con  *netlink.Conn
+	w    *watcher
+
+	msgs  []netlink.Message
+	index []int
+
+	result   *BulkResult
+	resolved []bool
+
+	buf []byte
+}
+
+// flush sends the collected requests and waits for their acknowledgements.
+// Once ctx is done, the acknowledgements of the requests, that were already
+// sent, are still read, so the socket can be used for the next request.
+func (b *bulkWindow) flush(ctx context.Context) error {
+	if len(b.msgs) == 0 {
+		return nil
+	}
+	defer func() {
+		b.msgs = b.msgs[:0]
+		b.index = b.index[:0]
+	}()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.nfct.setConnWriteTimeout(b.con)
+	sent, err := b.con.SendMessages(b.msgs)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return err
+	}
+	b.result.Batches++
+
+	pending := make(map[uint32]int, len(sent))
+	for i, msg := range sent {
+		pending[msg.Header.Sequence] = b.index[i]
+	}
+
+	rc, rawErr := b.con.SyscallConn()
+	if rawErr == nil && b.buf == nil {
+		b.buf = make([]byte, receiveBufferSize)
+	}
+	var ctxErr error
+	var msgs []netlink.Message
+	for len(pending) > 0 {
+		if rawErr == nil {
+			msgs, err = readMessages(rc, b.buf, msgs)
+		} else {
+			// The socket does not provide access to single datagrams, e.g.
+			// for tests.
+			msgs, err = b.con.Receive()
+		}
+		if err != nil {
+			if ctxErr != nil || ctx.Err() == nil {
+				return err
+			}
+			ctxErr = ctx.Err()
+			b.w.stop()
+			if err := b.con.SetReadDeadline(time.Now().Add(drainTimeout)); err != nil {
+				return ctxErr
+			}
+			defer func() {
+				if err := b.con.SetReadDeadline(time.Time{}); err != nil {
+					b.nfct.logger.Printf("could not reset read deadline: %v", err)
+				}
+			}()
+			continue
+		}
+
+		for _, msg := range msgs {
+			if msg.Header.Type != netlink.Error {
+				continue
+			}
+			i, ok := pending[msg.Header.Sequence]
+			if !ok {
+				// left over from an earlier request
+				continue
+			}
+			delete(pending, msg.Header.Sequence)
+			b.result.Errors[i] = replyError(msg)
+			b.resolved[i] = true
+		}
+	}
+	return ctxErr
+}
@@ -0,0 +1,178 @@
+package conntrack
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nltest"
+)
+
+func TestBulk(t *testing.T) {
+	const entries = 500
+	var batches, requests int
+	nfct := &Nfct{logger: log.New(ioutil.Discard, "", 0)}
+	AdjustWriteTimeout(nfct, func() error { return nil })
+	nfct.Con = nltest.Dial(func(reqs []netlink.Message) ([]netlink.Message, error) {
+		if len(reqs) == 0 {
+			return nil, nil
+		}
+		batches++
+		var size int
+		var acks []netlink.Message
+		// acknowledge in reverse order
+		for i := len(reqs) - 1; i >= 0; i-- {
+			req := reqs[i]
+			if req.Header.Flags&netlink.Acknowledge == 0 {
+				t.Fatalf("request is not acknowledged")
+			}
+			size += (int(req.Header.Length) + 3) &^ 3
+			acks = append(acks, netlink.Message{
+				Header: netlink.Header{Type: netlink.Error, Sequence: req.Header.Sequence},
+				Data:   make([]byte, 20),
+			})
+		}
+		if size > MaxNetlinkMessageSize {
+			t.Fatalf("datagram exceeds maximum size: %d", size)
+		}
+		requests += len(reqs)
+		return acks, nil
+	})
+	defer nfct.Con.Close()
+
+	list := make([]Con, entries)
+	for i := range list {
+		list[i] = testCon(uint16(40000 + i))
+	}
+	// an entry, that can not be marshalled
+	label := make([]byte, 70000)
+	list[1].Label = &label
+
+	result, err := nfct.CreateBulk(context.Background(), Conntrack, IPv4, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Entries != entries || result.Batches != batches || batches < 2 || requests != entries-1 {
+		t.Fatalf("unexpected statistics: %#v (%d batches, %d requests)", result.BulkStats, batches, requests)
+	}
+	if result.Errors[0] != nil || result.Errors[1] == nil || result.Errors[2] != nil {
+		t.Fatalf("unexpected errors: %v", result.Errors[:3])
+	}
+	if result.Failed != 1 || result.Succeeded != entries-1 {
+		t.Fatalf("unexpected statistics: %#v", result.BulkStats)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, err = nfct.DeleteBulk(ctx, Conntrack, IPv4, list[:3])
+	if err != context.Canceled || result.Failed != 3 || result.Errors[2] != context.Canceled {
+		t.Fatalf("unexpected result for cancelled context: %#v (%v)", result, err)
+	}
+	if _, err := nfct.UpdateBulk(context.Background(), Expected, IPv4, list); err != ErrUnknownCtTable {
+		t.Fatalf("unexpected error for unknown table: %v", err)
+	}
+}
+
+func TestDeleteMatching(t *testing.T) {
+	const entries = 500
+	logger := log.New(ioutil.Discard, "", 0)
+	var mu sync.Mutex
+	var batches, deletes int
+	dial := func() (*netlink.Conn, error) {
+		return nltest.Dial(func(reqs []netlink.Message) ([]netlink.Message, error) {
+			if len(reqs) == 0 {
+				return nil, nil
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if reqs[0].Header.Flags&netlink.Dump != 0 {
+				var msgs []netlink.Message
+				for i := 0; i < entries; i++ {
+					c := testCon(uint16(40000 + i))
+					id := uint32(i)
+					c.ID = &id
+					data, err := MarshalAttributes(logger, IPv4, c)
+					if err != nil {
+						return nil, err
+					}
+					msgs = append(msgs, netlink.Message{
+						Header: netlink.Header{Type: netlink.HeaderType(1<<8 | ipctnlMsgCtNew), Flags: netlink.Multi, Sequence: reqs[0].Header.Sequence},
+						Data:   data,
+					})
+				}
+				return append(msgs, netlink.Message{
+					Header: netlink.Header{Type: netlink.Done, Flags: netlink.Multi, Sequence: reqs[0].Header.Sequence},
+					Data:   []byte{0, 0, 0, 0},
+				}), nil
+			}
+
+			batches++
+			var size int
+			var acks []netlink.Message
+			for _, req := range reqs {
+				if req.Header.Type&0xff != ipctnlMsgCtDelete {
+					t.Errorf("unexpected request: %v", req.Header)
+				}
+				size += (int(req.Header.Length) + 3) &^ 3
+				c, err := ParseAttributes(logger, req.Data)
+				if err != nil || c.ID == nil || *c.Origin.Proto.SrcPort%2 != 1 {
+					t.Errorf("unexpected entry: %v (%v)", c, err)
+				}
+				deletes++
+				acks = append(acks, netlink.Message{
+					Header: netlink.Header{Type: netlink.Error, Sequence: req.Header.Sequence},
+					Data:   make([]byte, 20),
+				})
+			}
+			if size > MaxNetlinkMessageSize {
+				t.Errorf("datagram exceeds maximum size: %d", size)
+			}
+			return acks, nil
+		}), nil
+	}
+	odd := PredicateFunc(func(c Con) bool { return *c.Origin.Proto.SrcPort%2 == 1 })
+
+	for _, tc := range []struct {
+		name string
+		nfct func() *Nfct
+	}{
+		{
+			name: "shared socket",
+			nfct: func() *Nfct {
+				con, _ := dial()
+				nfct := &Nfct{logger: logger, Con: con}
+				AdjustWriteTimeout(nfct, func() error { return nil })
+				return nfct
+			},
+		},
+		{
+			name: "request pool",
+			nfct: func() *Nfct {
+				con, _ := dial()
+				nfct := &Nfct{logger: logger, Con: con, pool: newDialPool(2, dial)}
+				AdjustWriteTimeout(nfct, func() error { return nil })
+				return nfct
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			batches, deletes = 0, 0
+			nfct := tc.nfct()
+			defer nfct.Close()
+
+			stats, err := nfct.DeleteMatching(context.Background(), Conntrack, IPv4, odd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Matched != entries/2 || stats.Deleted != entries/2 || stats.Failed != 0 {
+				t.Fatalf("unexpected statistics: %#v", stats)
+			}
+			if deletes != entries/2 || batches < 2 {
+				t.Fatalf("unexpected requests: %d deletes in %d batches", deletes, batches)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package conntrack
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"time"
@@ -89,6 +90,12 @@ func Open(config *Config) (*Nfct, error) {
 		nfct.logger = config.Logger
 	}
 
+	if err := nfct.applySocketOptions(config); err != nil {
+		con.Close()
+		return nil, err
+	}
+
+	nfct.writeTimeout = config.WriteTimeout
 	if config.WriteTimeout > 0 {
 		nfct.setWriteTimeout = func() error {
 			deadline := time.Now().Add(config.WriteTimeout)
@@ -98,7 +105,37 @@ func Open(config *Config) (*Nfct, error) {
 		nfct.setWriteTimeout = func() error { return nil }
 	}
 
+	if config.MaxConcurrentRequests > 0 {
+		netlinkConfig := netlink.Config{NetNS: config.NetNS, DisableNSLockThread: config.DisableNSLockThread}
+		socketConfig := *config
+		nfct.pool = newDialPool(config.MaxConcurrentRequests, func() (*netlink.Conn, error) {
+			con, err := netlink.Dial(unix.NETLINK_NETFILTER, &netlinkConfig)
+			if err != nil {
+				return nil, err
+			}
+			if err := setSocketOptions(con, &socketConfig); err != nil {
+				con.Close()
+				return nil, err
+			}
+			return con, nil
+		})
+	}
+
 	nfct.addConntrackInformation = config.AddConntrackInformation
+	nfct.decodeMask = config.DecodeMask
+
+	nfct.resyncOnOverflow = config.ResyncOnOverflow
+	nfct.resyncDump = config.ResyncDump
+	resyncConfig := Config{
+		NetNS:               config.NetNS,
+		WriteTimeout:        config.WriteTimeout,
+		Logger:              nfct.logger,
+		DisableNSLockThread: config.DisableNSLockThread,
+		DecodeMask:          config.DecodeMask,
+	}
+	nfct.resyncOpen = func() (*Nfct, error) {
+		return Open(&resyncConfig)
+	}
 
 	return &nfct, nil
 }
@@ -115,6 +152,11 @@ func (nfct *Nfct) Close() error {
 	if nfct.errChan != nil {
 		close(nfct.errChan)
 	}
+	if nfct.pool != nil && nfct.pool.dial != nil {
+		if err := nfct.pool.close(); err != nil {
+			nfct.logger.Printf("could not close request sockets: %v", err)
+		}
+	}
 	return nfct.Con.Close()
 }
 
@@ -125,6 +167,11 @@ func (nfct *Nfct) SetOption(o netlink.ConnOption, enable bool) error {
 
 // Flush a conntrack subsystem
 func (nfct *Nfct) Flush(t Table, f Family) error {
+	return nfct.FlushContext(context.Background(), t, f)
+}
+
+// FlushContext is like Flush, but honours the deadline and cancellation of ctx.
+func (nfct *Nfct) FlushContext(ctx context.Context, t Table, f Family) error {
 	data := putExtraHeader(uint8(f), unix.NFNETLINK_V0, 0)
 	req := netlink.Message{
 		Header: netlink.Header{
@@ -142,11 +189,58 @@ func (nfct *Nfct) Flush(t Table, f Family) error {
 		return ErrUnknownCtTable
 	}
 
-	return nfct.execute(req)
+	return nfct.execute(ctx, req)
 }
 
 // Dump a conntrack subsystem
 func (nfct *Nfct) Dump(t Table, f Family) ([]Con, error) {
+	return nfct.DumpContext(context.Background(), t, f)
+}
+
+// DumpContext is like Dump, but honours the deadline and cancellation of ctx.
+func (nfct *Nfct) DumpContext(ctx context.Context, t Table, f Family) ([]Con, error) {
+	req, err := dumpRequest(t, f)
+	if err != nil {
+		return nil, err
+	}
+	return nfct.query(ctx, req)
+}
+
+// DumpMasked is like DumpContext, but decodes only the attributes selected by
+// mask, instead of the DecodeMask of the Config.
+func (nfct *Nfct) DumpMasked(ctx context.Context, t Table, f Family, mask Field) ([]Con, error) {
+	req, err := dumpRequest(t, f)
+	if err != nil {
+		return nil, err
+	}
+	var conn []Con
+	err = nfct.queryMaskedFunc(ctx, req, mask, func(c Con) error {
+		conn = append(conn, c)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// DumpMatching is like DumpContext, but returns only the entries, that match
+// p. The kernel filters the entries of the Conntrack table in advance, as far
+// as it supports the parts of p, like ConnMatch or an exact MatchCIDR, that
+// are combined by MatchAll. The other parts of p are matched in userspace.
+func (nfct *Nfct) DumpMatching(ctx context.Context, t Table, f Family, p Predicate) ([]Con, error) {
+	var conn []Con
+	err := nfct.dumpMatching(ctx, t, f, p, func(c Con) error {
+		conn = append(conn, c)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func dumpRequest(t Table, f Family) (netlink.Message, error) {
 	data := putExtraHeader(uint8(f), unix.NFNETLINK_V0, 0)
 	req := netlink.Message{
 		Header: netlink.Header{
@@ -161,18 +255,30 @@ func (nfct *Nfct) Dump(t Table, f Family) ([]Con, error) {
 	} else if t == Expected {
 		req.Header.Type |= netlink.HeaderType(ipctnlMsgExpGet)
 	} else {
-		return nil, ErrUnknownCtTable
+		return req, ErrUnknownCtTable
 	}
-
-	return nfct.query(req)
+	return req, nil
 }
 
 // Create a new entry in the conntrack subsystem with certain attributes
 func (nfct *Nfct) Create(t Table, f Family, attributes Con) error {
-	query, err := nestAttributes(nfct.logger, &attributes)
+	return nfct.CreateContext(context.Background(), t, f, attributes)
+}
+
+// CreateContext is like Create, but honours the deadline and cancellation of ctx.
+func (nfct *Nfct) CreateContext(ctx context.Context, t Table, f Family, attributes Con) error {
+	req, err := nfct.createRequest(t, f, attributes)
 	if err != nil {
 		return err
 	}
+	return nfct.execute(ctx, req)
+}
+
+func (nfct *Nfct) createRequest(t Table, f Family, attributes Con) (netlink.Message, error) {
+	query, err := nestAttributes(nfct.logger, &attributes)
+	if err != nil {
+		return netlink.Message{}, err
+	}
 	data := putExtraHeader(uint8(f), unix.NFNETLINK_V0, unix.NFNL_SUBSYS_CTNETLINK)
 	data = append(data, query...)
 
@@ -189,18 +295,30 @@ func (nfct *Nfct) Create(t Table, f Family, attributes Con) error {
 	} else if t == Expected {
 		req.Header.Type |= netlink.HeaderType(ipctnlMsgExpNew)
 	} else {
-		return ErrUnknownCtTable
+		return req, ErrUnknownCtTable
 	}
-
-	return nfct.execute(req)
+	return req, nil
 }
 
 // Query conntrack subsystem with certain attributes
 func (nfct *Nfct) Query(t Table, f Family, filter FilterAttr) ([]Con, error) {
-	query, err := nestFilter(filter)
+	return nfct.QueryContext(context.Background(), t, f, filter)
+}
+
+// QueryContext is like Query, but honours the deadline and cancellation of ctx.
+func (nfct *Nfct) QueryContext(ctx context.Context, t Table, f Family, filter FilterAttr) ([]Con, error) {
+	req, err := queryRequest(t, f, filter)
 	if err != nil {
 		return nil, err
 	}
+	return nfct.query(ctx, req)
+}
+
+func queryRequest(t Table, f Family, filter FilterAttr) (netlink.Message, error) {
+	query, err := nestFilter(filter)
+	if err != nil {
+		return netlink.Message{}, err
+	}
 	data := putExtraHeader(uint8(f), unix.NFNETLINK_V0, unix.NFNL_SUBSYS_CTNETLINK)
 	data = append(data, query...)
 
@@ -217,75 +335,85 @@ func (nfct *Nfct) Query(t Table, f Family, filter FilterAttr) ([]Con, error) {
 	} else if t == Expected {
 		req.Header.Type |= netlink.HeaderType(ipctnlMsgExpGet)
 	} else {
-		return nil, ErrUnknownCtTable
+		return req, ErrUnknownCtTable
 	}
-	return nfct.query(req)
+	return req, nil
 }
 
 // Get returns matching conntrack entries with certain attributes
 func (nfct *Nfct) Get(t Table, f Family, match Con) ([]Con, error) {
+	return nfct.GetContext(context.Background(), t, f, match)
+}
+
+// GetContext is like Get, but honours the deadline and cancellation of ctx.
+func (nfct *Nfct) GetContext(ctx context.Context, t Table, f Family, match Con) ([]Con, error) {
+	req, err := nfct.getRequest(t, f, match)
+	if err != nil {
+		return []Con{}, err
+	}
+	return nfct.query(ctx, req)
+}
+
+func (nfct *Nfct) getRequest(t Table, f Family, match Con) (netlink.Message, error) {
 	if t != Conntrack {
-		return nil, ErrUnknownCtTable
+		return netlink.Message{}, ErrUnknownCtTable
 	}
 	query, err := nestAttributes(nfct.logger, &match)
 	if err != nil {
-		return []Con{}, err
+		return netlink.Message{}, err
 	}
 	data := putExtraHeader(uint8(f), unix.NFNETLINK_V0, unix.NFNL_SUBSYS_CTNETLINK)
 	data = append(data, query...)
 
 	req := netlink.Message{
 		Header: netlink.Header{
-			Type:  netlink.HeaderType(t << 8),
+			Type:  netlink.HeaderType(t<<8) | netlink.HeaderType(ipctnlMsgCtGet),
 			Flags: netlink.Request | netlink.Acknowledge,
 		},
 		Data: data,
 	}
-
-	if t == Conntrack {
-		req.Header.Type |= netlink.HeaderType(ipctnlMsgCtGet)
-	} else if t == Expected {
-		req.Header.Type |= netlink.HeaderType(ipctnlMsgExpGet)
-	} else {
-		return []Con{}, ErrUnknownCtTable
-	}
-
-	return nfct.query(req)
+	return req, nil
 }
 
 // Update an existing conntrack entry
 func (nfct *Nfct) Update(t Table, f Family, attributes Con) error {
+	return nfct.UpdateContext(context.Background(), t, f, attributes)
+}
+
+// UpdateContext is like Update, but honours the deadline and cancellation of ctx.
+func (nfct *Nfct) UpdateContext(ctx context.Context, t Table, f Family, attributes Con) error {
+	req, err := nfct.updateRequest(t, f, attributes)
+	if err != nil {
+		return err
+	}
+	return nfct.execute(ctx, req)
+}
+
+func (nfct *Nfct) updateRequest(t Table, f Family, attributes Con) (netlink.Message, error) {
 	if t != Conntrack {
-		return ErrUnknownCtTable
+		return netlink.Message{}, ErrUnknownCtTable
 	}
 
 	query, err := nestAttributes(nfct.logger, &attributes)
 	if err != nil {
-		return err
+		return netlink.Message{}, err
 	}
 	data := putExtraHeader(uint8(f), unix.NFNETLINK_V0, unix.NFNL_SUBSYS_CTNETLINK)
 	data = append(data, query...)
 
 	req := netlink.Message{
 		Header: netlink.Header{
-			Type:  netlink.HeaderType(t << 8),
+			Type:  netlink.HeaderType(t<<8) | netlink.HeaderType(ipctnlMsgCtNew),
 			Flags: netlink.Request | netlink.Acknowledge,
 		},
 		Data: data,
 	}
-
-	if t == Conntrack {
-		req.Header.Type |= netlink.HeaderType(ipctnlMsgCtNew)
-	} else if t == Expected {
-		req.Header.Type |= netlink.HeaderType(ipctnlMsgExpNew)
-	} else {
-		return ErrUnknownCtTable
-	}
-
-	return nfct.execute(req)
+	return req, nil
 }
 
 // send a message with no reply
+//
+// Failures are not reported. Use UpdateBulk to learn about failing entries.
 func (nfct *Nfct) UpdateSingle(t Table, f Family, attrs []*Con) error {
 	if t != Conntrack {
 		return ErrUnknownCtTable
@@ -318,7 +446,11 @@ func (nfct *Nfct) UpdateSingle(t Table, f Family, attrs []*Con) error {
 			return ErrUnknownCtTable
 		}
 
-		_, e := nfct.Con.Send(req)
+		e := nfct.withConn(context.Background(), func(con *netlink.Conn) error {
+			nfct.setConnWriteTimeout(con)
+			_, err := con.Send(req)
+			return err
+		})
 		if e != nil {
 			return e
 		}
@@ -328,6 +460,8 @@ func (nfct *Nfct) UpdateSingle(t Table, f Family, attrs []*Con) error {
 }
 
 // send messages with no reply
+//
+// Failures are not reported. Use UpdateBulk to learn about failing entries.
 func (nfct *Nfct) UpdateBatch(t Table, f Family, attrs []*Con) error {
 	if t != Conntrack {
 		return ErrUnknownCtTable
@@ -368,7 +502,7 @@ func (nfct *Nfct) UpdateBatch(t Table, f Family, attrs []*Con) error {
 
 		// exceed max size
 		if dataLen+l > MaxNetlinkMessageSize {
-			_, err = nfct.Con.SendMessages(msgs)
+			err = nfct.sendMessages(msgs)
 			if err != nil {
 				return err
 			}
@@ -383,18 +517,40 @@ func (nfct *Nfct) UpdateBatch(t Table, f Family, attrs []*Con) error {
 
 	err = nil
 	if len(msgs) > 0 {
-		_, err = nfct.Con.SendMessages(msgs)
+		err = nfct.sendMessages(msgs)
 	}
 
 	return err
 }
 
+// sendMessages sends msgs without waiting for a reply.
+func (nfct *Nfct) sendMessages(msgs []netlink.Message) error {
+	return nfct.withConn(context.Background(), func(con *netlink.Conn) error {
+		nfct.setConnWriteTimeout(con)
+		_, err := con.SendMessages(msgs)
+		return err
+	})
+}
+
 // Delete elements from the conntrack subsystem with certain attributes
 func (nfct *Nfct) Delete(t Table, f Family, filters Con) error {
-	query, err := nestAttributes(nfct.logger, &filters)
+	return nfct.DeleteContext(context.Background(), t, f, filters)
+}
+
+// DeleteContext is like Delete, but honours the deadline and cancellation of ctx.
+func (nfct *Nfct) DeleteContext(ctx context.Context, t Table, f Family, filters Con) error {
+	req, err := nfct.deleteRequest(t, f, filters)
 	if err != nil {
 		return err
 	}
+	return nfct.execute(ctx, req)
+}
+
+func (nfct *Nfct) deleteRequest(t Table, f Family, filters Con) (netlink.Message, error) {
+	query, err := nestAttributes(nfct.logger, &filters)
+	if err != nil {
+		return netlink.Message{}, err
+	}
 	data := putExtraHeader(uint8(f), unix.NFNETLINK_V0, unix.NFNL_SUBSYS_CTNETLINK)
 	data = append(data, query...)
 
@@ -411,14 +567,19 @@ func (nfct *Nfct) Delete(t Table, f Family, filters Con) error {
 	} else if t == Expected {
 		req.Header.Type |= netlink.HeaderType(ipctnlMsgExpDelete)
 	} else {
-		return ErrUnknownCtTable
+		return req, ErrUnknownCtTable
 	}
-
-	return nfct.execute(req)
+	return req, nil
 }
 
 // DumpCPUStats dumps per CPU statistics
 func (nfct *Nfct) DumpCPUStats(t Table) ([]CPUStat, error) {
+	return nfct.DumpCPUStatsContext(context.Background(), t)
+}
+
+// DumpCPUStatsContext is like DumpCPUStats, but honours the deadline and
+// cancellation of ctx.
+func (nfct *Nfct) DumpCPUStatsContext(ctx context.Context, t Table) ([]CPUStat, error) {
 	data := putExtraHeader(unix.AF_UNSPEC, unix.NFNETLINK_V0, 0)
 	req := netlink.Message{
 		Header: netlink.Header{
@@ -434,7 +595,29 @@ func (nfct *Nfct) DumpCPUStats(t Table) ([]CPUStat, error) {
 	} else {
 		return nil, ErrUnknownCtTable
 	}
-	return nfct.getCPUStats(req)
+	return nfct.getCPUStats(ctx, req)
+}
+
+// DumpGlobalStats dumps global statistics of the conntrack table
+func (nfct *Nfct) DumpGlobalStats(t Table) (GlobalStats, error) {
+	return nfct.DumpGlobalStatsContext(context.Background(), t)
+}
+
+// DumpGlobalStatsContext is like DumpGlobalStats, but honours the deadline and
+// cancellation of ctx.
+func (nfct *Nfct) DumpGlobalStatsContext(ctx context.Context, t Table) (GlobalStats, error) {
+	if t != Conntrack {
+		return GlobalStats{}, ErrUnknownCtTable
+	}
+	data := putExtraHeader(unix.AF_UNSPEC, unix.NFNETLINK_V0, 0)
+	req := netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(t<<8) | netlink.HeaderType(ipctnlMsgCtGetStats),
+			Flags: netlink.Request | netlink.Acknowledge,
+		},
+		Data: data,
+	}
+	return nfct.getGlobalStats(ctx, req)
 }
 
 // ParseAttributes extracts all the attributes from the given data
@@ -448,6 +631,17 @@ func ParseAttributes(logger *log.Logger, data []byte) (Con, error) {
 	return c, err
 }
 
+// MarshalAttributes encodes the attributes of c, that can be sent to the kernel,
+// including the header for family f. It is the counterpart of ParseAttributes.
+func MarshalAttributes(logger *log.Logger, f Family, c Con) ([]byte, error) {
+	query, err := nestAttributes(logger, &c)
+	if err != nil {
+		return nil, err
+	}
+	data := putExtraHeader(uint8(f), unix.NFNETLINK_V0, unix.NFNL_SUBSYS_CTNETLINK)
+	return append(data, query...), nil
+}
+
 // HookFunc is a function, that receives events from a Netlinkgroup.
 // Return something different than 0, to stop receiving messages.
 type HookFunc func(c Con) int
@@ -469,7 +663,17 @@ func (nfct *Nfct) AttachErrChan() <-chan error {
 // is received it will stop from processing further events.
 // If your function returns something different than 0, it will stop.
 func (nfct *Nfct) Register(ctx context.Context, t Table, group NetlinkGroup, fn HookFunc) error {
-	return nfct.register(ctx, t, group, []ConnAttr{}, fn)
+	return nfct.RegisterMasked(ctx, t, group, nfct.decodeMask, fn)
+}
+
+// RegisterMasked is like Register, but decodes only the attributes of events
+// selected by mask, instead of the DecodeMask of the Config.
+func (nfct *Nfct) RegisterMasked(ctx context.Context, t Table, group NetlinkGroup, mask Field, fn HookFunc) error {
+	filter, err := constructFilter(t, []ConnAttr{})
+	if err != nil {
+		return err
+	}
+	return nfct.register(ctx, t, group, eventFilter{kernel: filter}, mask, fn)
 }
 
 // RegisterFiltered registers your function to receive events from a Netlinkgroup and applies a filter.
@@ -479,24 +683,81 @@ func (nfct *Nfct) Register(ctx context.Context, t Table, group NetlinkGroup, fn
 // Otherwise, ConnAttr of different ConnAttrType will be connected by an AND operation for the filter.
 // Note: When you add filters for IPv4 specific fields, it will automatically filter for IPv4-only events.
 // The same rule applies for IPv6. However, if you apply a filter for both IPv4- and IPv6-specific fields,
-// it will result in filtering out all events, meaning no event will match.
+// IPv4 events have to match the IPv4-specific filters and IPv6 events the IPv6-specific filters. So
+// AttrOrigIPv4Dst and AttrOrigIPv6Dst select connections to either address.
+// The NAT attributes, like AttrSNatIPv4, only exist for entries, of which the
+// source or destination was translated, and hold the translated address or port.
+// AttrHelperName and AttrSecCtx are compared with names without terminating NUL.
+// If the filter exceeds the limit of instructions of the kernel, the kernel
+// applies a coarser filter and events are matched exactly in userspace.
+// For the Expected table, the attributes of the original tuple, like
+// AttrOrigIPv4Src, refer to the tuple of the expected connection and the
+// attributes of the master tuple to its master. Besides, AttrTimeout, AttrZone,
+// AttrHelperName, AttrExpID, AttrExpFlags, AttrExpClass and AttrExpNATDir are
+// supported. Current kernels do not include the zone in events of expectations.
 func (nfct *Nfct) RegisterFiltered(ctx context.Context, t Table, group NetlinkGroup, filter []ConnAttr, fn HookFunc) error {
-	return nfct.register(ctx, t, group, filter, fn)
+	bpfFilter, err := buildAttrsFilter(t, filter)
+	if err != nil {
+		return err
+	}
+	return nfct.register(ctx, t, group, bpfFilter, nfct.decodeMask, fn)
+}
+
+// RegisterFilterExpr registers your function to receive events from a Netlinkgroup,
+// that match expr. Unlike RegisterFiltered, expr can combine attributes of any
+// type with And, Or and Not. Filters in text form are parsed by ParseFilter.
+// Like with RegisterFiltered, events are matched in userspace, if the filter
+// exceeds the limit of instructions of the kernel, and the attributes of
+// expectations are supported for the Expected table.
+// If an unexpected error is received it will stop from processing further events.
+// If your function returns something different than 0, it will stop.
+func (nfct *Nfct) RegisterFilterExpr(ctx context.Context, t Table, group NetlinkGroup, expr FilterExpr, fn HookFunc) error {
+	filter, err := buildEventFilter(t, expr)
+	if err != nil {
+		return err
+	}
+	return nfct.register(ctx, t, group, filter, nfct.decodeMask, fn)
+}
+
+// RegisterMatching registers your function to receive events from a Netlinkgroup,
+// of which the entries match p. For the Conntrack table, the parts of p, that
+// compare attributes, like MatchCIDR, MatchPorts, MatchValue and ConnMatch,
+// are compiled into a BPF filter, that is applied by the kernel. Other parts,
+// like a PredicateFunc, are matched in userspace, like entries, that are
+// passed to fn after an overflow with ResyncDump. p is matched against the
+// decoded entries, so the attributes, that p compares, have to be selected by
+// the DecodeMask of the Config.
+// If an unexpected error is received it will stop from processing further events.
+// If your function returns something different than 0, it will stop.
+func (nfct *Nfct) RegisterMatching(ctx context.Context, t Table, group NetlinkGroup, p Predicate, fn HookFunc) error {
+	expr := And()
+	if t == Conntrack {
+		// the attributes of expectations differ from the fields of Con
+		expr, _ = predicateExpr(p)
+	}
+	filter, err := buildEventFilter(t, expr)
+	if err != nil {
+		return err
+	}
+	nfct.match = p
+	return nfct.register(ctx, t, group, filter, nfct.decodeMask, fn)
 }
 
-// EnableDebug print bpf filter for RegisterFiltered function
+// EnableDebug print bpf filter for RegisterFiltered and RegisterFilterExpr function
 func (nfct *Nfct) EnableDebug() {
 	nfct.debug = true
 }
 
-func (nfct *Nfct) register(ctx context.Context, t Table, groups NetlinkGroup, filter []ConnAttr, fn func(c Con) int) error {
+func (nfct *Nfct) register(ctx context.Context, t Table, groups NetlinkGroup, filter eventFilter, mask Field, fn func(c Con) int) error {
 	nfct.ctx, nfct.ctxCancel = context.WithCancel(ctx)
+	nfct.eventMask = mask
+	nfct.filter = filter
 	nfct.shutdown = make(chan struct{})
 
 	if err := nfct.manageGroups(t, uint32(groups), true); err != nil {
 		return err
 	}
-	if err := nfct.attachFilter(t, filter); err != nil {
+	if err := nfct.attachFilter(filter.kernel); err != nil {
 		return err
 	}
 
@@ -540,42 +801,81 @@ func (nfct *Nfct) register(ctx context.Context, t Table, groups NetlinkGroup, fi
 			close(nfct.shutdown)
 		}()
 
-		for {
-			reply, err := nfct.Con.Receive()
-			if err != nil {
-				if nfct.ctx.Err() != nil {
-					// TODO: Here we ignore internal/poll.ErrFileClosing which is expected after
-					//       nfct.ctx is done. Maybe improve graceful handling.
-					return
-				}
-				if opError, ok := err.(*netlink.OpError); ok {
-					if opError.Timeout() || opError.Temporary() {
-						continue
-					}
-				}
-				if nfct.errChan != nil {
-					nfct.errChan <- err
-				} else {
-					nfct.logger.Printf("receiving error: %v", err)
-				}
+		nfct.receiveEvents(t, enricher, fn)
+	}()
+	return nil
+}
+
+// receiveEvents passes received events to fn, until fn returns something
+// different than 0 or an unexpected error is received.
+func (nfct *Nfct) receiveEvents(t Table, enricher func(*Con, netlink.Header), fn HookFunc) {
+	for {
+		reply, err := nfct.Con.Receive()
+		if err != nil {
+			if nfct.ctx.Err() != nil {
+				// TODO: Here we ignore internal/poll.ErrFileClosing which is expected after
+				//       nfct.ctx is done. Maybe improve graceful handling.
 				return
 			}
-
-			c := Con{}
-			for _, msg := range reply {
-				if err := parseConnectionMsg(nfct.logger, &c, msg, (int(msg.Header.Type)&0x300)>>8, int(msg.Header.Type)&0xF); err != nil {
-					nfct.logger.Printf("could not parse received message: %v", err)
+			if errors.Is(err, unix.ENOBUFS) {
+				nfct.countOverflow()
+				nfct.growReadBuffer()
+				if nfct.resyncOnOverflow {
+					if stop := nfct.resync(t, fn); stop {
+						return
+					}
 					continue
 				}
-				enricher(&c, msg.Header)
-				if ret := fn(c); ret != 0 {
-					return
+			}
+			if opError, ok := err.(*netlink.OpError); ok {
+				if opError.Timeout() || opError.Temporary() {
+					continue
 				}
 			}
+			if nfct.errChan != nil {
+				nfct.errChan <- err
+			} else {
+				nfct.logger.Printf("receiving error: %v", err)
+			}
+			return
+		}
 
+		for _, msg := range reply {
+			if !nfct.matchEvent(msg) {
+				continue
+			}
+			c := Con{}
+			if err := parseConnectionMsg(nfct.logger, &c, msg, (int(msg.Header.Type)&0x300)>>8, int(msg.Header.Type)&0xF, fieldMask(nfct.eventMask)); err != nil {
+				nfct.logger.Printf("could not parse received message: %v", err)
+				continue
+			}
+			if nfct.match != nil && !nfct.match.Match(c) {
+				continue
+			}
+			enricher(&c, msg.Header)
+			if ret := fn(c); ret != 0 {
+				return
+			}
 		}
-	}()
-	return nil
+
+	}
+}
+
+// matchEvent reports whether msg passes the filter of events in userspace.
+func (nfct *Nfct) matchEvent(msg netlink.Message) bool {
+	if nfct.filter.exact == nil {
+		return true
+	}
+	return nfct.filter.match(rawMessage(msg))
+}
+
+// rawMessage returns msg as it is passed to a BPF filter by the kernel.
+func rawMessage(msg netlink.Message) []byte {
+	raw := make([]byte, NetlinkHeaderSize, NetlinkHeaderSize+len(msg.Data))
+	nlenc.PutUint32(raw[0:4], uint32(NetlinkHeaderSize+len(msg.Data)))
+	nlenc.PutUint16(raw[4:6], uint16(msg.Header.Type))
+	nlenc.PutUint16(raw[6:8], uint16(msg.Header.Flags))
+	return append(raw, msg.Data...)
 }
 
 func (nfct *Nfct) manageGroups(t Table, groups uint32, join bool) error {
@@ -645,117 +945,95 @@ func unmarschalErrMsg(b []byte) (ErrMsg, error) {
 	return msg, nil
 }
 
-func (nfct *Nfct) execute(req netlink.Message) error {
-	if err := nfct.setWriteTimeout(); err != nil {
-		nfct.logger.Printf("could not set write timeout: %v", err)
-	}
-	reply, e := nfct.Con.Execute(req)
-	if e != nil {
-		return e
-	}
-	if e := netlink.Validate(req, reply); e != nil {
-		return e
+// setConnWriteTimeout sets the deadline for the next write on con.
+func (nfct *Nfct) setConnWriteTimeout(con *netlink.Conn) {
+	var err error
+	if con == nfct.Con {
+		err = nfct.setWriteTimeout()
+	} else if nfct.writeTimeout > 0 {
+		err = con.SetWriteDeadline(time.Now().Add(nfct.writeTimeout))
 	}
-	for _, msg := range reply {
-		errMsg, err := unmarschalErrMsg(msg.Data)
-		if err != nil {
-			return err
-		}
-		if errMsg.Code != 0 {
-			return fmt.Errorf("%#v", errMsg)
-		}
+	if err != nil {
+		nfct.logger.Printf("could not set write timeout: %v", err)
 	}
-	return nil
 }
 
-func (nfct *Nfct) send(req netlink.Message) error {
-	if err := nfct.setWriteTimeout(); err != nil {
-		nfct.logger.Printf("could not set write timeout: %v", err)
-	}
-	verify, err := nfct.Con.Send(req)
+func (nfct *Nfct) execute(ctx context.Context, req netlink.Message) error {
+	return nfct.request(ctx, req, func(msg netlink.Message) error {
+		return nil
+	})
+}
+
+// send sends req over con and returns it, as it was sent to the kernel.
+func (nfct *Nfct) send(con *netlink.Conn, req netlink.Message) (netlink.Message, error) {
+	nfct.setConnWriteTimeout(con)
+	verify, err := con.Send(req)
 	if err != nil {
-		return err
+		return verify, err
 	}
 
 	if err := netlink.Validate(req, []netlink.Message{verify}); err != nil {
-		return err
+		return verify, err
 	}
 
-	return nil
+	return verify, nil
 }
 
-func (nfct *Nfct) query(req netlink.Message) ([]Con, error) {
-
-	if err := nfct.send(req); err != nil {
-		return nil, err
-	}
-
-	reply, err := nfct.Con.Receive()
-	if err != nil {
-		return nil, err
-	}
-
+func (nfct *Nfct) query(ctx context.Context, req netlink.Message) ([]Con, error) {
 	var conn []Con
-	for _, msg := range reply {
-		c := Con{}
-		if err := parseConnectionMsg(nfct.logger, &c, msg, (int(req.Header.Type)&0x300)>>8, int(req.Header.Type)&0xF); err != nil {
-			return nil, err
-		}
-		// check if c is an empty struct
-		if (Con{}) == c {
-			continue
-		}
+	err := nfct.queryFunc(ctx, req, func(c Con) error {
 		conn = append(conn, c)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return conn, nil
 }
 
-func (nfct *Nfct) getCPUStats(req netlink.Message) ([]CPUStat, error) {
+func (nfct *Nfct) getCPUStats(ctx context.Context, req netlink.Message) ([]CPUStat, error) {
 	var stats []CPUStat
-	if err := nfct.send(req); err != nil {
-		return nil, err
-	}
-	reply, err := nfct.Con.Receive()
-	if err != nil {
-		return nil, err
+	table := Table((int(req.Header.Type) & 0x300) >> 8)
+	if table != Conntrack && table != Expected {
+		return nil, fmt.Errorf("unknown table")
 	}
-
-	for _, msg := range reply {
-		if msg.Header.Type == netlink.Error {
-			errMsg, err := unmarschalErrMsg(msg.Data)
-			if err != nil {
-				nfct.logger.Printf("could not unmarshal ErrMsg: %v", err)
-				continue
-			}
-			if errMsg.Code == 0 {
-				continue
-			}
-			nfct.logger.Printf("unknown error: %v", errMsg)
-			continue
-		}
-
+	err := nfct.request(ctx, req, func(msg netlink.Message) error {
 		var stat CPUStat
 		offset := checkHeader(msg.Data[:2])
-		switch Table((int(req.Header.Type) & 0x300) >> 8) {
+		switch table {
 		case Conntrack:
 			if err := extractCPUStats(&stat, nfct.logger, msg.Data[offset:]); err != nil {
 				nfct.logger.Printf("could not extract CPU stats: %v", err)
-				continue
+				return nil
 			}
 		case Expected:
 			if err := extractExpCPUStats(&stat, nfct.logger, msg.Data[offset:]); err != nil {
 				nfct.logger.Printf("could not extract CPU stats: %v", err)
-				continue
+				return nil
 			}
-		default:
-			return nil, fmt.Errorf("unknown table")
 		}
-
 		stats = append(stats, stat)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return stats, nil
 }
 
+func (nfct *Nfct) getGlobalStats(ctx context.Context, req netlink.Message) (GlobalStats, error) {
+	var stats GlobalStats
+	// The statistics and the acknowledgement are received as separate messages.
+	err := nfct.request(ctx, req, func(msg netlink.Message) error {
+		// skip struct nfgenmsg, which does not use AF_INET or AF_INET6 here
+		if len(msg.Data) < 4 {
+			return ErrDataLength
+		}
+		return extractGlobalStats(&stats, nfct.logger, msg.Data[4:])
+	})
+	return stats, err
+}
+
 // /include/uapi/linux/netfilter/nfnetlink.h:struct nfgenmsg{} res_id is Big Endian
 func putExtraHeader(familiy, version uint8, resid uint16) []byte {
 	buf := make([]byte, 2)
@@ -765,7 +1043,19 @@ func putExtraHeader(familiy, version uint8, resid uint16) []byte {
 
 type extractFunc func(*log.Logger, *Con, []byte) error
 
-func parseConnectionMsg(logger *log.Logger, c *Con, msg netlink.Message, reqTable, reqType int) error {
+var conntrackExtractFuncs = map[int]extractFunc{
+	ipctnlMsgCtNew:    extractAttributes,
+	ipctnlMsgCtGet:    extractAttributes,
+	ipctnlMsgCtDelete: extractAttributes,
+}
+
+var expectExtractFuncs = map[int]extractFunc{
+	ipctnlMsgExpNew:    extractExpectAttributes,
+	ipctnlMsgExpGet:    extractExpectAttributes,
+	ipctnlMsgExpDelete: extractExpectAttributes,
+}
+
+func parseConnectionMsg(logger *log.Logger, c *Con, msg netlink.Message, reqTable, reqType int, mask Field) error {
 
 	if msg.Header.Type == netlink.Error {
 		errMsg, err := unmarschalErrMsg(msg.Data)
@@ -782,22 +1072,17 @@ func parseConnectionMsg(logger *log.Logger, c *Con, msg netlink.Message, reqTabl
 
 	switch reqTable {
 	case unix.NFNL_SUBSYS_CTNETLINK:
-		fnMap = map[int]extractFunc{
-			ipctnlMsgCtNew:    extractAttributes,
-			ipctnlMsgCtGet:    extractAttributes,
-			ipctnlMsgCtDelete: extractAttributes,
-		}
+		fnMap = conntrackExtractFuncs
 	case unix.NFNL_SUBSYS_CTNETLINK_EXP:
-		fnMap = map[int]extractFunc{
-			ipctnlMsgExpNew:    extractExpectAttributes,
-			ipctnlMsgExpGet:    extractExpectAttributes,
-			ipctnlMsgExpDelete: extractExpectAttributes,
-		}
+		fnMap = expectExtractFuncs
 	default:
 		return fmt.Errorf("unknown conntrack table")
 	}
 
 	if fn, ok := fnMap[reqType]; ok {
+		if reqTable == unix.NFNL_SUBSYS_CTNETLINK && mask != FieldAll {
+			return extractMaskedAttributes(logger, c, msg.Data, mask)
+		}
 		return fn(logger, c, msg.Data)
 	}
 
@@ -4,11 +4,21 @@
 package conntrack
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"net"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/florianl/go-conntrack/internal/unix"
 )
 
 func TestLinuxConntrackUpdatePing(t *testing.T) {
@@ -141,3 +151,1264 @@ func TestLinuxConntrackDeleteEntry(t *testing.T) {
 		}
 	}
 }
+
+func TestLinuxConntrackBufferSizes(t *testing.T) {
+	nfct, err := Open(&Config{
+		ReadBufferSize:    1 << 16,
+		WriteBufferSize:   1 << 16,
+		ReadBufferMaxSize: 1 << 18,
+		BroadcastError:    true,
+	})
+	if err != nil {
+		t.Fatalf("could not open socket: %v", err)
+	}
+	defer nfct.Close()
+
+	size, err := nfct.ReadBufferSize()
+	if err != nil {
+		t.Fatalf("could not get size of receive buffer: %v", err)
+	}
+	if size < 1<<16 {
+		t.Fatalf("unexpected size of receive buffer: %d", size)
+	}
+	if size, err := nfct.WriteBufferSize(); err != nil || size < 1<<16 {
+		t.Fatalf("unexpected size of send buffer: %d (%v)", size, err)
+	}
+
+	for i := 0; i < 4; i++ {
+		nfct.growReadBuffer()
+	}
+	grown, err := nfct.ReadBufferSize()
+	if err != nil {
+		t.Fatalf("could not get size of receive buffer: %v", err)
+	}
+	// The kernel reports twice the size that was set.
+	if grown != 2*(1<<18) {
+		t.Fatalf("unexpected size of receive buffer after growing: %d", grown)
+	}
+}
+
+func TestLinuxConntrackPoolBufferSizes(t *testing.T) {
+	nfct, err := Open(&Config{
+		ReadBufferSize:        1 << 16,
+		WriteBufferSize:       1 << 16,
+		MaxConcurrentRequests: 2,
+	})
+	if err != nil {
+		t.Fatalf("could not open socket: %v", err)
+	}
+	defer nfct.Close()
+
+	pool := nfct.requestPool()
+	con, err := pool.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("could not acquire socket: %v", err)
+	}
+	defer pool.release(con)
+
+	if size, err := getBufferSize(con, unix.SO_RCVBUF); err != nil || size < 1<<16 {
+		t.Fatalf("unexpected size of receive buffer of pooled socket: %d (%v)", size, err)
+	}
+	if size, err := getBufferSize(con, unix.SO_SNDBUF); err != nil || size < 1<<16 {
+		t.Fatalf("unexpected size of send buffer of pooled socket: %d (%v)", size, err)
+	}
+}
+
+// netns creates a network namespace and returns it.
+func netns(t *testing.T, name string) *os.File {
+	t.Helper()
+	if out, err := exec.Command("ip", "netns", "add", name).CombinedOutput(); err != nil {
+		t.Skipf("could not create network namespace: %v: %s", err, out)
+	}
+	f, err := os.Open("/var/run/netns/" + name)
+	if err != nil {
+		exec.Command("ip", "netns", "del", name).Run()
+		t.Fatalf("could not open network namespace: %v", err)
+	}
+	return f
+}
+
+func deleteNetns(f *os.File) {
+	f.Close()
+	exec.Command("ip", "netns", "del", filepath.Base(f.Name())).Run()
+}
+
+func TestLinuxConntrackSnapshotRestore(t *testing.T) {
+	srcNS := netns(t, "ct-snapshot-src")
+	defer deleteNetns(srcNS)
+	dstNS := netns(t, "ct-snapshot-dst")
+	defer deleteNetns(dstNS)
+
+	src, err := Open(&Config{NetNS: int(srcNS.Fd())})
+	if err != nil {
+		t.Fatalf("could not open socket: %v", err)
+	}
+	defer src.Close()
+
+	client := net.ParseIP("192.0.2.1")
+	service := net.ParseIP("192.0.2.2")
+	backend := net.ParseIP("10.0.0.2")
+	proto := uint8(6)
+	clientPort := uint16(40000)
+	servicePort := uint16(80)
+	backendPort := uint16(8080)
+	state := uint8(3)
+	wscale := uint8(7)
+	flags := uint8(0x09) // IP_CT_TCP_FLAG_WINDOW_SCALE | IP_CT_TCP_FLAG_BE_LIBERAL
+	timeout := uint32(600)
+	mark := uint32(0x42)
+	zone := uint16(1)
+	entry := Con{
+		Origin: &IPTuple{Src: &client, Dst: &service, Proto: &ProtoTuple{
+			Number: &proto, SrcPort: &clientPort, DstPort: &servicePort}},
+		Reply: &IPTuple{Src: &backend, Dst: &client, Proto: &ProtoTuple{
+			Number: &proto, SrcPort: &backendPort, DstPort: &clientPort}},
+		ProtoInfo: &ProtoInfo{TCP: &TCPInfo{State: &state, WScaleOrig: &wscale, WScaleRepl: &wscale,
+			FlagsOrig: &TCPFlags{Flags: &flags, Mask: &flags}, FlagsReply: &TCPFlags{Flags: &flags, Mask: &flags}}},
+		Timeout: &timeout,
+		Mark:    &mark,
+		Zone:    &zone,
+	}
+	if err := src.Create(Conntrack, IPv4, entry); err != nil {
+		t.Fatalf("could not create entry: %v", err)
+	}
+
+	snapshot, err := src.Snapshot(Conntrack, IPv4, func(c Con) bool {
+		return c.Mark != nil && *c.Mark == 0x42
+	})
+	if err != nil {
+		t.Fatalf("could not create snapshot: %v", err)
+	}
+	var buf bytes.Buffer
+	if _, err := snapshot.WriteTo(&buf); err != nil {
+		t.Fatalf("could not write snapshot: %v", err)
+	}
+	restored, err := ReadSnapshot(&buf)
+	if err != nil {
+		t.Fatalf("could not read snapshot: %v", err)
+	}
+
+	dst, err := Open(&Config{NetNS: int(dstNS.Fd())})
+	if err != nil {
+		t.Fatalf("could not open socket: %v", err)
+	}
+	defer dst.Close()
+
+	result, err := dst.Restore(restored, RestoreConfig{Remap: []RemapFunc{RemapZone(1, 2)}})
+	if err != nil {
+		t.Fatalf("could not restore snapshot: %v", err)
+	}
+	if result.Restored != 1 || len(result.Failed) != 0 {
+		t.Fatalf("unexpected result of restore: %#v", result)
+	}
+
+	entries, err := dst.Dump(Conntrack, IPv4)
+	if err != nil {
+		t.Fatalf("could not dump table: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("unexpected number of entries: %d", len(entries))
+	}
+	c := entries[0]
+	if c.Zone == nil || *c.Zone != 2 {
+		t.Fatalf("zone was not remapped: %v", c.Zone)
+	}
+	if !c.Reply.Src.Equal(backend) || *c.Reply.Proto.SrcPort != backendPort {
+		t.Fatalf("unexpected reply tuple: %v", c.Reply)
+	}
+	if *c.ProtoInfo.TCP.WScaleOrig != wscale || *c.ProtoInfo.TCP.FlagsOrig.Flags != flags {
+		t.Fatalf("unexpected TCP window state")
+	}
+}
+
+func TestLinuxConntrackDumpFunc(t *testing.T) {
+	ns := netns(t, "ct-dumpfunc")
+	defer deleteNetns(ns)
+
+	nfct, err := Open(&Config{NetNS: int(ns.Fd())})
+	if err != nil {
+		t.Fatalf("could not open socket: %v", err)
+	}
+	defer nfct.Close()
+
+	// enough entries to span multiple datagrams
+	const entries = 1000
+	createUDPEntries(t, nfct, entries)
+
+	var n int
+	if err := nfct.DumpFunc(context.Background(), Conntrack, IPv4, func(c Con) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatalf("could not dump table: %v", err)
+	}
+	if n != entries {
+		t.Fatalf("unexpected number of entries: %d", n)
+	}
+
+	n = 0
+	if err := nfct.DumpEntries(context.Background(), IPv4, func(e *Entry) error {
+		if e.Origin.Proto != 17 || e.Origin.DstPort != 53 || e.Fields&FieldTimeout == 0 {
+			return fmt.Errorf("unexpected entry: %#v", e)
+		}
+		n++
+		return nil
+	}); err != nil {
+		t.Fatalf("could not dump entries: %v", err)
+	}
+	if n != entries {
+		t.Fatalf("unexpected number of decoded entries: %d", n)
+	}
+
+	// stop early and make sure the socket is still usable afterwards
+	errStop := errors.New("stop")
+	n = 0
+	if err := nfct.DumpFunc(context.Background(), Conntrack, IPv4, func(c Con) error {
+		n++
+		if n == 10 {
+			return errStop
+		}
+		return nil
+	}); err != errStop {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n != 10 {
+		t.Fatalf("unexpected number of entries after stop: %d", n)
+	}
+
+	src := net.ParseIP("192.0.2.1")
+	dst := net.ParseIP("192.0.2.2")
+	proto := uint8(17)
+	dstPort := uint16(53)
+	srcPort := uint16(10000)
+	match := Con{Origin: &IPTuple{Src: &src, Dst: &dst, Proto: &ProtoTuple{
+		Number: &proto, SrcPort: &srcPort, DstPort: &dstPort}}}
+	got, err := nfct.Get(Conntrack, IPv4, match)
+	if err != nil {
+		t.Fatalf("could not get entry: %v", err)
+	}
+	if len(got) != 1 || *got[0].Origin.Proto.SrcPort != srcPort {
+		t.Fatalf("unexpected entries: %v", got)
+	}
+	srcPort = 9999
+	if _, err := nfct.Get(Conntrack, IPv4, match); !errors.Is(err, unix.ENOENT) {
+		t.Fatalf("unexpected error for missing entry: %v", err)
+	}
+	if list, err := nfct.Dump(Conntrack, IPv4); err != nil || len(list) != entries {
+		t.Fatalf("unexpected result of dump: %d entries (%v)", len(list), err)
+	}
+}
+
+// createUDPEntries creates n entries from 192.0.2.1 to 192.0.2.2:53 with
+// source ports starting at 10000.
+func createUDPEntries(t *testing.T, nfct *Nfct, n int) {
+	t.Helper()
+	src := net.ParseIP("192.0.2.1")
+	dst := net.ParseIP("192.0.2.2")
+	proto := uint8(17)
+	dstPort := uint16(53)
+	timeout := uint32(600)
+	for i := 0; i < n; i++ {
+		srcPort := uint16(10000 + i)
+		entry := Con{
+			Origin: &IPTuple{Src: &src, Dst: &dst, Proto: &ProtoTuple{
+				Number: &proto, SrcPort: &srcPort, DstPort: &dstPort}},
+			Reply: &IPTuple{Src: &dst, Dst: &src, Proto: &ProtoTuple{
+				Number: &proto, SrcPort: &dstPort, DstPort: &srcPort}},
+			Timeout: &timeout,
+		}
+		if err := nfct.Create(Conntrack, IPv4, entry); err != nil {
+			t.Fatalf("could not create entry: %v", err)
+		}
+	}
+}
+
+func TestLinuxConntrackContext(t *testing.T) {
+	ns := netns(t, "ct-context")
+	defer deleteNetns(ns)
+
+	nfct, err := Open(&Config{NetNS: int(ns.Fd())})
+	if err != nil {
+		t.Fatalf("could not open socket: %v", err)
+	}
+	defer nfct.Close()
+
+	const entries = 1000
+	createUDPEntries(t, nfct, entries)
+
+	// cancel in the middle of a dump
+	ctx, cancel := context.WithCancel(context.Background())
+	var n int
+	err = nfct.DumpFunc(ctx, Conntrack, IPv4, func(c Con) error {
+		n++
+		if n == 10 {
+			cancel()
+		}
+		return nil
+	})
+	if err != context.Canceled || n != 10 {
+		t.Fatalf("unexpected result of cancelled dump: %d entries (%v)", n, err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	if _, err := nfct.DumpContext(ctx, Conntrack, IPv4); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error for expired context: %v", err)
+	}
+	if err := nfct.FlushContext(ctx, Conntrack, IPv4); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error for expired context: %v", err)
+	}
+
+	// the socket is usable after the cancelled requests
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	list, err := nfct.DumpContext(ctx, Conntrack, IPv4)
+	if err != nil || len(list) != entries {
+		t.Fatalf("unexpected result of dump: %d entries (%v)", len(list), err)
+	}
+	if _, err := nfct.DumpCPUStatsContext(ctx, Conntrack); err != nil {
+		t.Fatalf("could not dump CPU statistics: %v", err)
+	}
+	if err := nfct.DeleteContext(ctx, Conntrack, IPv4, list[0]); err != nil {
+		t.Fatalf("could not delete entry: %v", err)
+	}
+	if err := nfct.DeleteContext(ctx, Conntrack, IPv4, list[0]); !errors.Is(err, unix.ENOENT) {
+		t.Fatalf("unexpected error for deleted entry: %v", err)
+	}
+	if err := nfct.FlushContext(ctx, Conntrack, IPv4); err != nil {
+		t.Fatalf("could not flush table: %v", err)
+	}
+	if list, err := nfct.DumpContext(ctx, Conntrack, IPv4); err != nil || len(list) != 0 {
+		t.Fatalf("unexpected result of dump after flush: %d entries (%v)", len(list), err)
+	}
+}
+
+func TestLinuxConntrackConcurrent(t *testing.T) {
+	ns := netns(t, "ct-concurrent")
+	defer deleteNetns(ns)
+
+	for _, limit := range []int{0, 4} {
+		nfct, err := Open(&Config{NetNS: int(ns.Fd()), MaxConcurrentRequests: limit})
+		if err != nil {
+			t.Fatalf("could not open socket: %v", err)
+		}
+
+		const entries = 200
+		if err := nfct.Flush(Conntrack, IPv4); err != nil {
+			t.Fatal(err)
+		}
+		createUDPEntries(t, nfct, entries)
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 16)
+		for i := 0; i < 8; i++ {
+			wg.Add(2)
+			go func(i int) {
+				defer wg.Done()
+				list, err := nfct.Dump(Conntrack, IPv4)
+				if err != nil {
+					errs <- err
+				} else if len(list) != entries {
+					errs <- fmt.Errorf("dump returned %d entries", len(list))
+				}
+			}(i)
+			go func(i int) {
+				defer wg.Done()
+				for j := i; j < entries; j += 8 {
+					src, dst, proto := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), uint8(17)
+					sport, dport := uint16(10000+j), uint16(53)
+					match := Con{Origin: &IPTuple{Src: &src, Dst: &dst,
+						Proto: &ProtoTuple{Number: &proto, SrcPort: &sport, DstPort: &dport}}}
+					list, err := nfct.Get(Conntrack, IPv4, match)
+					if err != nil {
+						errs <- err
+						return
+					}
+					if len(list) != 1 || *list[0].Origin.Proto.SrcPort != sport {
+						errs <- fmt.Errorf("get of port %d returned %v", sport, list)
+						return
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Errorf("limit %d: %v", limit, err)
+		}
+		nfct.Close()
+	}
+}
+
+func TestLinuxConntrackBulk(t *testing.T) {
+	ns := netns(t, "ct-bulk")
+	defer deleteNetns(ns)
+
+	nfct, err := Open(&Config{NetNS: int(ns.Fd())})
+	if err != nil {
+		t.Fatalf("could not open socket: %v", err)
+	}
+	defer nfct.Close()
+
+	const entries = 20000
+	src, dst, proto := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), uint8(17)
+	list := make([]Con, entries)
+	for i := range list {
+		sport, dport := uint16(10000+i), uint16(53)
+		timeout := uint32(600)
+		list[i] = Con{
+			Origin:  &IPTuple{Src: &src, Dst: &dst, Proto: &ProtoTuple{Number: &proto, SrcPort: &sport, DstPort: &dport}},
+			Reply:   &IPTuple{Src: &dst, Dst: &src, Proto: &ProtoTuple{Number: &proto, SrcPort: &dport, DstPort: &sport}},
+			Timeout: &timeout,
+		}
+	}
+	// create a subset in advance, so these entries fail with EEXIST
+	for i := 0; i < entries; i += 1000 {
+		if err := nfct.Create(Conntrack, IPv4, list[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := nfct.CreateBulk(context.Background(), Conntrack, IPv4, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Failed != entries/1000 || result.Succeeded != entries-entries/1000 || result.Batches < 2 {
+		t.Fatalf("unexpected statistics: %#v", result.BulkStats)
+	}
+	for i, err := range result.Errors {
+		if (i%1000 == 0) != errors.Is(err, unix.EEXIST) {
+			t.Fatalf("unexpected result of entry %d: %v", i, err)
+		}
+	}
+
+	mark := uint32(0x42)
+	for i := range list {
+		list[i].Mark = &mark
+	}
+	result, err = nfct.UpdateBulk(context.Background(), Conntrack, IPv4, list)
+	if err != nil || result.Succeeded != entries {
+		t.Fatalf("unexpected result of update: %#v (%v)", result.BulkStats, err)
+	}
+
+	result, err = nfct.DeleteBulk(context.Background(), Conntrack, IPv4, list[:entries/2])
+	if err != nil || result.Succeeded != entries/2 {
+		t.Fatalf("unexpected result of delete: %#v (%v)", result.BulkStats, err)
+	}
+	result, err = nfct.DeleteBulk(context.Background(), Conntrack, IPv4, list[:10])
+	if err != nil || result.Failed != 10 || !errors.Is(result.Errors[9], unix.ENOENT) {
+		t.Fatalf("unexpected result of repeated delete: %#v (%v)", result, err)
+	}
+
+	var marked int
+	if err := nfct.DumpFunc(context.Background(), Conntrack, IPv4, func(c Con) error {
+		if c.Mark != nil && *c.Mark == mark {
+			marked++
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if marked != entries/2 {
+		t.Fatalf("unexpected number of remaining entries: %d", marked)
+	}
+}
+
+// countingMatch counts the entries, that are passed to Match.
+type countingMatch struct {
+	ConnMatch
+	calls *int
+}
+
+func (m countingMatch) Match(c Con) bool {
+	*m.calls++
+	return m.ConnMatch.Match(c)
+}
+
+func TestLinuxConntrackDeleteMatching(t *testing.T) {
+	ns := netns(t, "ct-deletematching")
+	defer deleteNetns(ns)
+
+	nfct, err := Open(&Config{NetNS: int(ns.Fd())})
+	if err != nil {
+		t.Fatalf("could not open socket: %v", err)
+	}
+	defer nfct.Close()
+
+	src, backend, other := net.ParseIP("192.0.2.1"), net.ParseIP("10.0.3.4"), net.ParseIP("10.0.3.5")
+	proto := uint8(17)
+	create := func(sport uint16, dst net.IP, dport uint16, mark uint32, zone uint16) {
+		timeout := uint32(600)
+		entry := Con{
+			Origin:  &IPTuple{Src: &src, Dst: &dst, Proto: &ProtoTuple{Number: &proto, SrcPort: &sport, DstPort: &dport}},
+			Reply:   &IPTuple{Src: &dst, Dst: &src, Proto: &ProtoTuple{Number: &proto, SrcPort: &dport, DstPort: &sport}},
+			Timeout: &timeout,
+			Mark:    &mark,
+			Zone:    &zone,
+		}
+		if err := nfct.Create(Conntrack, IPv4, entry); err != nil {
+			t.Fatalf("could not create entry: %v", err)
+		}
+	}
+	for i := uint16(0); i < 100; i++ {
+		create(10000+i, backend, 443, 0, 0)
+		create(10000+i, backend, 80, 0x10, 5)
+		create(10000+i, other, 443, 0x10, 0)
+		create(10000+i, other, 80, 0x11, 5)
+	}
+
+	var calls int
+	port := uint16(443)
+	match := countingMatch{
+		ConnMatch: ConnMatch{Origin: &IPTuple{Dst: &backend, Proto: &ProtoTuple{Number: &proto, DstPort: &port}}},
+		calls:     &calls,
+	}
+	stats, err := nfct.DeleteMatching(context.Background(), Conntrack, IPv4, match)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (DeleteStats{Matched: 100, Deleted: 100}) {
+		t.Fatalf("unexpected statistics: %#v", stats)
+	}
+	// the kernel filtered the entries
+	if calls != 100 {
+		t.Fatalf("unexpected number of entries passed to the predicate: %d", calls)
+	}
+
+	mark, zone := uint32(0x10), uint16(5)
+	calls = 0
+	match.ConnMatch = ConnMatch{Mark: &mark, Zone: &zone}
+	stats, err = nfct.DeleteMatching(context.Background(), Conntrack, Family(unix.AF_UNSPEC), match)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (DeleteStats{Matched: 100, Deleted: 100}) {
+		t.Fatalf("unexpected statistics: %#v", stats)
+	}
+	if calls != 100 {
+		t.Fatalf("unexpected number of entries passed to the predicate: %d", calls)
+	}
+
+	stats, err = nfct.DeleteMatching(context.Background(), Conntrack, IPv4, PredicateFunc(func(c Con) bool {
+		return c.Mark != nil && *c.Mark&0x10 != 0
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (DeleteStats{Matched: 200, Deleted: 200}) {
+		t.Fatalf("unexpected statistics: %#v", stats)
+	}
+	list, err := nfct.Dump(Conntrack, IPv4)
+	if err != nil || len(list) != 0 {
+		t.Fatalf("unexpected remaining entries: %d (%v)", len(list), err)
+	}
+}
+
+func TestLinuxConntrackRegisterFilterExpr(t *testing.T) {
+	ns := netns(t, "ct-filterexpr")
+	defer deleteNetns(ns)
+
+	monitor, err := Open(&Config{NetNS: int(ns.Fd())})
+	if err != nil {
+		t.Fatalf("could not open socket: %v", err)
+	}
+	defer monitor.Close()
+	nfct, err := Open(&Config{NetNS: int(ns.Fd())})
+	if err != nil {
+		t.Fatalf("could not open socket: %v", err)
+	}
+	defer nfct.Close()
+
+	port := func(p uint16) []byte {
+		b := make([]byte, 2)
+		binary.BigEndian.PutUint16(b, p)
+		return b
+	}
+	// (orig dst port 80 OR 443) AND NOT mark 0x1 OR zone 7
+	expr := Or(
+		And(
+			Or(ConnAttr{Type: AttrOrigPortDst, Data: port(80)}, ConnAttr{Type: AttrOrigPortDst, Data: port(443)}),
+			Not(ConnAttr{Type: AttrMark, Data: []byte{0, 0, 0, 1}}),
+		),
+		ConnAttr{Type: AttrZone, Data: port(7)},
+	)
+	events := make(chan uint16, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := monitor.RegisterFilterExpr(ctx, Conntrack, NetlinkCtNew, expr, func(c Con) int {
+		events <- *c.Origin.Proto.SrcPort
+		return 0
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	src, dst, proto := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), uint8(17)
+	for i, entry := range []struct {
+		dport uint16
+		mark  uint32
+		zone  uint16
+	}{{80, 0, 0}, {443, 2, 0}, {22, 0, 0}, {80, 1, 0}, {22, 1, 7}} {
+		sport, dport, mark, zone := uint16(10000+i), entry.dport, entry.mark, entry.zone
+		timeout := uint32(600)
+		c := Con{
+			Origin:  &IPTuple{Src: &src, Dst: &dst, Proto: &ProtoTuple{Number: &proto, SrcPort: &sport, DstPort: &dport}},
+			Reply:   &IPTuple{Src: &dst, Dst: &src, Proto: &ProtoTuple{Number: &proto, SrcPort: &dport, DstPort: &sport}},
+			Timeout: &timeout,
+			Mark:    &mark,
+			Zone:    &zone,
+		}
+		if err := nfct.Create(Conntrack, IPv4, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var received []uint16
+	timer := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case p := <-events:
+			received = append(received, p)
+		case <-timer:
+			done = true
+		}
+	}
+	if fmt.Sprint(received) != "[10000 10001 10004]" {
+		t.Fatalf("unexpected events: %v", received)
+	}
+}
+
+func TestLinuxConntrackRegisterFilterCompare(t *testing.T) {
+	ns := netns(t, "ct-filtercompare")
+	defer deleteNetns(ns)
+
+	monitor, err := Open(&Config{NetNS: int(ns.Fd())})
+	if err != nil {
+		t.Fatalf("could not open socket: %v", err)
+	}
+	defer monitor.Close()
+	nfct, err := Open(&Config{NetNS: int(ns.Fd())})
+	if err != nil {
+		t.Fatalf("could not open socket: %v", err)
+	}
+	defer nfct.Close()
+
+	// connections to ephemeral ports or about to expire
+	expr := Or(
+		AttrRange{Type: AttrOrigPortDst, Min: 32768, Max: 60999},
+		AttrCompare{Type: AttrTimeout, Op: OpLess, Value: 30},
+	)
+	events := make(chan uint16, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := monitor.RegisterFilterExpr(ctx, Conntrack, NetlinkCtNew, expr, func(c Con) int {
+		events <- *c.Origin.Proto.SrcPort
+		return 0
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	src, dst, proto := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), uint8(17)
+	for i, entry := range []struct {
+		dport   uint16
+		timeout uint32
+	}{{80, 600}, {40000, 600}, {61000, 600}, {80, 10}, {32768, 600}} {
+		sport, dport, timeout := uint16(10000+i), entry.dport, entry.timeout
+		c := Con{
+			Origin:  &IPTuple{Src: &src, Dst: &dst, Proto: &ProtoTuple{Number: &proto, SrcPort: &sport, DstPort: &dport}},
+			Reply:   &IPTuple{Src: &dst, Dst: &src, Proto: &ProtoTuple{Number: &proto, SrcPort: &dport, DstPort: &sport}},
+			Timeout: &timeout,
+		}
+		if err := nfct.Create(Conntrack, IPv4, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var received []uint16
+	timer := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case p := <-events:
+			received = append(received, p)
+		case <-timer:
+			done = true
+		}
+	}
+	if fmt.Sprint(received) != "[10001 10003 10004]" {
+		t.Fatalf("unexpected events: %v", received)
+	}
+}
+
+func TestLinuxConntrackRegisterFilterAttributes(t *testing.T) {
+	ns := netns(t, "ct-filterattrs")
+	defer deleteNetns(ns)
+
+	nfct, err := Open(&Config{NetNS: int(ns.Fd())})
+	if err != nil {
+		t.Fatalf("could not open socket: %v", err)
+	}
+	defer nfct.Close()
+
+	// the kernel accepts the filters of all attributes
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for typ, check := range filterCheck {
+		if check.ct == ctaUnspec {
+			continue
+		}
+		attr := ConnAttr{Type: typ, Data: make([]byte, check.len)}
+		if check.str {
+			attr.Data = []byte("ftp")
+		}
+		if check.mask {
+			attr.Mask = make([]byte, check.len)
+		}
+		monitor, err := Open(&Config{NetNS: int(ns.Fd())})
+		if err != nil {
+			t.Fatalf("could not open socket: %v", err)
+		}
+		if err := monitor.RegisterFiltered(ctx, Conntrack, NetlinkCtNew, []ConnAttr{attr}, func(c Con) int {
+			return 0
+		}); err != nil {
+			t.Fatalf("filter for %d: %v", typ, err)
+		}
+		monitor.Close()
+	}
+
+	monitor, err := Open(&Config{NetNS: int(ns.Fd())})
+	if err != nil {
+		t.Fatalf("could not open socket: %v", err)
+	}
+	defer monitor.Close()
+	// IPv6 entries without source NAT, that are not related to another entry
+	filters := []ConnAttr{
+		{Type: AttrOrigL3Proto, Data: []byte{unix.AF_INET6}},
+		{Type: AttrSNatPort, Data: []byte{0, 80}, Negate: true},
+		{Type: AttrMasterL3Proto, Data: []byte{unix.AF_INET6}, Negate: true},
+	}
+	events := make(chan uint16, 10)
+	if err := monitor.RegisterFiltered(ctx, Conntrack, NetlinkCtNew, filters, func(c Con) int {
+		events <- *c.Origin.Proto.SrcPort
+		return 0
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	proto := uint8(17)
+	for i, addrs := range [][2]string{{"192.0.2.1", "192.0.2.2"}, {"2001:db8::1", "2001:db8::2"}} {
+		src, dst := net.ParseIP(addrs[0]), net.ParseIP(addrs[1])
+		f := IPv4
+		if src.To4() == nil {
+			f = IPv6
+		}
+		sport, dport, timeout := uint16(10000+i), uint16(80), uint32(600)
+		c := Con{
+			Origin:  &IPTuple{Src: &src, Dst: &dst, Proto: &ProtoTuple{Number: &proto, SrcPort: &sport, DstPort: &dport}},
+			Reply:   &IPTuple{Src: &dst, Dst: &src, Proto: &ProtoTuple{Number: &proto, SrcPort: &dport, DstPort: &sport}},
+			Timeout: &timeout,
+		}
+		if err := nfct.Create(Conntrack, f, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var received []uint16
+	timer := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case p := <-events:
+			received = append(received, p)
+		case <-timer:
+			done = true
+		}
+	}
+	if fmt.Sprint(received) != "[10001]" {
+		t.Fatalf("unexpected events: %v", received)
+	}
+}
+
+func TestLinuxConntrackRegisterFilterStatus(t *testing.T) {
+	ns := netns(t, "ct-filterstatus")
+	defer deleteNetns(ns)
+
+	monitor, err := Open(&Config{NetNS: int(ns.Fd())})
+	if err != nil {
+		t.Fatalf("could not open socket: %v", err)
+	}
+	defer monitor.Close()
+	nfct, err := Open(&Config{NetNS: int(ns.Fd())})
+	if err != nil {
+		t.Fatalf("could not open socket: %v", err)
+	}
+	defer nfct.Close()
+
+	// entries without NAT, that became assured
+	expr := And(StatusAll(StatusAssured), StatusNone(StatusNatMask))
+	events := make(chan uint16, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := monitor.RegisterFilterExpr(ctx, Conntrack, NetlinkCtUpdate, expr, func(c Con) int {
+		events <- *c.Origin.Proto.SrcPort
+		return 0
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	src, dst, proto := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), uint8(17)
+	for i, status := range []Status{0, StatusSeenReply | StatusAssured, StatusSeenReply} {
+		sport, dport, timeout := uint16(10000+i), uint16(80), uint32(600)
+		c := Con{
+			Origin:  &IPTuple{Src: &src, Dst: &dst, Proto: &ProtoTuple{Number: &proto, SrcPort: &sport, DstPort: &dport}},
+			Reply:   &IPTuple{Src: &dst, Dst: &src, Proto: &ProtoTuple{Number: &proto, SrcPort: &dport, DstPort: &sport}},
+			Timeout: &timeout,
+		}
+		if err := nfct.Create(Conntrack, IPv4, c); err != nil {
+			t.Fatal(err)
+		}
+		if status == 0 {
+			continue
+		}
+		// The kernel rejects changes of the CONFIRMED bit.
+		bits := uint32(StatusConfirmed | status)
+		c.Status = &bits
+		if err := nfct.Update(Conntrack, IPv4, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var received []uint16
+	timer := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case p := <-events:
+			received = append(received, p)
+		case <-timer:
+			done = true
+		}
+	}
+	if fmt.Sprint(received) != "[10001]" {
+		t.Fatalf("unexpected events: %v", received)
+	}
+}
+
+func TestLinuxConntrackRegisterParsedFilter(t *testing.T) {
+	ns := netns(t, "ct-filterparse")
+	defer deleteNetns(ns)
+
+	nfct, err := Open(&Config{NetNS: int(ns.Fd())})
+	if err != nil {
+		t.Fatalf("could not open socket: %v", err)
+	}
+	defer nfct.Close()
+
+	filter, err := ParseFilter("orig.src in 192.0.2.0/24 and l4proto udp and (orig.dport 80 or orig.dport 443) and not mark 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := filter.ConnAttrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan string, 20)
+	for name, register := range map[string]func(nfct *Nfct, fn HookFunc) error{
+		"expr": func(nfct *Nfct, fn HookFunc) error {
+			return nfct.RegisterFilterExpr(ctx, Conntrack, NetlinkCtNew, filter, fn)
+		},
+		"attrs": func(nfct *Nfct, fn HookFunc) error {
+			return nfct.RegisterFiltered(ctx, Conntrack, NetlinkCtNew, attrs, fn)
+		},
+	} {
+		name := name
+		monitor, err := Open(&Config{NetNS: int(ns.Fd())})
+		if err != nil {
+			t.Fatalf("could not open socket: %v", err)
+		}
+		defer monitor.Close()
+		if err := register(monitor, func(c Con) int {
+			events <- fmt.Sprintf("%s:%d", name, *c.Origin.Proto.SrcPort)
+			return 0
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	proto := uint8(17)
+	for i, entry := range []struct {
+		src   string
+		dport uint16
+		mark  uint32
+	}{{"192.0.2.1", 80, 0}, {"198.51.100.1", 80, 0}, {"192.0.2.1", 22, 0}, {"192.0.2.1", 443, 1}, {"192.0.2.9", 443, 2}} {
+		src, dst := net.ParseIP(entry.src), net.ParseIP("203.0.113.1")
+		sport, dport, mark, timeout := uint16(10000+i), entry.dport, entry.mark, uint32(600)
+		c := Con{
+			Origin:  &IPTuple{Src: &src, Dst: &dst, Proto: &ProtoTuple{Number: &proto, SrcPort: &sport, DstPort: &dport}},
+			Reply:   &IPTuple{Src: &dst, Dst: &src, Proto: &ProtoTuple{Number: &proto, SrcPort: &dport, DstPort: &sport}},
+			Timeout: &timeout,
+			Mark:    &mark,
+		}
+		if err := nfct.Create(Conntrack, IPv4, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var received []string
+	timer := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case e := <-events:
+			received = append(received, e)
+		case <-timer:
+			done = true
+		}
+	}
+	sort.Strings(received)
+	if fmt.Sprint(received) != "[attrs:10000 attrs:10004 expr:10000 expr:10004]" {
+		t.Fatalf("unexpected events: %v", received)
+	}
+}
+
+func TestLinuxConntrackRegisterFilterLarge(t *testing.T) {
+	ns := netns(t, "ct-filterlarge")
+	defer deleteNetns(ns)
+
+	nfct, err := Open(&Config{NetNS: int(ns.Fd())})
+	if err != nil {
+		t.Fatalf("could not open socket: %v", err)
+	}
+	defer nfct.Close()
+
+	addr6 := func(i int) net.IP {
+		ip := net.ParseIP("2001:db8::")
+		ip[14], ip[15] = byte(i>>8), byte(i)
+		return ip
+	}
+	addr4 := func(i int) net.IP {
+		return net.IPv4(10, 0, byte(i>>8), byte(i)).To4()
+	}
+	// IPv6 addresses exceed the limit of the kernel, IPv4 addresses do not
+	var attrs []ConnAttr
+	var srcs []FilterExpr
+	for i := 0; i < 1000; i += 2 {
+		attrs = append(attrs, ConnAttr{Type: AttrOrigIPv6Src, Data: addr6(i), Mask: net.CIDRMask(128, 128)})
+		srcs = append(srcs, ConnAttr{Type: AttrOrigIPv4Src, Data: addr4(i)})
+	}
+	expr := And(Or(srcs...), ConnAttr{Type: AttrOrigIPv4Dst, Data: net.IPv4(192, 0, 2, 2).To4()})
+	if prog, err := CompileFilter(Conntrack, attrs); err != nil || !prog.Coarse() {
+		t.Fatalf("filter of IPv6 addresses is not coarse: %v", err)
+	}
+
+	events := make(chan string, 20)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for name, register := range map[string]func(m *Nfct, fn HookFunc) error{
+		"attrs": func(m *Nfct, fn HookFunc) error {
+			return m.RegisterFiltered(ctx, Conntrack, NetlinkCtNew, attrs, fn)
+		},
+		"expr": func(m *Nfct, fn HookFunc) error {
+			return m.RegisterFilterExpr(ctx, Conntrack, NetlinkCtNew, expr, fn)
+		},
+	} {
+		name := name
+		monitor, err := Open(&Config{NetNS: int(ns.Fd())})
+		if err != nil {
+			t.Fatalf("could not open socket: %v", err)
+		}
+		defer monitor.Close()
+		if err := register(monitor, func(c Con) int {
+			events <- fmt.Sprintf("%s:%d", name, *c.Origin.Proto.SrcPort)
+			return 0
+		}); err != nil {
+			t.Fatalf("could not register %s: %v", name, err)
+		}
+	}
+
+	proto := uint8(17)
+	for i := 0; i < 6; i++ {
+		for _, family := range []Family{IPv4, IPv6} {
+			src, dst := addr4(i), net.IPv4(192, 0, 2, 2).To4()
+			if family == IPv6 {
+				src, dst = addr6(i), net.ParseIP("2001:db8:1::1")
+			}
+			sport, dport, timeout := uint16(10000+i), uint16(53), uint32(600)
+			c := Con{
+				Origin:  &IPTuple{Src: &src, Dst: &dst, Proto: &ProtoTuple{Number: &proto, SrcPort: &sport, DstPort: &dport}},
+				Reply:   &IPTuple{Src: &dst, Dst: &src, Proto: &ProtoTuple{Number: &proto, SrcPort: &dport, DstPort: &sport}},
+				Timeout: &timeout,
+			}
+			if err := nfct.Create(Conntrack, family, c); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var received []string
+	timer := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case e := <-events:
+			received = append(received, e)
+		case <-timer:
+			done = true
+		}
+	}
+	sort.Strings(received)
+	if fmt.Sprint(received) != "[attrs:10000 attrs:10002 attrs:10004 expr:10000 expr:10002 expr:10004]" {
+		t.Fatalf("unexpected events: %v", received)
+	}
+}
+
+func TestLinuxConntrackRegisterFilterExpected(t *testing.T) {
+	ns := netns(t, "ct-filterexpected")
+	defer deleteNetns(ns)
+
+	nfct, err := Open(&Config{NetNS: int(ns.Fd())})
+	if err != nil {
+		t.Fatalf("could not open socket: %v", err)
+	}
+	defer nfct.Close()
+
+	f, err := ParseFilter("helper sip and orig.dport in 10000-20000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan string, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for name, register := range map[string]func(m *Nfct, fn HookFunc) error{
+		"attrs": func(m *Nfct, fn HookFunc) error {
+			return m.RegisterFiltered(ctx, Expected, NetlinkCtExpectedNew, []ConnAttr{{Type: AttrHelperName, Data: []byte("sip")}}, fn)
+		},
+		"expr": func(m *Nfct, fn HookFunc) error {
+			return m.RegisterFilterExpr(ctx, Expected, NetlinkCtExpectedNew, f, fn)
+		},
+	} {
+		name := name
+		monitor, err := Open(&Config{NetNS: int(ns.Fd())})
+		if err != nil {
+			t.Fatalf("could not open socket: %v", err)
+		}
+		defer monitor.Close()
+		if err := register(monitor, func(c Con) int {
+			events <- fmt.Sprintf("%s:%s:%d", name, *c.Exp.HelperName, *c.Exp.Tuple.Proto.DstPort)
+			return 0
+		}); err != nil {
+			t.Fatalf("could not register %s: %v", name, err)
+		}
+	}
+
+	src, dst := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	mask := net.IPv4(255, 255, 255, 255).To4()
+	for i, entry := range []struct {
+		helper string
+		proto  uint8
+		port   uint16
+	}{{"sip", 17, 5060}, {"ftp", 6, 21}} {
+		helper, proto, sport, dport, timeout := entry.helper, entry.proto, uint16(1000+i), entry.port, uint32(600)
+		state := uint8(3)
+		master := Con{
+			Origin:    &IPTuple{Src: &src, Dst: &dst, Proto: &ProtoTuple{Number: &proto, SrcPort: &sport, DstPort: &dport}},
+			Reply:     &IPTuple{Src: &dst, Dst: &src, Proto: &ProtoTuple{Number: &proto, SrcPort: &dport, DstPort: &sport}},
+			ProtoInfo: &ProtoInfo{TCP: &TCPInfo{State: &state}},
+			Timeout:   &timeout,
+			Helper:    &Helper{Name: &helper},
+		}
+		if proto != 6 {
+			master.ProtoInfo = nil
+		}
+		if err := nfct.Create(Conntrack, IPv4, master); err != nil {
+			t.Fatalf("could not create master for %s: %v", helper, err)
+		}
+		for _, port := range []uint16{5000, 15000} {
+			port, wild, all := port, uint16(0), uint16(0xffff)
+			exp := Exp{
+				Master:     master.Origin,
+				Tuple:      &IPTuple{Src: &src, Dst: &dst, Proto: &ProtoTuple{Number: &proto, SrcPort: &wild, DstPort: &port}},
+				Mask:       &IPTuple{Src: &mask, Dst: &mask, Proto: &ProtoTuple{Number: &proto, SrcPort: &wild, DstPort: &all}},
+				Timeout:    &timeout,
+				HelperName: &helper,
+			}
+			if err := nfct.Create(Expected, IPv4, Con{Exp: &exp}); err != nil {
+				t.Fatalf("could not create expectation for %s: %v", helper, err)
+			}
+		}
+	}
+
+	var received []string
+	timer := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case e := <-events:
+			received = append(received, e)
+		case <-timer:
+			done = true
+		}
+	}
+	sort.Strings(received)
+	if fmt.Sprint(received) != "[attrs:sip:15000 attrs:sip:5000 expr:sip:15000]" {
+		t.Fatalf("unexpected events: %v", received)
+	}
+}
+
+func TestLinuxConntrackRegisterFilterDualStack(t *testing.T) {
+	ns := netns(t, "ct-filterdualstack")
+	defer deleteNetns(ns)
+
+	nfct, err := Open(&Config{NetNS: int(ns.Fd())})
+	if err != nil {
+		t.Fatalf("could not open socket: %v", err)
+	}
+	defer nfct.Close()
+	monitor, err := Open(&Config{NetNS: int(ns.Fd())})
+	if err != nil {
+		t.Fatalf("could not open socket: %v", err)
+	}
+	defer monitor.Close()
+
+	filter := []ConnAttr{
+		{Type: AttrOrigIPv4Dst, Data: net.ParseIP("192.0.2.10").To4(), Mask: net.CIDRMask(32, 32)},
+		{Type: AttrOrigIPv6Dst, Data: net.ParseIP("2001:db8::10"), Mask: net.CIDRMask(128, 128)},
+	}
+	events := make(chan uint16, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := monitor.RegisterFiltered(ctx, Conntrack, NetlinkCtNew, filter, func(c Con) int {
+		events <- *c.Origin.Proto.SrcPort
+		return 0
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	proto := uint8(17)
+	for i, entry := range []struct {
+		family   Family
+		src, dst string
+	}{
+		{IPv4, "192.0.2.1", "192.0.2.10"},
+		{IPv4, "192.0.2.1", "192.0.2.11"},
+		{IPv6, "2001:db8::1", "2001:db8::10"},
+		{IPv6, "2001:db8::1", "2001:db8::11"},
+	} {
+		src, dst := net.ParseIP(entry.src), net.ParseIP(entry.dst)
+		if entry.family == IPv4 {
+			src, dst = src.To4(), dst.To4()
+		}
+		sport, dport, timeout := uint16(10000+i), uint16(53), uint32(600)
+		c := Con{
+			Origin:  &IPTuple{Src: &src, Dst: &dst, Proto: &ProtoTuple{Number: &proto, SrcPort: &sport, DstPort: &dport}},
+			Reply:   &IPTuple{Src: &dst, Dst: &src, Proto: &ProtoTuple{Number: &proto, SrcPort: &dport, DstPort: &sport}},
+			Timeout: &timeout,
+		}
+		if err := nfct.Create(Conntrack, entry.family, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var received []uint16
+	timer := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case p := <-events:
+			received = append(received, p)
+		case <-timer:
+			done = true
+		}
+	}
+	if fmt.Sprint(received) != "[10000 10002]" {
+		t.Fatalf("unexpected events: %v", received)
+	}
+}
+
+func TestLinuxConntrackRegisterMatching(t *testing.T) {
+	ns := netns(t, "ct-registermatching")
+	defer deleteNetns(ns)
+
+	nfct, err := Open(&Config{NetNS: int(ns.Fd())})
+	if err != nil {
+		t.Fatalf("could not open socket: %v", err)
+	}
+	defer nfct.Close()
+	monitor, err := Open(&Config{NetNS: int(ns.Fd())})
+	if err != nil {
+		t.Fatalf("could not open socket: %v", err)
+	}
+	defer monitor.Close()
+
+	_, docs, _ := net.ParseCIDR("192.0.2.0/24")
+	_, docs6, _ := net.ParseCIDR("2001:db8::/64")
+	match := MatchAll(
+		MatchCIDR(EndpointOrigDst, docs, docs6),
+		MatchPorts(EndpointOrigDst, 1000, 2000),
+		// the kernel can not apply functions
+		PredicateFunc(func(c Con) bool {
+			return c.Mark != nil && *c.Mark%2 == 1
+		}),
+	)
+	events := make(chan uint16, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := monitor.RegisterMatching(ctx, Conntrack, NetlinkCtNew, match, func(c Con) int {
+		events <- *c.Origin.Proto.SrcPort
+		return 0
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	proto := uint8(17)
+	for i, entry := range []struct {
+		family   Family
+		src, dst string
+		port     uint16
+		mark     uint32
+	}{
+		{IPv4, "192.0.2.1", "192.0.2.10", 1000, 1},
+		{IPv4, "192.0.2.1", "192.0.2.10", 2001, 1},
+		{IPv4, "192.0.2.1", "198.51.100.10", 1500, 1},
+		{IPv4, "192.0.2.1", "192.0.2.10", 1500, 2},
+		{IPv6, "2001:db8::1", "2001:db8::10", 2000, 3},
+		{IPv6, "2001:db8::1", "2001:db8:1::10", 2000, 3},
+	} {
+		src, dst := net.ParseIP(entry.src), net.ParseIP(entry.dst)
+		if entry.family == IPv4 {
+			src, dst = src.To4(), dst.To4()
+		}
+		sport, dport, timeout, mark := uint16(10000+i), entry.port, uint32(600), entry.mark
+		c := Con{
+			Origin:  &IPTuple{Src: &src, Dst: &dst, Proto: &ProtoTuple{Number: &proto, SrcPort: &sport, DstPort: &dport}},
+			Reply:   &IPTuple{Src: &dst, Dst: &src, Proto: &ProtoTuple{Number: &proto, SrcPort: &dport, DstPort: &sport}},
+			Timeout: &timeout,
+			Mark:    &mark,
+		}
+		if err := nfct.Create(Conntrack, entry.family, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var received []uint16
+	timer := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case p := <-events:
+			received = append(received, p)
+		case <-timer:
+			done = true
+		}
+	}
+	if fmt.Sprint(received) != "[10000 10004]" {
+		t.Fatalf("unexpected events: %v", received)
+	}
+
+	entries, err := nfct.DumpMatching(context.Background(), Conntrack, Family(unix.AF_UNSPEC), match)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ports []uint16
+	for _, c := range entries {
+		ports = append(ports, *c.Origin.Proto.SrcPort)
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+	if fmt.Sprint(ports) != "[10000 10004]" {
+		t.Fatalf("unexpected entries: %v", ports)
+	}
+}
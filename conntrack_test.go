@@ -1,6 +1,7 @@
 package conntrack
 
 import (
+	"context"
 	"net"
 	"testing"
 
@@ -9,6 +10,41 @@ import (
 	"github.com/mdlayher/netlink/nltest"
 )
 
+// testCon returns a TCP connection from 192.0.2.1:clientPort to 192.0.2.2:80,
+// that is forwarded to 10.0.0.2:8080.
+func testCon(clientPort uint16) Con {
+	client := net.ParseIP("192.0.2.1")
+	service := net.ParseIP("192.0.2.2")
+	backend := net.ParseIP("10.0.0.2")
+	proto := uint8(6)
+	servicePort := uint16(80)
+	backendPort := uint16(8080)
+	state := uint8(3)
+	wscale := uint8(7)
+	flags := uint8(0x09)
+	mask := uint8(0)
+	timeout := uint32(600)
+	mark := uint32(0x42)
+	zone := uint16(1)
+	pos := uint32(1000)
+	label := []byte{0x1, 0x0, 0x0, 0x0}
+	helper := "ftp"
+	return Con{
+		Origin: &IPTuple{Src: &client, Dst: &service, Proto: &ProtoTuple{
+			Number: &proto, SrcPort: &clientPort, DstPort: &servicePort}},
+		Reply: &IPTuple{Src: &backend, Dst: &client, Proto: &ProtoTuple{
+			Number: &proto, SrcPort: &backendPort, DstPort: &clientPort}},
+		ProtoInfo: &ProtoInfo{TCP: &TCPInfo{State: &state, WScaleOrig: &wscale, WScaleRepl: &wscale,
+			FlagsOrig: &TCPFlags{Flags: &flags, Mask: &mask}}},
+		Helper:     &Helper{Name: &helper},
+		SeqAdjOrig: &SeqAdj{CorrectionPos: &pos, OffsetBefore: &pos, OffsetAfter: &pos},
+		Timeout:    &timeout,
+		Mark:       &mark,
+		Zone:       &zone,
+		Label:      &label,
+	}
+}
+
 func TestFlush(t *testing.T) {
 	tests := []struct {
 		name   string
@@ -265,3 +301,51 @@ func BenchmarkMsg(b *testing.B) {
 		testMarshal(Conntrack, IPv4, filter)
 	}
 }
+
+func TestDumpGlobalStats(t *testing.T) {
+	nfct := &Nfct{}
+	AdjustWriteTimeout(nfct, func() error { return nil })
+	nfct.Con = nltest.Dial(func(reqs []netlink.Message) ([]netlink.Message, error) {
+		if len(reqs) == 0 {
+			return nil, nil
+		}
+		// NFNL_SUBSYS_CTNETLINK<<8|IPCTNL_MSG_CT_GET_STATS
+		if reqs[0].Header.Type != netlink.HeaderType(1<<8|5) {
+			t.Fatalf("unexpected header type: %#v", reqs[0].Header.Type)
+		}
+		return []netlink.Message{
+			{
+				Header: netlink.Header{Type: reqs[0].Header.Type, Sequence: reqs[0].Header.Sequence},
+				// nfgen_family=AF_UNSPEC, version=NFNETLINK_V0, res_id=htons(0),
+				// CTA_STATS_GLOBAL_ENTRIES=42, CTA_STATS_GLOBAL_MAX_ENTRIES=65536
+				Data: []byte{0x0, 0x0, 0x0, 0x0, 0x8, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x2a, 0x8, 0x0, 0x2, 0x0, 0x0, 0x1, 0x0, 0x0},
+			},
+			{
+				Header: netlink.Header{Type: netlink.Error, Sequence: reqs[0].Header.Sequence},
+				Data:   make([]byte, 20),
+			},
+		}, nil
+	})
+	defer nfct.Con.Close()
+
+	stats, err := nfct.DumpGlobalStats(Conntrack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Entries == nil || *stats.Entries != 42 {
+		t.Fatalf("unexpected number of entries: %v", stats.Entries)
+	}
+	if stats.MaxEntries == nil || *stats.MaxEntries != 65536 {
+		t.Fatalf("unexpected maximum number of entries: %v", stats.MaxEntries)
+	}
+
+	if _, err := nfct.DumpGlobalStats(Expected); err != ErrUnknownCtTable {
+		t.Fatalf("unexpected error for expected table: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := nfct.DumpGlobalStatsContext(ctx, Conntrack); err != context.Canceled {
+		t.Fatalf("unexpected error for cancelled context: %v", err)
+	}
+}
@@ -0,0 +1,1052 @@
+package conntrack
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/mdlayher/netlink"
+)
+
+// Field is a set of attributes of an Entry.
+type Field uint32
+
+// Attributes of an Entry
+const (
+	FieldOrigin Field = 1 << iota
+	FieldReply
+	FieldStatus
+	FieldProtoInfo
+	FieldHelper
+	FieldNatSrc
+	FieldNatDst
+	FieldTimeout
+	FieldMark
+	FieldCounterOrigin
+	FieldCounterReply
+	FieldUse
+	FieldID
+	FieldSeqAdjOrig
+	FieldSeqAdjRepl
+	FieldZone
+	FieldSecCtx
+	FieldTimestamp
+	FieldLabel
+	FieldMarkMask
+	FieldStatusMask
+	FieldLabelMask
+
+	// FieldAll contains all attributes.
+	FieldAll Field = 1<<iota - 1
+
+	// FieldRaw keeps a copy of the undecoded message in Con.Raw, if not all
+	// attributes are selected. It is not contained in FieldAll, as the copy
+	// costs an allocation per entry.
+	FieldRaw Field = FieldAll + 1
+)
+
+// TupleField is a set of attributes of a Tuple.
+type TupleField uint16
+
+// Attributes of a Tuple
+const (
+	TupleSrc TupleField = 1 << iota
+	TupleDst
+	TupleProto
+	TupleSrcPort
+	TupleDstPort
+	TupleIcmpID
+	TupleIcmpType
+	TupleIcmpCode
+	TupleZone
+)
+
+// Tuple is the value type representation of IPTuple. IPv4 addresses are
+// stored as IPv4-mapped IPv6 addresses.
+type Tuple struct {
+	// Fields contains the attributes, that are set.
+	Fields TupleField
+
+	Src      [16]byte
+	Dst      [16]byte
+	Proto    uint8
+	SrcPort  uint16
+	DstPort  uint16
+	IcmpID   uint16
+	IcmpType uint8
+	IcmpCode uint8
+	Zone     uint16
+
+	present presence
+}
+
+// EntryCounter contains the counters of a direction. 32 bit counters are
+// widened to 64 bit.
+type EntryCounter struct {
+	Packets uint64
+	Bytes   uint64
+
+	present presence
+}
+
+// EntryProtoInfo contains the protocol specific information of an Entry.
+type EntryProtoInfo struct {
+	// Proto is the layer 4 protocol, the information belongs to.
+	Proto uint8
+	State uint8
+
+	// TCP
+	WScaleOrig uint8
+	WScaleRepl uint8
+	FlagsOrig  uint8
+	MaskOrig   uint8
+	FlagsReply uint8
+	MaskReply  uint8
+
+	// DCCP
+	Role         uint8
+	HandshakeSeq uint64
+
+	// SCTP
+	VTagOriginal uint32
+	VTagReply    uint32
+
+	present presence
+}
+
+// EntryNat contains the translation of addresses and ports.
+type EntryNat struct {
+	IPMin   [16]byte
+	IPMax   [16]byte
+	PortMin uint16
+	PortMax uint16
+
+	present presence
+}
+
+// Entry is the value type representation of Con for the Conntrack table. The
+// presence of attributes is stored in Fields instead of pointers, so that a
+// single Entry can be reused to decode many messages without allocations.
+type Entry struct {
+	// Fields contains the attributes, that are set.
+	Fields Field
+
+	Origin        Tuple
+	Reply         Tuple
+	ProtoInfo     EntryProtoInfo
+	CounterOrigin EntryCounter
+	CounterReply  EntryCounter
+	NatSrc        EntryNat
+	NatDst        EntryNat
+	SeqAdjOrig    SeqAdjValue
+	SeqAdjRepl    SeqAdjValue
+	ID            uint32
+	Status        uint32
+	Use           uint32
+	Mark          uint32
+	Timeout       uint32
+	Zone          uint16
+	MarkMask      uint32
+	StatusMask    uint32
+
+	// TimestampStart and TimestampStop are nanoseconds since the Unix
+	// epoch. TimestampStop is zero for connections, that are not destroyed.
+	TimestampStart int64
+	TimestampStop  int64
+
+	// The buffers of the following attributes are reused by Decode.
+	Helper     []byte
+	HelperInfo []byte
+	SecCtx     []byte
+	Label      []byte
+	LabelMask  []byte
+
+	present presence
+}
+
+// SeqAdjValue is the value type representation of SeqAdj.
+type SeqAdjValue struct {
+	CorrectionPos uint32
+	OffsetBefore  uint32
+	OffsetAfter   uint32
+
+	present presence
+}
+
+// presence contains the nested attributes, that were sent by the kernel. It
+// is only needed by Con, which reports missing attributes as nil pointers.
+type presence uint16
+
+// nested attributes of Tuple
+const (
+	presTupleIP presence = 1 << iota
+	presTupleProto
+	presTupleSrcV6
+	presTupleDstV6
+	presTupleIcmpv6
+)
+
+// nested attributes of EntryProtoInfo
+const (
+	presState presence = 1 << iota
+	presWScaleOrig
+	presWScaleRepl
+	presFlagsOrig
+	presFlagsOrigMask
+	presFlagsReply
+	presFlagsReplyMask
+	presRole
+	presHandshakeSeq
+	presVTagOriginal
+	presVTagReply
+	// presFlagsOrigNest and presFlagsReplyNest mark empty flags
+	presFlagsOrigNest
+	presFlagsReplyNest
+)
+
+// nested attributes of EntryNat
+const (
+	presIPMin presence = 1 << iota
+	presIPMinV6
+	presIPMax
+	presIPMaxV6
+	presNatProto
+	presPortMin
+	presPortMax
+)
+
+// nested attributes of EntryCounter
+const (
+	presPackets presence = 1 << iota
+	presBytes
+	presPackets32
+	presBytes32
+)
+
+// nested attributes of SeqAdjValue
+const (
+	presCorrectionPos presence = 1 << iota
+	presOffsetBefore
+	presOffsetAfter
+)
+
+// nested attributes of Entry
+const (
+	presHelperName presence = 1 << iota
+	presHelperInfo
+	presSecCtxName
+	presTimestampStart
+	presTimestampStop
+)
+
+// SrcIP returns the source address of the tuple. The returned address refers
+// to the memory of t.
+func (t *Tuple) SrcIP() net.IP {
+	return tupleIP(&t.Src)
+}
+
+// DstIP returns the destination address of the tuple. The returned address
+// refers to the memory of t.
+func (t *Tuple) DstIP() net.IP {
+	return tupleIP(&t.Dst)
+}
+
+func tupleIP(ip *[16]byte) net.IP {
+	if v4 := net.IP(ip[:]).To4(); v4 != nil {
+		return v4
+	}
+	return ip[:]
+}
+
+// TupleKey returns the key of the entry based on its original tuple and
+// zone. It returns false, if the original tuple is not available.
+func (e *Entry) TupleKey() (TupleKey, bool) {
+	var key TupleKey
+	o := &e.Origin
+	if e.Fields&FieldOrigin == 0 || o.Fields&(TupleSrc|TupleDst) != TupleSrc|TupleDst {
+		return key, false
+	}
+	key.Src = o.Src
+	key.Dst = o.Dst
+	key.L4Proto = o.Proto
+	key.SrcPort = o.SrcPort
+	key.DstPort = o.DstPort
+	key.IcmpType = o.IcmpType
+	key.IcmpCode = o.IcmpCode
+	key.IcmpID = o.IcmpID
+	if e.Fields&FieldZone != 0 {
+		key.Zone = e.Zone
+	} else {
+		key.Zone = o.Zone
+	}
+	return key, true
+}
+
+// fieldMask returns the attributes selected by mask, where an empty mask
+// selects all attributes.
+func fieldMask(mask Field) Field {
+	if mask == 0 {
+		return FieldAll
+	}
+	return mask
+}
+
+// attrIterator iterates over netlink attributes without allocations.
+type attrIterator struct {
+	data []byte
+	typ  uint16
+	val  []byte
+	err  error
+}
+
+func (it *attrIterator) next() bool {
+	if len(it.data) < 4 {
+		if len(it.data) != 0 {
+			it.err = ErrAttrLength
+		}
+		return false
+	}
+	length := int(nativeEndian.Uint16(it.data[0:2]))
+	if length < 4 || length > len(it.data) {
+		it.err = ErrAttrLength
+		return false
+	}
+	// strip NLA_F_NESTED and NLA_F_NET_BYTEORDER
+	it.typ = nativeEndian.Uint16(it.data[2:4]) & 0x3fff
+	it.val = it.data[4:length]
+	aligned := (length + 3) &^ 3
+	if aligned > len(it.data) {
+		aligned = len(it.data)
+	}
+	it.data = it.data[aligned:]
+	return true
+}
+
+func (it *attrIterator) uint8() uint8 {
+	if len(it.val) < 1 {
+		it.err = ErrAttrLength
+		return 0
+	}
+	return it.val[0]
+}
+
+func (it *attrIterator) uint16() uint16 {
+	if len(it.val) < 2 {
+		it.err = ErrAttrLength
+		return 0
+	}
+	return binary.BigEndian.Uint16(it.val)
+}
+
+func (it *attrIterator) uint32() uint32 {
+	if len(it.val) < 4 {
+		it.err = ErrAttrLength
+		return 0
+	}
+	return binary.BigEndian.Uint32(it.val)
+}
+
+func (it *attrIterator) uint64() uint64 {
+	if len(it.val) < 8 {
+		it.err = ErrAttrLength
+		return 0
+	}
+	return binary.BigEndian.Uint64(it.val)
+}
+
+// string returns the value without the terminating NUL byte.
+func (it *attrIterator) string() []byte {
+	for i, b := range it.val {
+		if b == 0 {
+			return it.val[:i]
+		}
+	}
+	return it.val
+}
+
+func putIP(dst *[16]byte, ip []byte) {
+	switch len(ip) {
+	case net.IPv4len:
+		*dst = [16]byte{10: 0xff, 11: 0xff}
+		copy(dst[12:], ip)
+	case net.IPv6len:
+		copy(dst[:], ip)
+	}
+}
+
+// Decode resets e and decodes the attributes of a message of the Conntrack
+// table into it, as they are passed to ParseAttributes. Unknown attributes
+// are ignored.
+func (e *Entry) Decode(data []byte) error {
+	return e.DecodeFields(data, FieldAll)
+}
+
+// DecodeFields is like Decode, but decodes only the attributes selected by
+// fields. Other attributes are skipped without being parsed.
+func (e *Entry) DecodeFields(data []byte, fields Field) error {
+	*e = Entry{
+		Helper:     e.Helper[:0],
+		HelperInfo: e.HelperInfo[:0],
+		SecCtx:     e.SecCtx[:0],
+		Label:      e.Label[:0],
+		LabelMask:  e.LabelMask[:0],
+	}
+	if len(data) < 2 {
+		return ErrDataLength
+	}
+
+	it := attrIterator{data: data[checkHeader(data[:2]):]}
+	for it.next() {
+		if int(it.typ) >= len(entryFields) || fields&entryFields[it.typ] == 0 {
+			continue
+		}
+		field := entryFields[it.typ]
+		e.Fields |= field
+		switch it.typ {
+		case ctaTupleOrig:
+			it.err = e.Origin.decode(it.val)
+		case ctaTupleReply:
+			it.err = e.Reply.decode(it.val)
+		case ctaProtoinfo:
+			it.err = e.ProtoInfo.decode(it.val)
+		case ctaHelp:
+			it.err = e.decodeHelper(it.val)
+		case ctaNatSrc:
+			it.err = e.NatSrc.decode(it.val)
+		case ctaNatDst:
+			it.err = e.NatDst.decode(it.val)
+		case ctaCountersOrig:
+			it.err = e.CounterOrigin.decode(it.val)
+		case ctaCountersReply:
+			it.err = e.CounterReply.decode(it.val)
+		case ctaSeqAdjOrig:
+			it.err = e.SeqAdjOrig.decode(it.val)
+		case ctaSeqAdjRepl:
+			it.err = e.SeqAdjRepl.decode(it.val)
+		case ctaTimestamp:
+			it.err = e.decodeTimestamp(it.val)
+		case ctaSecCtx:
+			it.err = e.decodeSecCtx(it.val)
+		case ctaID:
+			e.ID = it.uint32()
+		case ctaStatus:
+			e.Status = it.uint32()
+		case ctaUse:
+			e.Use = it.uint32()
+		case ctaMark:
+			e.Mark = it.uint32()
+		case ctaTimeout:
+			e.Timeout = it.uint32()
+		case ctaZone:
+			e.Zone = it.uint16()
+		case ctaLables:
+			e.Label = append(e.Label, it.val...)
+		case ctaMarkMask:
+			e.MarkMask = it.uint32()
+		case ctaStatusMask:
+			e.StatusMask = it.uint32()
+		case ctaLablesMask:
+			e.LabelMask = append(e.LabelMask, it.val...)
+		}
+		if it.err != nil {
+			break
+		}
+	}
+	return it.err
+}
+
+// entryFields maps the top level attributes to the fields of an Entry.
+var entryFields = [...]Field{
+	ctaTupleOrig:     FieldOrigin,
+	ctaTupleReply:    FieldReply,
+	ctaStatus:        FieldStatus,
+	ctaProtoinfo:     FieldProtoInfo,
+	ctaHelp:          FieldHelper,
+	ctaNatSrc:        FieldNatSrc,
+	ctaNatDst:        FieldNatDst,
+	ctaTimeout:       FieldTimeout,
+	ctaMark:          FieldMark,
+	ctaCountersOrig:  FieldCounterOrigin,
+	ctaCountersReply: FieldCounterReply,
+	ctaUse:           FieldUse,
+	ctaID:            FieldID,
+	ctaSeqAdjOrig:    FieldSeqAdjOrig,
+	ctaSeqAdjRepl:    FieldSeqAdjRepl,
+	ctaZone:          FieldZone,
+	ctaSecCtx:        FieldSecCtx,
+	ctaTimestamp:     FieldTimestamp,
+	ctaLables:        FieldLabel,
+	ctaMarkMask:      FieldMarkMask,
+	ctaStatusMask:    FieldStatusMask,
+	ctaLablesMask:    FieldLabelMask,
+}
+
+func (t *Tuple) decode(data []byte) error {
+	it := attrIterator{data: data}
+	for it.next() {
+		switch it.typ {
+		case ctaTupleIP:
+			t.present |= presTupleIP
+			ip := attrIterator{data: it.val}
+			for ip.next() {
+				switch ip.typ {
+				case ctaIPv4Src:
+					putIP(&t.Src, ip.val)
+					t.Fields |= TupleSrc
+				case ctaIPv6Src:
+					putIP(&t.Src, ip.val)
+					t.Fields |= TupleSrc
+					t.present |= presTupleSrcV6
+				case ctaIPv4Dst:
+					putIP(&t.Dst, ip.val)
+					t.Fields |= TupleDst
+				case ctaIPv6Dst:
+					putIP(&t.Dst, ip.val)
+					t.Fields |= TupleDst
+					t.present |= presTupleDstV6
+				}
+			}
+			it.err = ip.err
+		case ctaTupleProto:
+			t.present |= presTupleProto
+			it.err = t.decodeProto(it.val)
+		case ctaTupleZone:
+			t.Zone = it.uint16()
+			t.Fields |= TupleZone
+		}
+		if it.err != nil {
+			break
+		}
+	}
+	return it.err
+}
+
+func (t *Tuple) decodeProto(data []byte) error {
+	it := attrIterator{data: data}
+	for it.next() {
+		switch it.typ {
+		case ctaProtoNum:
+			t.Proto = it.uint8()
+			t.Fields |= TupleProto
+		case ctaProtoSrcPort:
+			t.SrcPort = it.uint16()
+			t.Fields |= TupleSrcPort
+		case ctaProtoDstPort:
+			t.DstPort = it.uint16()
+			t.Fields |= TupleDstPort
+		case ctaProtoIcmpID, ctaProtoIcmpv6ID:
+			t.IcmpID = it.uint16()
+			t.Fields |= TupleIcmpID
+		case ctaProtoIcmpType, ctaProtoIcmpv6Type:
+			t.IcmpType = it.uint8()
+			t.Fields |= TupleIcmpType
+		case ctaProtoIcmpCode, ctaProtoIcmpv6Code:
+			t.IcmpCode = it.uint8()
+			t.Fields |= TupleIcmpCode
+		}
+		if it.typ == ctaProtoIcmpv6ID || it.typ == ctaProtoIcmpv6Type || it.typ == ctaProtoIcmpv6Code {
+			t.present |= presTupleIcmpv6
+		}
+	}
+	return it.err
+}
+
+func (p *EntryProtoInfo) decode(data []byte) error {
+	it := attrIterator{data: data}
+	for it.next() {
+		info := attrIterator{data: it.val}
+		switch it.typ {
+		case ctaProtoinfoTCP:
+			p.Proto = 6
+			for info.next() {
+				switch info.typ {
+				case ctaProtoinfoTCPState:
+					p.State = info.uint8()
+					p.present |= presState
+				case ctaProtoinfoTCPWScaleOrig:
+					p.WScaleOrig = info.uint8()
+					p.present |= presWScaleOrig
+				case ctaProtoinfoTCPWScaleRepl:
+					p.WScaleRepl = info.uint8()
+					p.present |= presWScaleRepl
+				case ctaProtoinfoTCPFlagsOrig:
+					p.FlagsOrig, p.MaskOrig = tcpFlags(info.val)
+					p.present |= presFlagsOrigNest | tcpFlagsPresence(info.val, presFlagsOrig, presFlagsOrigMask)
+				case ctaProtoinfoTCPFlagsRepl:
+					p.FlagsReply, p.MaskReply = tcpFlags(info.val)
+					p.present |= presFlagsReplyNest | tcpFlagsPresence(info.val, presFlagsReply, presFlagsReplyMask)
+				}
+			}
+		case ctaProtoinfoDCCP:
+			p.Proto = 33
+			for info.next() {
+				switch info.typ {
+				case ctaProtoinfoDCCPState:
+					p.State = info.uint8()
+					p.present |= presState
+				case ctaProtoinfoDCCPRole:
+					p.Role = info.uint8()
+					p.present |= presRole
+				case ctaProtoinfoDCCPHandshakeSeq:
+					p.HandshakeSeq = info.uint64()
+					p.present |= presHandshakeSeq
+				}
+			}
+		case ctaProtoinfoSCTP:
+			p.Proto = 132
+			for info.next() {
+				switch info.typ {
+				case ctaProtoinfoSCTPState:
+					p.State = info.uint8()
+					p.present |= presState
+				case ctaProtoinfoSCTPVTagOriginal:
+					p.VTagOriginal = info.uint32()
+					p.present |= presVTagOriginal
+				case ctaProtoinfoSCTPVTagReply:
+					p.VTagReply = info.uint32()
+					p.present |= presVTagReply
+				}
+			}
+		}
+		if info.err != nil {
+			return info.err
+		}
+	}
+	return it.err
+}
+
+func tcpFlags(data []byte) (flags, mask uint8) {
+	if len(data) > 0 {
+		flags = data[0]
+	}
+	if len(data) > 1 {
+		mask = data[1]
+	}
+	return flags, mask
+}
+
+// tcpFlagsPresence returns the parts of the TCP flags, that are present in
+// data.
+func tcpFlagsPresence(data []byte, flags, mask presence) presence {
+	var p presence
+	if len(data) > 0 {
+		p |= flags
+	}
+	if len(data) > 1 {
+		p |= mask
+	}
+	return p
+}
+
+func (n *EntryNat) decode(data []byte) error {
+	it := attrIterator{data: data}
+	for it.next() {
+		switch it.typ {
+		case ctaNatV4MinIP:
+			putIP(&n.IPMin, it.val)
+			n.present |= presIPMin
+		case ctaNatV6MinIP:
+			putIP(&n.IPMin, it.val)
+			n.present |= presIPMin | presIPMinV6
+		case ctaNatV4MaxIP:
+			putIP(&n.IPMax, it.val)
+			n.present |= presIPMax
+		case ctaNatV6MaxIP:
+			putIP(&n.IPMax, it.val)
+			n.present |= presIPMax | presIPMaxV6
+		case ctaNatProto:
+			n.present |= presNatProto
+			proto := attrIterator{data: it.val}
+			for proto.next() {
+				switch proto.typ {
+				case ctaProtoNatPortMin:
+					n.PortMin = proto.uint16()
+					n.present |= presPortMin
+				case ctaProtoNatPortMax:
+					n.PortMax = proto.uint16()
+					n.present |= presPortMax
+				}
+			}
+			it.err = proto.err
+		}
+		if it.err != nil {
+			break
+		}
+	}
+	return it.err
+}
+
+func (c *EntryCounter) decode(data []byte) error {
+	it := attrIterator{data: data}
+	for it.next() {
+		switch it.typ {
+		case ctaCounterPackets:
+			c.Packets = it.uint64()
+			c.present |= presPackets
+		case ctaCounterBytes:
+			c.Bytes = it.uint64()
+			c.present |= presBytes
+		case ctaCounter32Packets:
+			c.Packets = uint64(it.uint32())
+			c.present |= presPackets32
+		case ctaCounter32Bytes:
+			c.Bytes = uint64(it.uint32())
+			c.present |= presBytes32
+		}
+	}
+	return it.err
+}
+
+func (s *SeqAdjValue) decode(data []byte) error {
+	it := attrIterator{data: data}
+	for it.next() {
+		switch it.typ {
+		case ctaSeqAdjCorrPos:
+			s.CorrectionPos = it.uint32()
+			s.present |= presCorrectionPos
+		case ctaSeqAdjOffsetBefore:
+			s.OffsetBefore = it.uint32()
+			s.present |= presOffsetBefore
+		case ctaSeqAdjOffsetAfter:
+			s.OffsetAfter = it.uint32()
+			s.present |= presOffsetAfter
+		}
+	}
+	return it.err
+}
+
+func (e *Entry) decodeHelper(data []byte) error {
+	it := attrIterator{data: data}
+	for it.next() {
+		switch it.typ {
+		case ctaHelpName:
+			e.Helper = append(e.Helper, it.string()...)
+			e.present |= presHelperName
+		case ctaHelpInfo:
+			e.HelperInfo = append(e.HelperInfo, it.string()...)
+			e.present |= presHelperInfo
+		}
+	}
+	return it.err
+}
+
+func (e *Entry) decodeSecCtx(data []byte) error {
+	it := attrIterator{data: data}
+	for it.next() {
+		if it.typ == ctaSecCtxName {
+			e.SecCtx = append(e.SecCtx, it.string()...)
+			e.present |= presSecCtxName
+		}
+	}
+	return it.err
+}
+
+func (e *Entry) decodeTimestamp(data []byte) error {
+	it := attrIterator{data: data}
+	for it.next() {
+		switch it.typ {
+		case ctaTimestampStart:
+			e.TimestampStart = int64(it.uint64())
+			e.present |= presTimestampStart
+		case ctaTimestampStop:
+			e.TimestampStop = int64(it.uint64())
+			e.present |= presTimestampStop
+		}
+	}
+	return it.err
+}
+
+// Con returns a copy of the entry as Con, as it is returned by
+// ParseAttributes. Attributes, that were not sent by the kernel, are reported
+// as nil pointers. The presence of nested attributes is recorded by Decode.
+func (e *Entry) Con() Con {
+	var c Con
+	if e.Fields&FieldOrigin != 0 {
+		c.Origin = e.Origin.ipTuple()
+	}
+	if e.Fields&FieldReply != 0 {
+		c.Reply = e.Reply.ipTuple()
+	}
+	if e.Fields&FieldProtoInfo != 0 {
+		c.ProtoInfo = e.ProtoInfo.protoInfo()
+	}
+	if e.Fields&FieldHelper != 0 {
+		c.Helper = &Helper{}
+		if e.present&presHelperName != 0 {
+			name := string(e.Helper)
+			c.Helper.Name = &name
+		}
+		if e.present&presHelperInfo != 0 {
+			info := string(e.HelperInfo)
+			c.Helper.Info = &info
+		}
+	}
+	if e.Fields&FieldNatSrc != 0 {
+		c.NatSrc = e.NatSrc.nat()
+	}
+	if e.Fields&FieldNatDst != 0 {
+		c.NatDst = e.NatDst.nat()
+	}
+	if e.Fields&FieldCounterOrigin != 0 {
+		c.CounterOrigin = e.CounterOrigin.counter()
+	}
+	if e.Fields&FieldCounterReply != 0 {
+		c.CounterReply = e.CounterReply.counter()
+	}
+	if e.Fields&FieldSeqAdjOrig != 0 {
+		c.SeqAdjOrig = e.SeqAdjOrig.seqAdj()
+	}
+	if e.Fields&FieldSeqAdjRepl != 0 {
+		c.SeqAdjRepl = e.SeqAdjRepl.seqAdj()
+	}
+	c.ID = fieldUint32(e.Fields, FieldID, e.ID)
+	c.Status = fieldUint32(e.Fields, FieldStatus, e.Status)
+	c.Use = fieldUint32(e.Fields, FieldUse, e.Use)
+	c.Mark = fieldUint32(e.Fields, FieldMark, e.Mark)
+	c.Timeout = fieldUint32(e.Fields, FieldTimeout, e.Timeout)
+	c.MarkMask = fieldUint32(e.Fields, FieldMarkMask, e.MarkMask)
+	c.StatusMask = fieldUint32(e.Fields, FieldStatusMask, e.StatusMask)
+	if e.Fields&FieldZone != 0 {
+		zone := e.Zone
+		c.Zone = &zone
+	}
+	if e.Fields&FieldTimestamp != 0 {
+		ts := &Timestamp{}
+		if e.present&presTimestampStart != 0 {
+			start := time.Unix(0, e.TimestampStart)
+			ts.Start = &start
+		}
+		if e.present&presTimestampStop != 0 {
+			stop := time.Unix(0, e.TimestampStop)
+			ts.Stop = &stop
+		}
+		c.Timestamp = ts
+	}
+	if e.Fields&FieldSecCtx != 0 {
+		c.SecCtx = &SecCtx{}
+		if e.present&presSecCtxName != 0 {
+			name := string(e.SecCtx)
+			c.SecCtx.Name = &name
+		}
+	}
+	if e.Fields&FieldLabel != 0 {
+		label := append([]byte{}, e.Label...)
+		c.Label = &label
+	}
+	if e.Fields&FieldLabelMask != 0 {
+		mask := append([]byte{}, e.LabelMask...)
+		c.LabelMask = &mask
+	}
+	return c
+}
+
+func fieldUint32(fields, field Field, v uint32) *uint32 {
+	if fields&field == 0 {
+		return nil
+	}
+	return &v
+}
+
+// conIP returns a copy of ip, that has the length of the attribute it was
+// decoded from.
+func conIP(ip *[16]byte, v6 bool) *net.IP {
+	v := append(net.IP(nil), tupleIP(ip)...)
+	if v6 {
+		v = append(net.IP(nil), ip[:]...)
+	}
+	return &v
+}
+
+func (t *Tuple) ipTuple() *IPTuple {
+	v := &IPTuple{}
+	if t.Fields&TupleSrc != 0 {
+		v.Src = conIP(&t.Src, t.present&presTupleSrcV6 != 0)
+	}
+	if t.Fields&TupleDst != 0 {
+		v.Dst = conIP(&t.Dst, t.present&presTupleDstV6 != 0)
+	}
+	if t.present&presTupleIP != 0 {
+		// the addresses are reported as pair
+		if v.Src == nil {
+			v.Src = new(net.IP)
+		}
+		if v.Dst == nil {
+			v.Dst = new(net.IP)
+		}
+	}
+	if t.Fields&TupleZone != 0 {
+		zone := t.Zone
+		v.Zone = &zone
+	}
+	protoFields := TupleProto | TupleSrcPort | TupleDstPort | TupleIcmpID | TupleIcmpType | TupleIcmpCode
+	if t.Fields&protoFields == 0 && t.present&presTupleProto == 0 {
+		return v
+	}
+
+	p := &ProtoTuple{}
+	if t.Fields&TupleProto != 0 {
+		proto := t.Proto
+		p.Number = &proto
+	}
+	if t.Fields&TupleSrcPort != 0 {
+		port := t.SrcPort
+		p.SrcPort = &port
+	}
+	if t.Fields&TupleDstPort != 0 {
+		port := t.DstPort
+		p.DstPort = &port
+	}
+	id, typ, code := &p.IcmpID, &p.IcmpType, &p.IcmpCode
+	if t.present&presTupleIcmpv6 != 0 || (t.present == 0 && t.Proto == 58) {
+		id, typ, code = &p.Icmpv6ID, &p.Icmpv6Type, &p.Icmpv6Code
+	}
+	if t.Fields&TupleIcmpID != 0 {
+		val := t.IcmpID
+		*id = &val
+	}
+	if t.Fields&TupleIcmpType != 0 {
+		val := t.IcmpType
+		*typ = &val
+	}
+	if t.Fields&TupleIcmpCode != 0 {
+		val := t.IcmpCode
+		*code = &val
+	}
+	v.Proto = p
+	return v
+}
+
+func (p *EntryProtoInfo) protoInfo() *ProtoInfo {
+	v := *p
+	switch p.Proto {
+	case 6:
+		tcp := &TCPInfo{}
+		if p.present&presState != 0 {
+			tcp.State = &v.State
+		}
+		if p.present&presWScaleOrig != 0 {
+			tcp.WScaleOrig = &v.WScaleOrig
+		}
+		if p.present&presWScaleRepl != 0 {
+			tcp.WScaleRepl = &v.WScaleRepl
+		}
+		tcp.FlagsOrig = v.tcpFlags(&v.FlagsOrig, &v.MaskOrig, presFlagsOrigNest, presFlagsOrig, presFlagsOrigMask)
+		tcp.FlagsReply = v.tcpFlags(&v.FlagsReply, &v.MaskReply, presFlagsReplyNest, presFlagsReply, presFlagsReplyMask)
+		return &ProtoInfo{TCP: tcp}
+	case 33:
+		dccp := &DCCPInfo{}
+		if p.present&presState != 0 {
+			dccp.State = &v.State
+		}
+		if p.present&presRole != 0 {
+			dccp.Role = &v.Role
+		}
+		if p.present&presHandshakeSeq != 0 {
+			dccp.HandshakeSeq = &v.HandshakeSeq
+		}
+		return &ProtoInfo{DCCP: dccp}
+	case 132:
+		sctp := &SCTPInfo{}
+		if p.present&presState != 0 {
+			sctp.State = &v.State
+		}
+		if p.present&presVTagOriginal != 0 {
+			sctp.VTagOriginal = &v.VTagOriginal
+		}
+		if p.present&presVTagReply != 0 {
+			sctp.VTagReply = &v.VTagReply
+		}
+		return &ProtoInfo{SCTP: sctp}
+	}
+	return &ProtoInfo{}
+}
+
+// tcpFlags returns the TCP flags of a direction, if they are present.
+func (p *EntryProtoInfo) tcpFlags(flags, mask *uint8, nest, flagsPresent, maskPresent presence) *TCPFlags {
+	if p.present&nest == 0 {
+		return nil
+	}
+	v := &TCPFlags{}
+	if p.present&flagsPresent != 0 {
+		v.Flags = flags
+	}
+	if p.present&maskPresent != 0 {
+		v.Mask = mask
+	}
+	return v
+}
+
+func (n *EntryNat) nat() *Nat {
+	v := &Nat{}
+	if n.present&presIPMin != 0 {
+		v.IPMin = conIP(&n.IPMin, n.present&presIPMinV6 != 0)
+	}
+	if n.present&presIPMax != 0 {
+		v.IPMax = conIP(&n.IPMax, n.present&presIPMaxV6 != 0)
+	}
+	if n.present&presNatProto != 0 {
+		v.Proto = &ProtoTuple{}
+		if n.present&presPortMin != 0 {
+			portMin := n.PortMin
+			v.Proto.SrcPort = &portMin
+		}
+		if n.present&presPortMax != 0 {
+			portMax := n.PortMax
+			v.Proto.DstPort = &portMax
+		}
+	}
+	return v
+}
+
+func (c *EntryCounter) counter() *Counter {
+	v := &Counter{}
+	packets, bytes := c.Packets, c.Bytes
+	packets32, bytes32 := uint32(c.Packets), uint32(c.Bytes)
+	if c.present&presPackets != 0 {
+		v.Packets = &packets
+	}
+	if c.present&presBytes != 0 {
+		v.Bytes = &bytes
+	}
+	if c.present&presPackets32 != 0 {
+		v.Packets32 = &packets32
+	}
+	if c.present&presBytes32 != 0 {
+		v.Bytes32 = &bytes32
+	}
+	return v
+}
+
+func (s *SeqAdjValue) seqAdj() *SeqAdj {
+	v := *s
+	adj := &SeqAdj{}
+	if s.present&presCorrectionPos != 0 {
+		adj.CorrectionPos = &v.CorrectionPos
+	}
+	if s.present&presOffsetBefore != 0 {
+		adj.OffsetBefore = &v.OffsetBefore
+	}
+	if s.present&presOffsetAfter != 0 {
+		adj.OffsetAfter = &v.OffsetAfter
+	}
+	return adj
+}
+
+// DumpEntries dumps the Conntrack table and calls fn for every entry, as
+// soon as it is received. The same Entry is reused for all entries, so fn
+// must not retain it. See DumpFunc for the handling of errors returned by fn.
+func (nfct *Nfct) DumpEntries(ctx context.Context, f Family, fn func(e *Entry) error) error {
+	req, err := dumpRequest(Conntrack, f)
+	if err != nil {
+		return err
+	}
+	var e Entry
+	mask := fieldMask(nfct.decodeMask)
+	return nfct.request(ctx, req, func(msg netlink.Message) error {
+		if err := e.DecodeFields(msg.Data, mask); err != nil {
+			return err
+		}
+		return fn(&e)
+	})
+}
@@ -0,0 +1,312 @@
+package conntrack
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/florianl/go-conntrack/internal/unix"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nltest"
+)
+
+func decoderTestData(tb testing.TB) []byte {
+	c := testCon(40000)
+	id := uint32(0x1234)
+	status := uint32(0xe)
+	c.ID = &id
+	c.Status = &status
+	data, err := MarshalAttributes(log.New(ioutil.Discard, "", 0), IPv4, c)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return data
+}
+
+func TestEntryDecode(t *testing.T) {
+	data := decoderTestData(t)
+
+	var e Entry
+	if err := e.Decode(data); err != nil {
+		t.Fatal(err)
+	}
+	want := FieldOrigin | FieldReply | FieldProtoInfo | FieldHelper |
+		FieldSeqAdjOrig | FieldID | FieldStatus | FieldMark | FieldTimeout | FieldZone | FieldLabel
+	if e.Fields != want {
+		t.Fatalf("unexpected fields: %#x", e.Fields)
+	}
+	if !e.Origin.SrcIP().Equal(net.ParseIP("192.0.2.1")) || !e.Reply.SrcIP().Equal(net.ParseIP("10.0.0.2")) ||
+		e.Origin.SrcPort != 40000 || e.Reply.SrcPort != 8080 || e.Origin.Proto != 6 {
+		t.Fatalf("unexpected tuples: %#v %#v", e.Origin, e.Reply)
+	}
+	if e.ProtoInfo.Proto != 6 || e.ProtoInfo.State != 3 || e.ProtoInfo.WScaleOrig != 7 || e.ProtoInfo.FlagsOrig != 0x09 {
+		t.Fatalf("unexpected protocol information: %#v", e.ProtoInfo)
+	}
+	if string(e.Helper) != "ftp" || e.SeqAdjOrig.OffsetAfter != 1000 ||
+		e.ID != 0x1234 || e.Mark != 0x42 || e.Zone != 1 || !bytes.Equal(e.Label, []byte{0x1, 0x0, 0x0, 0x0}) {
+		t.Fatalf("unexpected entry: %#v", e)
+	}
+
+	key, ok := e.TupleKey()
+	if !ok {
+		t.Fatal("missing tuple key")
+	}
+	c := e.Con()
+	if conKey, _ := c.TupleKey(); conKey != key {
+		t.Fatalf("unexpected key of Con: %v", conKey)
+	}
+	parsed, err := ParseAttributes(log.New(ioutil.Discard, "", 0), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Origin.Src.Equal(*parsed.Origin.Src) || len(*c.Origin.Src) != len(*parsed.Origin.Src) ||
+		*c.ProtoInfo.TCP.FlagsOrig.Flags != *parsed.ProtoInfo.TCP.FlagsOrig.Flags ||
+		*c.Helper.Name != *parsed.Helper.Name {
+		t.Fatalf("Con differs from parsed attributes:\n%#v\n%#v", c, parsed)
+	}
+
+	// a reused entry does not allocate
+	allocs := testing.AllocsPerRun(100, func() {
+		if err := e.Decode(data); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("unexpected allocations: %v", allocs)
+	}
+
+	// length of the first attribute exceeds the data
+	invalid := append([]byte(nil), data...)
+	nativeEndian.PutUint16(invalid[4:6], 0xffff)
+	if err := e.Decode(invalid); err != ErrAttrLength {
+		t.Fatalf("unexpected error for invalid length: %v", err)
+	}
+}
+
+func BenchmarkParseAttributes(b *testing.B) {
+	data := decoderTestData(b)
+	logger := log.New(ioutil.Discard, "", 0)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseAttributes(logger, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEntryDecode(b *testing.B) {
+	data := decoderTestData(b)
+	var e Entry
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := e.Decode(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDecodeMask(t *testing.T) {
+	data := decoderTestData(t)
+	logger := log.New(ioutil.Discard, "", 0)
+	mask := FieldOrigin | FieldMark
+
+	nfct := &Nfct{logger: logger, decodeMask: mask | FieldRaw}
+	AdjustWriteTimeout(nfct, func() error { return nil })
+	nfct.Con = nltest.Dial(func(reqs []netlink.Message) ([]netlink.Message, error) {
+		if len(reqs) == 0 {
+			return nil, nil
+		}
+		return []netlink.Message{{
+			Header: netlink.Header{Type: netlink.HeaderType(1<<8 | ipctnlMsgCtNew), Sequence: reqs[0].Header.Sequence},
+			Data:   data,
+		}}, nil
+	})
+	defer nfct.Con.Close()
+
+	list, err := nfct.Dump(Conntrack, IPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := list[0]
+	if c.Origin == nil || c.Mark == nil || c.Reply != nil || c.ProtoInfo != nil || c.Helper != nil || c.Label != nil {
+		t.Fatalf("unexpected attributes: %#v", c)
+	}
+	if c.Raw == nil {
+		t.Fatal("raw message is missing")
+	}
+	full, err := ParseAttributes(logger, *c.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full.ProtoInfo == nil || *full.Helper.Name != "ftp" {
+		t.Fatalf("raw message is incomplete: %#v", full)
+	}
+
+	list, err = nfct.DumpMasked(context.Background(), Conntrack, IPv4, FieldAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list[0].Raw != nil || list[0].ProtoInfo == nil {
+		t.Fatalf("unexpected attributes: %#v", list[0])
+	}
+	// the message is only kept with FieldRaw
+	list, err = nfct.DumpMasked(context.Background(), Conntrack, IPv4, mask)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list[0].Raw != nil || list[0].Mark == nil {
+		t.Fatalf("unexpected attributes: %#v", list[0])
+	}
+
+	var e Entry
+	if err := e.DecodeFields(data, mask); err != nil {
+		t.Fatal(err)
+	}
+	if e.Fields != mask || e.Mark != 0x42 || e.Origin.SrcPort != 40000 || e.Reply.Fields != 0 {
+		t.Fatalf("unexpected entry: %#v", e)
+	}
+}
+
+func TestEntryCon(t *testing.T) {
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	ae.Nested(ctaTupleOrig, func(nae *netlink.AttributeEncoder) error {
+		nae.Nested(ctaTupleIP, func(nae *netlink.AttributeEncoder) error {
+			nae.Bytes(ctaIPv6Src, net.ParseIP("::ffff:192.0.2.1"))
+			nae.Bytes(ctaIPv6Dst, net.ParseIP("2001:db8::2"))
+			return nil
+		})
+		nae.Nested(ctaTupleProto, func(nae *netlink.AttributeEncoder) error {
+			nae.Uint8(ctaProtoNum, 58)
+			nae.Uint16(ctaProtoIcmpv6ID, 7)
+			nae.Uint8(ctaProtoIcmpv6Type, 128)
+			nae.Uint8(ctaProtoIcmpv6Code, 0)
+			return nil
+		})
+		return nil
+	})
+	ae.Nested(ctaTupleReply, func(nae *netlink.AttributeEncoder) error {
+		nae.Nested(ctaTupleIP, func(nae *netlink.AttributeEncoder) error {
+			nae.Bytes(ctaIPv4Src, net.ParseIP("10.0.0.2").To4())
+			return nil
+		})
+		nae.Nested(ctaTupleProto, func(nae *netlink.AttributeEncoder) error { return nil })
+		nae.Uint16(ctaTupleZone, 3)
+		return nil
+	})
+	ae.Nested(ctaProtoinfo, func(nae *netlink.AttributeEncoder) error {
+		nae.Nested(ctaProtoinfoTCP, func(nae *netlink.AttributeEncoder) error {
+			nae.Uint8(ctaProtoinfoTCPState, 3)
+			nae.Bytes(ctaProtoinfoTCPFlagsOrig, []byte{0x09})
+			return nil
+		})
+		return nil
+	})
+	ae.Nested(ctaHelp, func(nae *netlink.AttributeEncoder) error {
+		nae.String(ctaHelpName, "ftp")
+		return nil
+	})
+	ae.Nested(ctaNatSrc, func(nae *netlink.AttributeEncoder) error {
+		nae.Bytes(ctaNatV4MinIP, net.ParseIP("192.0.2.9").To4())
+		nae.Nested(ctaNatProto, func(nae *netlink.AttributeEncoder) error {
+			nae.Uint16(ctaProtoNatPortMin, 1024)
+			return nil
+		})
+		return nil
+	})
+	ae.Nested(ctaCountersOrig, func(nae *netlink.AttributeEncoder) error {
+		nae.Uint32(ctaCounter32Packets, 5)
+		nae.Uint64(ctaCounterBytes, 1000)
+		return nil
+	})
+	ae.Nested(ctaSeqAdjRepl, func(nae *netlink.AttributeEncoder) error {
+		nae.Uint32(ctaSeqAdjOffsetAfter, 10)
+		return nil
+	})
+	ae.Nested(ctaTimestamp, func(nae *netlink.AttributeEncoder) error {
+		nae.Uint64(ctaTimestampStart, 0)
+		return nil
+	})
+	ae.Nested(ctaSecCtx, func(nae *netlink.AttributeEncoder) error {
+		nae.String(ctaSecCtxName, "system_u")
+		return nil
+	})
+	ae.Uint32(ctaID, 0x1234)
+	ae.Uint32(ctaMark, 0x42)
+	ae.Uint32(ctaMarkMask, 0xff)
+	ae.Uint32(ctaStatusMask, 0x8)
+	ae.Uint16(ctaZone, 1)
+	ae.Bytes(ctaLables, []byte{0x1, 0x0, 0x0, 0x0})
+	ae.Bytes(ctaLablesMask, []byte{0xff, 0x0, 0x0, 0x0})
+	attrs, err := ae.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := append([]byte{unix.AF_INET6, unix.NFNETLINK_V0, 0, 0}, attrs...)
+
+	u8 := func(v uint8) *uint8 { return &v }
+	u16 := func(v uint16) *uint16 { return &v }
+	u32 := func(v uint32) *uint32 { return &v }
+	u64 := func(v uint64) *uint64 { return &v }
+	ip := func(s string) *net.IP {
+		v := net.ParseIP(s)
+		if v4 := v.To4(); v4 != nil && !strings.Contains(s, ":") {
+			v = v4
+		}
+		return &v
+	}
+	str := func(s string) *string { return &s }
+	start := time.Unix(0, 0)
+	label, labelMask := []byte{0x1, 0x0, 0x0, 0x0}, []byte{0xff, 0x0, 0x0, 0x0}
+	want := Con{
+		Origin: &IPTuple{Src: ip("::ffff:192.0.2.1"), Dst: ip("2001:db8::2"),
+			Proto: &ProtoTuple{Number: u8(58), Icmpv6ID: u16(7), Icmpv6Type: u8(128), Icmpv6Code: u8(0)}},
+		Reply:         &IPTuple{Src: ip("10.0.0.2"), Dst: new(net.IP), Proto: &ProtoTuple{}, Zone: u16(3)},
+		ProtoInfo:     &ProtoInfo{TCP: &TCPInfo{State: u8(3), FlagsOrig: &TCPFlags{Flags: u8(0x09)}}},
+		Helper:        &Helper{Name: str("ftp")},
+		NatSrc:        &Nat{IPMin: ip("192.0.2.9"), Proto: &ProtoTuple{SrcPort: u16(1024)}},
+		CounterOrigin: &Counter{Packets32: u32(5), Bytes: u64(1000)},
+		SeqAdjRepl:    &SeqAdj{OffsetAfter: u32(10)},
+		Timestamp:     &Timestamp{Start: &start},
+		SecCtx:        &SecCtx{Name: str("system_u")},
+		ID:            u32(0x1234),
+		Mark:          u32(0x42),
+		MarkMask:      u32(0xff),
+		StatusMask:    u32(0x8),
+		Zone:          u16(1),
+		Label:         &label,
+		LabelMask:     &labelMask,
+	}
+
+	var e Entry
+	if err := e.Decode(data); err != nil {
+		t.Fatal(err)
+	}
+	if got := e.Con(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected Con of entry:\n- want: %s\n-  got: %s", spew(want), spew(got))
+	}
+	parsed, err := ParseAttributes(log.New(ioutil.Discard, "", 0), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, want) {
+		t.Fatalf("unexpected parsed attributes:\n- want: %s\n-  got: %s", spew(want), spew(parsed))
+	}
+}
+
+// spew formats c with the values of its pointers.
+func spew(c Con) string {
+	b, _ := json.Marshal(c)
+	return string(b)
+}
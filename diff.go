@@ -0,0 +1,282 @@
+package conntrack
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FieldChange describes the change of a single attribute of an entry.
+// An empty value means, that the attribute is not set.
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// DiffEntry describes an entry, that differs between two sets of entries.
+type DiffEntry struct {
+	Key TupleKey
+
+	// Old is the entry of the first set. It is empty for added entries.
+	Old Con
+
+	// New is the entry of the second set. It is empty for removed entries.
+	New Con
+
+	// Fields contains the changed attributes of changed entries.
+	Fields []FieldChange
+}
+
+// DiffResult contains the differences between two sets of entries. All
+// lists are sorted by their key.
+type DiffResult struct {
+	Added   []DiffEntry
+	Removed []DiffEntry
+	Changed []DiffEntry
+}
+
+// DiffConfig contains options for Diff.
+type DiffConfig struct {
+	// IgnoreFields contains attributes, that are not compared. An entry
+	// matches all attributes with this prefix, e.g. "counter" ignores all
+	// counters and "status" all status bits.
+	IgnoreFields []string
+}
+
+// Diff compares two sets of entries, like two dumps or snapshots of a table.
+// Entries are matched by their original tuple and zone. If the ID or the
+// start time of two matched entries differ, the tuple has been reused by a
+// new connection and the entries are reported as removed and added.
+func Diff(before, after []Con, config DiffConfig) DiffResult {
+	var result DiffResult
+
+	old := make(map[TupleKey]Con, len(before))
+	for _, c := range before {
+		if key, ok := c.TupleKey(); ok {
+			old[key] = c
+		}
+	}
+
+	for _, c := range after {
+		key, ok := c.TupleKey()
+		if !ok {
+			continue
+		}
+		prev, exists := old[key]
+		if !exists {
+			result.Added = append(result.Added, DiffEntry{Key: key, New: c})
+			continue
+		}
+		delete(old, key)
+		if !sameConnection(prev, c) {
+			result.Removed = append(result.Removed, DiffEntry{Key: key, Old: prev})
+			result.Added = append(result.Added, DiffEntry{Key: key, New: c})
+			continue
+		}
+		if fields := diffFields(prev, c, config.IgnoreFields); len(fields) > 0 {
+			result.Changed = append(result.Changed, DiffEntry{Key: key, Old: prev, New: c, Fields: fields})
+		}
+	}
+	for key, c := range old {
+		result.Removed = append(result.Removed, DiffEntry{Key: key, Old: c})
+	}
+
+	sortDiffEntries(result.Added)
+	sortDiffEntries(result.Removed)
+	sortDiffEntries(result.Changed)
+	return result
+}
+
+// Empty returns true, if there are no differences.
+func (r DiffResult) Empty() bool {
+	return len(r.Added) == 0 && len(r.Removed) == 0 && len(r.Changed) == 0
+}
+
+func sortDiffEntries(entries []DiffEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key.String() < entries[j].Key.String()
+	})
+}
+
+// sameConnection reports whether a and b describe the same connection.
+func sameConnection(a, b Con) bool {
+	if a.ID != nil && b.ID != nil && *a.ID != *b.ID {
+		return false
+	}
+	if a.Timestamp != nil && b.Timestamp != nil && a.Timestamp.Start != nil && b.Timestamp.Start != nil &&
+		!a.Timestamp.Start.Equal(*b.Timestamp.Start) {
+		return false
+	}
+	return true
+}
+
+type diffField struct {
+	name  string
+	value func(c Con) string
+}
+
+var diffFieldList = []diffField{
+	{"mark", func(c Con) string { return formatHex(c.Mark) }},
+	{"timeout", func(c Con) string { return formatUint32(c.Timeout) }},
+	{"tcp.state", func(c Con) string {
+		if c.ProtoInfo == nil || c.ProtoInfo.TCP == nil || c.ProtoInfo.TCP.State == nil {
+			return ""
+		}
+		return TCPState(*c.ProtoInfo.TCP.State).String()
+	}},
+	{"counter.orig.packets", func(c Con) string { return formatCounter(c.CounterOrigin, true) }},
+	{"counter.orig.bytes", func(c Con) string { return formatCounter(c.CounterOrigin, false) }},
+	{"counter.reply.packets", func(c Con) string { return formatCounter(c.CounterReply, true) }},
+	{"counter.reply.bytes", func(c Con) string { return formatCounter(c.CounterReply, false) }},
+	{"reply", func(c Con) string { return formatTuple(c.Reply) }},
+	{"helper", func(c Con) string {
+		if c.Helper == nil || c.Helper.Name == nil {
+			return ""
+		}
+		return *c.Helper.Name
+	}},
+	{"label", func(c Con) string {
+		if c.Label == nil {
+			return ""
+		}
+		return hex.EncodeToString(*c.Label)
+	}},
+}
+
+func diffFields(a, b Con, ignore []string) []FieldChange {
+	var changes []FieldChange
+	add := func(field, old, new string) {
+		if old == new {
+			return
+		}
+		for _, prefix := range ignore {
+			if strings.HasPrefix(field, prefix) {
+				return
+			}
+		}
+		changes = append(changes, FieldChange{Field: field, Old: old, New: new})
+	}
+
+	if a.Status != nil && b.Status != nil {
+		for bit := 0; bit < 32; bit++ {
+			old := *a.Status >> uint(bit) & 1
+			new := *b.Status >> uint(bit) & 1
+			add("status."+statusBitName(bit), strconv.Itoa(int(old)), strconv.Itoa(int(new)))
+		}
+	} else {
+		add("status", formatHex(a.Status), formatHex(b.Status))
+	}
+	for _, f := range diffFieldList {
+		add(f.name, f.value(a), f.value(b))
+	}
+	return changes
+}
+
+func formatHex(v *uint32) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprintf("0x%x", *v)
+}
+
+func formatUint32(v *uint32) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatUint(uint64(*v), 10)
+}
+
+func formatCounter(c *Counter, packets bool) string {
+	if c == nil {
+		return ""
+	}
+	p, b := counterValues(c)
+	if packets {
+		return strconv.FormatUint(p, 10)
+	}
+	return strconv.FormatUint(b, 10)
+}
+
+func formatTuple(t *IPTuple) string {
+	if t == nil {
+		return ""
+	}
+	key, ok := Con{Origin: t}.TupleKey()
+	if !ok {
+		return ""
+	}
+	return key.String()
+}
+
+// WriteText writes the differences in a human readable format. Added entries
+// are prefixed by '+', removed entries by '-' and changed entries by '~',
+// followed by their changed attributes.
+func (r DiffResult) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, e := range r.Removed {
+		fmt.Fprintf(bw, "- %s%s\n", e.Key, formatID(e.Old))
+	}
+	for _, e := range r.Added {
+		fmt.Fprintf(bw, "+ %s%s\n", e.Key, formatID(e.New))
+	}
+	for _, e := range r.Changed {
+		fmt.Fprintf(bw, "~ %s%s\n", e.Key, formatID(e.New))
+		for _, f := range e.Fields {
+			fmt.Fprintf(bw, "    %s: %s -> %s\n", f.Field, textValue(f.Old), textValue(f.New))
+		}
+	}
+	return bw.Flush()
+}
+
+func formatID(c Con) string {
+	if c.ID == nil {
+		return ""
+	}
+	return fmt.Sprintf(" id %d", *c.ID)
+}
+
+func textValue(v string) string {
+	if v == "" {
+		return "<unset>"
+	}
+	return v
+}
+
+type jsonDiffEntry struct {
+	Key     string        `json:"key"`
+	ID      *uint32       `json:"id,omitempty"`
+	Changes []FieldChange `json:"changes,omitempty"`
+}
+
+type jsonDiff struct {
+	Added   []jsonDiffEntry `json:"added"`
+	Removed []jsonDiffEntry `json:"removed"`
+	Changed []jsonDiffEntry `json:"changed"`
+}
+
+// WriteJSON writes the differences as JSON object with the lists added,
+// removed and changed.
+func (r DiffResult) WriteJSON(w io.Writer) error {
+	convert := func(entries []DiffEntry, old bool) []jsonDiffEntry {
+		out := make([]jsonDiffEntry, 0, len(entries))
+		for _, e := range entries {
+			c := e.New
+			if old {
+				c = e.Old
+			}
+			out = append(out, jsonDiffEntry{Key: e.Key.String(), ID: c.ID, Changes: e.Fields})
+		}
+		return out
+	}
+	return json.NewEncoder(w).Encode(jsonDiff{
+		Added:   convert(r.Added, false),
+		Removed: convert(r.Removed, true),
+		Changed: convert(r.Changed, false),
+	})
+}
@@ -0,0 +1,105 @@
+package conntrack
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	withID := func(c Con, id uint32) Con {
+		c.ID = &id
+		return c
+	}
+	unchanged := withID(testCon(40000), 1)
+	removed := withID(testCon(40001), 2)
+	reusedOld := withID(testCon(40002), 3)
+	reusedNew := withID(testCon(40002), 4)
+	changedOld := withID(testCon(40003), 5)
+	changedNew := withID(testCon(40003), 5)
+	added := withID(testCon(40004), 6)
+
+	oldStatus := uint32(0x0a)
+	newStatus := uint32(0x0e)
+	changedOld.Status = &oldStatus
+	changedNew.Status = &newStatus
+	mark := uint32(0x43)
+	changedNew.Mark = &mark
+	packets, bytes := uint64(10), uint64(1000)
+	changedNew.CounterOrigin = &Counter{Packets: &packets, Bytes: &bytes}
+
+	result := Diff([]Con{unchanged, removed, reusedOld, changedOld},
+		[]Con{unchanged, reusedNew, changedNew, added}, DiffConfig{})
+	if len(result.Added) != 2 || len(result.Removed) != 2 || len(result.Changed) != 1 {
+		t.Fatalf("unexpected result: %d added, %d removed, %d changed",
+			len(result.Added), len(result.Removed), len(result.Changed))
+	}
+	if *result.Removed[0].Old.ID != 2 || *result.Removed[1].Old.ID != 3 {
+		t.Fatalf("unexpected removed entries: %v", result.Removed)
+	}
+	if *result.Added[0].New.ID != 4 || *result.Added[1].New.ID != 6 {
+		t.Fatalf("unexpected added entries: %v", result.Added)
+	}
+
+	expected := []FieldChange{
+		{Field: "status.ASSURED", Old: "0", New: "1"},
+		{Field: "mark", Old: "0x42", New: "0x43"},
+		{Field: "counter.orig.packets", Old: "", New: "10"},
+		{Field: "counter.orig.bytes", Old: "", New: "1000"},
+	}
+	fields := result.Changed[0].Fields
+	if len(fields) != len(expected) {
+		t.Fatalf("unexpected changes: %v", fields)
+	}
+	for i := range expected {
+		if fields[i] != expected[i] {
+			t.Fatalf("unexpected change %d: %v", i, fields[i])
+		}
+	}
+
+	result = Diff([]Con{changedOld}, []Con{changedNew}, DiffConfig{IgnoreFields: []string{"counter", "status"}})
+	if len(result.Changed) != 1 || len(result.Changed[0].Fields) != 1 || result.Changed[0].Fields[0].Field != "mark" {
+		t.Fatalf("fields were not ignored: %v", result.Changed)
+	}
+	if !Diff([]Con{unchanged}, []Con{unchanged}, DiffConfig{}).Empty() {
+		t.Fatalf("unexpected differences of equal sets")
+	}
+}
+
+func TestDiffOutput(t *testing.T) {
+	before := testCon(40000)
+	after := testCon(40000)
+	timeout := uint32(300)
+	after.Timeout = &timeout
+	result := Diff([]Con{before}, []Con{after, testCon(40001)}, DiffConfig{})
+
+	var text bytes.Buffer
+	if err := result.WriteText(&text); err != nil {
+		t.Fatal(err)
+	}
+	want := "+ tcp 192.0.2.1:40001 -> 192.0.2.2:80 zone 1\n" +
+		"~ tcp 192.0.2.1:40000 -> 192.0.2.2:80 zone 1\n" +
+		"    timeout: 600 -> 300\n"
+	if text.String() != want {
+		t.Fatalf("unexpected text output:\n%s", text.String())
+	}
+
+	var buf bytes.Buffer
+	if err := result.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var out map[string][]struct {
+		Key     string        `json:"key"`
+		Changes []FieldChange `json:"changes"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out["added"]) != 1 || len(out["removed"]) != 0 || len(out["changed"]) != 1 {
+		t.Fatalf("unexpected JSON output: %s", buf.String())
+	}
+	if out["changed"][0].Changes[0].Field != "timeout" || !strings.Contains(buf.String(), `"removed":[]`) {
+		t.Fatalf("unexpected JSON output: %s", buf.String())
+	}
+}
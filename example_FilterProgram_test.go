@@ -0,0 +1,38 @@
+package conntrack_test
+
+import (
+	"fmt"
+	"net"
+
+	ct "github.com/florianl/go-conntrack"
+)
+
+func ExampleFilterProgram_Match() {
+	filter, err := ct.ParseFilter("l4proto tcp and orig.dport in 8000-8100")
+	if err != nil {
+		fmt.Println("could not parse filter:", err)
+		return
+	}
+	prog, err := ct.CompileFilterExpr(ct.Conntrack, filter)
+	if err != nil {
+		fmt.Println("could not compile filter:", err)
+		return
+	}
+
+	src, dst := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	proto, sport := uint8(6), uint16(40000)
+	for _, dport := range []uint16{80, 8080} {
+		dport := dport
+		c := ct.Con{Origin: &ct.IPTuple{Src: &src, Dst: &dst,
+			Proto: &ct.ProtoTuple{Number: &proto, SrcPort: &sport, DstPort: &dport}}}
+		accept, err := prog.Match(ct.IPv4, c)
+		if err != nil {
+			fmt.Println("could not run filter:", err)
+			return
+		}
+		fmt.Printf("port %d: %v\n", dport, accept)
+	}
+	// Output:
+	// port 80: false
+	// port 8080: true
+}
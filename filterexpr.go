@@ -0,0 +1,462 @@
+package conntrack
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/florianl/go-conntrack/internal/unix"
+	"golang.org/x/net/bpf"
+)
+
+// FilterExpr is a boolean expression over attributes of a connection. It is
+// compiled to a BPF filter, that is applied to events by the kernel.
+// A FilterExpr is built with And, Or and Not from ConnAttr, AttrCompare,
+// AttrRange, StatusAll, StatusAny and StatusNone. A ConnAttr matches, if the
+// attribute exists and its value equals Data. If Mask is set, only the masked
+// bits are compared. A ConnAttr with Negate set matches, if the attribute does
+// not exist or its value differs.
+type FilterExpr interface {
+	compile(c *filterCompiler, t, f bpfLabel) error
+}
+
+// ErrFilterCompare is returned, if an attribute can not be compared numerically
+// or the value of a comparison exceeds the size of the attribute.
+var ErrFilterCompare = errors.New("unsupported comparison of filter attribute")
+
+// CompareOp is the operator of a numeric comparison.
+type CompareOp uint8
+
+// Operators of AttrCompare
+const (
+	OpEqual CompareOp = iota
+	OpNotEqual
+	OpLess
+	OpLessEqual
+	OpGreater
+	OpGreaterEqual
+)
+
+// AttrCompare is a FilterExpr, that compares the value of a numeric attribute
+// with Value, e.g. AttrOrigPortDst, AttrTimeout, AttrUse or counters. It does
+// not match, if the attribute does not exist.
+type AttrCompare struct {
+	Type  ConnAttrType
+	Op    CompareOp
+	Value uint64
+}
+
+// AttrRange is a FilterExpr, that matches if the value of a numeric attribute
+// is within Min and Max, inclusively. It does not match, if the attribute does
+// not exist.
+type AttrRange struct {
+	Type     ConnAttrType
+	Min, Max uint64
+}
+
+type andExpr []FilterExpr
+
+type orExpr []FilterExpr
+
+type notExpr struct {
+	expr FilterExpr
+}
+
+// And returns an expression, that matches if all exprs match. Without exprs,
+// it matches every connection.
+func And(exprs ...FilterExpr) FilterExpr {
+	return andExpr(exprs)
+}
+
+// Or returns an expression, that matches if any of exprs matches. Without
+// exprs, it matches no connection.
+func Or(exprs ...FilterExpr) FilterExpr {
+	return orExpr(exprs)
+}
+
+// Not returns an expression, that matches if expr does not match.
+func Not(expr FilterExpr) FilterExpr {
+	return notExpr{expr: expr}
+}
+
+// familyExpr matches events of a family.
+type familyExpr Family
+
+// SKF_AD_OFF + SKF_AD_NLATTR and SKF_AD_OFF + SKF_AD_NLATTR_NEST
+const (
+	bpfAncNLAttr     = 0xfffff00c
+	bpfAncNLAttrNest = 0xfffff010
+)
+
+// sizeof(nlmsghdr) + sizeof(nfgenmsg)
+const bpfAttrOffset = 0x14
+
+// filterCompiler translates a FilterExpr into a bpfProgram.
+type filterCompiler struct {
+	prog   bpfProgram
+	checks map[ConnAttrType]filterCheckStruct
+	// nests counts the lookups of nests, if it is set.
+	nests map[string]*nestLookup
+	// slots holds the scratch memory, that the offsets of nests are kept in.
+	slots map[string]uint32
+}
+
+func (e andExpr) compile(c *filterCompiler, t, f bpfLabel) error {
+	if len(e) == 0 {
+		c.prog.jumpTo(t)
+		return nil
+	}
+	for i := 0; i < len(e); {
+		// negated attributes of the same type are looked up once
+		attrs := setAttrs(e[i:], true)
+		n := len(attrs)
+		if n < 2 {
+			n = 1
+		}
+		next := t
+		if i+n < len(e) {
+			next = c.prog.newLabel()
+		}
+		if n > 1 {
+			if err := c.compileSet(attrs, f, next, next); err != nil {
+				return err
+			}
+		} else if err := e[i].compile(c, next, f); err != nil {
+			return err
+		}
+		i += n
+		if next != t {
+			c.prog.bind(next)
+		}
+	}
+	return nil
+}
+
+func (e orExpr) compile(c *filterCompiler, t, f bpfLabel) error {
+	if len(e) == 0 {
+		c.prog.jumpTo(f)
+		return nil
+	}
+	for i := 0; i < len(e); {
+		// alternative values of the same attribute are looked up once
+		attrs := setAttrs(e[i:], false)
+		n := len(attrs)
+		if n < 2 {
+			n = 1
+		}
+		next := f
+		if i+n < len(e) {
+			next = c.prog.newLabel()
+		}
+		if n > 1 {
+			if err := c.compileSet(attrs, t, next, next); err != nil {
+				return err
+			}
+		} else if err := e[i].compile(c, t, next); err != nil {
+			return err
+		}
+		i += n
+		if next != f {
+			c.prog.bind(next)
+		}
+	}
+	return nil
+}
+
+func (e notExpr) compile(c *filterCompiler, t, f bpfLabel) error {
+	return e.expr.compile(c, f, t)
+}
+
+func (a ConnAttr) compile(c *filterCompiler, t, f bpfLabel) error {
+	check, err := c.check(a)
+	if err != nil {
+		return err
+	}
+	if a.Negate {
+		t, f = f, t
+	}
+	c.loadAttr(check, f)
+	c.compareValue(check, a, t, f)
+	return nil
+}
+
+func (e familyExpr) compile(c *filterCompiler, t, f bpfLabel) error {
+	// nfgenmsg.nfgen_family
+	c.prog.emit(bpf.RawInstruction{Op: unix.BPF_LD | unix.BPF_B | unix.BPF_ABS, K: NetlinkHeaderSize})
+	c.prog.jump(unix.BPF_JEQ, uint32(e), t, f)
+	return nil
+}
+
+// check validates a and returns how its attribute is found.
+func (c *filterCompiler) check(a ConnAttr) (filterCheckStruct, error) {
+	check, ok := c.checks[a.Type]
+	if !ok || check.ct == ctaUnspec {
+		return check, ErrFilterAttributeNotImplemented
+	}
+	if !check.validLength(a.Data) {
+		return check, ErrFilterAttributeLength
+	}
+	if a.Mask != nil && (!check.mask || len(a.Mask) != check.len) {
+		return check, ErrFilterAttributeMaskLength
+	}
+	return check, nil
+}
+
+// numericCheck validates, that the attribute of typ can be compared with
+// values and returns how it is found.
+func (c *filterCompiler) numericCheck(typ ConnAttrType, values ...uint64) (filterCheckStruct, error) {
+	check, ok := c.checks[typ]
+	if !ok || check.ct == ctaUnspec {
+		return check, ErrFilterAttributeNotImplemented
+	}
+	switch check.len {
+	case 1, 2, 4, 8:
+	default:
+		return check, ErrFilterCompare
+	}
+	for _, v := range values {
+		if check.len < 8 && v>>(8*uint(check.len)) != 0 {
+			return check, ErrFilterCompare
+		}
+	}
+	return check, nil
+}
+
+func (a AttrCompare) compile(c *filterCompiler, t, f bpfLabel) error {
+	check, err := c.numericCheck(a.Type, a.Value)
+	if err != nil {
+		return err
+	}
+	// a missing attribute never matches
+	missing := f
+	var op uint16
+	switch a.Op {
+	case OpEqual:
+		op = unix.BPF_JEQ
+	case OpNotEqual:
+		op, t, f = unix.BPF_JEQ, f, t
+	case OpLess:
+		op, t, f = unix.BPF_JGE, f, t
+	case OpLessEqual:
+		op, t, f = unix.BPF_JGT, f, t
+	case OpGreater:
+		op = unix.BPF_JGT
+	case OpGreaterEqual:
+		op = unix.BPF_JGE
+	default:
+		return ErrFilterCompare
+	}
+	c.loadAttr(check, missing)
+	c.compareNumber(check, op, a.Value, t, f)
+	return nil
+}
+
+func (a AttrRange) compile(c *filterCompiler, t, f bpfLabel) error {
+	check, err := c.numericCheck(a.Type, a.Min, a.Max)
+	if err != nil {
+		return err
+	}
+	if check.len == 8 {
+		return And(
+			AttrCompare{Type: a.Type, Op: OpGreaterEqual, Value: a.Min},
+			AttrCompare{Type: a.Type, Op: OpLessEqual, Value: a.Max},
+		).compile(c, t, f)
+	}
+	c.loadAttr(check, f)
+	c.loadValue(check, 0)
+	next := c.prog.newLabel()
+	c.prog.jump(unix.BPF_JGE, uint32(a.Min), next, f)
+	c.prog.bind(next)
+	c.prog.jump(unix.BPF_JGT, uint32(a.Max), f, t)
+	return nil
+}
+
+// loadValue emits an instruction, that loads the i-th word of the value of
+// the attribute at X into A.
+func (c *filterCompiler) loadValue(check filterCheckStruct, i int) {
+	if check.family {
+		// nfgenmsg.nfgen_family
+		c.prog.emit(bpf.RawInstruction{Op: unix.BPF_LD | unix.BPF_B | unix.BPF_ABS, K: NetlinkHeaderSize})
+		return
+	}
+	op := uint16(unix.BPF_W)
+	switch check.len {
+	case 1:
+		op = unix.BPF_B
+	case 2:
+		op = unix.BPF_H
+	}
+	c.prog.emit(bpf.RawInstruction{Op: unix.BPF_LD | unix.BPF_IND | op, K: uint32(4 + check.off + 4*i)})
+}
+
+// compareNumber emits instructions, that compare the value of the attribute
+// at X with v by the conditional jump op.
+func (c *filterCompiler) compareNumber(check filterCheckStruct, op uint16, v uint64, t, f bpfLabel) {
+	c.loadValue(check, 0)
+	if check.len != 8 {
+		c.prog.jump(op, uint32(v), t, f)
+		return
+	}
+	// 64 bit values are compared by their upper and lower half
+	hi, lo := uint32(v>>32), uint32(v)
+	low := c.prog.newLabel()
+	if op == unix.BPF_JEQ {
+		c.prog.jump(unix.BPF_JEQ, hi, low, f)
+	} else {
+		equal := c.prog.newLabel()
+		c.prog.jump(unix.BPF_JGT, hi, t, equal)
+		c.prog.bind(equal)
+		c.prog.jump(unix.BPF_JEQ, hi, low, f)
+	}
+	c.prog.bind(low)
+	c.loadValue(check, 1)
+	c.prog.jump(op, lo, t, f)
+}
+
+// loadAttr emits instructions, that load the offset of the attribute into X.
+// If the attribute does not exist, it jumps to missing.
+func (c *filterCompiler) loadAttr(check filterCheckStruct, missing bpfLabel) {
+	if check.status != 0 {
+		// the attribute only exists, if the bits of the status are set
+		c.loadAttr(filterCheck[AttrStatus], missing)
+		c.loadValue(filterCheck[AttrStatus], 0)
+		c.prog.emit(bpf.RawInstruction{Op: unix.BPF_ALU | unix.BPF_AND | unix.BPF_K, K: uint32(check.status)})
+		next := c.prog.newLabel()
+		c.prog.jump(unix.BPF_JEQ, uint32(check.status), next, missing)
+		c.prog.bind(next)
+	}
+	path := append(append([]uint32{}, check.nest...), uint32(check.ct))
+	anc := uint32(bpfAncNLAttr)
+	if slot, ok := c.slots[nestKey(check.nest)]; ok {
+		// the offset of the nest is kept in scratch memory
+		c.prog.emit(bpf.RawInstruction{Op: unix.BPF_LD | unix.BPF_MEM, K: slot})
+		next := c.prog.newLabel()
+		c.prog.jump(unix.BPF_JEQ, 0, missing, next)
+		c.prog.bind(next)
+		path, anc = path[len(check.nest):], bpfAncNLAttrNest
+	} else {
+		c.countNest(check.nest)
+		c.prog.emit(bpf.RawInstruction{Op: unix.BPF_LD | unix.BPF_IMM, K: bpfAttrOffset})
+	}
+	for _, typ := range path {
+		c.prog.emit(
+			bpf.RawInstruction{Op: unix.BPF_LDX | unix.BPF_IMM, K: typ},
+			bpf.RawInstruction{Op: unix.BPF_LD | unix.BPF_B | unix.BPF_ABS, K: anc},
+		)
+		next := c.prog.newLabel()
+		c.prog.jump(unix.BPF_JEQ, 0, missing, next)
+		c.prog.bind(next)
+		// attributes of the nest are searched within the nest
+		anc = bpfAncNLAttrNest
+	}
+	c.prog.emit(bpf.RawInstruction{Op: unix.BPF_MISC | unix.BPF_TAX})
+}
+
+// compareValue emits instructions, that compare the value of the attribute at
+// X with a.
+func (c *filterCompiler) compareValue(check filterCheckStruct, a ConnAttr, t, f bpfLabel) {
+	data, mask := a.Data, a.Mask
+	if check.str {
+		c.compareStringLength(len(a.Data)+1, f)
+		// The terminating NUL is compared as well. As the value is
+		// compared by words, the bytes after it are masked.
+		data = append(append([]byte{}, a.Data...), 0)
+		mask = make([]byte, len(data))
+		for i := range mask {
+			mask[i] = 0xff
+		}
+		for len(data)%4 != 0 {
+			data = append(data, 0)
+			mask = append(mask, 0)
+		}
+	}
+	words := (len(data) + 3) / 4
+	for i := 0; i < words; i++ {
+		c.loadValue(check, i)
+		val := wordValue(data, i)
+		if mask != nil {
+			mask := wordValue(mask, i)
+			if mask != 0xffffffff {
+				c.prog.emit(bpf.RawInstruction{Op: unix.BPF_ALU | unix.BPF_AND | unix.BPF_K, K: mask})
+			}
+			val &= mask
+		}
+		if i == words-1 {
+			c.prog.jump(unix.BPF_JEQ, val, t, f)
+			continue
+		}
+		next := c.prog.newLabel()
+		c.prog.jump(unix.BPF_JEQ, val, next, f)
+		c.prog.bind(next)
+	}
+}
+
+// compareStringLength emits instructions, that jump to f, if the length of the
+// value of the attribute at X is not n.
+func (c *filterCompiler) compareStringLength(n int, f bpfLabel) {
+	// nla_len is stored in host byte order, but loaded in network byte order.
+	b := make([]byte, 2)
+	nativeEndian.PutUint16(b, uint16(4+n))
+	c.prog.emit(bpf.RawInstruction{Op: unix.BPF_LD | unix.BPF_IND | unix.BPF_H, K: 0})
+	next := c.prog.newLabel()
+	c.prog.jump(unix.BPF_JEQ, uint32(binary.BigEndian.Uint16(b)), next, f)
+	c.prog.bind(next)
+}
+
+// wordValue returns the i-th value of data, as it is loaded by BPF.
+func wordValue(data []byte, i int) uint32 {
+	if len(data) < 4 {
+		return encodeValue(data)
+	}
+	return binary.BigEndian.Uint32(data[4*i : 4*i+4])
+}
+
+// compileFilterExpr returns the BPF filter for events of subsys, that accepts
+// events matching expr. Events of other subsystems are accepted.
+func compileFilterExpr(subsys Table, expr FilterExpr) ([]bpf.RawInstruction, error) {
+	raw, err := compileProgram(subsys, expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) >= bpfMAXINSTR {
+		return nil, ErrFilterLength
+	}
+	return raw, nil
+}
+
+// compileProgram is like compileFilterExpr, but does not limit the number of
+// instructions.
+func compileProgram(subsys Table, expr FilterExpr) ([]bpf.RawInstruction, error) {
+	if expr == nil {
+		expr = And()
+	}
+	// The first pass counts the lookups of nests. Nests, that are looked up
+	// more than once, are looked up once at the start of the program.
+	checks := filterChecks(subsys)
+	count := filterCompiler{checks: checks, nests: make(map[string]*nestLookup)}
+	if _, err := count.compileProgram(subsys, expr, nil); err != nil {
+		return nil, err
+	}
+	c := filterCompiler{checks: checks}
+	return c.compileProgram(subsys, expr, sharedNests(count.nests))
+}
+
+func (c *filterCompiler) compileProgram(subsys Table, expr FilterExpr, nests []*nestLookup) ([]bpf.RawInstruction, error) {
+	c.prog.emit(filterSubsys(uint32(subsys))...)
+	if len(nests) > 0 {
+		c.slots = make(map[string]uint32)
+	}
+	for _, n := range nests {
+		c.storeNest(n.path, n.slot)
+		c.slots[nestKey(n.path)] = n.slot
+	}
+
+	accept, reject := c.prog.newLabel(), c.prog.newLabel()
+	if err := expr.compile(c, accept, reject); err != nil {
+		return nil, err
+	}
+	c.prog.bind(reject)
+	c.prog.emit(bpf.RawInstruction{Op: unix.BPF_RET | unix.BPF_K, K: bpfVerdictReject})
+	c.prog.bind(accept)
+	c.prog.emit(bpf.RawInstruction{Op: unix.BPF_RET | unix.BPF_K, K: bpfVerdictAccept})
+	return c.prog.assemble()
+}
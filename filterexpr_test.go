@@ -0,0 +1,353 @@
+package conntrack
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+
+	"github.com/florianl/go-conntrack/internal/unix"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+// eventMessage returns c as netlink message of a new conntrack entry.
+func eventMessage(tb testing.TB, c Con) []byte {
+	msg, err := EventMessage(IPv4, c)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return msg
+}
+
+// appendAttributes appends the attributes, that are encoded by fn, to the
+// event.
+func appendAttributes(tb testing.TB, event []byte, fn func(ae *netlink.AttributeEncoder)) []byte {
+	ae := netlink.NewAttributeEncoder()
+	fn(ae)
+	data, err := ae.Encode()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	event = append(append([]byte{}, event...), data...)
+	nlenc.PutUint32(event[0:4], uint32(len(event)))
+	return event
+}
+
+// withCounter appends the byte counter of the original direction to the event,
+// as Con can not be marshalled with counters.
+func withCounter(tb testing.TB, event []byte, bytes uint64) []byte {
+	return appendAttributes(tb, event, func(ae *netlink.AttributeEncoder) {
+		ae.Nested(ctaCountersOrig, func(nae *netlink.AttributeEncoder) error {
+			nae.ByteOrder = binary.BigEndian
+			nae.Uint64(ctaCounterBytes, bytes)
+			return nil
+		})
+	})
+}
+
+func be16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func be128(v uint32) []byte {
+	return append(make([]byte, 12), be32(v)...)
+}
+
+func be32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func TestFilterExpr(t *testing.T) {
+	event := func(port uint16, mark uint32, zone uint16) []byte {
+		c := testCon(40000)
+		*c.Origin.Proto.DstPort = port
+		c.Mark = &mark
+		c.Zone = &zone
+		return eventMessage(t, c)
+	}
+	// (orig dst port 80 OR 443) AND NOT mark 0x1 OR zone 7
+	expr := Or(
+		And(
+			Or(ConnAttr{Type: AttrOrigPortDst, Data: be16(80)}, ConnAttr{Type: AttrOrigPortDst, Data: be16(443)}),
+			Not(ConnAttr{Type: AttrMark, Data: be32(1)}),
+		),
+		ConnAttr{Type: AttrZone, Data: be16(7)},
+	)
+
+	tests := []struct {
+		name  string
+		event []byte
+		want  uint32
+	}{
+		{name: "port 80", event: event(80, 0, 0), want: bpfVerdictAccept},
+		{name: "port 443", event: event(443, 2, 0), want: bpfVerdictAccept},
+		{name: "port 22", event: event(22, 0, 0), want: bpfVerdictReject},
+		{name: "marked", event: event(80, 1, 0), want: bpfVerdictReject},
+		{name: "zone 7", event: event(22, 1, 7), want: bpfVerdictAccept},
+	}
+	raw, err := compileFilterExpr(Conntrack, expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := runFilter(raw, tc.event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Fatalf("unexpected verdict %#x, filter:\n%s", got, fmtRawInstructions(raw))
+			}
+		})
+	}
+
+	// a missing attribute matches a negated attribute
+	c := testCon(40000)
+	c.Mark = nil
+	raw, err = compileFilterExpr(Conntrack, ConnAttr{Type: AttrMark, Data: be32(1), Negate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := runFilter(raw, eventMessage(t, c)); got != bpfVerdictAccept {
+		t.Fatalf("unexpected verdict for missing attribute: %#x", got)
+	}
+
+	for name, expr := range map[string]FilterExpr{
+		"length":          ConnAttr{Type: AttrOrigPortDst, Data: []byte{80}},
+		"not implemented": And(ConnAttr{Type: AttrOrigNatSeqCorrectionPos, Data: be32(1)}),
+	} {
+		if _, err := compileFilterExpr(Conntrack, expr); err == nil {
+			t.Fatalf("missing error for %s", name)
+		}
+	}
+}
+
+func TestFilterExprFarJumps(t *testing.T) {
+	// many alternatives exceed the range of conditional jumps
+	var ports []FilterExpr
+	for port := uint16(1); port <= 200; port++ {
+		ports = append(ports, ConnAttr{Type: AttrOrigPortDst, Data: be16(port)})
+	}
+	expr := And(Or(ports...), Not(ConnAttr{Type: AttrMark, Data: be32(1)}))
+	raw, err := compileFilterExpr(Conntrack, expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) < 256 {
+		t.Fatalf("filter is too short to test far jumps: %d", len(raw))
+	}
+	for _, port := range []uint16{1, 100, 200, 201} {
+		c := testCon(40000)
+		*c.Origin.Proto.DstPort = port
+		mark := uint32(0)
+		c.Mark = &mark
+		want := uint32(bpfVerdictAccept)
+		if port > 200 {
+			want = bpfVerdictReject
+		}
+		if got, err := runFilter(raw, eventMessage(t, c)); err != nil || got != want {
+			t.Fatalf("unexpected verdict for port %d: %#x (%v)", port, got, err)
+		}
+		mark = 1
+		if got, err := runFilter(raw, eventMessage(t, c)); err != nil || got != bpfVerdictReject {
+			t.Fatalf("unexpected verdict for marked port %d: %#x (%v)", port, got, err)
+		}
+	}
+}
+
+func TestFilterExprCompare(t *testing.T) {
+	event := func(port uint16, timeout uint32, bytes uint64) []byte {
+		c := testCon(40000)
+		*c.Origin.Proto.DstPort = port
+		c.Timeout = &timeout
+		return withCounter(t, eventMessage(t, c), bytes)
+	}
+	gb := uint64(1) << 30
+
+	tests := []struct {
+		name  string
+		expr  FilterExpr
+		event []byte
+		want  uint32
+	}{
+		{name: "ephemeral port", expr: AttrRange{Type: AttrOrigPortDst, Min: 32768, Max: 60999},
+			event: event(40000, 0, 0), want: bpfVerdictAccept},
+		{name: "lower bound", expr: AttrRange{Type: AttrOrigPortDst, Min: 32768, Max: 60999},
+			event: event(32768, 0, 0), want: bpfVerdictAccept},
+		{name: "upper bound", expr: AttrRange{Type: AttrOrigPortDst, Min: 32768, Max: 60999},
+			event: event(60999, 0, 0), want: bpfVerdictAccept},
+		{name: "below range", expr: AttrRange{Type: AttrOrigPortDst, Min: 32768, Max: 60999},
+			event: event(80, 0, 0), want: bpfVerdictReject},
+		{name: "above range", expr: AttrRange{Type: AttrOrigPortDst, Min: 32768, Max: 60999},
+			event: event(61000, 0, 0), want: bpfVerdictReject},
+		{name: "timeout less", expr: AttrCompare{Type: AttrTimeout, Op: OpLess, Value: 30},
+			event: event(80, 29, 0), want: bpfVerdictAccept},
+		{name: "timeout not less", expr: AttrCompare{Type: AttrTimeout, Op: OpLess, Value: 30},
+			event: event(80, 30, 0), want: bpfVerdictReject},
+		{name: "timeout less equal", expr: AttrCompare{Type: AttrTimeout, Op: OpLessEqual, Value: 30},
+			event: event(80, 30, 0), want: bpfVerdictAccept},
+		{name: "port greater", expr: AttrCompare{Type: AttrOrigPortDst, Op: OpGreater, Value: 1023},
+			event: event(1024, 0, 0), want: bpfVerdictAccept},
+		{name: "port not greater", expr: AttrCompare{Type: AttrOrigPortDst, Op: OpGreater, Value: 1023},
+			event: event(1023, 0, 0), want: bpfVerdictReject},
+		{name: "port not equal", expr: AttrCompare{Type: AttrOrigPortDst, Op: OpNotEqual, Value: 80},
+			event: event(443, 0, 0), want: bpfVerdictAccept},
+		{name: "port equal", expr: AttrCompare{Type: AttrOrigPortDst, Op: OpEqual, Value: 80},
+			event: event(80, 0, 0), want: bpfVerdictAccept},
+		{name: "passed 1 GB", expr: AttrCompare{Type: AttrOrigCounterBytes, Op: OpGreaterEqual, Value: gb},
+			event: event(80, 0, gb), want: bpfVerdictAccept},
+		{name: "below 1 GB", expr: AttrCompare{Type: AttrOrigCounterBytes, Op: OpGreaterEqual, Value: gb},
+			event: event(80, 0, gb-1), want: bpfVerdictReject},
+		{name: "upper half greater", expr: AttrCompare{Type: AttrOrigCounterBytes, Op: OpGreater, Value: 1<<32 | 5},
+			event: event(80, 0, 2<<32), want: bpfVerdictAccept},
+		{name: "upper half less", expr: AttrCompare{Type: AttrOrigCounterBytes, Op: OpGreater, Value: 2<<32 | 5},
+			event: event(80, 0, 1<<32|7), want: bpfVerdictReject},
+		{name: "lower half", expr: AttrCompare{Type: AttrOrigCounterBytes, Op: OpLess, Value: 1<<32 | 5},
+			event: event(80, 0, 1<<32|4), want: bpfVerdictAccept},
+		{name: "counter equal", expr: AttrCompare{Type: AttrOrigCounterBytes, Op: OpEqual, Value: 1<<32 | 5},
+			event: event(80, 0, 1<<32|5), want: bpfVerdictAccept},
+		{name: "counter range", expr: AttrRange{Type: AttrOrigCounterBytes, Min: gb, Max: 4 * gb},
+			event: event(80, 0, 5*gb), want: bpfVerdictReject},
+		{name: "missing counter", expr: AttrCompare{Type: AttrReplCounterBytes, Op: OpLess, Value: gb},
+			event: event(80, 0, 0), want: bpfVerdictReject},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			raw, err := compileFilterExpr(Conntrack, tc.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := runFilter(raw, tc.event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Fatalf("unexpected verdict %#x, filter:\n%s", got, fmtRawInstructions(raw))
+			}
+		})
+	}
+
+	for name, expr := range map[string]FilterExpr{
+		"address":         AttrCompare{Type: AttrOrigIPv6Src, Op: OpGreater, Value: 1},
+		"value too large": AttrRange{Type: AttrOrigPortDst, Min: 1, Max: 1 << 16},
+		"operator":        AttrCompare{Type: AttrTimeout, Op: CompareOp(42)},
+		"not implemented": AttrCompare{Type: AttrOrigNatSeqOffsetBefore, Op: OpLess, Value: 1},
+		"string":          AttrCompare{Type: AttrHelperName, Op: OpLess, Value: 1},
+	} {
+		if _, err := compileFilterExpr(Conntrack, expr); err == nil {
+			t.Fatalf("missing error for %s", name)
+		}
+	}
+}
+
+func TestFilterExprAttributes(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	nat := func(status Status) []byte {
+		c := testCon(40000)
+		bits := uint32(status)
+		c.Status = &bits
+		return eventMessage(t, c)
+	}
+	labels := make([]byte, 16)
+	labels[0], labels[12] = 0x02, 0x10
+	labeled := testCon(40000)
+	labeled.Label = &labels
+
+	masterIP, masterPort, proto := net.ParseIP("192.0.2.7"), uint16(21), uint8(6)
+	master, err := marshalIPTuple(logger, &IPTuple{Src: &masterIP, Dst: &masterIP,
+		Proto: &ProtoTuple{Number: &proto, SrcPort: &masterPort, DstPort: &masterPort}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	related := appendAttributes(t, eventMessage(t, testCon(40000)), func(ae *netlink.AttributeEncoder) {
+		ae.Bytes(ctaTupleMaster|nlafNested, master)
+		ae.Nested(ctaSecCtx, func(nae *netlink.AttributeEncoder) error {
+			nae.String(ctaSecCtxName, "system_u:object_r:unlabeled_t:s0")
+			return nil
+		})
+	})
+
+	tests := []struct {
+		name  string
+		attr  ConnAttr
+		event []byte
+		want  uint32
+	}{
+		{name: "snat", attr: ConnAttr{Type: AttrSNatIPv4, Data: []byte{192, 0, 2, 1}},
+			event: nat(StatusSrcNat), want: bpfVerdictAccept},
+		{name: "without snat", attr: ConnAttr{Type: AttrSNatIPv4, Data: []byte{192, 0, 2, 1}},
+			event: nat(StatusDstNat), want: bpfVerdictReject},
+		{name: "dnat", attr: ConnAttr{Type: AttrDNatIPv4, Data: []byte{10, 0, 0, 0}, Mask: []byte{255, 0, 0, 0}},
+			event: nat(StatusDstNat), want: bpfVerdictAccept},
+		{name: "dnat port", attr: ConnAttr{Type: AttrDNatPort, Data: be16(8080)},
+			event: nat(StatusSrcNat | StatusDstNat), want: bpfVerdictAccept},
+		{name: "snat port", attr: ConnAttr{Type: AttrSNatPort, Data: be16(8080)},
+			event: nat(StatusSrcNat | StatusDstNat), want: bpfVerdictReject},
+		{name: "negated without snat", attr: ConnAttr{Type: AttrSNatPort, Data: be16(40000), Negate: true},
+			event: nat(0), want: bpfVerdictAccept},
+		{name: "tcp flags", attr: ConnAttr{Type: AttrTCPFlagsOrig, Data: []byte{0x09}},
+			event: nat(0), want: bpfVerdictAccept},
+		{name: "tcp mask", attr: ConnAttr{Type: AttrTCPMaskOrig, Data: []byte{0x09}},
+			event: nat(0), want: bpfVerdictReject},
+		{name: "helper", attr: ConnAttr{Type: AttrHelperName, Data: []byte("ftp")},
+			event: nat(0), want: bpfVerdictAccept},
+		{name: "helper prefix", attr: ConnAttr{Type: AttrHelperName, Data: []byte("ft")},
+			event: nat(0), want: bpfVerdictReject},
+		{name: "helper longer", attr: ConnAttr{Type: AttrHelperName, Data: []byte("ftp2")},
+			event: nat(0), want: bpfVerdictReject},
+		{name: "secctx", attr: ConnAttr{Type: AttrSecCtx, Data: []byte("system_u:object_r:unlabeled_t:s0")},
+			event: related, want: bpfVerdictAccept},
+		{name: "other secctx", attr: ConnAttr{Type: AttrSecCtx, Data: []byte("system_u:object_r:unlabeled_t:s1")},
+			event: related, want: bpfVerdictReject},
+		{name: "label bits", attr: ConnAttr{Type: AttrConnlabels, Data: labels, Mask: labels},
+			event: eventMessage(t, labeled), want: bpfVerdictAccept},
+		{name: "missing label bit", attr: ConnAttr{Type: AttrConnlabels, Data: be128(1), Mask: be128(1)},
+			event: eventMessage(t, labeled), want: bpfVerdictReject},
+		{name: "master", attr: ConnAttr{Type: AttrMasterIPv4Src, Data: []byte{192, 0, 2, 7}},
+			event: related, want: bpfVerdictAccept},
+		{name: "master port", attr: ConnAttr{Type: AttrMasterPortDst, Data: be16(21)},
+			event: related, want: bpfVerdictAccept},
+		{name: "master l4 proto", attr: ConnAttr{Type: AttrMasterL4Proto, Data: []byte{17}},
+			event: related, want: bpfVerdictReject},
+		{name: "master l3 proto", attr: ConnAttr{Type: AttrMasterL3Proto, Data: []byte{unix.AF_INET}},
+			event: related, want: bpfVerdictAccept},
+		{name: "without master", attr: ConnAttr{Type: AttrMasterL3Proto, Data: []byte{unix.AF_INET}},
+			event: nat(0), want: bpfVerdictReject},
+		{name: "l3 proto", attr: ConnAttr{Type: AttrOrigL3Proto, Data: []byte{unix.AF_INET6}},
+			event: nat(0), want: bpfVerdictReject},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			raw, err := compileFilterExpr(Conntrack, tc.attr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := runFilter(raw, tc.event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Fatalf("unexpected verdict %#x, filter:\n%s", got, fmtRawInstructions(raw))
+			}
+
+			// RegisterFiltered requires masks for these attributes.
+			if filterCheck[tc.attr.Type].mask && tc.attr.Mask == nil {
+				return
+			}
+			raw, err = constructFilter(Conntrack, []ConnAttr{tc.attr})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := runFilter(raw, tc.event); err != nil || got != tc.want {
+				t.Fatalf("unexpected verdict of RegisterFiltered %#x (%v), filter:\n%s", got, err, fmtRawInstructions(raw))
+			}
+		})
+	}
+}
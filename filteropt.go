@@ -0,0 +1,391 @@
+package conntrack
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/florianl/go-conntrack/internal/unix"
+	"golang.org/x/net/bpf"
+)
+
+// BPF_MEMWORDS
+const bpfMemWords = 16
+
+// setAttr returns expr as attribute, if it is a comparison of an attribute,
+// that is possibly negated.
+func setAttr(expr FilterExpr) (ConnAttr, bool) {
+	switch e := expr.(type) {
+	case ConnAttr:
+		return e, true
+	case filterNode:
+		return termAttr(e)
+	}
+	return ConnAttr{}, false
+}
+
+// setAttrs returns the attributes of the same type, that exprs start with and
+// of which Negate equals negate.
+func setAttrs(exprs []FilterExpr, negate bool) []ConnAttr {
+	var attrs []ConnAttr
+	for _, expr := range exprs {
+		a, ok := setAttr(expr)
+		if !ok || a.Negate != negate || (len(attrs) > 0 && a.Type != attrs[0].Type) {
+			break
+		}
+		attrs = append(attrs, a)
+	}
+	return attrs
+}
+
+// compileSet emits instructions, that look up the attribute of attrs once.
+// They jump to t, if its value equals any of attrs, to missing, if it does not
+// exist, and to f otherwise. Negate of attrs is ignored.
+func (c *filterCompiler) compileSet(attrs []ConnAttr, t, f, missing bpfLabel) error {
+	var check filterCheckStruct
+	for _, a := range attrs {
+		var err error
+		if check, err = c.check(a); err != nil {
+			return err
+		}
+	}
+	c.loadAttr(check, missing)
+	if check.str || check.len > 4 {
+		for i, a := range attrs {
+			next := f
+			if i < len(attrs)-1 {
+				next = c.prog.newLabel()
+			}
+			c.compareValue(check, a, t, next)
+			if next != f {
+				c.prog.bind(next)
+			}
+		}
+		return nil
+	}
+
+	// values are grouped by their mask and searched within each group
+	full := uint32(1)<<(8*uint(check.len)) - 1
+	var masks []uint32
+	values := make(map[uint32][]uint32)
+	for _, a := range attrs {
+		mask := full
+		if a.Mask != nil {
+			mask = wordValue(a.Mask, 0)
+		}
+		if _, ok := values[mask]; !ok {
+			masks = append(masks, mask)
+		}
+		values[mask] = append(values[mask], wordValue(a.Data, 0)&mask)
+	}
+	for i, mask := range masks {
+		next := f
+		if i < len(masks)-1 {
+			next = c.prog.newLabel()
+		}
+		c.loadValue(check, 0)
+		if mask != full {
+			c.prog.emit(bpf.RawInstruction{Op: unix.BPF_ALU | unix.BPF_AND | unix.BPF_K, K: mask})
+		}
+		c.searchValues(sortValues(values[mask]), t, next)
+		if next != f {
+			c.prog.bind(next)
+		}
+	}
+	return nil
+}
+
+// sortValues returns the distinct values of vals in ascending order.
+func sortValues(vals []uint32) []uint32 {
+	sorted := append([]uint32{}, vals...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	n := 0
+	for i, v := range sorted {
+		if i == 0 || v != sorted[n-1] {
+			sorted[n] = v
+			n++
+		}
+	}
+	return sorted[:n]
+}
+
+// searchValues emits a binary search of A within vals, that are sorted. It
+// jumps to t, if A is found, and to f otherwise.
+func (c *filterCompiler) searchValues(vals []uint32, t, f bpfLabel) {
+	for len(vals) > 3 {
+		mid := len(vals) / 2
+		cmp, lower, higher := c.prog.newLabel(), c.prog.newLabel(), c.prog.newLabel()
+		c.prog.jump(unix.BPF_JEQ, vals[mid], t, cmp)
+		c.prog.bind(cmp)
+		c.prog.jump(unix.BPF_JGT, vals[mid], higher, lower)
+		c.prog.bind(lower)
+		c.searchValues(vals[:mid], t, f)
+		c.prog.bind(higher)
+		vals = vals[mid+1:]
+	}
+	for i, v := range vals {
+		next := f
+		if i < len(vals)-1 {
+			next = c.prog.newLabel()
+		}
+		c.prog.jump(unix.BPF_JEQ, v, t, next)
+		if next != f {
+			c.prog.bind(next)
+		}
+	}
+}
+
+// nestLookup is a nest, that attributes of a program are looked up in.
+type nestLookup struct {
+	path  []uint32
+	count int
+	slot  uint32
+}
+
+func nestKey(path []uint32) string {
+	return fmt.Sprint(path)
+}
+
+// countNest counts a lookup of the nest at path, while lookups are counted.
+func (c *filterCompiler) countNest(path []uint32) {
+	if c.nests == nil || len(path) == 0 {
+		return
+	}
+	key := nestKey(path)
+	n, ok := c.nests[key]
+	if !ok {
+		n = &nestLookup{path: path}
+		c.nests[key] = n
+	}
+	n.count++
+}
+
+// sharedNests returns the nests, that are looked up more than once, and
+// assigns a word of scratch memory to each of them.
+func sharedNests(nests map[string]*nestLookup) []*nestLookup {
+	var shared []*nestLookup
+	for _, n := range nests {
+		if n.count > 1 {
+			shared = append(shared, n)
+		}
+	}
+	sort.Slice(shared, func(i, j int) bool {
+		if shared[i].count != shared[j].count {
+			return shared[i].count > shared[j].count
+		}
+		return nestKey(shared[i].path) < nestKey(shared[j].path)
+	})
+	if len(shared) > bpfMemWords {
+		shared = shared[:bpfMemWords]
+	}
+	for i, n := range shared {
+		n.slot = uint32(i)
+	}
+	return shared
+}
+
+// storeNest emits instructions, that store the offset of the nest at path in
+// the scratch memory slot, or 0 if it does not exist.
+func (c *filterCompiler) storeNest(path []uint32, slot uint32) {
+	store := c.prog.newLabel()
+	c.prog.emit(bpf.RawInstruction{Op: unix.BPF_LD | unix.BPF_IMM, K: bpfAttrOffset})
+	anc := uint32(bpfAncNLAttr)
+	for i, typ := range path {
+		c.prog.emit(
+			bpf.RawInstruction{Op: unix.BPF_LDX | unix.BPF_IMM, K: typ},
+			bpf.RawInstruction{Op: unix.BPF_LD | unix.BPF_B | unix.BPF_ABS, K: anc},
+		)
+		if i < len(path)-1 {
+			// A is 0, if the nest does not exist
+			next := c.prog.newLabel()
+			c.prog.jump(unix.BPF_JEQ, 0, store, next)
+			c.prog.bind(next)
+		}
+		anc = bpfAncNLAttrNest
+	}
+	c.prog.bind(store)
+	c.prog.emit(bpf.RawInstruction{Op: unix.BPF_ST, K: slot})
+}
+
+// eventFilter is a filter for events. The kernel applies kernel. If exact is
+// set, events, that pass kernel, are matched exactly by exact in userspace.
+type eventFilter struct {
+	kernel, exact []bpf.RawInstruction
+}
+
+// match reports whether the event msg passes the filter in userspace.
+func (ef eventFilter) match(msg []byte) bool {
+	if ef.exact == nil {
+		return true
+	}
+	verdict, err := runFilter(ef.exact, msg)
+	return err == nil && verdict != bpfVerdictReject
+}
+
+// matchDumped reports whether msg passes the filter in the kernel and in
+// userspace. It is used for entries of a dump, that the kernel does not
+// filter like events.
+func (ef eventFilter) matchDumped(msg []byte) bool {
+	if ef.kernel != nil {
+		verdict, err := runFilter(ef.kernel, msg)
+		if err != nil || verdict == bpfVerdictReject {
+			return false
+		}
+	}
+	return ef.match(msg)
+}
+
+// buildEventFilter returns the filter for events of subsys, that match expr.
+// If the program for expr exceeds the limit of the kernel, the kernel applies
+// a program for a relaxed expression, that accepts at least all matching
+// events.
+func buildEventFilter(subsys Table, expr FilterExpr) (eventFilter, error) {
+	raw, err := compileProgram(subsys, expr)
+	if err != nil {
+		return eventFilter{}, err
+	}
+	if len(raw) < bpfMAXINSTR {
+		return eventFilter{kernel: raw}, nil
+	}
+	for _, limit := range []int{64, 16, 4, 1, 0} {
+		kernel, err := compileProgram(subsys, relaxExpr(expr, limit, true))
+		if err != nil {
+			return eventFilter{}, err
+		}
+		if len(kernel) < bpfMAXINSTR {
+			return eventFilter{kernel: kernel, exact: raw}, nil
+		}
+	}
+	return eventFilter{}, ErrFilterLength
+}
+
+// relaxExpr returns expr, of which And and Or with more than limit operands
+// are replaced. If positive is set, the returned expression matches at least
+// the connections, that expr matches, otherwise at most.
+func relaxExpr(expr FilterExpr, limit int, positive bool) FilterExpr {
+	relaxList := func(exprs []FilterExpr, and bool) FilterExpr {
+		if len(exprs) > limit {
+			if positive {
+				return And()
+			}
+			return Or()
+		}
+		relaxed := make([]FilterExpr, len(exprs))
+		for i := range exprs {
+			relaxed[i] = relaxExpr(exprs[i], limit, positive)
+		}
+		if and {
+			return And(relaxed...)
+		}
+		return Or(relaxed...)
+	}
+
+	switch e := expr.(type) {
+	case andExpr:
+		return relaxList(e, true)
+	case orExpr:
+		return relaxList(e, false)
+	case notExpr:
+		return Not(relaxExpr(e.expr, limit, !positive))
+	case *Filter:
+		return relaxExpr(e.root, limit, positive)
+	case *filterList:
+		return relaxList(e.exprs(), e.and)
+	case *filterNot:
+		return Not(relaxExpr(e.node, limit, !positive))
+	}
+	return expr
+}
+
+// addrFamily returns the family of the addresses of typ or 0, if the
+// attribute is no address.
+func addrFamily(typ ConnAttrType) Family {
+	switch typ {
+	case AttrOrigIPv4Src, AttrOrigIPv4Dst, AttrReplIPv4Src, AttrReplIPv4Dst,
+		AttrMasterIPv4Src, AttrMasterIPv4Dst, AttrSNatIPv4, AttrDNatIPv4:
+		return IPv4
+	case AttrOrigIPv6Src, AttrOrigIPv6Dst, AttrReplIPv6Src, AttrReplIPv6Dst,
+		AttrMasterIPv6Src, AttrMasterIPv6Dst, AttrSNatIPv6, AttrDNatIPv6:
+		return IPv6
+	}
+	return 0
+}
+
+// addrCounterparts maps the attributes of IPv4 addresses to the attributes of
+// the same addresses of IPv6 and vice versa.
+var addrCounterparts = map[ConnAttrType]ConnAttrType{
+	AttrOrigIPv4Src: AttrOrigIPv6Src, AttrOrigIPv6Src: AttrOrigIPv4Src,
+	AttrOrigIPv4Dst: AttrOrigIPv6Dst, AttrOrigIPv6Dst: AttrOrigIPv4Dst,
+	AttrReplIPv4Src: AttrReplIPv6Src, AttrReplIPv6Src: AttrReplIPv4Src,
+	AttrReplIPv4Dst: AttrReplIPv6Dst, AttrReplIPv6Dst: AttrReplIPv4Dst,
+	AttrMasterIPv4Src: AttrMasterIPv6Src, AttrMasterIPv6Src: AttrMasterIPv4Src,
+	AttrMasterIPv4Dst: AttrMasterIPv6Dst, AttrMasterIPv6Dst: AttrMasterIPv4Dst,
+	AttrSNatIPv4: AttrSNatIPv6, AttrSNatIPv6: AttrSNatIPv4,
+	AttrDNatIPv4: AttrDNatIPv6, AttrDNatIPv6: AttrDNatIPv4,
+}
+
+// dualStack reports whether filters contain IPv4 and IPv6 addresses.
+func dualStack(filters []ConnAttr) bool {
+	var v4, v6 bool
+	for _, a := range filters {
+		switch addrFamily(a.Type) {
+		case IPv4:
+			v4 = true
+		case IPv6:
+			v6 = true
+		}
+	}
+	return v4 && v6
+}
+
+// attrsExpr returns the expression for filters of RegisterFiltered. If filters
+// contain IPv4 and IPv6 addresses, the addresses of either family are only
+// compared for events of their family.
+func attrsExpr(filters []ConnAttr) (FilterExpr, error) {
+	groups := make(map[ConnAttrType][]FilterExpr)
+	negate := make(map[ConnAttrType]bool)
+	var types []ConnAttrType
+	for _, a := range filters {
+		if _, ok := groups[a.Type]; !ok {
+			types = append(types, a.Type)
+			negate[a.Type] = a.Negate
+		} else if negate[a.Type] != a.Negate {
+			return nil, ErrFilterAttributeNegateMix
+		}
+		groups[a.Type] = append(groups[a.Type], a)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	dual := dualStack(filters)
+	var exprs []FilterExpr
+	v4 := []FilterExpr{familyExpr(IPv4)}
+	v6 := []FilterExpr{familyExpr(IPv6)}
+	for _, typ := range types {
+		group := Or(groups[typ]...)
+		if negate[typ] {
+			group = And(groups[typ]...)
+		}
+		switch family := addrFamily(typ); {
+		case dual && family == IPv4:
+			v4 = append(v4, group)
+		case dual && family == IPv6:
+			v6 = append(v6, group)
+		default:
+			exprs = append(exprs, group)
+		}
+	}
+	if dual {
+		exprs = append(exprs, Or(And(v4...), And(v6...)))
+	}
+	return And(exprs...), nil
+}
+
+// buildAttrsFilter returns the filter for events of subsys, that match filters
+// of RegisterFiltered. The filters are built by the compiler of filter
+// expressions, which needs fewer instructions than constructFilter.
+func buildAttrsFilter(subsys Table, filters []ConnAttr) (eventFilter, error) {
+	expr, err := attrsExpr(filters)
+	if err != nil {
+		return eventFilter{}, err
+	}
+	return buildEventFilter(subsys, expr)
+}
@@ -0,0 +1,265 @@
+package conntrack
+
+import (
+	"net"
+	"testing"
+
+	"github.com/florianl/go-conntrack/internal/unix"
+	"golang.org/x/net/bpf"
+)
+
+func TestFilterSet(t *testing.T) {
+	var ports []FilterExpr
+	for port := uint16(1000); port < 3000; port += 2 {
+		ports = append(ports, ConnAttr{Type: AttrOrigPortDst, Data: be16(port)})
+	}
+	expr := And(
+		Or(ports...),
+		Or(
+			ConnAttr{Type: AttrOrigIPv4Src, Data: []byte{192, 0, 2, 0}, Mask: []byte{255, 255, 255, 0}},
+			ConnAttr{Type: AttrOrigIPv4Src, Data: []byte{10, 0, 0, 0}, Mask: []byte{255, 0, 0, 0}},
+			ConnAttr{Type: AttrOrigIPv4Src, Data: []byte{198, 51, 100, 7}},
+		),
+		Not(ConnAttr{Type: AttrMark, Data: be32(1)}),
+		Not(ConnAttr{Type: AttrMark, Data: be32(2)}),
+	)
+	raw, err := compileFilterExpr(Conntrack, expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the attribute is looked up once for all values
+	if len(raw) > 3*len(ports) {
+		t.Fatalf("filter with %d ports has %d instructions", len(ports), len(raw))
+	}
+
+	tests := []struct {
+		src  string
+		port uint16
+		mark *uint32
+		want uint32
+	}{
+		{src: "192.0.2.1", port: 1000, want: bpfVerdictAccept},
+		{src: "192.0.2.1", port: 2998, want: bpfVerdictAccept},
+		{src: "192.0.2.1", port: 1999, want: bpfVerdictReject},
+		{src: "192.0.2.1", port: 3000, want: bpfVerdictReject},
+		{src: "192.0.2.1", port: 998, want: bpfVerdictReject},
+		{src: "10.1.2.3", port: 2000, want: bpfVerdictAccept},
+		{src: "198.51.100.7", port: 2000, want: bpfVerdictAccept},
+		{src: "198.51.100.8", port: 2000, want: bpfVerdictReject},
+		{src: "192.0.2.1", port: 2000, mark: new(uint32), want: bpfVerdictAccept},
+		{src: "192.0.2.1", port: 2000, mark: func() *uint32 { m := uint32(2); return &m }(), want: bpfVerdictReject},
+	}
+	for _, tc := range tests {
+		c := testCon(40000)
+		src := net.ParseIP(tc.src)
+		c.Origin.Src = &src
+		*c.Origin.Proto.DstPort = tc.port
+		c.Mark = tc.mark
+		if got, err := runFilter(raw, eventMessage(t, c)); err != nil || got != tc.want {
+			t.Fatalf("unexpected verdict for %s:%d: %#x (%v)", tc.src, tc.port, got, err)
+		}
+	}
+}
+
+func TestFilterSharedNests(t *testing.T) {
+	expr := And(
+		ConnAttr{Type: AttrOrigIPv4Src, Data: []byte{192, 0, 2, 1}},
+		ConnAttr{Type: AttrOrigIPv4Dst, Data: []byte{192, 0, 2, 2}},
+		ConnAttr{Type: AttrOrigPortDst, Data: be16(80)},
+	)
+	raw, err := compileFilterExpr(Conntrack, expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := 0
+	for _, r := range raw {
+		if r.Op == unix.BPF_ST {
+			stores++
+		}
+	}
+	if stores != 1 {
+		t.Fatalf("unexpected number of stored nests %d, filter:\n%s", stores, fmtRawInstructions(raw))
+	}
+
+	c := testCon(40000)
+	if got, err := runFilter(raw, eventMessage(t, c)); err != nil || got != bpfVerdictAccept {
+		t.Fatalf("unexpected verdict: %#x (%v)", got, err)
+	}
+	dst := net.ParseIP("192.0.2.3")
+	c.Origin.Dst = &dst
+	if got, err := runFilter(raw, eventMessage(t, c)); err != nil || got != bpfVerdictReject {
+		t.Fatalf("unexpected verdict for other destination: %#x (%v)", got, err)
+	}
+	c.Origin = nil
+	if got, err := runFilter(raw, eventMessage(t, c)); err != nil || got != bpfVerdictReject {
+		t.Fatalf("unexpected verdict without tuple: %#x (%v)", got, err)
+	}
+}
+
+func TestRemoveJumps(t *testing.T) {
+	var p bpfProgram
+	accept, reject, hop, next := p.newLabel(), p.newLabel(), p.newLabel(), p.newLabel()
+	p.emit(bpf.RawInstruction{Op: unix.BPF_LD | unix.BPF_IMM, K: 1})
+	p.jump(unix.BPF_JEQ, 1, hop, reject)
+	p.bind(hop)
+	p.jumpTo(next)
+	p.bind(next)
+	p.jump(unix.BPF_JEQ, 2, accept, accept)
+	p.bind(reject)
+	p.emit(bpf.RawInstruction{Op: unix.BPF_RET | unix.BPF_K, K: bpfVerdictReject})
+	p.bind(accept)
+	p.emit(bpf.RawInstruction{Op: unix.BPF_RET | unix.BPF_K, K: bpfVerdictAccept})
+
+	raw, err := p.assemble()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []bpf.RawInstruction{
+		{Op: unix.BPF_LD | unix.BPF_IMM, K: 1},
+		{Op: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: 1, Jt: 1},
+		{Op: unix.BPF_RET | unix.BPF_K, K: bpfVerdictReject},
+		{Op: unix.BPF_RET | unix.BPF_K, K: bpfVerdictAccept},
+	}
+	if len(raw) != len(want) {
+		t.Fatalf("unexpected filter:\n%s", fmtRawInstructions(raw))
+	}
+	for i := range want {
+		if raw[i] != want[i] {
+			t.Fatalf("unexpected instruction %d:\n%s", i, fmtRawInstructions(raw))
+		}
+	}
+}
+
+func TestEventFilterCoarse(t *testing.T) {
+	addr := func(i int) net.IP {
+		ip := net.ParseIP("2001:db8::")
+		ip[13], ip[14], ip[15] = byte(i>>16), byte(i>>8), byte(i)
+		return ip
+	}
+	full := net.CIDRMask(128, 128)
+	var attrs []ConnAttr
+	for i := 0; i < 1000; i++ {
+		attrs = append(attrs, ConnAttr{Type: AttrOrigIPv6Src, Data: addr(2 * i), Mask: full})
+	}
+	attrs = append(attrs, ConnAttr{Type: AttrOrigPortDst, Data: be16(80)})
+	if _, err := constructFilter(Conntrack, attrs); err != ErrFilterLength {
+		t.Fatalf("filter does not exceed the limit: %v", err)
+	}
+
+	prog, err := CompileFilter(Conntrack, attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !prog.Coarse() || len(prog.Instructions()) >= bpfMAXINSTR {
+		t.Fatalf("unexpected program of %d instructions", len(prog.Instructions()))
+	}
+	for _, tc := range []struct {
+		src  net.IP
+		port uint16
+		want bool
+	}{
+		{src: addr(0), port: 80, want: true},
+		{src: addr(1998), port: 80, want: true},
+		{src: addr(1), port: 80, want: false},
+		{src: addr(2000), port: 80, want: false},
+		{src: addr(2), port: 22, want: false},
+	} {
+		c := testCon(40000)
+		dst := net.ParseIP("2001:db8:1::1")
+		c.Origin.Src, c.Origin.Dst = &tc.src, &dst
+		*c.Origin.Proto.DstPort = tc.port
+		msg, err := EventMessage(IPv6, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := prog.Run(msg)
+		if err != nil || got != tc.want {
+			t.Fatalf("unexpected verdict for %s:%d: %v (%v)", tc.src, tc.port, got, err)
+		}
+		// the coarse program of the kernel checks the port
+		kernel, err := runFilter(prog.Instructions(), msg)
+		if err != nil || (kernel != bpfVerdictReject) != (tc.port == 80) {
+			t.Fatalf("unexpected verdict of the kernel for %s:%d: %#x (%v)", tc.src, tc.port, kernel, err)
+		}
+	}
+
+	// IPv4 addresses are searched and fit into the limit
+	attrs = attrs[:0]
+	for i := 0; i < 1000; i++ {
+		attrs = append(attrs, ConnAttr{Type: AttrOrigIPv4Src, Data: []byte{10, 0, byte(i >> 8), byte(i)}, Mask: full[:4]})
+	}
+	if prog, err = CompileFilter(Conntrack, attrs); err != nil || prog.Coarse() {
+		t.Fatalf("unexpected coarse program: %v", err)
+	}
+	raw, err := constructFilter(Conntrack, attrs)
+	if err != nil || len(prog.Instructions()) >= len(raw) {
+		t.Fatalf("program of %d instructions is not shorter than %d instructions: %v", len(prog.Instructions()), len(raw), err)
+	}
+}
+
+func TestFilterDualStack(t *testing.T) {
+	f, err := ParseFilter("(orig.dst 192.0.2.10 or orig.dst 2001:db8::10) and orig.dport 80 and not orig.src 2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := f.ConnAttrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dualStack(attrs) {
+		t.Fatalf("unexpected attributes: %v", attrs)
+	}
+	prog, err := CompileFilter(Conntrack, attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		family   Family
+		src, dst string
+		port     uint16
+		want     bool
+	}{
+		{family: IPv4, src: "192.0.2.1", dst: "192.0.2.10", port: 80, want: true},
+		{family: IPv4, src: "192.0.2.1", dst: "192.0.2.11", port: 80, want: false},
+		{family: IPv4, src: "192.0.2.1", dst: "192.0.2.10", port: 81, want: false},
+		{family: IPv6, src: "2001:db8::2", dst: "2001:db8::10", port: 80, want: true},
+		{family: IPv6, src: "2001:db8::1", dst: "2001:db8::10", port: 80, want: false},
+		{family: IPv6, src: "2001:db8::2", dst: "2001:db8::11", port: 80, want: false},
+	} {
+		c := testCon(40000)
+		src, dst := net.ParseIP(tc.src), net.ParseIP(tc.dst)
+		c.Origin.Src, c.Origin.Dst = &src, &dst
+		*c.Origin.Proto.DstPort = tc.port
+		msg, err := EventMessage(tc.family, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the filter expression and the attributes match the same events
+		for name, run := range map[string]func() (bool, error){
+			"attributes": func() (bool, error) { return prog.Run(msg) },
+			"expression": func() (bool, error) {
+				raw, err := compileFilterExpr(Conntrack, f)
+				if err != nil {
+					return false, err
+				}
+				verdict, err := runFilter(raw, msg)
+				return verdict != bpfVerdictReject, err
+			},
+		} {
+			if got, err := run(); err != nil || got != tc.want {
+				t.Fatalf("unexpected verdict of %s for %s -> %s:%d: %v (%v)", name, tc.src, tc.dst, tc.port, got, err)
+			}
+		}
+	}
+
+	// addresses of one family have to match in events of the other family
+	// as well, which RegisterFiltered does not support
+	f, err = ParseFilter("(orig.dst 192.0.2.10 or orig.dst 2001:db8::10) and orig.src 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.ConnAttrs(); err != ErrFilterNotAttributes {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
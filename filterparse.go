@@ -0,0 +1,772 @@
+package conntrack
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ErrFilterNotAttributes is returned, if a Filter can not be expressed by
+// attributes for RegisterFiltered.
+var ErrFilterNotAttributes = errors.New("filter can not be expressed by attributes")
+
+// FilterSyntaxError describes an error in the text of a filter.
+type FilterSyntaxError struct {
+	// Offset is the byte offset of the unexpected token within the filter.
+	Offset int
+	// Expected describes, what was expected at Offset.
+	Expected string
+	// Found is the token, that was found instead.
+	Found string
+}
+
+func (e *FilterSyntaxError) Error() string {
+	return fmt.Sprintf("filter: offset %d: expected %s, found %s", e.Offset, e.Expected, e.Found)
+}
+
+// Filter is a filter expression, that is parsed from text by ParseFilter.
+// It is a FilterExpr and can be used with RegisterFilterExpr.
+type Filter struct {
+	root filterNode
+}
+
+// ParseFilter parses a filter expression like
+//
+//	orig.src in 10.0.0.0/8 and l4proto tcp and orig.dport in 8000-8100 and not mark & 0xff == 1
+//
+// Terms are combined with "and", "or", "not" and parentheses, where "not"
+// binds stronger than "and" and "and" binds stronger than "or". A term
+// compares a field with a value:
+//
+//	orig.src, orig.dst, reply.src, reply.dst, master.src, master.dst, snat.ip, dnat.ip
+//		IPv4 or IPv6 addresses, compared with ==, != or in a CIDR
+//	orig.sport, orig.dport, reply.sport, reply.dport, master.sport, master.dport,
+//	snat.port, dnat.port, icmp.type, icmp.code, icmp.id, zone, mark, timeout,
+//	use, id, secmark, orig.packets, orig.bytes, reply.packets, reply.bytes,
+//	exp.id, exp.flags, exp.class
+//		numbers, compared with ==, !=, <, <=, >, >= or in a range like 1-1023
+//	l4proto, family, tcp.state
+//		numbers or names like tcp, ipv6 or established
+//	helper, secctx
+//		names, compared with == or !=
+//	status
+//		names of status bits like assured|seen_reply, that have to be set.
+//		With "status any", one of the bits has to be set.
+//
+// The operator can be omitted for equality. Addresses are masked with CIDR
+// notation like orig.src in 10.0.0.0/8, while mark and exp.flags can be masked
+// like mark & 0xff == 1. The returned error is a *FilterSyntaxError, if s is
+// not a valid filter.
+//
+// Filters for the Expected table refer to the tuple of the expected
+// connection with orig and to its master with master.
+func ParseFilter(s string) (*Filter, error) {
+	toks, err := lexFilter(s)
+	if err != nil {
+		return nil, err
+	}
+	p := filterParser{toks: toks}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, p.unexpected(tok, `"and", "or" or end of filter`)
+	}
+	return &Filter{root: root}, nil
+}
+
+// String returns the filter in a normalized form, that is parsed to the same
+// filter by ParseFilter.
+func (f *Filter) String() string {
+	var b strings.Builder
+	f.root.format(&b, precOr)
+	return b.String()
+}
+
+func (f *Filter) compile(c *filterCompiler, t, fl bpfLabel) error {
+	return f.root.compile(c, t, fl)
+}
+
+// ConnAttrs returns the filter as attributes for RegisterFiltered. This is
+// only possible for filters, that combine comparisons with "and", while
+// comparisons of the same field may be combined with "or". Ranges, less and
+// greater comparisons and status bits are not supported. IPv4 and IPv6
+// addresses of a field, like orig.dst, may be combined with "or", as long as
+// all addresses are compared like this.
+func (f *Filter) ConnAttrs() ([]ConnAttr, error) {
+	conjuncts := []filterNode{f.root}
+	if l, ok := f.root.(*filterList); ok && l.and {
+		conjuncts = l.nodes
+	}
+
+	// whether the attributes of a type are negated
+	negated := make(map[ConnAttrType]bool)
+	// whether addresses of one family only have to match
+	single := false
+	var attrs []ConnAttr
+	for _, node := range conjuncts {
+		var alternatives []ConnAttr
+		switch n := node.(type) {
+		case *filterList:
+			if n.and {
+				return nil, ErrFilterNotAttributes
+			}
+			for _, alt := range n.nodes {
+				attr, ok := termAttr(alt)
+				if !ok || attr.Negate {
+					return nil, ErrFilterNotAttributes
+				}
+				if len(alternatives) > 0 && attr.Type != alternatives[0].Type &&
+					attr.Type != addrCounterparts[alternatives[0].Type] {
+					return nil, ErrFilterNotAttributes
+				}
+				alternatives = append(alternatives, attr)
+			}
+		default:
+			attr, ok := termAttr(n)
+			if !ok {
+				return nil, ErrFilterNotAttributes
+			}
+			alternatives = append(alternatives, attr)
+		}
+
+		// Attributes of the same type are linked by OR, while negated
+		// attributes of the same type all have to match.
+		negate := alternatives[0].Negate
+		types := make(map[ConnAttrType]bool)
+		for _, attr := range alternatives {
+			types[attr.Type] = true
+		}
+		for typ := range types {
+			if n, ok := negated[typ]; ok && (!negate || !n) {
+				return nil, ErrFilterNotAttributes
+			}
+			negated[typ] = negate
+			if !negate && addrFamily(typ) != 0 && !types[addrCounterparts[typ]] {
+				single = true
+			}
+		}
+		for _, attr := range alternatives {
+			if check := filterCheck[attr.Type]; check.mask && attr.Mask == nil {
+				attr.Mask = make([]byte, check.len)
+				for i := range attr.Mask {
+					attr.Mask[i] = 0xff
+				}
+			}
+			attrs = append(attrs, attr)
+		}
+	}
+	// For RegisterFiltered, addresses of one family do not have to match
+	// for events of the other family.
+	if single && dualStack(attrs) {
+		return nil, ErrFilterNotAttributes
+	}
+	return attrs, nil
+}
+
+// termAttr returns the attribute of a comparison, that is possibly negated.
+func termAttr(node filterNode) (ConnAttr, bool) {
+	negate := false
+	for {
+		n, ok := node.(*filterNot)
+		if !ok {
+			break
+		}
+		negate = !negate
+		node = n.node
+	}
+	term, ok := node.(*filterTerm)
+	if !ok {
+		return ConnAttr{}, false
+	}
+	attr, ok := term.expr.(ConnAttr)
+	if !ok {
+		return ConnAttr{}, false
+	}
+	attr.Negate = attr.Negate != negate
+	return attr, true
+}
+
+// precedence of the operators
+const (
+	precOr = iota
+	precAnd
+	precNot
+)
+
+// filterNode is a node of a parsed Filter.
+type filterNode interface {
+	FilterExpr
+	format(b *strings.Builder, prec int)
+}
+
+// filterList combines nodes with "and" or "or".
+type filterList struct {
+	and   bool
+	nodes []filterNode
+}
+
+func (l *filterList) exprs() []FilterExpr {
+	exprs := make([]FilterExpr, len(l.nodes))
+	for i, n := range l.nodes {
+		exprs[i] = n
+	}
+	return exprs
+}
+
+func (l *filterList) compile(c *filterCompiler, t, f bpfLabel) error {
+	if l.and {
+		return And(l.exprs()...).compile(c, t, f)
+	}
+	return Or(l.exprs()...).compile(c, t, f)
+}
+
+func (l *filterList) format(b *strings.Builder, prec int) {
+	op, own := " or ", precOr
+	if l.and {
+		op, own = " and ", precAnd
+	}
+	if prec > own {
+		b.WriteString("(")
+	}
+	for i, n := range l.nodes {
+		if i > 0 {
+			b.WriteString(op)
+		}
+		n.format(b, own+1)
+	}
+	if prec > own {
+		b.WriteString(")")
+	}
+}
+
+type filterNot struct {
+	node filterNode
+}
+
+func (n *filterNot) compile(c *filterCompiler, t, f bpfLabel) error {
+	return n.node.compile(c, f, t)
+}
+
+func (n *filterNot) format(b *strings.Builder, prec int) {
+	b.WriteString("not ")
+	n.node.format(b, precNot)
+}
+
+// filterTerm is a comparison of a field with a value.
+type filterTerm struct {
+	text string
+	expr FilterExpr
+}
+
+func (term *filterTerm) compile(c *filterCompiler, t, f bpfLabel) error {
+	return term.expr.compile(c, t, f)
+}
+
+func (term *filterTerm) format(b *strings.Builder, prec int) {
+	b.WriteString(term.text)
+}
+
+type filterFieldKind int
+
+const (
+	fieldAddr filterFieldKind = iota
+	fieldNumber
+	fieldString
+	fieldStatus
+)
+
+type filterField struct {
+	kind filterFieldKind
+	// attribute of numbers and strings
+	attr ConnAttrType
+	// attributes of addresses
+	v4, v6 ConnAttrType
+	// names of values
+	names map[string]uint64
+}
+
+// protoValues returns the protocol numbers by their names.
+func protoValues() map[string]uint64 {
+	m := make(map[string]uint64, len(protoNames))
+	for proto, name := range protoNames {
+		m[name] = uint64(proto)
+	}
+	return m
+}
+
+var familyNames = map[string]uint64{
+	"ipv4": uint64(IPv4), "ipv6": uint64(IPv6),
+}
+
+var filterFields = map[string]filterField{
+	"orig.src":      {kind: fieldAddr, v4: AttrOrigIPv4Src, v6: AttrOrigIPv6Src},
+	"orig.dst":      {kind: fieldAddr, v4: AttrOrigIPv4Dst, v6: AttrOrigIPv6Dst},
+	"reply.src":     {kind: fieldAddr, v4: AttrReplIPv4Src, v6: AttrReplIPv6Src},
+	"reply.dst":     {kind: fieldAddr, v4: AttrReplIPv4Dst, v6: AttrReplIPv6Dst},
+	"master.src":    {kind: fieldAddr, v4: AttrMasterIPv4Src, v6: AttrMasterIPv6Src},
+	"master.dst":    {kind: fieldAddr, v4: AttrMasterIPv4Dst, v6: AttrMasterIPv6Dst},
+	"snat.ip":       {kind: fieldAddr, v4: AttrSNatIPv4, v6: AttrSNatIPv6},
+	"dnat.ip":       {kind: fieldAddr, v4: AttrDNatIPv4, v6: AttrDNatIPv6},
+	"orig.sport":    {kind: fieldNumber, attr: AttrOrigPortSrc},
+	"orig.dport":    {kind: fieldNumber, attr: AttrOrigPortDst},
+	"reply.sport":   {kind: fieldNumber, attr: AttrReplPortSrc},
+	"reply.dport":   {kind: fieldNumber, attr: AttrReplPortDst},
+	"master.sport":  {kind: fieldNumber, attr: AttrMasterPortSrc},
+	"master.dport":  {kind: fieldNumber, attr: AttrMasterPortDst},
+	"snat.port":     {kind: fieldNumber, attr: AttrSNatPort},
+	"dnat.port":     {kind: fieldNumber, attr: AttrDNatPort},
+	"icmp.type":     {kind: fieldNumber, attr: AttrIcmpType},
+	"icmp.code":     {kind: fieldNumber, attr: AttrIcmpCode},
+	"icmp.id":       {kind: fieldNumber, attr: AttrIcmpID},
+	"l4proto":       {kind: fieldNumber, attr: AttrOrigL4Proto, names: protoValues()},
+	"family":        {kind: fieldNumber, attr: AttrOrigL3Proto, names: familyNames},
+	"tcp.state":     {kind: fieldNumber, attr: AttrTCPState, names: lowerNames(tcpStateNames)},
+	"zone":          {kind: fieldNumber, attr: AttrZone},
+	"mark":          {kind: fieldNumber, attr: AttrMark},
+	"timeout":       {kind: fieldNumber, attr: AttrTimeout},
+	"use":           {kind: fieldNumber, attr: AttrUse},
+	"id":            {kind: fieldNumber, attr: AttrID},
+	"secmark":       {kind: fieldNumber, attr: AttrSecmark},
+	"orig.packets":  {kind: fieldNumber, attr: AttrOrigCounterPackets},
+	"orig.bytes":    {kind: fieldNumber, attr: AttrOrigCounterBytes},
+	"reply.packets": {kind: fieldNumber, attr: AttrReplCounterPackets},
+	"reply.bytes":   {kind: fieldNumber, attr: AttrReplCounterBytes},
+	"exp.id":        {kind: fieldNumber, attr: AttrExpID},
+	"exp.flags":     {kind: fieldNumber, attr: AttrExpFlags},
+	"exp.class":     {kind: fieldNumber, attr: AttrExpClass},
+	"helper":        {kind: fieldString, attr: AttrHelperName},
+	"secctx":        {kind: fieldString, attr: AttrSecCtx},
+	"status":        {kind: fieldStatus},
+}
+
+func lowerNames(names []string) map[string]uint64 {
+	m := make(map[string]uint64, len(names))
+	for i, name := range names {
+		m[strings.ToLower(name)] = uint64(i)
+	}
+	return m
+}
+
+// name returns the name of v or its decimal representation.
+func (field filterField) name(v uint64) string {
+	for name, value := range field.names {
+		if value == v {
+			return name
+		}
+	}
+	return strconv.FormatUint(v, 10)
+}
+
+type filterTokenKind int
+
+const (
+	tokEOF filterTokenKind = iota
+	tokWord
+	tokString
+	tokSymbol
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	text string
+	pos  int
+}
+
+func (tok filterToken) String() string {
+	if tok.kind == tokEOF {
+		return "end of filter"
+	}
+	if tok.kind == tokString {
+		return tok.text
+	}
+	return strconv.Quote(tok.text)
+}
+
+// is reports whether tok is one of the words or symbols.
+func (tok filterToken) is(texts ...string) bool {
+	if tok.kind != tokWord && tok.kind != tokSymbol {
+		return false
+	}
+	for _, text := range texts {
+		if tok.text == text {
+			return true
+		}
+	}
+	return false
+}
+
+var filterSymbols = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "&", "|", "!", "(", ")"}
+
+func isWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '.' || c == ':' || c == '/' || c == '-'
+}
+
+func lexFilter(s string) ([]filterToken, error) {
+	var toks []filterToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isWordByte(c):
+			start := i
+			for i < len(s) && isWordByte(s[i]) {
+				i++
+			}
+			toks = append(toks, filterToken{kind: tokWord, text: s[start:i], pos: start})
+		case c == '"':
+			start := i
+			for i++; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(s) {
+				return nil, &FilterSyntaxError{Offset: len(s), Expected: `closing "`, Found: "end of filter"}
+			}
+			i++
+			toks = append(toks, filterToken{kind: tokString, text: s[start:i], pos: start})
+		default:
+			var sym string
+			for _, candidate := range filterSymbols {
+				if strings.HasPrefix(s[i:], candidate) {
+					sym = candidate
+					break
+				}
+			}
+			if sym == "" {
+				return nil, &FilterSyntaxError{Offset: i, Expected: "field, value or operator", Found: strconv.Quote(s[i : i+1])}
+			}
+			toks = append(toks, filterToken{kind: tokSymbol, text: sym, pos: i})
+			i += len(sym)
+		}
+	}
+	return append(toks, filterToken{kind: tokEOF, pos: len(s)}), nil
+}
+
+type filterParser struct {
+	toks []filterToken
+	i    int
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.toks[p.i]
+}
+
+func (p *filterParser) next() filterToken {
+	tok := p.toks[p.i]
+	if tok.kind != tokEOF {
+		p.i++
+	}
+	return tok
+}
+
+func (p *filterParser) unexpected(tok filterToken, expected string) error {
+	return &FilterSyntaxError{Offset: tok.pos, Expected: expected, Found: tok.String()}
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	return p.parseList(false, p.parseAnd, "or", "||")
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	return p.parseList(true, p.parseNot, "and", "&&")
+}
+
+func (p *filterParser) parseList(and bool, parse func() (filterNode, error), ops ...string) (filterNode, error) {
+	node, err := parse()
+	if err != nil {
+		return nil, err
+	}
+	if !p.peek().is(ops...) {
+		return node, nil
+	}
+	list := &filterList{and: and, nodes: []filterNode{node}}
+	for p.peek().is(ops...) {
+		p.next()
+		node, err := parse()
+		if err != nil {
+			return nil, err
+		}
+		list.nodes = append(list.nodes, node)
+	}
+	return list, nil
+}
+
+func (p *filterParser) parseNot() (filterNode, error) {
+	tok := p.peek()
+	switch {
+	case tok.is("not", "!"):
+		p.next()
+		node, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &filterNot{node: node}, nil
+	case tok.is("("):
+		p.next()
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if tok := p.next(); !tok.is(")") {
+			return nil, p.unexpected(tok, `")"`)
+		}
+		return node, nil
+	case tok.kind == tokWord:
+		return p.parseTerm()
+	}
+	return nil, p.unexpected(tok, `field, "not" or "("`)
+}
+
+func (p *filterParser) parseTerm() (filterNode, error) {
+	tok := p.next()
+	field, ok := filterFields[tok.text]
+	if !ok {
+		return nil, p.unexpected(tok, "field")
+	}
+	switch field.kind {
+	case fieldAddr:
+		return p.parseAddr(tok.text, field)
+	case fieldString:
+		return p.parseString(tok.text, field)
+	case fieldStatus:
+		return p.parseStatus(tok.text)
+	}
+	return p.parseNumber(tok.text, field)
+}
+
+// parseOp parses the operator of a comparison. It returns "", if the operator
+// is omitted.
+func (p *filterParser) parseOp(ops ...string) (string, error) {
+	tok := p.peek()
+	if tok.is(ops...) {
+		p.next()
+		return tok.text, nil
+	}
+	if tok.kind == tokWord || tok.kind == tokString {
+		return "", nil
+	}
+	return "", p.unexpected(tok, "operator "+strings.Join(ops, ", "))
+}
+
+// termText returns the normalized text of a term.
+func termText(name, op, value string) string {
+	if op == "" {
+		return name + " " + value
+	}
+	return name + " " + op + " " + value
+}
+
+func (p *filterParser) parseAddr(name string, field filterField) (filterNode, error) {
+	op, err := p.parseOp("==", "!=", "in")
+	if err != nil {
+		return nil, err
+	}
+	tok := p.next()
+	var ip net.IP
+	var mask net.IPMask
+	var text string
+	if tok.kind == tokWord && strings.Contains(tok.text, "/") {
+		_, ipnet, err := net.ParseCIDR(tok.text)
+		if err != nil {
+			return nil, p.unexpected(tok, "IPv4 or IPv6 network")
+		}
+		ip, mask, text = ipnet.IP, ipnet.Mask, ipnet.String()
+	} else {
+		if tok.kind == tokWord {
+			ip = net.ParseIP(tok.text)
+		}
+		if ip == nil {
+			return nil, p.unexpected(tok, "IPv4 or IPv6 address")
+		}
+		text = ip.String()
+	}
+
+	attr := ConnAttr{Type: field.v6, Negate: op == "!="}
+	if ip4 := ip.To4(); ip4 != nil {
+		attr.Type = field.v4
+		ip = ip4
+		if len(mask) == net.IPv6len {
+			mask = mask[net.IPv6len-net.IPv4len:]
+		}
+	} else {
+		ip = ip.To16()
+	}
+	attr.Data = []byte(ip)
+	if mask != nil {
+		attr.Mask = []byte(mask)
+	}
+	return &filterTerm{text: termText(name, op, text), expr: attr}, nil
+}
+
+func (p *filterParser) parseString(name string, field filterField) (filterNode, error) {
+	op, err := p.parseOp("==", "!=")
+	if err != nil {
+		return nil, err
+	}
+	tok := p.next()
+	var value string
+	switch tok.kind {
+	case tokWord:
+		value = tok.text
+	case tokString:
+		if value, err = strconv.Unquote(tok.text); err != nil || value == "" {
+			return nil, p.unexpected(tok, "name")
+		}
+	default:
+		return nil, p.unexpected(tok, "name")
+	}
+	text := value
+	if !isWord(value) || filterKeyword(value) {
+		text = strconv.Quote(value)
+	}
+	attr := ConnAttr{Type: field.attr, Data: []byte(value), Negate: op == "!="}
+	return &filterTerm{text: termText(name, op, text), expr: attr}, nil
+}
+
+func isWord(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isWordByte(s[i]) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func filterKeyword(s string) bool {
+	switch s {
+	case "and", "or", "not", "in", "any":
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) parseStatus(name string) (filterNode, error) {
+	anyBit := false
+	if p.peek().is("any") {
+		p.next()
+		anyBit = true
+	}
+	var status Status
+	var names []string
+	for {
+		tok := p.next()
+		bit := -1
+		for i, bitName := range statusBitNames {
+			if tok.kind == tokWord && strings.EqualFold(tok.text, bitName) {
+				bit = i
+			}
+		}
+		if bit < 0 {
+			return nil, p.unexpected(tok, "name of status bit")
+		}
+		status |= 1 << uint(bit)
+		names = append(names, strings.ToLower(statusBitNames[bit]))
+		if !p.peek().is("|") {
+			break
+		}
+		p.next()
+	}
+	if anyBit {
+		return &filterTerm{text: name + " any " + strings.Join(names, "|"), expr: StatusAny(status)}, nil
+	}
+	return &filterTerm{text: name + " " + strings.Join(names, "|"), expr: StatusAll(status)}, nil
+}
+
+func (p *filterParser) parseNumber(name string, field filterField) (filterNode, error) {
+	check, ok := filterCheck[field.attr]
+	if !ok {
+		check = expectFilterCheck[field.attr]
+	}
+	bits := 8 * check.len
+
+	var mask uint64
+	var masked bool
+	if p.peek().is("&") {
+		tok := p.next()
+		if !check.mask {
+			return nil, p.unexpected(tok, "operator")
+		}
+		tok = p.next()
+		v, err := strconv.ParseUint(tok.text, 0, bits)
+		if tok.kind != tokWord || err != nil {
+			return nil, p.unexpected(tok, fmt.Sprintf("mask of %d bits", bits))
+		}
+		mask, masked = v, true
+		name = fmt.Sprintf("%s & %#x", name, mask)
+	}
+
+	ops := []string{"==", "!=", "<", "<=", ">", ">=", "in"}
+	if masked {
+		ops = ops[:2]
+	}
+	op, err := p.parseOp(ops...)
+	if err != nil {
+		return nil, err
+	}
+
+	tok := p.next()
+	value := func(s string) (uint64, error) {
+		if v, ok := field.names[strings.ToLower(s)]; ok {
+			return v, nil
+		}
+		v, err := strconv.ParseUint(s, 0, bits)
+		if tok.kind != tokWord || err != nil {
+			return 0, p.unexpected(tok, fmt.Sprintf("number of %d bits", bits))
+		}
+		return v, nil
+	}
+
+	if op == "in" {
+		if i := strings.Index(tok.text, "-"); i > 0 {
+			min, err := value(tok.text[:i])
+			if err != nil {
+				return nil, err
+			}
+			max, err := value(tok.text[i+1:])
+			if err != nil {
+				return nil, err
+			}
+			if min > max {
+				return nil, p.unexpected(tok, "range with lower bound first")
+			}
+			text := termText(name, op, field.name(min)+"-"+field.name(max))
+			return &filterTerm{text: text, expr: AttrRange{Type: field.attr, Min: min, Max: max}}, nil
+		}
+	}
+	v, err := value(tok.text)
+	if err != nil {
+		return nil, err
+	}
+	text := termText(name, op, field.name(v))
+
+	var cmp CompareOp
+	switch op {
+	case "<":
+		cmp = OpLess
+	case "<=":
+		cmp = OpLessEqual
+	case ">":
+		cmp = OpGreater
+	case ">=":
+		cmp = OpGreaterEqual
+	default:
+		data := make([]byte, 8)
+		binary.BigEndian.PutUint64(data, v)
+		attr := ConnAttr{Type: field.attr, Data: data[8-check.len:], Negate: op == "!="}
+		if masked {
+			m := make([]byte, 8)
+			binary.BigEndian.PutUint64(m, mask)
+			attr.Mask = m[8-check.len:]
+		}
+		return &filterTerm{text: text, expr: attr}, nil
+	}
+	return &filterTerm{text: text, expr: AttrCompare{Type: field.attr, Op: cmp, Value: v}}, nil
+}
@@ -0,0 +1,169 @@
+package conntrack
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   string
+	}{
+		{filter: "orig.src in 10.0.0.0/8 and l4proto tcp and orig.dport in 8000-8100 and not mark & 0xff == 1",
+			want: "orig.src in 10.0.0.0/8 and l4proto tcp and orig.dport in 8000-8100 and not mark & 0xff == 1"},
+		{filter: "orig.src in 10.1.2.3/8", want: "orig.src in 10.0.0.0/8"},
+		{filter: "orig.src in ::ffff:10.0.0.0/104", want: "orig.src in 10.0.0.0/8"},
+		{filter: "l4proto 6", want: "l4proto tcp"},
+		{filter: "l4proto==UDP", want: "l4proto == udp"},
+		{filter: "reply.dst != 2001:0db8::0001", want: "reply.dst != 2001:db8::1"},
+		{filter: "!orig.sport<1024 && zone 0x10 || timeout >= 30", want: "not orig.sport < 1024 and zone 16 or timeout >= 30"},
+		{filter: "(zone 1 or zone 2) and (mark 1)", want: "(zone 1 or zone 2) and mark 1"},
+		{filter: "zone 1 or (zone 2 and mark 1)", want: "zone 1 or zone 2 and mark 1"},
+		{filter: "not (zone 1 or zone 2)", want: "not (zone 1 or zone 2)"},
+		{filter: "zone 1 and (zone 2 and zone 3)", want: "zone 1 and (zone 2 and zone 3)"},
+		{filter: "not not zone 1", want: "not not zone 1"},
+		{filter: "status ASSURED|seen_reply", want: "status assured|seen_reply"},
+		{filter: "status any src_nat | dst_nat", want: "status any src_nat|dst_nat"},
+		{filter: `helper "ftp"`, want: "helper ftp"},
+		{filter: `secctx == "system_u:object_r:unlabeled_t:s0 x"`, want: `secctx == "system_u:object_r:unlabeled_t:s0 x"`},
+		{filter: `helper "and"`, want: `helper "and"`},
+		{filter: "tcp.state in syn_sent-established", want: "tcp.state in syn_sent-established"},
+		{filter: "orig.bytes > 1073741824", want: "orig.bytes > 1073741824"},
+		{filter: "family ipv6 and snat.port 1024", want: "family ipv6 and snat.port 1024"},
+		{filter: "orig.dport in 80", want: "orig.dport in 80"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.filter, func(t *testing.T) {
+			f, err := ParseFilter(tc.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.String(); got != tc.want {
+				t.Fatalf("unexpected string: %s", got)
+			}
+			again, err := ParseFilter(f.String())
+			if err != nil {
+				t.Fatalf("could not parse string of filter: %v", err)
+			}
+			if !reflect.DeepEqual(f, again) {
+				t.Fatalf("string does not round trip:\n%#v\n%#v", f.root, again.root)
+			}
+			if _, err := compileFilterExpr(Conntrack, f); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	tests := []struct {
+		filter   string
+		offset   int
+		expected string
+	}{
+		{filter: "", offset: 0, expected: `field, "not" or "("`},
+		{filter: "orig.src", offset: 8, expected: "operator ==, !=, in"},
+		{filter: "orig.sorc 10.0.0.1", offset: 0, expected: "field"},
+		{filter: "orig.src in 10.0.0.0/33", offset: 12, expected: "IPv4 or IPv6 network"},
+		{filter: "orig.src 10.0.0.256", offset: 9, expected: "IPv4 or IPv6 address"},
+		{filter: "zone 1 and", offset: 10, expected: `field, "not" or "("`},
+		{filter: "zone 1 zone 2", offset: 7, expected: `"and", "or" or end of filter`},
+		{filter: "(zone 1 or zone 2", offset: 17, expected: `")"`},
+		{filter: "orig.dport 65536", offset: 11, expected: "number of 16 bits"},
+		{filter: "orig.dport in 100-10", offset: 14, expected: "range with lower bound first"},
+		{filter: "orig.dport & 0xff == 1", offset: 11, expected: "operator"},
+		{filter: "mark & 0xff < 1", offset: 12, expected: "operator ==, !="},
+		{filter: "l4proto tcpp", offset: 8, expected: "number of 8 bits"},
+		{filter: "status assured|", offset: 15, expected: "name of status bit"},
+		{filter: `helper "ftp`, offset: 11, expected: `closing "`},
+		{filter: "zone 1 ; zone 2", offset: 7, expected: "field, value or operator"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.filter, func(t *testing.T) {
+			_, err := ParseFilter(tc.filter)
+			var serr *FilterSyntaxError
+			if !errors.As(err, &serr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if serr.Offset != tc.offset || serr.Expected != tc.expected {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	f, err := ParseFilter("orig.src in 192.0.2.0/24 and l4proto tcp and orig.dport in 8000-8100 and not mark & 0xff == 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := compileFilterExpr(Conntrack, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		src  string
+		port uint16
+		mark uint32
+		want uint32
+	}{
+		{src: "192.0.2.1", port: 8080, mark: 0x200, want: bpfVerdictAccept},
+		{src: "192.0.2.1", port: 8080, mark: 0x201, want: bpfVerdictReject},
+		{src: "192.0.2.1", port: 8101, mark: 0, want: bpfVerdictReject},
+		{src: "198.51.100.1", port: 8080, mark: 0, want: bpfVerdictReject},
+	} {
+		c := testCon(40000)
+		src := net.ParseIP(tc.src)
+		c.Origin.Src = &src
+		*c.Origin.Proto.DstPort = tc.port
+		c.Mark = &tc.mark
+		if got, err := runFilter(raw, eventMessage(t, c)); err != nil || got != tc.want {
+			t.Fatalf("unexpected verdict for %s:%d mark %#x: %#x (%v)", tc.src, tc.port, tc.mark, got, err)
+		}
+	}
+}
+
+func TestFilterConnAttrs(t *testing.T) {
+	f, err := ParseFilter("(orig.dport 80 or orig.dport 443) and not mark 1 and not mark 2 and orig.src in 10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := f.ConnAttrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ConnAttr{
+		{Type: AttrOrigPortDst, Data: be16(80)},
+		{Type: AttrOrigPortDst, Data: be16(443)},
+		{Type: AttrMark, Data: be32(1), Mask: be32(0xffffffff), Negate: true},
+		{Type: AttrMark, Data: be32(2), Mask: be32(0xffffffff), Negate: true},
+		{Type: AttrOrigIPv4Src, Data: []byte{10, 0, 0, 0}, Mask: []byte{255, 0, 0, 0}},
+	}
+	if !reflect.DeepEqual(attrs, want) {
+		t.Fatalf("unexpected attributes: %v", attrs)
+	}
+	if _, err := constructFilter(Conntrack, attrs); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, filter := range []string{
+		"zone 1 or mark 1",
+		"zone 1 and zone 2",
+		"zone 1 and not zone 2",
+		"orig.dport 80 or not orig.dport 443",
+		"orig.dport > 1024",
+		"status assured",
+		"not (zone 1 and mark 1)",
+	} {
+		f, err := ParseFilter(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.ConnAttrs(); err != ErrFilterNotAttributes {
+			t.Fatalf("unexpected error for %s: %v", filter, err)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package conntrack
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FlowRecord contains the accounting of a completed connection. It is based on
+// the destroy event of a connection and requires accounting (nf_conntrack_acct)
+// and timestamps (nf_conntrack_timestamp) to be enabled in the kernel.
+type FlowRecord struct {
+	L4Proto uint8
+	Src     net.IP
+	Dst     net.IP
+	SrcPort uint16
+	DstPort uint16
+
+	// NatSrc and NatSrcPort are set, if the source of the connection was translated.
+	NatSrc     net.IP
+	NatSrcPort uint16
+
+	// NatDst and NatDstPort are set, if the destination of the connection was translated.
+	NatDst     net.IP
+	NatDstPort uint16
+
+	Start    time.Time
+	Stop     time.Time
+	Duration time.Duration
+
+	OrigPackets  uint64
+	OrigBytes    uint64
+	ReplyPackets uint64
+	ReplyBytes   uint64
+
+	// TCPState is the final state of a TCP connection.
+	TCPState *uint8
+
+	Mark  uint32
+	Zone  uint16
+	Label []byte
+}
+
+// NewFlowRecord creates a FlowRecord from a connection. It returns false, if
+// the original tuple of the connection is not available.
+func NewFlowRecord(c Con) (FlowRecord, bool) {
+	var r FlowRecord
+	if c.Origin == nil || c.Origin.Src == nil || c.Origin.Dst == nil {
+		return r, false
+	}
+	r.Src = *c.Origin.Src
+	r.Dst = *c.Origin.Dst
+	if p := c.Origin.Proto; p != nil {
+		if p.Number != nil {
+			r.L4Proto = *p.Number
+		}
+		if p.SrcPort != nil {
+			r.SrcPort = *p.SrcPort
+		}
+		if p.DstPort != nil {
+			r.DstPort = *p.DstPort
+		}
+	}
+
+	// The reply tuple reflects the translated addresses of a connection.
+	if c.Reply != nil {
+		var replySrcPort, replyDstPort uint16
+		if p := c.Reply.Proto; p != nil {
+			if p.SrcPort != nil {
+				replySrcPort = *p.SrcPort
+			}
+			if p.DstPort != nil {
+				replyDstPort = *p.DstPort
+			}
+		}
+		if c.Reply.Dst != nil && (!c.Reply.Dst.Equal(r.Src) || replyDstPort != r.SrcPort) {
+			r.NatSrc = *c.Reply.Dst
+			r.NatSrcPort = replyDstPort
+		}
+		if c.Reply.Src != nil && (!c.Reply.Src.Equal(r.Dst) || replySrcPort != r.DstPort) {
+			r.NatDst = *c.Reply.Src
+			r.NatDstPort = replySrcPort
+		}
+	}
+
+	if c.Timestamp != nil {
+		if c.Timestamp.Start != nil {
+			r.Start = *c.Timestamp.Start
+		}
+		if c.Timestamp.Stop != nil {
+			r.Stop = *c.Timestamp.Stop
+		}
+		if c.Timestamp.Start != nil && c.Timestamp.Stop != nil {
+			r.Duration = r.Stop.Sub(r.Start)
+		}
+	}
+
+	r.OrigPackets, r.OrigBytes = counterValues(c.CounterOrigin)
+	r.ReplyPackets, r.ReplyBytes = counterValues(c.CounterReply)
+
+	if c.ProtoInfo != nil && c.ProtoInfo.TCP != nil && c.ProtoInfo.TCP.State != nil {
+		state := *c.ProtoInfo.TCP.State
+		r.TCPState = &state
+	}
+	if c.Mark != nil {
+		r.Mark = *c.Mark
+	}
+	if key, ok := c.TupleKey(); ok {
+		r.Zone = key.Zone
+	}
+	if c.Label != nil {
+		r.Label = *c.Label
+	}
+	return r, true
+}
+
+func counterValues(c *Counter) (packets, bytes uint64) {
+	if c == nil {
+		return
+	}
+	if c.Packets != nil {
+		packets = *c.Packets
+	} else if c.Packets32 != nil {
+		packets = uint64(*c.Packets32)
+	}
+	if c.Bytes != nil {
+		bytes = *c.Bytes
+	} else if c.Bytes32 != nil {
+		bytes = uint64(*c.Bytes32)
+	}
+	return
+}
+
+// FlowKeyFunc returns the key of the group a FlowRecord belongs to.
+type FlowKeyFunc func(r FlowRecord) string
+
+// GroupBySource groups flow records by their source IP.
+func GroupBySource(r FlowRecord) string {
+	return r.Src.String()
+}
+
+// GroupByDestService groups flow records by their destination IP, protocol
+// and destination port.
+func GroupByDestService(r FlowRecord) string {
+	return fmt.Sprintf("%s/%d/%d", r.Dst, r.L4Proto, r.DstPort)
+}
+
+// GroupByMark groups flow records by their mark.
+func GroupByMark(r FlowRecord) string {
+	return fmt.Sprintf("0x%x", r.Mark)
+}
+
+// GroupByZone groups flow records by their zone.
+func GroupByZone(r FlowRecord) string {
+	return strconv.Itoa(int(r.Zone))
+}
+
+// GroupByLabel groups flow records by their connection labels.
+func GroupByLabel(r FlowRecord) string {
+	return hex.EncodeToString(r.Label)
+}
+
+// GroupByAll combines multiple FlowKeyFunc into one.
+func GroupByAll(fns ...FlowKeyFunc) FlowKeyFunc {
+	return func(r FlowRecord) string {
+		keys := make([]string, len(fns))
+		for i, fn := range fns {
+			keys[i] = fn(r)
+		}
+		return strings.Join(keys, "|")
+	}
+}
+
+// FlowAggregate contains the accumulated flow records of a group.
+type FlowAggregate struct {
+	Key string
+
+	Flows        uint64
+	OrigPackets  uint64
+	OrigBytes    uint64
+	ReplyPackets uint64
+	ReplyBytes   uint64
+
+	// Duration is the sum of the durations of all flows.
+	Duration time.Duration
+
+	// First is the earliest start and Last the latest stop of all flows.
+	First time.Time
+	Last  time.Time
+}
+
+// FlowAggregatorConfig contains options for a FlowAggregator.
+type FlowAggregatorConfig struct {
+	// GroupBy returns the key of the group a flow record is accumulated in.
+	// If not set, all flow records are accumulated in one group.
+	GroupBy FlowKeyFunc
+
+	// FlushInterval is the interval in which Run passes the aggregates to OnFlush.
+	FlushInterval time.Duration
+
+	// OnRecord is called for every completed flow record.
+	OnRecord func(FlowRecord)
+
+	// OnFlush is called with the aggregates of every interval.
+	OnFlush func([]FlowAggregate)
+}
+
+// FlowAggregator accumulates flow records from destroy events.
+type FlowAggregator struct {
+	config FlowAggregatorConfig
+
+	mu     sync.Mutex
+	groups map[string]*FlowAggregate
+}
+
+// NewFlowAggregator returns a new FlowAggregator.
+func NewFlowAggregator(config FlowAggregatorConfig) *FlowAggregator {
+	return &FlowAggregator{
+		config: config,
+		groups: make(map[string]*FlowAggregate),
+	}
+}
+
+// Hook is a HookFunc for Register, that accumulates destroy events. Other
+// events are ignored, if their origin is available via AddConntrackInformation.
+func (a *FlowAggregator) Hook(c Con) int {
+	if c.Info != nil && c.Info.NetlinkGroup != NetlinkCtDestroy {
+		return 0
+	}
+	if r, ok := NewFlowRecord(c); ok {
+		a.Add(r)
+	}
+	return 0
+}
+
+// Add accumulates a flow record.
+func (a *FlowAggregator) Add(r FlowRecord) {
+	if a.config.OnRecord != nil {
+		a.config.OnRecord(r)
+	}
+
+	var key string
+	if a.config.GroupBy != nil {
+		key = a.config.GroupBy(r)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	agg, ok := a.groups[key]
+	if !ok {
+		agg = &FlowAggregate{Key: key}
+		a.groups[key] = agg
+	}
+	agg.Flows++
+	agg.OrigPackets += r.OrigPackets
+	agg.OrigBytes += r.OrigBytes
+	agg.ReplyPackets += r.ReplyPackets
+	agg.ReplyBytes += r.ReplyBytes
+	agg.Duration += r.Duration
+	if !r.Start.IsZero() && (agg.First.IsZero() || r.Start.Before(agg.First)) {
+		agg.First = r.Start
+	}
+	if r.Stop.After(agg.Last) {
+		agg.Last = r.Stop
+	}
+}
+
+// Flush returns the aggregates sorted by their key and resets the FlowAggregator.
+func (a *FlowAggregator) Flush() []FlowAggregate {
+	a.mu.Lock()
+	groups := a.groups
+	a.groups = make(map[string]*FlowAggregate)
+	a.mu.Unlock()
+
+	aggs := make([]FlowAggregate, 0, len(groups))
+	for _, agg := range groups {
+		aggs = append(aggs, *agg)
+	}
+	sort.Slice(aggs, func(i, j int) bool {
+		return aggs[i].Key < aggs[j].Key
+	})
+	return aggs
+}
+
+// Run passes the aggregates to OnFlush every FlushInterval, until ctx is done.
+// The remaining aggregates are flushed before Run returns.
+func (a *FlowAggregator) Run(ctx context.Context) error {
+	if a.config.FlushInterval <= 0 {
+		return fmt.Errorf("invalid flush interval: %v", a.config.FlushInterval)
+	}
+	ticker := time.NewTicker(a.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			a.flush()
+		case <-ctx.Done():
+			a.flush()
+			return ctx.Err()
+		}
+	}
+}
+
+func (a *FlowAggregator) flush() {
+	aggs := a.Flush()
+	if a.config.OnFlush != nil && len(aggs) > 0 {
+		a.config.OnFlush(aggs)
+	}
+}
@@ -0,0 +1,85 @@
+package conntrack
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// flowEvent returns testCon from src as destroy event with the counters and
+// the timestamps of a flow of 30 seconds.
+func flowEvent(src string, origBytes, replyBytes uint64) Con {
+	c := testCon(40000)
+	srcIP := net.ParseIP(src)
+	var packets uint64 = 10
+	start := time.Unix(1000, 0)
+	stop := time.Unix(1030, 0)
+	c.Info = &InfoSource{Table: Conntrack, NetlinkGroup: NetlinkCtDestroy}
+	c.Origin.Src, c.Reply.Dst = &srcIP, &srcIP
+	c.CounterOrigin = &Counter{Packets: &packets, Bytes: &origBytes}
+	c.CounterReply = &Counter{Packets: &packets, Bytes: &replyBytes}
+	c.Timestamp = &Timestamp{Start: &start, Stop: &stop}
+	return c
+}
+
+func TestNewFlowRecord(t *testing.T) {
+	r, ok := NewFlowRecord(flowEvent("198.51.100.1", 100, 2000))
+	if !ok {
+		t.Fatalf("could not create flow record")
+	}
+	if r.NatSrc != nil {
+		t.Fatalf("unexpected source NAT: %v", r.NatSrc)
+	}
+	if !r.NatDst.Equal(net.ParseIP("10.0.0.2")) || r.NatDstPort != 8080 {
+		t.Fatalf("unexpected destination NAT: %v:%d", r.NatDst, r.NatDstPort)
+	}
+	if r.Duration != 30*time.Second {
+		t.Fatalf("unexpected duration: %v", r.Duration)
+	}
+	if r.OrigBytes != 100 || r.ReplyBytes != 2000 || r.OrigPackets != 10 || r.ReplyPackets != 10 {
+		t.Fatalf("unexpected counters: %#v", r)
+	}
+	if r.TCPState == nil || *r.TCPState != 3 {
+		t.Fatalf("unexpected TCP state: %v", r.TCPState)
+	}
+
+	if _, ok := NewFlowRecord(Con{}); ok {
+		t.Fatalf("created flow record without original tuple")
+	}
+}
+
+func TestFlowAggregator(t *testing.T) {
+	var records int
+	a := NewFlowAggregator(FlowAggregatorConfig{
+		GroupBy:  GroupByAll(GroupBySource, GroupByMark),
+		OnRecord: func(FlowRecord) { records++ },
+	})
+
+	a.Hook(flowEvent("198.51.100.1", 100, 2000))
+	a.Hook(flowEvent("198.51.100.1", 50, 1000))
+	a.Hook(flowEvent("198.51.100.2", 10, 10))
+
+	update := flowEvent("198.51.100.3", 10, 10)
+	update.Info.NetlinkGroup = NetlinkCtUpdate
+	a.Hook(update)
+
+	if records != 3 {
+		t.Fatalf("unexpected number of records: %d", records)
+	}
+
+	aggs := a.Flush()
+	if len(aggs) != 2 {
+		t.Fatalf("unexpected number of aggregates: %d", len(aggs))
+	}
+	if aggs[0].Key != "198.51.100.1|0x42" || aggs[0].Flows != 2 || aggs[0].OrigBytes != 150 ||
+		aggs[0].ReplyBytes != 3000 || aggs[0].Duration != time.Minute {
+		t.Fatalf("unexpected aggregate: %#v", aggs[0])
+	}
+	if !aggs[0].First.Equal(time.Unix(1000, 0)) || !aggs[0].Last.Equal(time.Unix(1030, 0)) {
+		t.Fatalf("unexpected time range: %v - %v", aggs[0].First, aggs[0].Last)
+	}
+
+	if aggs := a.Flush(); len(aggs) != 0 {
+		t.Fatalf("aggregator was not reset: %d", len(aggs))
+	}
+}
@@ -21,6 +21,7 @@ const (
 	// Instruction classes
 	BPF_LD   = linux.BPF_LD
 	BPF_LDX  = linux.BPF_LDX
+	BPF_ST   = linux.BPF_ST
 	BPF_ALU  = linux.BPF_ALU
 	BPF_JMP  = linux.BPF_JMP
 	BPF_RET  = linux.BPF_RET
@@ -33,15 +34,60 @@ const (
 	BPF_IMM = linux.BPF_IMM
 	BPF_ABS = linux.BPF_ABS
 	BPF_IND = linux.BPF_IND
+	BPF_MEM = linux.BPF_MEM
 
 	// alu/jmp fields
-	BPF_ADD = linux.BPF_ADD
-	BPF_AND = linux.BPF_AND
-	BPF_JA  = linux.BPF_JA
-	BPF_JEQ = linux.BPF_JEQ
-	BPF_K   = linux.BPF_K
+	BPF_ADD  = linux.BPF_ADD
+	BPF_AND  = linux.BPF_AND
+	BPF_JA   = linux.BPF_JA
+	BPF_JEQ  = linux.BPF_JEQ
+	BPF_JGT  = linux.BPF_JGT
+	BPF_JGE  = linux.BPF_JGE
+	BPF_JSET = linux.BPF_JSET
+	BPF_K    = linux.BPF_K
 
 	// include/uapi/linux/filter.h
 	BPF_TAX = linux.BPF_TAX
 	BPF_TXA = linux.BPF_TXA
+
+	// socket options
+	SOL_SOCKET     = linux.SOL_SOCKET
+	SO_RCVBUF      = linux.SO_RCVBUF
+	SO_SNDBUF      = linux.SO_SNDBUF
+	SO_RCVBUFFORCE = linux.SO_RCVBUFFORCE
+	SO_SNDBUFFORCE = linux.SO_SNDBUFFORCE
+)
+
+// errno values
+const (
+	ENOENT  = linux.ENOENT
+	EEXIST  = linux.EEXIST
+	ENOBUFS = linux.ENOBUFS
+	EAGAIN  = linux.EAGAIN
+	EINTR   = linux.EINTR
+
+	EINVAL     = linux.EINVAL
+	EOPNOTSUPP = linux.EOPNOTSUPP
 )
+
+// flags of received messages
+const (
+	MSG_TRUNC = linux.MSG_TRUNC
+)
+
+// Recvmsg reads a single message from the socket fd into p and returns the
+// number of bytes read and the flags of the message.
+func Recvmsg(fd int, p []byte, flags int) (int, int, error) {
+	n, _, recvflags, _, err := linux.Recvmsg(fd, p, nil, flags)
+	return n, recvflags, err
+}
+
+// SetsockoptInt sets the socket option opt of the socket fd to value.
+func SetsockoptInt(fd, level, opt, value int) error {
+	return linux.SetsockoptInt(fd, level, opt, value)
+}
+
+// GetsockoptInt returns the value of the socket option opt of the socket fd.
+func GetsockoptInt(fd, level, opt int) (int, error) {
+	return linux.GetsockoptInt(fd, level, opt)
+}
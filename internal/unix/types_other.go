@@ -3,6 +3,8 @@
 
 package unix
 
+import "syscall"
+
 const (
 	AF_UNSPEC                     = 0x0
 	AF_INET                       = 0x2
@@ -16,6 +18,7 @@ const (
 	// Instruction classes
 	BPF_LD   = 0x00
 	BPF_LDX  = 0x01
+	BPF_ST   = 0x02
 	BPF_ALU  = 0x04
 	BPF_JMP  = 0x05
 	BPF_RET  = 0x06
@@ -28,15 +31,57 @@ const (
 	BPF_IMM = 0x00
 	BPF_ABS = 0x20
 	BPF_IND = 0x40
+	BPF_MEM = 0x60
 
 	// alu/jmp fields
-	BPF_ADD = 0x00
-	BPF_AND = 0x50
-	BPF_JA  = 0x00
-	BPF_JEQ = 0x10
-	BPF_K   = 0x00
+	BPF_ADD  = 0x00
+	BPF_AND  = 0x50
+	BPF_JA   = 0x00
+	BPF_JEQ  = 0x10
+	BPF_JGT  = 0x20
+	BPF_JGE  = 0x30
+	BPF_JSET = 0x40
+	BPF_K    = 0x00
 
 	// include/uapi/linux/filter.h
 	BPF_TAX = 0x00
 	BPF_TXA = 0x80
+
+	// socket options
+	SOL_SOCKET     = 0x1
+	SO_RCVBUF      = 0x8
+	SO_SNDBUF      = 0x7
+	SO_RCVBUFFORCE = 0x21
+	SO_SNDBUFFORCE = 0x20
+)
+
+// errno values
+const (
+	ENOENT  = syscall.Errno(0x2)
+	EEXIST  = syscall.Errno(0x11)
+	ENOBUFS = syscall.Errno(0x69)
+	EAGAIN  = syscall.Errno(0xb)
+	EINTR   = syscall.Errno(0x4)
+
+	EINVAL     = syscall.Errno(0x16)
+	EOPNOTSUPP = syscall.Errno(0x5f)
 )
+
+const (
+	MSG_TRUNC = 0x20
+)
+
+// Recvmsg is not supported on this platform.
+func Recvmsg(fd int, p []byte, flags int) (int, int, error) {
+	return 0, 0, syscall.ENOTSUP
+}
+
+// SetsockoptInt is not supported on this platform.
+func SetsockoptInt(fd, level, opt, value int) error {
+	return syscall.ENOTSUP
+}
+
+// GetsockoptInt is not supported on this platform.
+func GetsockoptInt(fd, level, opt int) (int, error) {
+	return 0, syscall.ENOTSUP
+}
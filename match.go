@@ -0,0 +1,317 @@
+package conntrack
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+
+	"github.com/florianl/go-conntrack/internal/unix"
+
+	"github.com/mdlayher/netlink"
+)
+
+// Predicate selects entries of the conntrack table.
+type Predicate interface {
+	// Match reports whether c is selected.
+	Match(c Con) bool
+}
+
+// PredicateFunc is a Predicate, that is implemented by a function.
+type PredicateFunc func(c Con) bool
+
+// Match calls fn(c).
+func (fn PredicateFunc) Match(c Con) bool {
+	return fn(c)
+}
+
+// kernelFilter is implemented by predicates, that can be applied in parts by
+// the kernel while a table is dumped. The returned attributes are added to the
+// dump request. The kernel may select more entries than the predicate, but
+// never less.
+type kernelFilter interface {
+	kernelFilter(logger *log.Logger, f Family) ([]byte, error)
+}
+
+// ConnMatch is a Predicate, that compares the attributes of an entry with the
+// fields, that are set. Fields, that are not set, match every entry.
+// The comparisons are applied by the kernel while dumping, as far as the
+// kernel supports them.
+type ConnMatch struct {
+	// Origin and Reply are compared with the tuples of the entry. The
+	// addresses, the protocol number, the ports and the ICMP fields of the
+	// tuples are compared.
+	Origin *IPTuple
+	Reply  *IPTuple
+
+	// Zone is compared with the zone of the entry. Entries without a zone
+	// are in zone 0.
+	Zone *uint16
+
+	// Mark is compared with the mark of the entry, after both are masked with
+	// MarkMask. If MarkMask is not set, all bits are compared.
+	Mark     *uint32
+	MarkMask *uint32
+}
+
+// Match reports whether c matches all set fields of m.
+func (m ConnMatch) Match(c Con) bool {
+	if m.Zone != nil && *m.Zone != valueUint16(c.Zone) {
+		return false
+	}
+	if m.Mark != nil {
+		mask := ^uint32(0)
+		if m.MarkMask != nil {
+			mask = *m.MarkMask
+		}
+		if *m.Mark&mask != valueUint32(c.Mark)&mask {
+			return false
+		}
+	}
+	return matchTuple(m.Origin, c.Origin) && matchTuple(m.Reply, c.Reply)
+}
+
+func matchTuple(want, have *IPTuple) bool {
+	if want == nil {
+		return true
+	}
+	if have == nil {
+		have = &IPTuple{}
+	}
+	if !matchIP(want.Src, have.Src) || !matchIP(want.Dst, have.Dst) {
+		return false
+	}
+	if want.Proto == nil {
+		return true
+	}
+	wp, hp := want.Proto, have.Proto
+	if hp == nil {
+		hp = &ProtoTuple{}
+	}
+	return matchUint8(wp.Number, hp.Number) &&
+		matchUint16(wp.SrcPort, hp.SrcPort) && matchUint16(wp.DstPort, hp.DstPort) &&
+		matchUint16(wp.IcmpID, hp.IcmpID) && matchUint8(wp.IcmpType, hp.IcmpType) &&
+		matchUint8(wp.IcmpCode, hp.IcmpCode) && matchUint16(wp.Icmpv6ID, hp.Icmpv6ID) &&
+		matchUint8(wp.Icmpv6Type, hp.Icmpv6Type) && matchUint8(wp.Icmpv6Code, hp.Icmpv6Code)
+}
+
+func matchIP(want, have *net.IP) bool {
+	return want == nil || (have != nil && want.Equal(*have))
+}
+
+func matchUint8(want, have *uint8) bool {
+	return want == nil || (have != nil && *want == *have)
+}
+
+func matchUint16(want, have *uint16) bool {
+	return want == nil || (have != nil && *want == *have)
+}
+
+func valueUint8(v *uint8) uint8 {
+	if v == nil {
+		return 0
+	}
+	return *v
+}
+
+func valueUint16(v *uint16) uint16 {
+	if v == nil {
+		return 0
+	}
+	return *v
+}
+
+func valueUint32(v *uint32) uint32 {
+	if v == nil {
+		return 0
+	}
+	return *v
+}
+
+// dumpMatching dumps the table and calls fn for every entry, that matches p.
+// The kernel filters the entries in advance, as far as p supports it. If the
+// kernel rejects the filter, the table is dumped without it.
+func (nfct *Nfct) dumpMatching(ctx context.Context, t Table, f Family, p Predicate, fn func(c Con) error) error {
+	req, err := dumpRequest(t, f)
+	if err != nil {
+		return err
+	}
+	match := func(c Con) error {
+		if !p.Match(c) {
+			return nil
+		}
+		return fn(c)
+	}
+
+	kf, ok := p.(kernelFilter)
+	if !ok {
+		// predicates of MatchAll and the like are applied in parts
+		if m, found := kernelMatch(p); found {
+			kf, ok = m, true
+		}
+	}
+	if !ok || t != Conntrack {
+		return nfct.queryMaskedFunc(ctx, req, FieldAll, match)
+	}
+	attrs, err := kf.kernelFilter(nfct.logger, f)
+	if err != nil {
+		return err
+	}
+	filtered := req
+	filtered.Data = append(append([]byte{}, req.Data...), attrs...)
+
+	var received bool
+	err = nfct.queryMaskedFunc(ctx, filtered, FieldAll, func(c Con) error {
+		received = true
+		return match(c)
+	})
+	if err != nil && !received && (errors.Is(err, unix.EINVAL) || errors.Is(err, unix.EOPNOTSUPP)) {
+		nfct.logger.Printf("kernel rejected dump filter: %v", err)
+		return nfct.queryMaskedFunc(ctx, req, FieldAll, match)
+	}
+	return err
+}
+
+// flags of CTA_FILTER_ORIG_FLAGS and CTA_FILTER_REPLY_FLAGS
+const (
+	ctaFilterFlagIPSrc      = 1 << 0
+	ctaFilterFlagIPDst      = 1 << 1
+	ctaFilterFlagProtoNum   = 1 << 3
+	ctaFilterFlagSrcPort    = 1 << 4
+	ctaFilterFlagDstPort    = 1 << 5
+	ctaFilterFlagIcmpType   = 1 << 6
+	ctaFilterFlagIcmpCode   = 1 << 7
+	ctaFilterFlagIcmpID     = 1 << 8
+	ctaFilterFlagIcmpv6Type = 1 << 9
+	ctaFilterFlagIcmpv6Code = 1 << 10
+	ctaFilterFlagIcmpv6ID   = 1 << 11
+)
+
+const (
+	ctaFilterOrigFlags  = 1
+	ctaFilterReplyFlags = 2
+)
+
+func (m ConnMatch) kernelFilter(logger *log.Logger, f Family) ([]byte, error) {
+	ae := netlink.NewAttributeEncoder()
+
+	if m.Mark != nil {
+		mask := ^uint32(0)
+		if m.MarkMask != nil {
+			mask = *m.MarkMask
+		}
+		ae.ByteOrder = binary.BigEndian
+		ae.Uint32(ctaMark, *m.Mark&mask)
+		ae.Uint32(ctaMarkMask, mask)
+		ae.ByteOrder = nativeEndian
+	}
+	if m.Zone != nil {
+		ae.ByteOrder = binary.BigEndian
+		ae.Uint16(ctaZone, *m.Zone)
+		ae.ByteOrder = nativeEndian
+	}
+
+	// Tuples can only be filtered for a specific family.
+	if f != IPv4 && f != IPv6 {
+		return ae.Encode()
+	}
+	origin, origFlags := kernelTuple(m.Origin, f)
+	reply, replyFlags := kernelTuple(m.Reply, f)
+	if origFlags == 0 && replyFlags == 0 {
+		return ae.Encode()
+	}
+	if origFlags != 0 {
+		data, err := marshalIPTuple(logger, origin)
+		if err != nil {
+			return nil, err
+		}
+		ae.Bytes(ctaTupleOrig|nlafNested, data)
+	}
+	if replyFlags != 0 {
+		data, err := marshalIPTuple(logger, reply)
+		if err != nil {
+			return nil, err
+		}
+		ae.Bytes(ctaTupleReply|nlafNested, data)
+	}
+	ae.Nested(ctaFilter, func(nae *netlink.AttributeEncoder) error {
+		nae.Uint32(ctaFilterOrigFlags, origFlags)
+		nae.Uint32(ctaFilterReplyFlags, replyFlags)
+		return nil
+	})
+	return ae.Encode()
+}
+
+// kernelTuple returns the part of t, that can be filtered by the kernel, and
+// the flags of the filter.
+func kernelTuple(t *IPTuple, f Family) (*IPTuple, uint32) {
+	var kt IPTuple
+	var flags uint32
+	if t == nil {
+		return &kt, 0
+	}
+	if t.Src != nil && matchesFamily(*t.Src, f) {
+		kt.Src = t.Src
+		flags |= ctaFilterFlagIPSrc
+	}
+	if t.Dst != nil && matchesFamily(*t.Dst, f) {
+		kt.Dst = t.Dst
+		flags |= ctaFilterFlagIPDst
+	}
+	// Without the protocol number, the kernel can not filter the protocol
+	// specific fields.
+	if t.Proto == nil || t.Proto.Number == nil {
+		return &kt, flags
+	}
+	p := t.Proto
+	kp := &ProtoTuple{Number: p.Number}
+	flags |= ctaFilterFlagProtoNum
+	switch *p.Number {
+	case 1:
+		if p.IcmpType != nil {
+			kp.IcmpType = p.IcmpType
+			flags |= ctaFilterFlagIcmpType
+		}
+		if p.IcmpCode != nil {
+			kp.IcmpCode = p.IcmpCode
+			flags |= ctaFilterFlagIcmpCode
+		}
+		if p.IcmpID != nil {
+			kp.IcmpID = p.IcmpID
+			flags |= ctaFilterFlagIcmpID
+		}
+	case 58:
+		if p.Icmpv6Type != nil {
+			kp.Icmpv6Type = p.Icmpv6Type
+			flags |= ctaFilterFlagIcmpv6Type
+		}
+		if p.Icmpv6Code != nil {
+			kp.Icmpv6Code = p.Icmpv6Code
+			flags |= ctaFilterFlagIcmpv6Code
+		}
+		if p.Icmpv6ID != nil {
+			kp.Icmpv6ID = p.Icmpv6ID
+			flags |= ctaFilterFlagIcmpv6ID
+		}
+	case 6, 17, 33, 132, 136:
+		// only protocols with ports provide them to the kernel filter
+		if p.SrcPort != nil {
+			kp.SrcPort = p.SrcPort
+			flags |= ctaFilterFlagSrcPort
+		}
+		if p.DstPort != nil {
+			kp.DstPort = p.DstPort
+			flags |= ctaFilterFlagDstPort
+		}
+	}
+	kt.Proto = kp
+	return &kt, flags
+}
+
+func matchesFamily(ip net.IP, f Family) bool {
+	if f == IPv4 {
+		return ip.To4() != nil
+	}
+	return ip.To4() == nil && ip.To16() != nil
+}
@@ -0,0 +1,124 @@
+package conntrack
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+
+	"github.com/florianl/go-conntrack/internal/unix"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"github.com/mdlayher/netlink/nltest"
+)
+
+func TestConnMatch(t *testing.T) {
+	c := testCon(40000)
+	dst := net.ParseIP("192.0.2.2")
+	other := net.ParseIP("192.0.2.3")
+	proto, port, otherPort := uint8(6), uint16(80), uint16(443)
+	mark, mask, zone := uint32(0x142), uint32(0xff), uint16(1)
+
+	tests := []struct {
+		name  string
+		match ConnMatch
+		want  bool
+	}{
+		{name: "empty", want: true},
+		{name: "destination", match: ConnMatch{Origin: &IPTuple{Dst: &dst, Proto: &ProtoTuple{Number: &proto, DstPort: &port}}}, want: true},
+		{name: "other destination", match: ConnMatch{Origin: &IPTuple{Dst: &other}}},
+		{name: "other port", match: ConnMatch{Origin: &IPTuple{Proto: &ProtoTuple{DstPort: &otherPort}}}},
+		{name: "masked mark", match: ConnMatch{Mark: &mark, MarkMask: &mask, Zone: &zone}, want: true},
+		{name: "mark", match: ConnMatch{Mark: &mark}},
+		{name: "reply", match: ConnMatch{Reply: &IPTuple{Dst: &dst}}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.match.Match(c); got != tc.want {
+				t.Fatalf("unexpected match: %v", got)
+			}
+		})
+	}
+
+	f, err := ConnMatch{
+		Origin: &IPTuple{Dst: &dst, Proto: &ProtoTuple{Number: &proto, DstPort: &port}},
+		Mark:   &mark,
+	}.kernelFilter(log.New(ioutil.Discard, "", 0), IPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := netlink.UnmarshalAttributes(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attrs) != 4 || attrs[0].Type != ctaMark || attrs[1].Type != ctaMarkMask ||
+		attrs[2].Type&^nlafNested != ctaTupleOrig || attrs[3].Type&^nlafNested != ctaFilter {
+		t.Fatalf("unexpected attributes: %v", attrs)
+	}
+	flags, err := netlink.UnmarshalAttributes(attrs[3].Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := uint32(ctaFilterFlagIPDst | ctaFilterFlagProtoNum | ctaFilterFlagDstPort)
+	if nlenc.Uint32(flags[0].Data) != want || nlenc.Uint32(flags[1].Data) != 0 {
+		t.Fatalf("unexpected filter flags: %v", flags)
+	}
+}
+
+func TestDumpMatchingFallback(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	var filtered, unfiltered int
+	nfct := &Nfct{logger: logger}
+	AdjustWriteTimeout(nfct, func() error { return nil })
+	nfct.Con = nltest.Dial(func(reqs []netlink.Message) ([]netlink.Message, error) {
+		if len(reqs) == 0 {
+			return nil, nil
+		}
+		req := reqs[0]
+		if len(req.Data) > 4 {
+			// a kernel, that does not support the filter
+			filtered++
+			data := make([]byte, 20)
+			nlenc.PutInt32(data[0:4], -int32(unix.EINVAL))
+			return []netlink.Message{{
+				Header: netlink.Header{Type: netlink.Error, Sequence: req.Header.Sequence},
+				Data:   data,
+			}}, nil
+		}
+		unfiltered++
+		var msgs []netlink.Message
+		for _, port := range []uint16{40000, 40001} {
+			data, err := MarshalAttributes(logger, IPv4, testCon(port))
+			if err != nil {
+				t.Fatal(err)
+			}
+			msgs = append(msgs, netlink.Message{
+				Header: netlink.Header{Type: netlink.HeaderType(1<<8 | ipctnlMsgCtNew), Flags: netlink.Multi, Sequence: req.Header.Sequence},
+				Data:   data,
+			})
+		}
+		return append(msgs, netlink.Message{
+			Header: netlink.Header{Type: netlink.Done, Flags: netlink.Multi, Sequence: req.Header.Sequence},
+			Data:   []byte{0, 0, 0, 0},
+		}), nil
+	})
+	defer nfct.Con.Close()
+
+	src := net.ParseIP("192.0.2.1")
+	proto, port := uint8(6), uint16(40001)
+	var ports []uint16
+	err := nfct.dumpMatching(context.Background(), Conntrack, IPv4,
+		ConnMatch{Origin: &IPTuple{Src: &src, Proto: &ProtoTuple{Number: &proto, SrcPort: &port}}},
+		func(c Con) error {
+			ports = append(ports, *c.Origin.Proto.SrcPort)
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filtered != 1 || unfiltered != 1 || len(ports) != 1 || ports[0] != 40001 {
+		t.Fatalf("unexpected result: %d filtered, %d unfiltered dumps, ports %v", filtered, unfiltered, ports)
+	}
+}
@@ -0,0 +1,137 @@
+package conntrack
+
+// MergeCon returns prev with all attributes of update applied. Update events
+// of the kernel carry only the attributes that changed. Nested structures are
+// copied instead of modified, so entries that were handed out before stay
+// untouched.
+func MergeCon(prev, update Con) Con {
+	merged := prev
+	merged.Info = nil
+
+	if update.Origin != nil {
+		merged.Origin = update.Origin
+	}
+	if update.Reply != nil {
+		merged.Reply = update.Reply
+	}
+	if update.ProtoInfo != nil {
+		merged.ProtoInfo = mergeProtoInfo(prev.ProtoInfo, update.ProtoInfo)
+	}
+	if update.CounterOrigin != nil {
+		merged.CounterOrigin = update.CounterOrigin
+	}
+	if update.CounterReply != nil {
+		merged.CounterReply = update.CounterReply
+	}
+	if update.Helper != nil {
+		merged.Helper = update.Helper
+	}
+	if update.NatSrc != nil {
+		merged.NatSrc = update.NatSrc
+	}
+	if update.NatDst != nil {
+		merged.NatDst = update.NatDst
+	}
+	if update.SeqAdjOrig != nil {
+		merged.SeqAdjOrig = update.SeqAdjOrig
+	}
+	if update.SeqAdjRepl != nil {
+		merged.SeqAdjRepl = update.SeqAdjRepl
+	}
+	if update.ID != nil {
+		merged.ID = update.ID
+	}
+	if update.Status != nil {
+		merged.Status = update.Status
+	}
+	if update.StatusMask != nil {
+		merged.StatusMask = update.StatusMask
+	}
+	if update.Use != nil {
+		merged.Use = update.Use
+	}
+	if update.Mark != nil {
+		merged.Mark = update.Mark
+	}
+	if update.MarkMask != nil {
+		merged.MarkMask = update.MarkMask
+	}
+	if update.Timeout != nil {
+		merged.Timeout = update.Timeout
+	}
+	if update.Zone != nil {
+		merged.Zone = update.Zone
+	}
+	if update.Timestamp != nil {
+		merged.Timestamp = mergeTimestamp(prev.Timestamp, update.Timestamp)
+	}
+	if update.SecCtx != nil {
+		merged.SecCtx = update.SecCtx
+	}
+	if update.Exp != nil {
+		merged.Exp = update.Exp
+	}
+	if update.Label != nil {
+		merged.Label = update.Label
+	}
+	if update.LabelMask != nil {
+		merged.LabelMask = update.LabelMask
+	}
+	// the undecoded message of prev does not contain the update
+	merged.Raw = update.Raw
+	return merged
+}
+
+func mergeProtoInfo(prev, update *ProtoInfo) *ProtoInfo {
+	if prev == nil {
+		return update
+	}
+	merged := *prev
+	if update.TCP != nil {
+		merged.TCP = mergeTCPInfo(prev.TCP, update.TCP)
+	}
+	if update.DCCP != nil {
+		merged.DCCP = update.DCCP
+	}
+	if update.SCTP != nil {
+		merged.SCTP = update.SCTP
+	}
+	return &merged
+}
+
+func mergeTCPInfo(prev, update *TCPInfo) *TCPInfo {
+	if prev == nil {
+		return update
+	}
+	merged := *prev
+	if update.State != nil {
+		merged.State = update.State
+	}
+	if update.WScaleOrig != nil {
+		merged.WScaleOrig = update.WScaleOrig
+	}
+	if update.WScaleRepl != nil {
+		merged.WScaleRepl = update.WScaleRepl
+	}
+	if update.FlagsOrig != nil {
+		merged.FlagsOrig = update.FlagsOrig
+	}
+	if update.FlagsReply != nil {
+		merged.FlagsReply = update.FlagsReply
+	}
+	return &merged
+}
+
+func mergeTimestamp(prev, update *Timestamp) *Timestamp {
+	if prev == nil {
+		return update
+	}
+	merged := *prev
+	if update.Start != nil {
+		merged.Start = update.Start
+	}
+	if update.Stop != nil {
+		merged.Stop = update.Stop
+	}
+	return &merged
+}
@@ -0,0 +1,294 @@
+// Package metrics serves statistics of the conntrack subsystem in the text
+// format of Prometheus and OpenMetrics.
+//
+// The following metrics are provided. Metric names and labels are stable.
+//
+//	conntrack_entries                        gauge    Number of entries in the conntrack table.
+//	conntrack_entries_max                    gauge    Maximum number of entries in the conntrack table.
+//	conntrack_stat_found_total{cpu}          counter  Lookups of existing entries.
+//	conntrack_stat_invalid_total{cpu}        counter  Packets that could not be tracked.
+//	conntrack_stat_ignore_total{cpu}         counter  Packets that were already tracked.
+//	conntrack_stat_insert_total{cpu}         counter  Inserted entries.
+//	conntrack_stat_insert_failed_total{cpu}  counter  Entries that could not be inserted.
+//	conntrack_stat_drop_total{cpu}           counter  Packets dropped because of failed tracking.
+//	conntrack_stat_early_drop_total{cpu}     counter  Entries dropped to make room for new ones.
+//	conntrack_stat_error_total{cpu}          counter  Packets with errors.
+//	conntrack_stat_search_restart_total{cpu} counter  Restarted lookups in the table.
+//	conntrack_expect_new_total{cpu}          counter  Expectations added.
+//	conntrack_expect_create_total{cpu}       counter  Expectations created.
+//	conntrack_expect_delete_total{cpu}       counter  Expectations deleted.
+//	conntrack_scrape_success{collector}      gauge    Whether a collector succeeded (1) or failed (0).
+//
+// With Config.Breakdown set, the entries of the table are counted as well:
+//
+//	conntrack_entries_by_protocol{l4proto}   gauge    Entries by layer 4 protocol.
+//	conntrack_entries_by_tcp_state{state}    gauge    TCP entries by their state.
+//	conntrack_entries_by_zone{zone}          gauge    Entries by zone.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	ct "github.com/florianl/go-conntrack"
+)
+
+// Config contains options for the Handler.
+type Config struct {
+	// Conntrack is used to open a connection to the conntrack subsystem for
+	// every scrape.
+	Conntrack ct.Config
+
+	// Breakdown reports the number of entries by layer 4 protocol, TCP state
+	// and zone. Without Mirror, this requires a dump of the table for every
+	// scrape.
+	Breakdown bool
+
+	// Mirror is used for the breakdown instead of a dump of the table.
+	Mirror *ct.Mirror
+
+	// Logger reports errors of collectors.
+	Logger *log.Logger
+}
+
+// source provides the information of the conntrack subsystem.
+type source interface {
+	DumpGlobalStats(t ct.Table) (ct.GlobalStats, error)
+	DumpCPUStats(t ct.Table) ([]ct.CPUStat, error)
+	Dump(t ct.Table, f ct.Family) ([]ct.Con, error)
+	Close() error
+}
+
+// Handler serves statistics of the conntrack subsystem.
+type Handler struct {
+	config Config
+	open   func() (source, error)
+}
+
+// NewHandler returns a new Handler.
+func NewHandler(config Config) *Handler {
+	h := &Handler{config: config}
+	h.open = func() (source, error) {
+		return ct.Open(&h.config.Conntrack)
+	}
+	return h
+}
+
+const (
+	contentTypePrometheus  = "text/plain; version=0.0.4; charset=utf-8"
+	contentTypeOpenMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set("Content-Type", contentTypeOpenMetrics)
+	} else {
+		w.Header().Set("Content-Type", contentTypePrometheus)
+	}
+
+	src, err := h.open()
+	if err != nil {
+		h.logf("could not open conntrack: %v", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer src.Close()
+
+	bw := bufio.NewWriter(w)
+	h.write(bw, src, openMetrics)
+	bw.Flush()
+}
+
+func (h *Handler) logf(format string, v ...interface{}) {
+	if h.config.Logger != nil {
+		h.config.Logger.Printf(format, v...)
+	}
+}
+
+func (h *Handler) write(w io.Writer, src source, openMetrics bool) {
+	e := &encoder{w: w, openMetrics: openMetrics}
+	success := map[string]bool{}
+
+	stats, err := src.DumpGlobalStats(ct.Conntrack)
+	success["global"] = err == nil
+	if err != nil {
+		h.logf("could not dump global stats: %v", err)
+	} else {
+		if stats.Entries != nil {
+			e.family("conntrack_entries", "gauge", "Number of entries in the conntrack table.")
+			e.sample("conntrack_entries", nil, uint64(*stats.Entries))
+		}
+		if stats.MaxEntries != nil {
+			e.family("conntrack_entries_max", "gauge", "Maximum number of entries in the conntrack table.")
+			e.sample("conntrack_entries_max", nil, uint64(*stats.MaxEntries))
+		}
+	}
+
+	cpuStats, err := src.DumpCPUStats(ct.Conntrack)
+	success["cpu"] = err == nil
+	if err != nil {
+		h.logf("could not dump CPU stats: %v", err)
+	} else {
+		for _, m := range cpuMetrics {
+			e.cpuCounter(m, cpuStats)
+		}
+	}
+
+	expStats, err := src.DumpCPUStats(ct.Expected)
+	success["expect"] = err == nil
+	if err != nil {
+		h.logf("could not dump expect CPU stats: %v", err)
+	} else {
+		for _, m := range expectMetrics {
+			e.cpuCounter(m, expStats)
+		}
+	}
+
+	if h.config.Breakdown {
+		var entries []ct.Con
+		var dumpErr error
+		if h.config.Mirror != nil {
+			entries = h.config.Mirror.Entries()
+		} else {
+			entries, dumpErr = src.Dump(ct.Conntrack, 0)
+		}
+		success["breakdown"] = dumpErr == nil
+		if dumpErr != nil {
+			h.logf("could not dump table: %v", dumpErr)
+		} else {
+			e.breakdown(entries)
+		}
+	}
+
+	e.family("conntrack_scrape_success", "gauge", "Whether a collector succeeded (1) or failed (0).")
+	collectors := make([]string, 0, len(success))
+	for name := range success {
+		collectors = append(collectors, name)
+	}
+	sort.Strings(collectors)
+	for _, name := range collectors {
+		var v uint64
+		if success[name] {
+			v = 1
+		}
+		e.sample("conntrack_scrape_success", []label{{"collector", name}}, v)
+	}
+
+	if openMetrics {
+		fmt.Fprint(w, "# EOF\n")
+	}
+}
+
+type cpuMetric struct {
+	name  string
+	help  string
+	value func(ct.CPUStat) *uint32
+}
+
+var cpuMetrics = []cpuMetric{
+	{"conntrack_stat_found", "Lookups of existing entries.", func(s ct.CPUStat) *uint32 { return s.Found }},
+	{"conntrack_stat_invalid", "Packets that could not be tracked.", func(s ct.CPUStat) *uint32 { return s.Invalid }},
+	{"conntrack_stat_ignore", "Packets that were already tracked.", func(s ct.CPUStat) *uint32 { return s.Ignore }},
+	{"conntrack_stat_insert", "Inserted entries.", func(s ct.CPUStat) *uint32 { return s.Insert }},
+	{"conntrack_stat_insert_failed", "Entries that could not be inserted.", func(s ct.CPUStat) *uint32 { return s.InsertFailed }},
+	{"conntrack_stat_drop", "Packets dropped because of failed tracking.", func(s ct.CPUStat) *uint32 { return s.Drop }},
+	{"conntrack_stat_early_drop", "Entries dropped to make room for new ones.", func(s ct.CPUStat) *uint32 { return s.EarlyDrop }},
+	{"conntrack_stat_error", "Packets with errors.", func(s ct.CPUStat) *uint32 { return s.Error }},
+	{"conntrack_stat_search_restart", "Restarted lookups in the table.", func(s ct.CPUStat) *uint32 { return s.SearchRestart }},
+}
+
+var expectMetrics = []cpuMetric{
+	{"conntrack_expect_new", "Expectations added.", func(s ct.CPUStat) *uint32 { return s.ExpNew }},
+	{"conntrack_expect_create", "Expectations created.", func(s ct.CPUStat) *uint32 { return s.ExpCreate }},
+	{"conntrack_expect_delete", "Expectations deleted.", func(s ct.CPUStat) *uint32 { return s.ExpDelete }},
+}
+
+type label struct {
+	name, value string
+}
+
+// encoder writes metrics in the Prometheus or OpenMetrics text format.
+type encoder struct {
+	w           io.Writer
+	openMetrics bool
+}
+
+func (e *encoder) family(name, typ, help string) {
+	// OpenMetrics names counter families without the _total suffix.
+	if e.openMetrics && typ == "counter" {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	fmt.Fprintf(e.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (e *encoder) sample(name string, labels []label, value uint64) {
+	if len(labels) == 0 {
+		fmt.Fprintf(e.w, "%s %d\n", name, value)
+		return
+	}
+	pairs := make([]string, len(labels))
+	for i, l := range labels {
+		pairs[i] = fmt.Sprintf("%s=%q", l.name, l.value)
+	}
+	fmt.Fprintf(e.w, "%s{%s} %d\n", name, strings.Join(pairs, ","), value)
+}
+
+func (e *encoder) cpuCounter(m cpuMetric, stats []ct.CPUStat) {
+	var written bool
+	for _, s := range stats {
+		v := m.value(s)
+		if v == nil {
+			continue
+		}
+		if !written {
+			e.family(m.name+"_total", "counter", m.help)
+			written = true
+		}
+		e.sample(m.name+"_total", []label{{"cpu", strconv.Itoa(int(s.ID))}}, uint64(*v))
+	}
+}
+
+func (e *encoder) breakdown(entries []ct.Con) {
+	protocols := map[string]uint64{}
+	states := map[string]uint64{}
+	zones := map[string]uint64{}
+
+	for _, c := range entries {
+		key, ok := c.TupleKey()
+		if !ok {
+			continue
+		}
+		protocols[ct.ProtoName(key.L4Proto)]++
+		zones[strconv.Itoa(int(key.Zone))]++
+
+		if c.ProtoInfo != nil && c.ProtoInfo.TCP != nil && c.ProtoInfo.TCP.State != nil {
+			states[ct.TCPState(*c.ProtoInfo.TCP.State).String()]++
+		}
+	}
+
+	e.family("conntrack_entries_by_protocol", "gauge", "Entries by layer 4 protocol.")
+	e.samples("conntrack_entries_by_protocol", "l4proto", protocols)
+	e.family("conntrack_entries_by_tcp_state", "gauge", "TCP entries by their state.")
+	e.samples("conntrack_entries_by_tcp_state", "state", states)
+	e.family("conntrack_entries_by_zone", "gauge", "Entries by zone.")
+	e.samples("conntrack_entries_by_zone", "zone", zones)
+}
+
+func (e *encoder) samples(name, labelName string, values map[string]uint64) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		e.sample(name, []label{{labelName, k}}, values[k])
+	}
+}
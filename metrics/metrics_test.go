@@ -0,0 +1,152 @@
+package metrics
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ct "github.com/florianl/go-conntrack"
+)
+
+type fakeSource struct {
+	global  ct.GlobalStats
+	cpu     []ct.CPUStat
+	expect  []ct.CPUStat
+	entries []ct.Con
+	dumpErr error
+	// expErr is returned for the CPU statistics of the Expected table.
+	expErr error
+	closed bool
+}
+
+func (f *fakeSource) DumpGlobalStats(t ct.Table) (ct.GlobalStats, error) {
+	return f.global, nil
+}
+
+func (f *fakeSource) DumpCPUStats(t ct.Table) ([]ct.CPUStat, error) {
+	if t == ct.Expected {
+		return f.expect, f.expErr
+	}
+	return f.cpu, nil
+}
+
+func (f *fakeSource) Dump(t ct.Table, family ct.Family) ([]ct.Con, error) {
+	return f.entries, f.dumpErr
+}
+
+func (f *fakeSource) Close() error {
+	f.closed = true
+	return nil
+}
+
+func uint32Ptr(v uint32) *uint32 { return &v }
+
+func testCon(proto, state uint8, zone uint16) ct.Con {
+	src := net.ParseIP("10.0.0.1")
+	dst := net.ParseIP("10.0.0.2")
+	c := ct.Con{
+		Origin: &ct.IPTuple{Src: &src, Dst: &dst, Proto: &ct.ProtoTuple{Number: &proto}},
+		Zone:   &zone,
+	}
+	if proto == 6 {
+		c.ProtoInfo = &ct.ProtoInfo{TCP: &ct.TCPInfo{State: &state}}
+	}
+	return c
+}
+
+func scrape(t *testing.T, h *Handler, accept string) (string, string) {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	body, _ := ioutil.ReadAll(rec.Result().Body)
+	return rec.Result().Header.Get("Content-Type"), string(body)
+}
+
+func TestHandler(t *testing.T) {
+	src := &fakeSource{
+		global: ct.GlobalStats{Entries: uint32Ptr(3), MaxEntries: uint32Ptr(65536)},
+		cpu: []ct.CPUStat{
+			{ID: 0, Found: uint32Ptr(1), InsertFailed: uint32Ptr(2)},
+			{ID: 1, Found: uint32Ptr(5), InsertFailed: uint32Ptr(0)},
+		},
+		expect: []ct.CPUStat{{ID: 0, ExpNew: uint32Ptr(7)}},
+		entries: []ct.Con{
+			testCon(6, 3, 0),
+			testCon(6, 7, 1),
+			testCon(17, 0, 0),
+		},
+	}
+	h := NewHandler(Config{Breakdown: true})
+	h.open = func() (source, error) { return src, nil }
+
+	contentType, body := scrape(t, h, "")
+	if contentType != contentTypePrometheus {
+		t.Fatalf("unexpected content type: %s", contentType)
+	}
+	if !src.closed {
+		t.Fatalf("source was not closed")
+	}
+	for _, line := range []string{
+		"conntrack_entries 3",
+		"conntrack_entries_max 65536",
+		"# TYPE conntrack_stat_found_total counter",
+		`conntrack_stat_found_total{cpu="1"} 5`,
+		`conntrack_stat_insert_failed_total{cpu="0"} 2`,
+		`conntrack_expect_new_total{cpu="0"} 7`,
+		`conntrack_entries_by_protocol{l4proto="tcp"} 2`,
+		`conntrack_entries_by_protocol{l4proto="udp"} 1`,
+		`conntrack_entries_by_tcp_state{state="ESTABLISHED"} 1`,
+		`conntrack_entries_by_tcp_state{state="TIME_WAIT"} 1`,
+		`conntrack_entries_by_zone{zone="0"} 2`,
+		`conntrack_scrape_success{collector="breakdown"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Fatalf("missing %q in:\n%s", line, body)
+		}
+	}
+	if strings.Contains(body, "conntrack_stat_drop_total") {
+		t.Fatalf("unexpected metric for missing value:\n%s", body)
+	}
+	if strings.Contains(body, "# EOF") {
+		t.Fatalf("unexpected EOF marker in Prometheus format")
+	}
+
+	src.dumpErr = errors.New("dump failed")
+	contentType, body = scrape(t, h, "application/openmetrics-text;version=1.0.0")
+	if contentType != contentTypeOpenMetrics {
+		t.Fatalf("unexpected content type: %s", contentType)
+	}
+	for _, line := range []string{
+		"# TYPE conntrack_stat_found counter",
+		`conntrack_stat_found_total{cpu="1"} 5`,
+		`conntrack_scrape_success{collector="breakdown"} 0`,
+		"# EOF",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Fatalf("missing %q in:\n%s", line, body)
+		}
+	}
+}
+
+func TestHandlerMirror(t *testing.T) {
+	src := &fakeSource{expErr: errors.New("dump failed")}
+	h := NewHandler(Config{Breakdown: true, Mirror: &ct.Mirror{}})
+	h.open = func() (source, error) { return src, nil }
+
+	_, body := scrape(t, h, "")
+	for _, line := range []string{
+		`conntrack_scrape_success{collector="expect"} 0`,
+		`conntrack_scrape_success{collector="breakdown"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Fatalf("missing %q in:\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,437 @@
+package conntrack
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrMirrorDecodeMask is returned by OpenMirror, if the DecodeMask of the
+// Config does not contain FieldOrigin, which identifies the entries.
+var ErrMirrorDecodeMask = errors.New("decode mask of mirror lacks FieldOrigin")
+
+// MirrorChange describes how an entry of a Mirror changed.
+type MirrorChange int
+
+// Changes of entries of a Mirror
+const (
+	MirrorAdded MirrorChange = iota
+	MirrorUpdated
+	MirrorRemoved
+)
+
+// MirrorEvent describes the change of an entry of a Mirror.
+type MirrorEvent struct {
+	Change MirrorChange
+
+	// Prev is the entry before the change. It is empty for MirrorAdded.
+	Prev Con
+
+	// Entry is the entry after the change. For MirrorRemoved it contains
+	// the removed entry including the attributes of the destroy event.
+	Entry Con
+}
+
+// MirrorConfig contains options for a Mirror.
+type MirrorConfig struct {
+	// Config is used to open the sockets of the Mirror.
+	Config Config
+
+	// Family restricts the Mirror to IPv4 or IPv6 entries. If not set,
+	// entries of both families are mirrored.
+	Family Family
+
+	// OnChange is called for every change of the Mirror. Calls happen in the
+	// order of the changes and must not block for long, as this delays
+	// processing further events.
+	OnChange func(MirrorEvent)
+}
+
+// Mirror is an in-memory copy of the conntrack table, that is kept in sync
+// by events. Entries returned by a Mirror are shared and must not be modified.
+type Mirror struct {
+	config MirrorConfig
+	events *Nfct
+
+	// cbMu keeps calls of OnChange in the order of the changes.
+	cbMu sync.Mutex
+
+	mu         sync.RWMutex
+	synced     bool
+	pending    []mirrorPending
+	resyncSeen map[TupleKey]struct{}
+	entries    map[TupleKey]Con
+	byID       map[uint32]TupleKey
+	bySrc      mirrorIndex
+	byMark     mirrorIndex
+	byZone     mirrorIndex
+}
+
+// mirrorPending is an event, that was received before the initial dump was
+// loaded.
+type mirrorPending struct {
+	c        Con
+	received time.Time
+}
+
+// mirrorIndex maps an attribute value to the keys of the entries with this value.
+type mirrorIndex map[interface{}]map[TupleKey]struct{}
+
+func (idx mirrorIndex) add(value interface{}, key TupleKey) {
+	keys, ok := idx[value]
+	if !ok {
+		keys = make(map[TupleKey]struct{})
+		idx[value] = keys
+	}
+	keys[key] = struct{}{}
+}
+
+func (idx mirrorIndex) remove(value interface{}, key TupleKey) {
+	keys, ok := idx[value]
+	if !ok {
+		return
+	}
+	delete(keys, key)
+	if len(keys) == 0 {
+		delete(idx, value)
+	}
+}
+
+// OpenMirror subscribes to the events of the conntrack table, dumps the table
+// and returns a Mirror, that contains all entries. Events, that are received
+// while dumping, are applied afterwards, unless the dump already contains
+// their change. Overflows of the receive buffer are handled by a fresh dump of
+// the table. If a DecodeMask is set, it has to contain FieldOrigin.
+func OpenMirror(ctx context.Context, config *MirrorConfig) (*Mirror, error) {
+	if mask := fieldMask(config.Config.DecodeMask); mask&FieldOrigin == 0 {
+		return nil, ErrMirrorDecodeMask
+	}
+	m := newMirror(*config)
+
+	eventConfig := config.Config
+	eventConfig.AddConntrackInformation = true
+	eventConfig.ResyncOnOverflow = true
+	eventConfig.ResyncDump = true
+	eventConfig.NoENOBUFS = false
+	events, err := Open(&eventConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := events.Register(ctx, Conntrack, NetlinkCtNew|NetlinkCtUpdate|NetlinkCtDestroy, m.hook); err != nil {
+		events.Close()
+		return nil, err
+	}
+	m.events = events
+
+	dumper, err := Open(&config.Config)
+	if err != nil {
+		events.Close()
+		return nil, err
+	}
+	start := time.Now()
+	entries, err := dumper.Dump(Conntrack, config.Family)
+	dumper.Close()
+	if err != nil {
+		events.Close()
+		return nil, err
+	}
+	m.load(entries, start)
+
+	return m, nil
+}
+
+func newMirror(config MirrorConfig) *Mirror {
+	return &Mirror{
+		config:  config,
+		entries: make(map[TupleKey]Con),
+		byID:    make(map[uint32]TupleKey),
+		bySrc:   make(mirrorIndex),
+		byMark:  make(mirrorIndex),
+		byZone:  make(mirrorIndex),
+	}
+}
+
+// Close stops the Mirror from receiving further events.
+func (m *Mirror) Close() error {
+	return m.events.Close()
+}
+
+// Len returns the number of entries.
+func (m *Mirror) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.entries)
+}
+
+// Entries returns all entries.
+func (m *Mirror) Entries() []Con {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	entries := make([]Con, 0, len(m.entries))
+	for _, c := range m.entries {
+		entries = append(entries, c)
+	}
+	return entries
+}
+
+// Get returns the entry with the given key.
+func (m *Mirror) Get(key TupleKey) (Con, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	c, ok := m.entries[key]
+	return c, ok
+}
+
+// GetByID returns the entry with the given conntrack ID.
+func (m *Mirror) GetByID(id uint32) (Con, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	key, ok := m.byID[id]
+	if !ok {
+		return Con{}, false
+	}
+	c, ok := m.entries[key]
+	return c, ok
+}
+
+// BySource returns all entries with the given source IP in the original tuple.
+func (m *Mirror) BySource(ip net.IP) []Con {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.collect(m.bySrc[ipKey(ip)])
+}
+
+// ByMark returns all entries with the given mark.
+func (m *Mirror) ByMark(mark uint32) []Con {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.collect(m.byMark[mark])
+}
+
+// ByZone returns all entries of the given zone.
+func (m *Mirror) ByZone(zone uint16) []Con {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.collect(m.byZone[zone])
+}
+
+func (m *Mirror) collect(keys map[TupleKey]struct{}) []Con {
+	entries := make([]Con, 0, len(keys))
+	for key := range keys {
+		entries = append(entries, m.entries[key])
+	}
+	return entries
+}
+
+// hook receives the events of the conntrack table.
+func (m *Mirror) hook(c Con) int {
+	if c.Info == nil {
+		return 0
+	}
+	m.mu.Lock()
+	if !m.synced {
+		m.pending = append(m.pending, mirrorPending{c: c, received: time.Now()})
+		m.mu.Unlock()
+		return 0
+	}
+	m.unlockAndNotify(m.handle(c))
+	return 0
+}
+
+// load applies the initial dump, that started at start, and the events, that
+// were received meanwhile. Events, that were received before the dump started,
+// are contained in the dump. The events of a connection, that is contained in
+// the dump, are merged into the dumped entry. Of its destroy events, only the
+// one, after which no further event of the tuple followed, is applied.
+func (m *Mirror) load(entries []Con, start time.Time) {
+	var changes []MirrorEvent
+
+	m.mu.Lock()
+	dumped := make(map[TupleKey]Con, len(entries))
+	for _, c := range entries {
+		if key, ok := c.TupleKey(); ok {
+			dumped[key] = c
+		}
+		changes = append(changes, m.upsert(c)...)
+	}
+
+	last := make(map[TupleKey]int)
+	for i, p := range m.pending {
+		if key, ok := p.c.TupleKey(); ok && !p.received.Before(start) {
+			last[key] = i
+		}
+	}
+	var skipResync bool
+	for i, p := range m.pending {
+		c, early := p.c, p.received.Before(start)
+		switch {
+		case c.Info.Overflow:
+			// a resync, that started before the dump, is older than it
+			skipResync = early
+			if early {
+				continue
+			}
+		case c.Info.Resync || c.Info.ResyncDone:
+			if skipResync {
+				skipResync = !c.Info.ResyncDone
+				continue
+			}
+		case early:
+			continue
+		default:
+			key, ok := c.TupleKey()
+			if !ok {
+				break
+			}
+			if d, ok := dumped[key]; ok && sameConnection(d, c) &&
+				c.Info.NetlinkGroup == NetlinkCtDestroy && last[key] != i {
+				continue
+			}
+		}
+		changes = append(changes, m.handle(c)...)
+	}
+	m.pending = nil
+	m.synced = true
+	m.unlockAndNotify(changes)
+}
+
+// unlockAndNotify releases m.mu and passes changes to OnChange. cbMu is
+// acquired before m.mu is released, so that changes are reported in order.
+func (m *Mirror) unlockAndNotify(changes []MirrorEvent) {
+	m.cbMu.Lock()
+	m.mu.Unlock()
+	defer m.cbMu.Unlock()
+
+	if m.config.OnChange == nil {
+		return
+	}
+	for _, change := range changes {
+		m.config.OnChange(change)
+	}
+}
+
+// handle applies an event. m.mu has to be held.
+func (m *Mirror) handle(c Con) []MirrorEvent {
+	switch {
+	case c.Info.Overflow:
+		m.resyncSeen = make(map[TupleKey]struct{})
+		return nil
+	case c.Info.Resync:
+		if key, ok := c.TupleKey(); ok && m.resyncSeen != nil {
+			m.resyncSeen[key] = struct{}{}
+		}
+		return m.upsert(c)
+	case c.Info.ResyncDone:
+		var changes []MirrorEvent
+		for key, prev := range m.entries {
+			if _, ok := m.resyncSeen[key]; ok {
+				continue
+			}
+			m.unindex(key, prev)
+			delete(m.entries, key)
+			changes = append(changes, MirrorEvent{Change: MirrorRemoved, Prev: prev, Entry: prev})
+		}
+		m.resyncSeen = nil
+		return changes
+	case c.Info.NetlinkGroup == NetlinkCtDestroy:
+		return m.remove(c)
+	default:
+		return m.upsert(c)
+	}
+}
+
+// keyOf returns the key of c. Events without original tuple are looked up by their ID.
+func (m *Mirror) keyOf(c Con) (TupleKey, bool) {
+	if key, ok := c.TupleKey(); ok {
+		return key, true
+	}
+	if c.ID != nil {
+		key, ok := m.byID[*c.ID]
+		return key, ok
+	}
+	return TupleKey{}, false
+}
+
+func (m *Mirror) accept(c Con) bool {
+	if m.config.Family == 0 || c.Origin == nil || c.Origin.Src == nil {
+		return true
+	}
+	isIPv4 := c.Origin.Src.To4() != nil
+	return isIPv4 == (m.config.Family == IPv4)
+}
+
+func (m *Mirror) upsert(c Con) []MirrorEvent {
+	if !m.accept(c) {
+		return nil
+	}
+	key, ok := m.keyOf(c)
+	if !ok {
+		return nil
+	}
+	prev, exists := m.entries[key]
+	if !exists {
+		entry := MergeCon(Con{}, c)
+		m.entries[key] = entry
+		m.index(key, entry)
+		return []MirrorEvent{{Change: MirrorAdded, Entry: entry}}
+	}
+
+	var changes []MirrorEvent
+	base := prev
+	if prev.ID != nil && c.ID != nil && *prev.ID != *c.ID {
+		// The tuple is used by a new connection, while the destroy event
+		// of the previous connection got lost.
+		changes = append(changes, MirrorEvent{Change: MirrorRemoved, Prev: prev, Entry: prev})
+		base = Con{}
+	}
+	m.unindex(key, prev)
+	entry := MergeCon(base, c)
+	m.entries[key] = entry
+	m.index(key, entry)
+	if base.Origin == nil {
+		return append(changes, MirrorEvent{Change: MirrorAdded, Entry: entry})
+	}
+	return append(changes, MirrorEvent{Change: MirrorUpdated, Prev: prev, Entry: entry})
+}
+
+func (m *Mirror) remove(c Con) []MirrorEvent {
+	key, ok := m.keyOf(c)
+	if !ok {
+		return nil
+	}
+	prev, exists := m.entries[key]
+	if !exists {
+		return nil
+	}
+	if prev.ID != nil && c.ID != nil && *prev.ID != *c.ID {
+		// destroy event of a previous connection with the same tuple
+		return nil
+	}
+	m.unindex(key, prev)
+	delete(m.entries, key)
+	return []MirrorEvent{{Change: MirrorRemoved, Prev: prev, Entry: MergeCon(prev, c)}}
+}
+
+func (m *Mirror) index(key TupleKey, c Con) {
+	if c.ID != nil {
+		m.byID[*c.ID] = key
+	}
+	m.bySrc.add(key.Src, key)
+	m.byZone.add(key.Zone, key)
+	if c.Mark != nil {
+		m.byMark.add(*c.Mark, key)
+	}
+}
+
+func (m *Mirror) unindex(key TupleKey, c Con) {
+	if c.ID != nil {
+		delete(m.byID, *c.ID)
+	}
+	m.bySrc.remove(key.Src, key)
+	m.byZone.remove(key.Zone, key)
+	if c.Mark != nil {
+		m.byMark.remove(*c.Mark, key)
+	}
+}
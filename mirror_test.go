@@ -0,0 +1,162 @@
+package conntrack
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// mirrorEvent returns testCon as event of group from src with id and mark.
+func mirrorEvent(src string, id, mark uint32, group NetlinkGroup) Con {
+	c := testCon(1000)
+	srcIP := net.ParseIP(src)
+	c.Info = &InfoSource{Table: Conntrack, NetlinkGroup: group}
+	c.Origin.Src = &srcIP
+	c.ID = &id
+	c.Mark = &mark
+	return c
+}
+
+func TestMirror(t *testing.T) {
+	var changes []MirrorChange
+	m := newMirror(MirrorConfig{OnChange: func(ev MirrorEvent) {
+		changes = append(changes, ev.Change)
+	}})
+
+	// events received while dumping are queued
+	m.hook(mirrorEvent("192.168.0.2", 2, 0x10, NetlinkCtNew))
+	m.hook(mirrorEvent("192.168.0.1", 1, 0x0, NetlinkCtDestroy))
+	if len(changes) != 0 {
+		t.Fatalf("unexpected changes before initial dump: %v", changes)
+	}
+
+	dump := mirrorEvent("192.168.0.1", 1, 0x0, 0)
+	dump.Info = nil
+	m.load([]Con{dump}, time.Time{})
+
+	if m.Len() != 1 {
+		t.Fatalf("unexpected number of entries: %d", m.Len())
+	}
+	if _, ok := m.GetByID(1); ok {
+		t.Fatalf("destroyed entry is still mirrored")
+	}
+	c, ok := m.GetByID(2)
+	if !ok {
+		t.Fatalf("could not get entry by ID")
+	}
+	if c.Info != nil {
+		t.Fatalf("mirrored entry contains event information")
+	}
+
+	// partial update
+	state := uint8(4)
+	update := Con{Info: &InfoSource{Table: Conntrack, NetlinkGroup: NetlinkCtUpdate},
+		ID: c.ID, ProtoInfo: &ProtoInfo{TCP: &TCPInfo{State: &state}}}
+	m.hook(update)
+	key, _ := c.TupleKey()
+	updated, ok := m.Get(key)
+	if !ok || updated.ProtoInfo == nil || *updated.ProtoInfo.TCP.State != 4 || *updated.Mark != 0x10 {
+		t.Fatalf("unexpected entry after update: %#v", updated)
+	}
+
+	if entries := m.BySource(net.ParseIP("192.168.0.2")); len(entries) != 1 {
+		t.Fatalf("unexpected entries by source: %d", len(entries))
+	}
+	if entries := m.ByMark(0x10); len(entries) != 1 {
+		t.Fatalf("unexpected entries by mark: %d", len(entries))
+	}
+	if entries := m.ByZone(1); len(entries) != 1 {
+		t.Fatalf("unexpected entries by zone: %d", len(entries))
+	}
+
+	// tuple reused by a new connection
+	m.hook(mirrorEvent("192.168.0.2", 3, 0x20, NetlinkCtNew))
+	if _, ok := m.GetByID(2); ok {
+		t.Fatalf("previous connection is still mirrored")
+	}
+	if entries := m.ByMark(0x10); len(entries) != 0 {
+		t.Fatalf("index of previous connection is still present")
+	}
+
+	// stale destroy event
+	m.hook(mirrorEvent("192.168.0.2", 2, 0x10, NetlinkCtDestroy))
+	if m.Len() != 1 {
+		t.Fatalf("stale destroy event removed entry")
+	}
+
+	// resync after an overflow
+	m.hook(Con{Info: &InfoSource{Table: Conntrack, Overflow: true}})
+	resync := mirrorEvent("192.168.0.3", 4, 0x0, 0)
+	resync.Info = &InfoSource{Table: Conntrack, Resync: true}
+	m.hook(resync)
+	m.hook(Con{Info: &InfoSource{Table: Conntrack, ResyncDone: true}})
+	if m.Len() != 1 {
+		t.Fatalf("unexpected number of entries after resync: %d", m.Len())
+	}
+	if _, ok := m.GetByID(4); !ok {
+		t.Fatalf("could not get resynced entry")
+	}
+
+	want := []MirrorChange{MirrorAdded, MirrorAdded, MirrorRemoved, MirrorUpdated,
+		MirrorRemoved, MirrorAdded, MirrorAdded, MirrorRemoved}
+	if len(changes) != len(want) {
+		t.Fatalf("unexpected changes:\n- want: %v\n-  got: %v", want, changes)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Fatalf("unexpected changes:\n- want: %v\n-  got: %v", want, changes)
+		}
+	}
+}
+
+func TestMirrorPending(t *testing.T) {
+	m := newMirror(MirrorConfig{})
+	before := mirrorPending{c: mirrorEvent("192.168.0.1", 1, 0x1, NetlinkCtNew)}
+	start := time.Now()
+	during := func(c Con) mirrorPending {
+		return mirrorPending{c: c, received: start.Add(time.Millisecond)}
+	}
+	m.pending = []mirrorPending{
+		// contained in the dump
+		before,
+		{c: mirrorEvent("192.168.0.2", 2, 0x1, NetlinkCtDestroy)},
+		// merged into the dumped state of the connection
+		during(mirrorEvent("192.168.0.1", 1, 0x2, NetlinkCtUpdate)),
+		// the connection ended after it was dumped
+		during(mirrorEvent("192.168.0.3", 3, 0x1, NetlinkCtUpdate)),
+		during(mirrorEvent("192.168.0.3", 3, 0x1, NetlinkCtDestroy)),
+		// the tuple was reused after it was dumped
+		during(mirrorEvent("192.168.0.4", 5, 0x5, NetlinkCtNew)),
+	}
+
+	var dump []Con
+	for i, src := range []string{"192.168.0.1", "192.168.0.2", "192.168.0.3", "192.168.0.4"} {
+		c := mirrorEvent(src, uint32(i+1), 0x3, 0)
+		c.Info = nil
+		timeout := uint32(120)
+		c.Timeout = &timeout
+		dump = append(dump, c)
+	}
+	m.load(dump, start)
+
+	if m.Len() != 3 {
+		t.Fatalf("unexpected number of entries: %d", m.Len())
+	}
+	if c, ok := m.GetByID(1); !ok || *c.Mark != 0x2 || c.Timeout == nil {
+		t.Fatalf("update event was not merged into the dumped entry: %#v", c)
+	}
+	if _, ok := m.GetByID(2); !ok {
+		t.Fatalf("dumped entry was removed by an older event")
+	}
+	if _, ok := m.GetByID(3); ok {
+		t.Fatalf("destroyed entry is still mirrored")
+	}
+	if c, ok := m.GetByID(5); !ok || *c.Mark != 0x5 {
+		t.Fatalf("new connection is not mirrored: %#v", c)
+	}
+
+	if _, err := OpenMirror(context.Background(), &MirrorConfig{Config: Config{DecodeMask: FieldMark}}); err != ErrMirrorDecodeMask {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -80,6 +80,30 @@ func nestAttributes(logger *log.Logger, filters *Con) ([]byte, error) {
 		ae.Bytes(ctaNatSrc|nlafNested, data)
 	}
 
+	if filters.NatDst != nil {
+		data, err := marshalNat(logger, filters.NatDst)
+		if err != nil {
+			return []byte{}, err
+		}
+		ae.Bytes(ctaNatDst|nlafNested, data)
+	}
+
+	if filters.SeqAdjOrig != nil {
+		data, err := marshalSeqAdj(logger, filters.SeqAdjOrig)
+		if err != nil {
+			return []byte{}, err
+		}
+		ae.Bytes(ctaSeqAdjOrig|nlafNested, data)
+	}
+
+	if filters.SeqAdjRepl != nil {
+		data, err := marshalSeqAdj(logger, filters.SeqAdjRepl)
+		if err != nil {
+			return []byte{}, err
+		}
+		ae.Bytes(ctaSeqAdjRepl|nlafNested, data)
+	}
+
 	if filters.Exp != nil {
 		if err := nestExpectedAttributes(logger, ae, filters.Exp); err != nil {
 			return []byte{}, err
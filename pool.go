@@ -0,0 +1,124 @@
+package conntrack
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/mdlayher/netlink"
+)
+
+// ErrClosed is returned, if a request is made after Close.
+var ErrClosed = errors.New("connection to conntrack is closed")
+
+// connPool hands out the sockets, requests are sent over. A socket is used by
+// a single request at a time, so the replies of parallel requests can not
+// interleave.
+type connPool struct {
+	// idle sockets, that are ready for the next request
+	idle chan *netlink.Conn
+	// slots limits the number of dialed sockets. It is nil, if the pool
+	// consists of a single shared socket.
+	slots chan struct{}
+	dial  func() (*netlink.Conn, error)
+
+	mu     sync.Mutex
+	conns  []*netlink.Conn
+	closed bool
+}
+
+// newSharedPool returns a pool, that serializes all requests on con.
+func newSharedPool(con *netlink.Conn) *connPool {
+	p := &connPool{idle: make(chan *netlink.Conn, 1)}
+	p.idle <- con
+	return p
+}
+
+// newDialPool returns a pool, that dials up to limit sockets on demand.
+func newDialPool(limit int, dial func() (*netlink.Conn, error)) *connPool {
+	return &connPool{
+		idle:  make(chan *netlink.Conn, limit),
+		slots: make(chan struct{}, limit),
+		dial:  dial,
+	}
+}
+
+// acquire returns a socket for exclusive use, waiting until one is available
+// or ctx is done. The socket has to be returned with release.
+func (p *connPool) acquire(ctx context.Context) (*netlink.Conn, error) {
+	select {
+	case con := <-p.idle:
+		return con, nil
+	default:
+	}
+
+	select {
+	case con := <-p.idle:
+		return con, nil
+	case p.slots <- struct{}{}:
+		con, err := p.open()
+		if err != nil {
+			<-p.slots
+			return nil, err
+		}
+		return con, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *connPool) open() (*netlink.Conn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, ErrClosed
+	}
+	con, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+	p.conns = append(p.conns, con)
+	return con, nil
+}
+
+// release returns con to the pool.
+func (p *connPool) release(con *netlink.Conn) {
+	p.idle <- con
+}
+
+// close closes all dialed sockets. Requests, that are in progress, fail.
+func (p *connPool) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	var err error
+	for _, con := range p.conns {
+		if e := con.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	p.conns = nil
+	return err
+}
+
+// requestPool returns the pool of sockets for requests. Without a configured
+// limit of concurrent requests, all requests share the socket of nfct.
+func (nfct *Nfct) requestPool() *connPool {
+	nfct.poolOnce.Do(func() {
+		if nfct.pool == nil {
+			nfct.pool = newSharedPool(nfct.Con)
+		}
+	})
+	return nfct.pool
+}
+
+// withConn runs fn with a socket, that is exclusively used by fn.
+func (nfct *Nfct) withConn(ctx context.Context, fn func(con *netlink.Conn) error) error {
+	pool := nfct.requestPool()
+	con, err := pool.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer pool.release(con)
+	return fn(con)
+}
@@ -0,0 +1,119 @@
+package conntrack
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nltest"
+)
+
+// echoConn returns a socket, that replies to a request with an entry carrying
+// the attributes of the request.
+func echoConn() *netlink.Conn {
+	return nltest.Dial(func(reqs []netlink.Message) ([]netlink.Message, error) {
+		if len(reqs) == 0 {
+			return nil, nil
+		}
+		req := reqs[0]
+		return []netlink.Message{
+			{
+				Header: netlink.Header{Type: netlink.HeaderType(1<<8 | ipctnlMsgCtNew), Sequence: req.Header.Sequence},
+				Data:   req.Data,
+			},
+			{
+				Header: netlink.Header{Type: netlink.Error, Sequence: req.Header.Sequence},
+				Data:   make([]byte, 20),
+			},
+		}, nil
+	})
+}
+
+func concurrentGets(t *testing.T, nfct *Nfct, n int) {
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(port uint16) {
+			defer wg.Done()
+			src, dst, proto := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), uint8(17)
+			match := Con{Origin: &IPTuple{Src: &src, Dst: &dst, Proto: &ProtoTuple{Number: &proto, SrcPort: &port, DstPort: &port}}}
+			for j := 0; j < 20; j++ {
+				list, err := nfct.Get(Conntrack, IPv4, match)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if len(list) != 1 || *list[0].Origin.Proto.SrcPort != port {
+					t.Errorf("reply for port %d does not match: %v", port, list)
+					return
+				}
+			}
+		}(uint16(40000 + i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+
+	t.Run("shared socket", func(t *testing.T) {
+		nfct := &Nfct{logger: logger}
+		AdjustWriteTimeout(nfct, func() error { return nil })
+		nfct.Con = echoConn()
+		defer nfct.Con.Close()
+
+		concurrentGets(t, nfct, 8)
+	})
+
+	t.Run("socket pool", func(t *testing.T) {
+		var mu sync.Mutex
+		var dialed int
+		nfct := &Nfct{logger: logger}
+		AdjustWriteTimeout(nfct, func() error { return nil })
+		nfct.Con = echoConn()
+		nfct.pool = newDialPool(3, func() (*netlink.Conn, error) {
+			mu.Lock()
+			dialed++
+			mu.Unlock()
+			return echoConn(), nil
+		})
+
+		concurrentGets(t, nfct, 8)
+		if dialed < 1 || dialed > 3 {
+			t.Fatalf("unexpected number of sockets: %d", dialed)
+		}
+		if err := nfct.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := nfct.pool.open(); err != ErrClosed {
+			t.Fatalf("unexpected error after close: %v", err)
+		}
+	})
+
+	t.Run("cancelled wait", func(t *testing.T) {
+		nfct := &Nfct{logger: logger}
+		nfct.pool = newDialPool(1, func() (*netlink.Conn, error) {
+			return echoConn(), nil
+		})
+		con, err := nfct.requestPool().acquire(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer con.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := nfct.requestPool().acquire(ctx); err != context.Canceled {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
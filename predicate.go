@@ -0,0 +1,603 @@
+package conntrack
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// Endpoint selects the source or destination of a tuple of an entry.
+type Endpoint uint8
+
+// Endpoints of MatchCIDR and MatchPorts
+const (
+	EndpointOrigSrc Endpoint = iota
+	EndpointOrigDst
+	EndpointReplSrc
+	EndpointReplDst
+)
+
+type allPredicate []Predicate
+
+type anyPredicate []Predicate
+
+type notPredicate struct {
+	p Predicate
+}
+
+type cidrPredicate struct {
+	e    Endpoint
+	nets []*net.IPNet
+}
+
+type portPredicate struct {
+	e        Endpoint
+	min, max uint16
+}
+
+type valuePredicate struct {
+	typ   ConnAttrType
+	op    CompareOp
+	value uint64
+}
+
+// MatchAll returns a Predicate, that matches if all ps match. Without ps, it
+// matches every entry.
+func MatchAll(ps ...Predicate) Predicate {
+	return allPredicate(ps)
+}
+
+// MatchAny returns a Predicate, that matches if any of ps matches. Without ps,
+// it matches no entry.
+func MatchAny(ps ...Predicate) Predicate {
+	return anyPredicate(ps)
+}
+
+// MatchNot returns a Predicate, that matches if p does not match.
+func MatchNot(p Predicate) Predicate {
+	return notPredicate{p: p}
+}
+
+// MatchCIDR returns a Predicate, that matches if the address of e is within
+// any of nets. Networks of IPv4 and IPv6 can be mixed.
+func MatchCIDR(e Endpoint, nets ...*net.IPNet) Predicate {
+	return cidrPredicate{e: e, nets: nets}
+}
+
+// MatchPorts returns a Predicate, that matches if the port of e is within min
+// and max, inclusively. It does not match entries of protocols without ports.
+func MatchPorts(e Endpoint, min, max uint16) Predicate {
+	return portPredicate{e: e, min: min, max: max}
+}
+
+// MatchValue returns a Predicate, that compares the value of a numeric
+// attribute with value, like AttrCompare. The ports, the protocol numbers,
+// the ICMP fields, AttrTCPState, AttrTimeout, AttrMark, AttrUse, AttrID,
+// AttrStatus, AttrZone, the counters, AttrTimestampStart and AttrTimestampStop
+// are supported. Timestamps are compared in nanoseconds since the epoch. It
+// does not match, if the attribute is not set.
+func MatchValue(typ ConnAttrType, op CompareOp, value uint64) Predicate {
+	return valuePredicate{typ: typ, op: op, value: value}
+}
+
+// Match reports whether all predicates of p match c.
+func (p allPredicate) Match(c Con) bool {
+	for _, sub := range p {
+		if !sub.Match(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Match reports whether any predicate of p matches c.
+func (p anyPredicate) Match(c Con) bool {
+	for _, sub := range p {
+		if sub.Match(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match reports whether the negated predicate does not match c.
+func (p notPredicate) Match(c Con) bool {
+	return !p.p.Match(c)
+}
+
+// Match reports whether the address of the endpoint is within the networks.
+func (p cidrPredicate) Match(c Con) bool {
+	ip := p.e.addr(c)
+	if ip == nil {
+		return false
+	}
+	for _, n := range p.nets {
+		if n.Contains(*ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match reports whether the port of the endpoint is within the range.
+func (p portPredicate) Match(c Con) bool {
+	port := p.e.port(c)
+	return port != nil && *port >= p.min && *port <= p.max
+}
+
+// Match reports whether the value of the attribute satisfies the comparison.
+func (p valuePredicate) Match(c Con) bool {
+	v, ok := attrValue(c, p.typ)
+	if !ok {
+		return false
+	}
+	switch p.op {
+	case OpEqual:
+		return v == p.value
+	case OpNotEqual:
+		return v != p.value
+	case OpLess:
+		return v < p.value
+	case OpLessEqual:
+		return v <= p.value
+	case OpGreater:
+		return v > p.value
+	case OpGreaterEqual:
+		return v >= p.value
+	}
+	return false
+}
+
+func (e Endpoint) tuple(c Con) *IPTuple {
+	if e == EndpointReplSrc || e == EndpointReplDst {
+		return c.Reply
+	}
+	return c.Origin
+}
+
+func (e Endpoint) source() bool {
+	return e == EndpointOrigSrc || e == EndpointReplSrc
+}
+
+func (e Endpoint) addr(c Con) *net.IP {
+	t := e.tuple(c)
+	if t == nil {
+		return nil
+	}
+	if e.source() {
+		return t.Src
+	}
+	return t.Dst
+}
+
+func (e Endpoint) port(c Con) *uint16 {
+	p := protoTuple(e.tuple(c))
+	if e.source() {
+		return p.SrcPort
+	}
+	return p.DstPort
+}
+
+// endpointAttrs holds the attributes of the ports and of the addresses of
+// either family, that are indexed by Endpoint.
+var endpointAttrs = map[Family][]ConnAttrType{
+	0:    {AttrOrigPortSrc, AttrOrigPortDst, AttrReplPortSrc, AttrReplPortDst},
+	IPv4: {AttrOrigIPv4Src, AttrOrigIPv4Dst, AttrReplIPv4Src, AttrReplIPv4Dst},
+	IPv6: {AttrOrigIPv6Src, AttrOrigIPv6Dst, AttrReplIPv6Src, AttrReplIPv6Dst},
+}
+
+// attrValues returns the values of the numeric attributes of an entry, that
+// are compared by MatchValue.
+var attrValues = map[ConnAttrType]func(c Con) (uint64, bool){
+	AttrOrigPortSrc: func(c Con) (uint64, bool) { return value16(protoTuple(c.Origin).SrcPort) },
+	AttrOrigPortDst: func(c Con) (uint64, bool) { return value16(protoTuple(c.Origin).DstPort) },
+	AttrReplPortSrc: func(c Con) (uint64, bool) { return value16(protoTuple(c.Reply).SrcPort) },
+	AttrReplPortDst: func(c Con) (uint64, bool) { return value16(protoTuple(c.Reply).DstPort) },
+	AttrOrigL4Proto: func(c Con) (uint64, bool) { return value8(protoTuple(c.Origin).Number) },
+	AttrReplL4Proto: func(c Con) (uint64, bool) { return value8(protoTuple(c.Reply).Number) },
+	AttrIcmpType:    func(c Con) (uint64, bool) { return value8(protoTuple(c.Origin).IcmpType) },
+	AttrIcmpCode:    func(c Con) (uint64, bool) { return value8(protoTuple(c.Origin).IcmpCode) },
+	AttrIcmpID:      func(c Con) (uint64, bool) { return value16(protoTuple(c.Origin).IcmpID) },
+	AttrIcmpv6Type:  func(c Con) (uint64, bool) { return value8(protoTuple(c.Origin).Icmpv6Type) },
+	AttrIcmpv6Code:  func(c Con) (uint64, bool) { return value8(protoTuple(c.Origin).Icmpv6Code) },
+	AttrIcmpv6ID:    func(c Con) (uint64, bool) { return value16(protoTuple(c.Origin).Icmpv6ID) },
+	AttrTCPState: func(c Con) (uint64, bool) {
+		if c.ProtoInfo == nil || c.ProtoInfo.TCP == nil {
+			return 0, false
+		}
+		return value8(c.ProtoInfo.TCP.State)
+	},
+	AttrTimeout:            func(c Con) (uint64, bool) { return value32(c.Timeout) },
+	AttrMark:               func(c Con) (uint64, bool) { return value32(c.Mark) },
+	AttrUse:                func(c Con) (uint64, bool) { return value32(c.Use) },
+	AttrID:                 func(c Con) (uint64, bool) { return value32(c.ID) },
+	AttrStatus:             func(c Con) (uint64, bool) { return value32(c.Status) },
+	AttrZone:               func(c Con) (uint64, bool) { return value16(c.Zone) },
+	AttrOrigCounterPackets: func(c Con) (uint64, bool) { return counterValue(c.CounterOrigin, true) },
+	AttrOrigCounterBytes:   func(c Con) (uint64, bool) { return counterValue(c.CounterOrigin, false) },
+	AttrReplCounterPackets: func(c Con) (uint64, bool) { return counterValue(c.CounterReply, true) },
+	AttrReplCounterBytes:   func(c Con) (uint64, bool) { return counterValue(c.CounterReply, false) },
+	AttrTimestampStart: func(c Con) (uint64, bool) {
+		if c.Timestamp == nil {
+			return 0, false
+		}
+		return timeValue(c.Timestamp.Start)
+	},
+	AttrTimestampStop: func(c Con) (uint64, bool) {
+		if c.Timestamp == nil {
+			return 0, false
+		}
+		return timeValue(c.Timestamp.Stop)
+	},
+}
+
+// attrValue returns the value of the numeric attribute typ of c.
+func attrValue(c Con, typ ConnAttrType) (uint64, bool) {
+	value, ok := attrValues[typ]
+	if !ok {
+		return 0, false
+	}
+	return value(c)
+}
+
+func protoTuple(t *IPTuple) *ProtoTuple {
+	if t == nil || t.Proto == nil {
+		return &ProtoTuple{}
+	}
+	return t.Proto
+}
+
+func value8(v *uint8) (uint64, bool) {
+	if v == nil {
+		return 0, false
+	}
+	return uint64(*v), true
+}
+
+func value16(v *uint16) (uint64, bool) {
+	if v == nil {
+		return 0, false
+	}
+	return uint64(*v), true
+}
+
+func value32(v *uint32) (uint64, bool) {
+	if v == nil {
+		return 0, false
+	}
+	return uint64(*v), true
+}
+
+func counterValue(c *Counter, packets bool) (uint64, bool) {
+	if c == nil {
+		return 0, false
+	}
+	if packets {
+		if c.Packets != nil {
+			return *c.Packets, true
+		}
+		return value32(c.Packets32)
+	}
+	if c.Bytes != nil {
+		return *c.Bytes, true
+	}
+	return value32(c.Bytes32)
+}
+
+func timeValue(t *time.Time) (uint64, bool) {
+	if t == nil {
+		return 0, false
+	}
+	return uint64(t.UnixNano()), true
+}
+
+// attrData returns v as the value of an attribute of n bytes in network byte
+// order.
+func attrData(v uint64, n int) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, v)
+	return data[8-n:]
+}
+
+// exprPredicate is implemented by predicates, of which the kernel can apply
+// a FilterExpr to events. filterExpr returns an expression, that matches at
+// least the events of the entries, that the predicate matches, and reports
+// whether it matches exactly those.
+type exprPredicate interface {
+	filterExpr() (FilterExpr, bool)
+}
+
+// predicateExpr returns the expression of p for events. Predicates, that the
+// kernel can not apply, like PredicateFunc, match every event.
+func predicateExpr(p Predicate) (FilterExpr, bool) {
+	if ep, ok := p.(exprPredicate); ok {
+		return ep.filterExpr()
+	}
+	return And(), false
+}
+
+func (p allPredicate) filterExpr() (FilterExpr, bool) {
+	exprs := make([]FilterExpr, 0, len(p))
+	exact := true
+	for _, sub := range p {
+		expr, ok := predicateExpr(sub)
+		exprs = append(exprs, expr)
+		exact = exact && ok
+	}
+	return And(exprs...), exact
+}
+
+func (p anyPredicate) filterExpr() (FilterExpr, bool) {
+	exprs := make([]FilterExpr, 0, len(p))
+	exact := true
+	for _, sub := range p {
+		expr, ok := predicateExpr(sub)
+		exprs = append(exprs, expr)
+		exact = exact && ok
+	}
+	return Or(exprs...), exact
+}
+
+func (p notPredicate) filterExpr() (FilterExpr, bool) {
+	expr, exact := predicateExpr(p.p)
+	if !exact {
+		// the complement of a coarser expression would drop matching events
+		return And(), false
+	}
+	return Not(expr), true
+}
+
+func (p cidrPredicate) filterExpr() (FilterExpr, bool) {
+	exprs := make([]FilterExpr, 0, len(p.nets))
+	for _, n := range p.nets {
+		f, ip := IPv6, n.IP.To16()
+		if len(n.Mask) == net.IPv4len {
+			f, ip = IPv4, n.IP.To4()
+		}
+		if len(ip) != len(n.Mask) {
+			return And(), false
+		}
+		exprs = append(exprs, ConnAttr{Type: endpointAttrs[f][p.e], Data: ip.Mask(n.Mask), Mask: n.Mask})
+	}
+	return Or(exprs...), true
+}
+
+func (p portPredicate) filterExpr() (FilterExpr, bool) {
+	return AttrRange{Type: endpointAttrs[0][p.e], Min: uint64(p.min), Max: uint64(p.max)}, true
+}
+
+func (p valuePredicate) filterExpr() (FilterExpr, bool) {
+	check, ok := filterCheck[p.typ]
+	if _, known := attrValues[p.typ]; !known || !ok {
+		return And(), false
+	}
+	if p.op > OpGreaterEqual {
+		return Or(), true
+	}
+	if check.len < 8 && p.value>>(8*uint(check.len)) != 0 {
+		// the value exceeds the attribute, which the kernel can not compare
+		return And(), false
+	}
+	return AttrCompare{Type: p.typ, Op: p.op, Value: p.value}, true
+}
+
+func (m ConnMatch) filterExpr() (FilterExpr, bool) {
+	var exprs []FilterExpr
+	exact := true
+	if m.Zone != nil {
+		if *m.Zone == 0 {
+			// entries in zone 0 have no zone attribute
+			exprs = append(exprs, Not(AttrCompare{Type: AttrZone, Op: OpNotEqual, Value: 0}))
+		} else {
+			exprs = append(exprs, AttrCompare{Type: AttrZone, Op: OpEqual, Value: uint64(*m.Zone)})
+		}
+	}
+	if m.Mark != nil {
+		mask := ^uint32(0)
+		if m.MarkMask != nil {
+			mask = *m.MarkMask
+		}
+		mark := ConnAttr{Type: AttrMark, Data: attrData(uint64(*m.Mark&mask), 4), Mask: attrData(uint64(mask), 4)}
+		if *m.Mark&mask != 0 {
+			exprs = append(exprs, mark)
+		} else {
+			// events of entries without a mark have no mark attribute
+			exprs = append(exprs, Or(mark, Not(AttrCompare{Type: AttrMark, Op: OpGreaterEqual, Value: 0})))
+		}
+	}
+	for _, tuple := range []struct {
+		t        *IPTuple
+		src, dst Endpoint
+	}{{m.Origin, EndpointOrigSrc, EndpointOrigDst}, {m.Reply, EndpointReplSrc, EndpointReplDst}} {
+		if tuple.t == nil {
+			continue
+		}
+		for _, addr := range []struct {
+			ip *net.IP
+			e  Endpoint
+		}{{tuple.t.Src, tuple.src}, {tuple.t.Dst, tuple.dst}} {
+			if addr.ip == nil {
+				continue
+			}
+			f, ip := IPv6, addr.ip.To16()
+			if ip4 := addr.ip.To4(); ip4 != nil {
+				f, ip = IPv4, ip4
+			}
+			if ip == nil {
+				return Or(), true
+			}
+			mask := net.CIDRMask(8*len(ip), 8*len(ip))
+			exprs = append(exprs, ConnAttr{Type: endpointAttrs[f][addr.e], Data: ip, Mask: mask})
+		}
+		p := tuple.t.Proto
+		if p == nil {
+			continue
+		}
+		num, sport, dport := AttrOrigL4Proto, AttrOrigPortSrc, AttrOrigPortDst
+		if tuple.src == EndpointReplSrc {
+			num, sport, dport = AttrReplL4Proto, AttrReplPortSrc, AttrReplPortDst
+		}
+		for _, v := range []struct {
+			typ   ConnAttrType
+			value uint64
+			ok    bool
+		}{
+			{num, uint64(valueUint8(p.Number)), p.Number != nil},
+			{sport, uint64(valueUint16(p.SrcPort)), p.SrcPort != nil},
+			{dport, uint64(valueUint16(p.DstPort)), p.DstPort != nil},
+		} {
+			if v.ok {
+				exprs = append(exprs, AttrCompare{Type: v.typ, Op: OpEqual, Value: v.value})
+			}
+		}
+		if p.IcmpID != nil || p.IcmpType != nil || p.IcmpCode != nil ||
+			p.Icmpv6ID != nil || p.Icmpv6Type != nil || p.Icmpv6Code != nil {
+			// the ICMP fields are matched in userspace
+			exact = false
+		}
+	}
+	return And(exprs...), exact
+}
+
+// kernelMatch returns the ConnMatch, that the kernel applies for p while the
+// table is dumped. It matches at least the entries, that p matches. kernelMatch
+// reports false, if the kernel can not apply any part of p.
+func kernelMatch(p Predicate) (ConnMatch, bool) {
+	var m ConnMatch
+	switch p := p.(type) {
+	case ConnMatch:
+		return p, true
+	case allPredicate:
+		// each of the predicates matches at least the entries of all, so
+		// the fields are taken from any of them
+		var found bool
+		for _, sub := range p {
+			if sm, ok := kernelMatch(sub); ok {
+				m = mergeMatch(m, sm)
+				found = true
+			}
+		}
+		return m, found
+	case anyPredicate:
+		if len(p) == 1 {
+			return kernelMatch(p[0])
+		}
+	case cidrPredicate:
+		if len(p.nets) != 1 {
+			break
+		}
+		if ones, bits := p.nets[0].Mask.Size(); bits == 0 || ones != bits {
+			break
+		}
+		ip := p.nets[0].IP
+		t := &IPTuple{Src: &ip}
+		if !p.e.source() {
+			t = &IPTuple{Dst: &ip}
+		}
+		return p.e.withTuple(t), true
+	case portPredicate:
+		if p.min != p.max {
+			break
+		}
+		port := p.min
+		t := &IPTuple{Proto: &ProtoTuple{SrcPort: &port}}
+		if !p.e.source() {
+			t = &IPTuple{Proto: &ProtoTuple{DstPort: &port}}
+		}
+		return p.e.withTuple(t), true
+	case valuePredicate:
+		if p.op != OpEqual {
+			break
+		}
+		switch p.typ {
+		case AttrMark:
+			if p.value>>32 == 0 {
+				mark := uint32(p.value)
+				return ConnMatch{Mark: &mark}, true
+			}
+		case AttrZone:
+			if p.value>>16 == 0 {
+				zone := uint16(p.value)
+				return ConnMatch{Zone: &zone}, true
+			}
+		case AttrOrigL4Proto, AttrReplL4Proto:
+			if p.value>>8 == 0 {
+				num := uint8(p.value)
+				e := EndpointOrigSrc
+				if p.typ == AttrReplL4Proto {
+					e = EndpointReplSrc
+				}
+				return e.withTuple(&IPTuple{Proto: &ProtoTuple{Number: &num}}), true
+			}
+		case AttrOrigPortSrc, AttrOrigPortDst, AttrReplPortSrc, AttrReplPortDst:
+			for e, typ := range endpointAttrs[0] {
+				if typ == p.typ && p.value>>16 == 0 {
+					return kernelMatch(portPredicate{e: Endpoint(e), min: uint16(p.value), max: uint16(p.value)})
+				}
+			}
+		}
+	}
+	return m, false
+}
+
+// withTuple returns a ConnMatch, that compares the tuple of e with t.
+func (e Endpoint) withTuple(t *IPTuple) ConnMatch {
+	if e == EndpointReplSrc || e == EndpointReplDst {
+		return ConnMatch{Reply: t}
+	}
+	return ConnMatch{Origin: t}
+}
+
+// mergeMatch returns a ConnMatch, that compares the fields of a and the fields
+// of b, which are not set in a.
+func mergeMatch(a, b ConnMatch) ConnMatch {
+	if a.Zone == nil {
+		a.Zone = b.Zone
+	}
+	if a.Mark == nil {
+		a.Mark, a.MarkMask = b.Mark, b.MarkMask
+	}
+	a.Origin = mergeTuple(a.Origin, b.Origin)
+	a.Reply = mergeTuple(a.Reply, b.Reply)
+	return a
+}
+
+func mergeTuple(a, b *IPTuple) *IPTuple {
+	if a == nil || b == nil {
+		if a == nil {
+			return b
+		}
+		return a
+	}
+	t := *a
+	if t.Src == nil {
+		t.Src = b.Src
+	}
+	if t.Dst == nil {
+		t.Dst = b.Dst
+	}
+	if t.Proto == nil || b.Proto == nil {
+		if t.Proto == nil {
+			t.Proto = b.Proto
+		}
+		return &t
+	}
+	p, q := *t.Proto, b.Proto
+	for _, f := range []struct{ a, b **uint8 }{
+		{&p.Number, &q.Number}, {&p.IcmpType, &q.IcmpType}, {&p.IcmpCode, &q.IcmpCode},
+		{&p.Icmpv6Type, &q.Icmpv6Type}, {&p.Icmpv6Code, &q.Icmpv6Code},
+	} {
+		if *f.a == nil {
+			*f.a = *f.b
+		}
+	}
+	for _, f := range []struct{ a, b **uint16 }{
+		{&p.SrcPort, &q.SrcPort}, {&p.DstPort, &q.DstPort}, {&p.IcmpID, &q.IcmpID}, {&p.Icmpv6ID, &q.Icmpv6ID},
+	} {
+		if *f.a == nil {
+			*f.a = *f.b
+		}
+	}
+	t.Proto = &p
+	return &t
+}
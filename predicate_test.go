@@ -0,0 +1,144 @@
+package conntrack
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPredicate(t *testing.T) {
+	_, docs, _ := net.ParseCIDR("192.0.2.0/24")
+	_, docs6, _ := net.ParseCIDR("2001:db8::/32")
+	_, private, _ := net.ParseCIDR("10.0.0.0/8")
+	mark, zero := uint32(0x42), uint32(0)
+	proto := uint8(6)
+
+	entry := func(src string, port uint16, mark *uint32) Con {
+		c := testCon(40000)
+		ip := net.ParseIP(src)
+		c.Origin.Src = &ip
+		if ip.To4() == nil {
+			// the tuples of an entry are of the same family
+			c.Origin.Dst, c.Reply.Src, c.Reply.Dst = &ip, &ip, &ip
+		}
+		*c.Origin.Proto.DstPort = port
+		c.Mark = mark
+		return c
+	}
+	entries := []Con{
+		entry("192.0.2.1", 80, &mark),
+		entry("192.0.2.1", 443, nil),
+		entry("198.51.100.1", 8080, &mark),
+		entry("2001:db8::1", 22, &mark),
+		entry("2001:db8::1", 80, nil),
+	}
+
+	tests := []struct {
+		name  string
+		p     Predicate
+		want  []bool
+		exact bool
+	}{
+		{
+			name:  "cidr",
+			p:     MatchCIDR(EndpointOrigSrc, docs, docs6),
+			want:  []bool{true, true, false, true, true},
+			exact: true,
+		},
+		{
+			name:  "ports",
+			p:     MatchAll(MatchCIDR(EndpointOrigSrc, docs), MatchPorts(EndpointOrigDst, 80, 1024)),
+			want:  []bool{true, true, false, false, false},
+			exact: true,
+		},
+		{
+			name:  "value",
+			p:     MatchAny(MatchValue(AttrOrigPortDst, OpGreater, 1024), MatchValue(AttrMark, OpEqual, 0x42)),
+			want:  []bool{true, false, true, true, false},
+			exact: true,
+		},
+		{
+			name:  "not",
+			p:     MatchNot(MatchAny(MatchCIDR(EndpointOrigSrc, docs6), MatchCIDR(EndpointReplSrc, private))),
+			want:  []bool{false, false, false, false, false},
+			exact: true,
+		},
+		{
+			name:  "conn match",
+			p:     ConnMatch{Origin: &IPTuple{Proto: &ProtoTuple{Number: &proto}}, Mark: &zero},
+			want:  []bool{false, true, false, false, true},
+			exact: true,
+		},
+		{
+			name: "function",
+			p: MatchAll(MatchPorts(EndpointOrigDst, 1, 1024), PredicateFunc(func(c Con) bool {
+				return c.Origin.Src.To4() == nil
+			})),
+			want: []bool{false, false, false, true, true},
+		},
+		{
+			name: "negated function",
+			p:    MatchNot(PredicateFunc(func(c Con) bool { return c.Mark != nil })),
+			want: []bool{false, true, false, false, true},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			expr, exact := predicateExpr(tc.p)
+			if exact != tc.exact {
+				t.Fatalf("unexpected exact expression: %v", exact)
+			}
+			prog, err := CompileFilterExpr(Conntrack, expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, c := range entries {
+				if got := tc.p.Match(c); got != tc.want[i] {
+					t.Fatalf("unexpected match of entry %d: %v", i, got)
+				}
+				f := IPv4
+				if c.Origin.Src.To4() == nil {
+					f = IPv6
+				}
+				// the kernel accepts at least the events of matching entries
+				accepted, err := prog.Match(f, c)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if (tc.want[i] && !accepted) || (tc.exact && accepted != tc.want[i]) {
+					t.Fatalf("unexpected verdict of the kernel for entry %d: %v", i, accepted)
+				}
+			}
+		})
+	}
+}
+
+func TestKernelMatch(t *testing.T) {
+	_, host, _ := net.ParseCIDR("192.0.2.2/32")
+	_, docs, _ := net.ParseCIDR("192.0.2.0/24")
+	mark := uint32(0x42)
+	p := MatchAll(
+		MatchCIDR(EndpointOrigDst, host),
+		MatchCIDR(EndpointOrigSrc, docs),
+		MatchValue(AttrOrigL4Proto, OpEqual, 6),
+		MatchPorts(EndpointOrigDst, 80, 80),
+		MatchAny(ConnMatch{Mark: &mark}),
+		PredicateFunc(func(c Con) bool { return true }),
+	)
+	m, ok := kernelMatch(p)
+	if !ok {
+		t.Fatal("predicate can not be applied by the kernel")
+	}
+	if m.Origin == nil || m.Origin.Src != nil || m.Origin.Dst == nil || !m.Origin.Dst.Equal(host.IP) ||
+		m.Origin.Proto == nil || *m.Origin.Proto.Number != 6 || *m.Origin.Proto.DstPort != 80 ||
+		m.Mark == nil || *m.Mark != mark || m.Reply != nil {
+		t.Fatalf("unexpected match: %+v", m)
+	}
+	c := testCon(40000)
+	if !p.Match(c) || !m.Match(c) {
+		t.Fatal("entry does not match")
+	}
+
+	if _, ok := kernelMatch(MatchAny(MatchCIDR(EndpointOrigDst, host), ConnMatch{Mark: &mark})); ok {
+		t.Fatal("alternatives can not be applied by the kernel")
+	}
+}
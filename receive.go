@@ -0,0 +1,343 @@
+package conntrack
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/florianl/go-conntrack/internal/unix"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+// receiveBufferSize is the size of the buffer, a single datagram of a
+// response is read into. The kernel does not send larger datagrams.
+const receiveBufferSize = 65536
+
+// drainTimeout limits the time to read the rest of a response, after its
+// request was cancelled.
+const drainTimeout = time.Second
+
+// ErrMsgTruncated is returned, if a received datagram exceeds the buffer.
+var ErrMsgTruncated = errors.New("received message was truncated")
+
+// DumpFunc dumps a conntrack subsystem and calls fn for every entry, as soon
+// as it is received. Only a single datagram of the response is held in memory
+// at any time. If fn returns an error, no further entries are passed to fn and
+// the error is returned, once the rest of the response is read.
+func (nfct *Nfct) DumpFunc(ctx context.Context, t Table, f Family, fn func(c Con) error) error {
+	req, err := dumpRequest(t, f)
+	if err != nil {
+		return err
+	}
+	return nfct.queryFunc(ctx, req, fn)
+}
+
+// QueryFunc is like Query, but calls fn for every matching entry, as soon as
+// it is received. See DumpFunc for the handling of errors returned by fn.
+func (nfct *Nfct) QueryFunc(ctx context.Context, t Table, f Family, filter FilterAttr, fn func(c Con) error) error {
+	req, err := queryRequest(t, f, filter)
+	if err != nil {
+		return err
+	}
+	return nfct.queryFunc(ctx, req, fn)
+}
+
+// GetFunc is like Get, but calls fn for every matching entry, as soon as it
+// is received. See DumpFunc for the handling of errors returned by fn.
+func (nfct *Nfct) GetFunc(ctx context.Context, t Table, f Family, match Con, fn func(c Con) error) error {
+	req, err := nfct.getRequest(t, f, match)
+	if err != nil {
+		return err
+	}
+	return nfct.queryFunc(ctx, req, fn)
+}
+
+func (nfct *Nfct) queryFunc(ctx context.Context, req netlink.Message, fn func(c Con) error) error {
+	return nfct.queryMaskedFunc(ctx, req, nfct.decodeMask, fn)
+}
+
+func (nfct *Nfct) queryMaskedFunc(ctx context.Context, req netlink.Message, mask Field, fn func(c Con) error) error {
+	mask = fieldMask(mask)
+	reqTable := (int(req.Header.Type) & 0x300) >> 8
+	reqType := int(req.Header.Type) & 0xF
+	return nfct.request(ctx, req, func(msg netlink.Message) error {
+		c := Con{}
+		if err := parseConnectionMsg(nfct.logger, &c, msg, reqTable, reqType, mask); err != nil {
+			return err
+		}
+		// check if c is an empty struct
+		if (Con{}) == c {
+			return nil
+		}
+		return fn(c)
+	})
+}
+
+// request sends req and calls fn for every message of the response, that
+// carries data. Once ctx is done, blocking reads and writes on the socket are
+// interrupted.
+func (nfct *Nfct) request(ctx context.Context, req netlink.Message, fn func(netlink.Message) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return nfct.withConn(ctx, func(con *netlink.Conn) error {
+		w := nfct.watch(ctx, con)
+		defer w.stop()
+
+		req, err := nfct.send(con, req)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			return err
+		}
+		return nfct.receive(ctx, con, w, req, fn)
+	})
+}
+
+// receive reads the response to req datagram by datagram and calls fn for
+// every message, that carries data. After fn, ctx or the validation of a
+// datagram failed, the rest of the response is read and discarded, so the
+// socket can be used for the next request.
+func (nfct *Nfct) receive(ctx context.Context, con *netlink.Conn, w *watcher, req netlink.Message, fn func(netlink.Message) error) error {
+	rc, err := con.SyscallConn()
+	if err != nil {
+		// The socket does not provide access to single datagrams, e.g.
+		// for tests. So fall back to receive the complete response at once.
+		msgs, err := con.Receive()
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			return err
+		}
+		for _, msg := range msgs {
+			if msg.Header.Type == netlink.Error || msg.Header.Type == netlink.Done {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fn(msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var fnErr error
+	var msgs []netlink.Message
+	buf := make([]byte, receiveBufferSize)
+	for {
+		msgs, err = readMessages(rc, buf, msgs)
+		if err != nil {
+			ctxErr := ctx.Err()
+			if ctxErr == nil {
+				return err
+			}
+			w.stop()
+			nfct.drain(con, rc, buf, req)
+			if fnErr != nil {
+				return fnErr
+			}
+			return ctxErr
+		}
+		if err := netlink.Validate(req, msgs); err != nil {
+			w.stop()
+			nfct.drain(con, rc, buf, req)
+			return err
+		}
+
+		var replyErr error
+		for _, msg := range msgs {
+			switch msg.Header.Type {
+			case netlink.Done, netlink.Error:
+				replyErr = replyError(msg)
+				continue
+			}
+			if fnErr != nil {
+				continue
+			}
+			if fnErr = ctx.Err(); fnErr != nil {
+				continue
+			}
+			fnErr = fn(msg)
+		}
+
+		last := lastDatagram(req, msgs)
+		if fnErr != nil && last {
+			return fnErr
+		}
+		if replyErr != nil {
+			return replyErr
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// lastDatagram reports whether msgs complete the response to req.
+func lastDatagram(req netlink.Message, msgs []netlink.Message) bool {
+	var multi bool
+	for _, msg := range msgs {
+		if msg.Header.Type == netlink.Done || msg.Header.Type == netlink.Error {
+			return true
+		}
+		if msg.Header.Flags&netlink.Multi != 0 {
+			multi = true
+		}
+	}
+	return !multi && req.Header.Flags&netlink.Acknowledge == 0
+}
+
+// drain reads and discards the rest of the response to req.
+func (nfct *Nfct) drain(con *netlink.Conn, rc syscall.RawConn, buf []byte, req netlink.Message) {
+	if err := con.SetReadDeadline(time.Now().Add(drainTimeout)); err != nil {
+		nfct.logger.Printf("could not set read deadline: %v", err)
+		return
+	}
+	defer func() {
+		if err := con.SetReadDeadline(time.Time{}); err != nil {
+			nfct.logger.Printf("could not reset read deadline: %v", err)
+		}
+	}()
+	var msgs []netlink.Message
+	for {
+		var err error
+		msgs, err = readMessages(rc, buf, msgs)
+		if err != nil {
+			nfct.logger.Printf("could not drain response: %v", err)
+			return
+		}
+		if err := netlink.Validate(req, msgs); err != nil {
+			// left over from an earlier request
+			continue
+		}
+		if lastDatagram(req, msgs) {
+			return
+		}
+	}
+}
+
+// watcher interrupts blocking operations on the socket, once its context is
+// done.
+type watcher struct {
+	nfct   *Nfct
+	con    *netlink.Conn
+	done   chan struct{}
+	exited chan struct{}
+	fired  bool
+	once   sync.Once
+}
+
+func (nfct *Nfct) watch(ctx context.Context, con *netlink.Conn) *watcher {
+	w := &watcher{nfct: nfct, con: con}
+	if ctx.Done() == nil {
+		// ctx can never be cancelled
+		return w
+	}
+	w.done = make(chan struct{})
+	w.exited = make(chan struct{})
+	go func() {
+		defer close(w.exited)
+		select {
+		case <-ctx.Done():
+			w.fired = true
+			if err := con.SetDeadline(time.Unix(1, 0)); err != nil {
+				nfct.logger.Printf("could not interrupt socket: %v", err)
+			}
+		case <-w.done:
+		}
+	}()
+	return w
+}
+
+// stop ends the watching and resets the deadlines of the socket, if they
+// were changed.
+func (w *watcher) stop() {
+	if w.done == nil {
+		return
+	}
+	w.once.Do(func() {
+		close(w.done)
+		<-w.exited
+		if !w.fired {
+			return
+		}
+		if err := w.con.SetDeadline(time.Time{}); err != nil {
+			w.nfct.logger.Printf("could not reset deadline: %v", err)
+		}
+	})
+}
+
+// readMessages reads a single datagram into buf and returns its messages,
+// which are appended to msgs[:0]. The data of the messages refers to buf.
+func readMessages(rc syscall.RawConn, buf []byte, msgs []netlink.Message) ([]netlink.Message, error) {
+	var n, flags int
+	var recvErr error
+	if err := rc.Read(func(fd uintptr) bool {
+		for {
+			n, flags, recvErr = unix.Recvmsg(int(fd), buf, 0)
+			if recvErr != unix.EINTR {
+				break
+			}
+		}
+		// wait for the socket to become readable
+		return recvErr != unix.EAGAIN
+	}); err != nil {
+		return nil, err
+	}
+	if recvErr != nil {
+		return nil, &netlink.OpError{Op: "receive", Err: recvErr}
+	}
+	if flags&unix.MSG_TRUNC != 0 {
+		return nil, ErrMsgTruncated
+	}
+
+	msgs = msgs[:0]
+	b := buf[:n]
+	for len(b) >= NetlinkHeaderSize {
+		length := int(nlenc.Uint32(b[0:4]))
+		if length < NetlinkHeaderSize || length > len(b) {
+			return nil, ErrDataLength
+		}
+		msgs = append(msgs, netlink.Message{
+			Header: netlink.Header{
+				Length:   uint32(length),
+				Type:     netlink.HeaderType(nlenc.Uint16(b[4:6])),
+				Flags:    netlink.HeaderFlags(nlenc.Uint16(b[6:8])),
+				Sequence: nlenc.Uint32(b[8:12]),
+				PID:      nlenc.Uint32(b[12:16]),
+			},
+			Data: b[NetlinkHeaderSize:length],
+		})
+
+		aligned := (length + 3) &^ 3
+		if aligned > len(b) {
+			break
+		}
+		b = b[aligned:]
+	}
+	return msgs, nil
+}
+
+// replyError returns the error, that is carried by a message of type
+// netlink.Error or netlink.Done.
+func replyError(msg netlink.Message) error {
+	if len(msg.Data) < 4 {
+		if msg.Header.Type == netlink.Done {
+			return nil
+		}
+		return ErrDataLength
+	}
+	code := int32(nlenc.Uint32(msg.Data[0:4]))
+	if code >= 0 {
+		return nil
+	}
+	return &netlink.OpError{Op: "receive", Err: syscall.Errno(-code)}
+}
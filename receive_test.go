@@ -0,0 +1,93 @@
+package conntrack
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nltest"
+)
+
+func TestDumpFunc(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	var entries []netlink.Message
+	for _, port := range []uint16{40000, 40001, 40002} {
+		data, err := MarshalAttributes(logger, IPv4, testCon(port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, netlink.Message{
+			Header: netlink.Header{Type: netlink.HeaderType(1<<8 | ipctnlMsgCtNew), Flags: netlink.Multi},
+			Data:   data,
+		})
+	}
+
+	nfct := &Nfct{logger: logger}
+	AdjustWriteTimeout(nfct, func() error { return nil })
+	nfct.Con = nltest.Dial(func(reqs []netlink.Message) ([]netlink.Message, error) {
+		if len(reqs) == 0 {
+			return nil, nil
+		}
+		msgs := make([]netlink.Message, 0, len(entries)+1)
+		for _, e := range entries {
+			e.Header.Sequence = reqs[0].Header.Sequence
+			msgs = append(msgs, e)
+		}
+		return append(msgs, netlink.Message{
+			Header: netlink.Header{Type: netlink.Done, Flags: netlink.Multi, Sequence: reqs[0].Header.Sequence},
+			Data:   []byte{0, 0, 0, 0},
+		}), nil
+	})
+	defer nfct.Con.Close()
+
+	var ports []uint16
+	if err := nfct.DumpFunc(context.Background(), Conntrack, IPv4, func(c Con) error {
+		ports = append(ports, *c.Origin.Proto.SrcPort)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(ports) != 3 || ports[2] != 40002 {
+		t.Fatalf("unexpected entries: %v", ports)
+	}
+
+	errStop := errors.New("stop")
+	ports = nil
+	err := nfct.DumpFunc(context.Background(), Conntrack, IPv4, func(c Con) error {
+		ports = append(ports, *c.Origin.Proto.SrcPort)
+		return errStop
+	})
+	if err != errStop || len(ports) != 1 {
+		t.Fatalf("dump did not stop: %v %v", err, ports)
+	}
+
+	if err := nfct.DumpFunc(context.Background(), Timeout, IPv4, nil); err != ErrUnknownCtTable {
+		t.Fatalf("unexpected error for unknown table: %v", err)
+	}
+}
+
+func TestCancelledContext(t *testing.T) {
+	var requests int
+	nfct := &Nfct{logger: log.New(ioutil.Discard, "", 0)}
+	AdjustWriteTimeout(nfct, func() error { return nil })
+	nfct.Con = nltest.Dial(func(reqs []netlink.Message) ([]netlink.Message, error) {
+		requests += len(reqs)
+		return nil, nil
+	})
+	defer nfct.Con.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := nfct.FlushContext(ctx, Conntrack, IPv4); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := nfct.DumpContext(ctx, Conntrack, IPv4); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if requests != 0 {
+		t.Fatalf("requests were sent with cancelled context")
+	}
+}
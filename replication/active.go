@@ -0,0 +1,346 @@
+package replication
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	ct "github.com/florianl/go-conntrack"
+)
+
+// ActiveStats contains statistics of the active node.
+type ActiveStats struct {
+	Sent          uint64
+	Retransmitted uint64
+	Acked         uint64
+	Resyncs       uint64
+	Errors        uint64
+}
+
+// Active streams the events of the conntrack table to the standby node.
+type Active struct {
+	config Config
+	t      *transport
+	events *ct.Nfct
+	dump   func() ([]ct.Con, error)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu        sync.Mutex
+	seq       uint32
+	queue     []queued
+	lastSend  time.Time
+	resyncing bool
+	stats     ActiveStats
+}
+
+type queued struct {
+	msg  message
+	sent time.Time
+}
+
+// OpenActive subscribes to the events of the conntrack table and streams them
+// over conn to the standby node, until Close is called or ctx is done.
+// Overflows of the receive buffer are handled by sending the complete table.
+func OpenActive(ctx context.Context, conn net.Conn, config *Config) (*Active, error) {
+	a := newActive(ctx, conn, *config)
+	a.dump = func() ([]ct.Con, error) {
+		nfct, err := ct.Open(&a.config.Conntrack)
+		if err != nil {
+			return nil, err
+		}
+		defer nfct.Close()
+		return nfct.Dump(ct.Conntrack, a.config.Family)
+	}
+
+	eventConfig := config.Conntrack
+	eventConfig.AddConntrackInformation = true
+	eventConfig.ResyncOnOverflow = true
+	eventConfig.ResyncDump = true
+	eventConfig.NoENOBUFS = false
+	events, err := ct.Open(&eventConfig)
+	if err != nil {
+		a.cancel()
+		return nil, err
+	}
+	if err := events.Register(a.ctx, ct.Conntrack, ct.NetlinkCtNew|ct.NetlinkCtUpdate|ct.NetlinkCtDestroy, a.Hook); err != nil {
+		events.Close()
+		a.cancel()
+		return nil, err
+	}
+	a.events = events
+
+	go a.run()
+	return a, nil
+}
+
+func newActive(ctx context.Context, conn net.Conn, config Config) *Active {
+	config.setDefaults()
+	a := &Active{
+		config: config,
+		t:      newTransport(conn),
+		done:   make(chan struct{}),
+	}
+	a.ctx, a.cancel = context.WithCancel(ctx)
+	return a
+}
+
+// Close stops receiving events and streaming them to the standby node.
+// conn is not closed.
+func (a *Active) Close() error {
+	a.cancel()
+	var err error
+	if a.events != nil {
+		err = a.events.Close()
+	}
+	<-a.done
+	return err
+}
+
+// Stats returns the statistics of the active node.
+func (a *Active) Stats() ActiveStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.stats
+}
+
+// Hook is a HookFunc for Register, that sends events to the standby node.
+// It requires AddConntrackInformation to distinguish the kind of events.
+func (a *Active) Hook(c ct.Con) int {
+	if !a.config.accept(c) {
+		return 0
+	}
+	typ := msgUpdate
+	if c.Info != nil {
+		switch {
+		case c.Info.Overflow:
+			a.sendSequenced(message{typ: msgResyncBegin})
+			return 0
+		case c.Info.ResyncDone:
+			a.sendSequenced(message{typ: msgResyncEnd})
+			return 0
+		case c.Info.Resync:
+			typ = msgNew
+		case c.Info.NetlinkGroup == ct.NetlinkCtNew:
+			typ = msgNew
+		case c.Info.NetlinkGroup == ct.NetlinkCtDestroy:
+			typ = msgDestroy
+		}
+	}
+	a.sendEntry(typ, c)
+	return 0
+}
+
+func (a *Active) sendEntry(typ msgType, c ct.Con) {
+	m, err := entryMessage(a.config.Logger, typ, c)
+	if err != nil {
+		a.config.Logger.Printf("could not encode entry: %v", err)
+		a.mu.Lock()
+		a.stats.Errors++
+		a.mu.Unlock()
+		return
+	}
+	a.sendSequenced(m)
+}
+
+// sendSequenced assigns the next sequence number to m, queues it until it is
+// acknowledged and sends it. Sending happens under a.mu, so that messages
+// are sent in the order of their sequence numbers.
+func (a *Active) sendSequenced(m message) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	m.seq = a.seq
+	a.seq++
+	if len(a.queue) >= a.config.QueueSize {
+		// The oldest message gets lost. If the standby node requests it,
+		// the complete table is sent instead.
+		a.queue = a.queue[1:]
+	}
+	now := time.Now()
+	a.queue = append(a.queue, queued{msg: m, sent: now})
+	a.stats.Sent++
+	a.write(m, now)
+}
+
+// write sends m to the standby node. a.mu has to be held.
+func (a *Active) write(m message, now time.Time) {
+	a.lastSend = now
+	if err := a.t.send(m); err != nil {
+		a.stats.Errors++
+		a.config.Logger.Printf("could not send message: %v", err)
+	}
+}
+
+func (a *Active) run() {
+	defer close(a.done)
+
+	go func() {
+		<-a.ctx.Done()
+		// interrupt a blocking receive
+		a.t.conn.SetReadDeadline(time.Now().Add(-1 * time.Second))
+	}()
+	go a.tick()
+
+	for {
+		m, err := a.t.receive()
+		if err != nil {
+			if a.ctx.Err() != nil {
+				return
+			}
+			if opError, ok := err.(net.Error); ok && opError.Timeout() {
+				continue
+			}
+			if err == ErrMsgLength || err == ErrVersion {
+				a.config.Logger.Printf("dropping message: %v", err)
+				continue
+			}
+			a.config.Logger.Printf("could not receive message: %v", err)
+			// Errors like ECONNREFUSED are reported for UDP, as long as the
+			// standby node is not listening.
+			if !a.sleep(a.config.RetransmitInterval) {
+				return
+			}
+			continue
+		}
+		a.handle(m)
+	}
+}
+
+// sleep waits for d and returns false, if a.ctx is done meanwhile.
+func (a *Active) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-a.ctx.Done():
+		return false
+	}
+}
+
+func (a *Active) handle(m message) {
+	switch m.typ {
+	case msgAck:
+		a.ack(m.seq)
+	case msgNack:
+		if !a.retransmit(m.seq) {
+			go a.resync()
+		}
+	case msgResync:
+		go a.resync()
+	default:
+		a.config.Logger.Printf("unexpected message type: %d", m.typ)
+	}
+}
+
+// ack removes all messages up to seq from the queue.
+func (a *Active) ack(seq uint32) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	i := 0
+	for ; i < len(a.queue); i++ {
+		if seqBefore(seq, a.queue[i].msg.seq) {
+			break
+		}
+	}
+	a.stats.Acked += uint64(i)
+	a.queue = a.queue[i:]
+}
+
+// retransmit sends all queued messages starting with seq again. It returns
+// false, if seq is no longer queued.
+func (a *Active) retransmit(seq uint32) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !seqBefore(seq, a.seq) {
+		// The standby node is up to date.
+		return true
+	}
+	if len(a.queue) == 0 || seqBefore(seq, a.queue[0].msg.seq) {
+		return false
+	}
+	now := time.Now()
+	for i := range a.queue {
+		if seqBefore(a.queue[i].msg.seq, seq) {
+			continue
+		}
+		a.queue[i].sent = now
+		a.stats.Retransmitted++
+		a.write(a.queue[i].msg, now)
+	}
+	return true
+}
+
+// resync sends the complete table to the standby node.
+func (a *Active) resync() {
+	if a.dump == nil {
+		a.config.Logger.Printf("could not resync: no table to dump")
+		return
+	}
+	a.mu.Lock()
+	if a.resyncing {
+		// The standby node receives the complete table already.
+		a.mu.Unlock()
+		return
+	}
+	a.resyncing = true
+	a.stats.Resyncs++
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		a.resyncing = false
+		a.mu.Unlock()
+	}()
+
+	entries, err := a.dump()
+	if err != nil {
+		a.config.Logger.Printf("could not dump table: %v", err)
+		a.mu.Lock()
+		a.stats.Errors++
+		a.mu.Unlock()
+		return
+	}
+
+	a.sendSequenced(message{typ: msgResyncBegin})
+	for _, c := range entries {
+		if a.config.accept(c) {
+			a.sendEntry(msgNew, c)
+		}
+	}
+	a.sendSequenced(message{typ: msgResyncEnd})
+}
+
+// tick retransmits unacknowledged messages and sends keepalives.
+func (a *Active) tick() {
+	interval := a.config.RetransmitInterval
+	if a.config.AliveInterval < interval {
+		interval = a.config.AliveInterval
+	}
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case now := <-ticker.C:
+			a.mu.Lock()
+			for i := range a.queue {
+				if now.Sub(a.queue[i].sent) < a.config.RetransmitInterval {
+					continue
+				}
+				a.queue[i].sent = now
+				a.stats.Retransmitted++
+				a.write(a.queue[i].msg, now)
+			}
+			if now.Sub(a.lastSend) >= a.config.AliveInterval {
+				a.write(message{typ: msgAlive, seq: a.seq}, now)
+			}
+			a.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package replication
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	ct "github.com/florianl/go-conntrack"
+)
+
+// Every message starts with a header of 8 bytes:
+//
+//	0       1       2               4                               8
+//	+-------+-------+---------------+-------------------------------+
+//	|version| type  |    length     |           sequence            |
+//	+-------+-------+---------------+-------------------------------+
+//
+// All values are in network byte order. length includes the header.
+// Messages of type msgNew, msgUpdate and msgDestroy carry an entry, that is
+// encoded by conntrack.MarshalAttributes.
+const (
+	protoVersion = 1
+	headerSize   = 8
+
+	// maxMessageSize is the maximum payload of an UDP datagram.
+	maxMessageSize = 65507
+)
+
+type msgType uint8
+
+const (
+	// sequenced messages, that are retransmitted until acknowledged
+	msgNew msgType = iota + 1
+	msgUpdate
+	msgDestroy
+	msgResyncBegin
+	msgResyncEnd
+
+	// control messages
+	msgAck    // all messages up to seq have been received
+	msgNack   // messages starting with seq have been lost
+	msgAlive  // seq is the next sequence number of the active node
+	msgResync // the standby node requests the complete state
+)
+
+func (t msgType) sequenced() bool {
+	return t >= msgNew && t <= msgResyncEnd
+}
+
+// Errors of the replication protocol
+var (
+	ErrVersion   = errors.New("unsupported protocol version")
+	ErrMsgLength = errors.New("invalid message length")
+)
+
+type message struct {
+	typ     msgType
+	seq     uint32
+	payload []byte
+}
+
+func (m message) marshal() []byte {
+	b := make([]byte, headerSize+len(m.payload))
+	b[0] = protoVersion
+	b[1] = byte(m.typ)
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	binary.BigEndian.PutUint32(b[4:8], m.seq)
+	copy(b[headerSize:], m.payload)
+	return b
+}
+
+func unmarshalMessage(b []byte) (message, error) {
+	if len(b) < headerSize {
+		return message{}, ErrMsgLength
+	}
+	if b[0] != protoVersion {
+		return message{}, ErrVersion
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if length < headerSize || length > len(b) {
+		return message{}, ErrMsgLength
+	}
+	return message{
+		typ:     msgType(b[1]),
+		seq:     binary.BigEndian.Uint32(b[4:8]),
+		payload: b[headerSize:length],
+	}, nil
+}
+
+// entryMessage encodes the entry of an event.
+func entryMessage(logger *log.Logger, typ msgType, c ct.Con) (message, error) {
+	f := ct.IPv4
+	if c.Origin != nil && c.Origin.Src != nil && c.Origin.Src.To4() == nil {
+		f = ct.IPv6
+	}
+	payload, err := ct.MarshalAttributes(logger, f, c)
+	if err != nil {
+		return message{}, err
+	}
+	if headerSize+len(payload) > maxMessageSize {
+		return message{}, ErrMsgLength
+	}
+	return message{typ: typ, payload: payload}, nil
+}
+
+// seqBefore compares sequence numbers in serial number arithmetic.
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// transport exchanges messages with the peer. For datagram connections every
+// message is sent in its own datagram, for stream connections messages are
+// delimited by the length of their header.
+type transport struct {
+	conn     net.Conn
+	datagram bool
+
+	writeMu sync.Mutex
+	buf     []byte
+}
+
+func newTransport(conn net.Conn) *transport {
+	_, datagram := conn.(net.PacketConn)
+	return &transport{
+		conn:     conn,
+		datagram: datagram,
+		buf:      make([]byte, 1<<16),
+	}
+}
+
+func (t *transport) send(m message) error {
+	b := m.marshal()
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	_, err := t.conn.Write(b)
+	return err
+}
+
+// receive returns the next message. The payload is only valid until the next
+// call of receive.
+func (t *transport) receive() (message, error) {
+	if t.datagram {
+		n, err := t.conn.Read(t.buf)
+		if err != nil {
+			return message{}, err
+		}
+		return unmarshalMessage(t.buf[:n])
+	}
+	if _, err := io.ReadFull(t.conn, t.buf[:headerSize]); err != nil {
+		return message{}, err
+	}
+	length := int(binary.BigEndian.Uint16(t.buf[2:4]))
+	if length < headerSize {
+		return message{}, ErrMsgLength
+	}
+	if _, err := io.ReadFull(t.conn, t.buf[headerSize:length]); err != nil {
+		return message{}, err
+	}
+	return unmarshalMessage(t.buf[:length])
+}
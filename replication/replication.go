@@ -0,0 +1,82 @@
+// Package replication replicates the conntrack table between an active and a
+// standby node, similar to conntrackd with the FTFW mode.
+//
+// The active node streams New, Update and Destroy events to the standby node.
+// Every event is sent with a sequence number and kept in a queue, until the
+// standby node acknowledges it. The standby node reports gaps in the sequence
+// numbers, so that lost messages get retransmitted. If messages are no longer
+// queued, the active node sends its complete table instead.
+//
+// The standby node keeps the replicated entries in an internal cache, that is
+// committed to its conntrack table on failover.
+//
+// Messages are exchanged over a net.Conn. For UDP every message is sent in
+// its own datagram and the connection has to be connected to the peer on both
+// nodes, e.g. by net.DialUDP with a local and a remote address. For TCP the
+// messages are delimited by the length in their header.
+package replication
+
+import (
+	"io/ioutil"
+	"log"
+	"time"
+
+	ct "github.com/florianl/go-conntrack"
+)
+
+// Config contains options for the active and the standby node.
+type Config struct {
+	// Conntrack is used to open the sockets to the conntrack subsystem.
+	Conntrack ct.Config
+
+	// Family restricts the replication to IPv4 or IPv6 entries. If not set,
+	// entries of both families are replicated.
+	Family ct.Family
+
+	// RetransmitInterval is the time after which unacknowledged messages are
+	// sent again. Defaults to 1 second.
+	RetransmitInterval time.Duration
+
+	// AckInterval is the maximum time the standby node delays the
+	// acknowledgement of received messages. Defaults to 100 milliseconds.
+	AckInterval time.Duration
+
+	// AliveInterval is the interval in which the active node sends a
+	// keepalive, if there are no events. Defaults to 1 second.
+	AliveInterval time.Duration
+
+	// QueueSize is the maximum number of unacknowledged messages of the
+	// active node. As the complete table is queued for a resync, it should
+	// exceed the number of entries. Defaults to 16384.
+	QueueSize int
+
+	// Logger reports errors.
+	Logger *log.Logger
+}
+
+func (c *Config) setDefaults() {
+	if c.RetransmitInterval <= 0 {
+		c.RetransmitInterval = time.Second
+	}
+	if c.AckInterval <= 0 {
+		c.AckInterval = 100 * time.Millisecond
+	}
+	if c.AliveInterval <= 0 {
+		c.AliveInterval = time.Second
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = 16384
+	}
+	if c.Logger == nil {
+		c.Logger = log.New(ioutil.Discard, "", 0)
+	}
+}
+
+// accept reports whether c belongs to the replicated family.
+func (c *Config) accept(con ct.Con) bool {
+	if c.Family == 0 || con.Origin == nil || con.Origin.Src == nil {
+		return true
+	}
+	isIPv4 := con.Origin.Src.To4() != nil
+	return isIPv4 == (c.Family == ct.IPv4)
+}
@@ -0,0 +1,190 @@
+//go:build integration && linux
+// +build integration,linux
+
+package replication
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ct "github.com/florianl/go-conntrack"
+)
+
+// netns creates a network namespace and returns it.
+func netns(t *testing.T, name string) *os.File {
+	t.Helper()
+	if out, err := exec.Command("ip", "netns", "add", name).CombinedOutput(); err != nil {
+		t.Skipf("could not create network namespace: %v: %s", err, out)
+	}
+	f, err := os.Open("/var/run/netns/" + name)
+	if err != nil {
+		exec.Command("ip", "netns", "del", name).Run()
+		t.Fatalf("could not open network namespace: %v", err)
+	}
+	return f
+}
+
+func deleteNetns(f *os.File) {
+	f.Close()
+	exec.Command("ip", "netns", "del", filepath.Base(f.Name())).Run()
+}
+
+func testEntry(port uint16) ct.Con {
+	src := net.ParseIP("192.0.2.1")
+	dst := net.ParseIP("192.0.2.2")
+	proto := uint8(6)
+	dstPort := uint16(80)
+	state := uint8(3) // ESTABLISHED
+	timeout := uint32(300)
+	mark := uint32(0x42)
+	return ct.Con{
+		Origin: &ct.IPTuple{Src: &src, Dst: &dst, Proto: &ct.ProtoTuple{
+			Number: &proto, SrcPort: &port, DstPort: &dstPort}},
+		Reply: &ct.IPTuple{Src: &dst, Dst: &src, Proto: &ct.ProtoTuple{
+			Number: &proto, SrcPort: &dstPort, DstPort: &port}},
+		ProtoInfo: &ct.ProtoInfo{TCP: &ct.TCPInfo{State: &state}},
+		Timeout:   &timeout,
+		Mark:      &mark,
+	}
+}
+
+func TestLinuxReplication(t *testing.T) {
+	for _, network := range []string{"udp", "tcp"} {
+		t.Run(network, func(t *testing.T) {
+			activeNS := netns(t, "ct-repl-active-"+network)
+			defer deleteNetns(activeNS)
+			standbyNS := netns(t, "ct-repl-standby-"+network)
+			defer deleteNetns(standbyNS)
+
+			activeConn, standbyConn := connect(t, network)
+			defer activeConn.Close()
+			defer standbyConn.Close()
+
+			active, err := ct.Open(&ct.Config{NetNS: int(activeNS.Fd())})
+			if err != nil {
+				t.Fatalf("could not open socket: %v", err)
+			}
+			defer active.Close()
+			// exists before the replication starts
+			if err := active.Create(ct.Conntrack, ct.IPv4, testEntry(1000)); err != nil {
+				t.Fatalf("could not create entry: %v", err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			config := &Config{
+				Conntrack:          ct.Config{NetNS: int(activeNS.Fd())},
+				Family:             ct.IPv4,
+				RetransmitInterval: 100 * time.Millisecond,
+				AckInterval:        10 * time.Millisecond,
+			}
+			a, err := OpenActive(ctx, activeConn, config)
+			if err != nil {
+				t.Fatalf("could not open active node: %v", err)
+			}
+			defer a.Close()
+
+			s := NewStandby(standbyConn, config)
+			go s.Run(ctx)
+
+			// created while replicating
+			for port := uint16(1001); port < 1005; port++ {
+				if err := active.Create(ct.Conntrack, ct.IPv4, testEntry(port)); err != nil {
+					t.Fatalf("could not create entry: %v", err)
+				}
+			}
+			if err := active.Delete(ct.Conntrack, ct.IPv4, testEntry(1004)); err != nil {
+				t.Fatalf("could not delete entry: %v", err)
+			}
+
+			waitFor(t, func() bool { return s.Len() == 4 })
+
+			// failover
+			standby, err := ct.Open(&ct.Config{NetNS: int(standbyNS.Fd())})
+			if err != nil {
+				t.Fatalf("could not open socket: %v", err)
+			}
+			defer standby.Close()
+
+			result := s.Commit(standby)
+			if result.Created != 4 || len(result.Failed) != 0 {
+				t.Fatalf("unexpected result of commit: %#v", result)
+			}
+			entries, err := standby.Dump(ct.Conntrack, ct.IPv4)
+			if err != nil {
+				t.Fatalf("could not dump table: %v", err)
+			}
+			if len(entries) != 4 {
+				t.Fatalf("unexpected number of committed entries: %d", len(entries))
+			}
+			for _, e := range entries {
+				if e.Mark == nil || *e.Mark != 0x42 {
+					t.Fatalf("unexpected mark of committed entry: %v", e.Mark)
+				}
+				if e.ProtoInfo == nil || e.ProtoInfo.TCP == nil || *e.ProtoInfo.TCP.State != 3 {
+					t.Fatalf("unexpected TCP state of committed entry")
+				}
+			}
+
+			// committing again updates the existing entries
+			result = s.Commit(standby)
+			if result.Updated != 4 || len(result.Failed) != 0 {
+				t.Fatalf("unexpected result of second commit: %#v", result)
+			}
+		})
+	}
+}
+
+func connect(t *testing.T, network string) (net.Conn, net.Conn) {
+	t.Helper()
+	switch network {
+	case "udp":
+		addr1 := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 37001}
+		addr2 := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 37002}
+		c1, err := net.DialUDP("udp", addr1, addr2)
+		if err != nil {
+			t.Fatalf("could not dial: %v", err)
+		}
+		c2, err := net.DialUDP("udp", addr2, addr1)
+		if err != nil {
+			c1.Close()
+			t.Fatalf("could not dial: %v", err)
+		}
+		return c1, c2
+	case "tcp":
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("could not listen: %v", err)
+		}
+		defer l.Close()
+		c1, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("could not dial: %v", err)
+		}
+		c2, err := l.Accept()
+		if err != nil {
+			c1.Close()
+			t.Fatalf("could not accept: %v", err)
+		}
+		return c1, c2
+	}
+	panic(fmt.Sprintf("unknown network %s", network))
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,231 @@
+package replication
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	ct "github.com/florianl/go-conntrack"
+	"github.com/florianl/go-conntrack/internal/unix"
+)
+
+func testCon(srcPort uint16, mark uint32, group ct.NetlinkGroup) ct.Con {
+	src := net.ParseIP("10.0.0.1")
+	dst := net.ParseIP("10.0.0.2")
+	proto := uint8(17)
+	dstPort := uint16(53)
+	return ct.Con{
+		Info: &ct.InfoSource{Table: ct.Conntrack, NetlinkGroup: group},
+		Origin: &ct.IPTuple{Src: &src, Dst: &dst, Proto: &ct.ProtoTuple{
+			Number: &proto, SrcPort: &srcPort, DstPort: &dstPort}},
+		Mark: &mark,
+	}
+}
+
+// lossyConn drops selected messages, that are written to it.
+type lossyConn struct {
+	*net.UDPConn
+
+	mu   sync.Mutex
+	drop map[uint32]bool
+}
+
+func (c *lossyConn) Write(b []byte) (int, error) {
+	m, err := unmarshalMessage(b)
+	if err == nil && m.typ.sequenced() {
+		c.mu.Lock()
+		drop := c.drop[m.seq]
+		delete(c.drop, m.seq)
+		c.mu.Unlock()
+		if drop {
+			return len(b), nil
+		}
+	}
+	return c.UDPConn.Write(b)
+}
+
+// udpPair returns two UDP sockets, that are connected to each other.
+func udpPair(t *testing.T) (*net.UDPConn, *net.UDPConn) {
+	t.Helper()
+	c1, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	c2, err := net.DialUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, c1.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("could not dial: %v", err)
+	}
+	c1.Close()
+	c1, err = net.DialUDP("udp", c1.LocalAddr().(*net.UDPAddr), c2.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("could not dial: %v", err)
+	}
+	return c1, c2
+}
+
+func waitUntil(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMessage(t *testing.T) {
+	m, err := entryMessage(nil, msgNew, testCon(1000, 0x10, ct.NetlinkCtNew))
+	if err != nil {
+		t.Fatalf("could not encode entry: %v", err)
+	}
+	m.seq = 0xfffffffe
+	got, err := unmarshalMessage(m.marshal())
+	if err != nil {
+		t.Fatalf("could not decode message: %v", err)
+	}
+	if got.typ != msgNew || got.seq != m.seq || len(got.payload) != len(m.payload) {
+		t.Fatalf("unexpected message: %#v", got)
+	}
+	if _, err := unmarshalMessage([]byte{2, 1, 0, 8, 0, 0, 0, 0}); err != ErrVersion {
+		t.Fatalf("unexpected error for unknown version: %v", err)
+	}
+	if _, err := unmarshalMessage([]byte{1, 1, 0, 9, 0, 0, 0, 0}); err != ErrMsgLength {
+		t.Fatalf("unexpected error for invalid length: %v", err)
+	}
+	if !seqBefore(0xffffffff, 0) || seqBefore(0, 0xffffffff) {
+		t.Fatalf("unexpected order of sequence numbers")
+	}
+}
+
+func TestReplication(t *testing.T) {
+	activeConn, standbyConn := udpPair(t)
+	defer activeConn.Close()
+	defer standbyConn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := &Config{
+		RetransmitInterval: 20 * time.Millisecond,
+		AckInterval:        5 * time.Millisecond,
+		AliveInterval:      20 * time.Millisecond,
+	}
+	lossy := &lossyConn{UDPConn: activeConn, drop: map[uint32]bool{}}
+	a := newActive(ctx, lossy, *config)
+	a.dump = func() ([]ct.Con, error) {
+		return []ct.Con{testCon(1, 0, 0), testCon(2, 0, 0)}, nil
+	}
+	go a.run()
+	defer a.Close()
+
+	s := NewStandby(standbyConn, config)
+	go s.Run(ctx)
+
+	// initial resync: begin, two entries and end
+	waitUntil(t, func() bool { return s.Len() == 2 })
+
+	// sequence number 5 is lost and has to be retransmitted
+	lossy.mu.Lock()
+	lossy.drop[5] = true
+	lossy.mu.Unlock()
+	a.Hook(testCon(3, 0, ct.NetlinkCtNew))
+	a.Hook(testCon(1, 0, ct.NetlinkCtDestroy))
+	a.Hook(testCon(2, 0x20, ct.NetlinkCtUpdate))
+
+	waitUntil(t, func() bool {
+		return s.Len() == 2 && a.Stats().Acked == 7
+	})
+	if a.Stats().Retransmitted == 0 {
+		t.Fatalf("lost message was not retransmitted")
+	}
+	entries := s.Entries()
+	for _, e := range entries {
+		if *e.Origin.Proto.SrcPort == 2 && *e.Mark != 0x20 {
+			t.Fatalf("entry was not updated: %#v", e)
+		}
+		if *e.Origin.Proto.SrcPort == 1 {
+			t.Fatalf("destroyed entry is still cached")
+		}
+	}
+
+	// overflow on the active node
+	a.Hook(ct.Con{Info: &ct.InfoSource{Table: ct.Conntrack, Overflow: true}})
+	resync := testCon(4, 0, 0)
+	resync.Info = &ct.InfoSource{Table: ct.Conntrack, Resync: true}
+	a.Hook(resync)
+	a.Hook(ct.Con{Info: &ct.InfoSource{Table: ct.Conntrack, ResyncDone: true}})
+	waitUntil(t, func() bool { return a.Stats().Acked == 10 })
+	if entries := s.Entries(); len(entries) != 1 || *entries[0].Origin.Proto.SrcPort != 4 {
+		t.Fatalf("unexpected entries after resync: %v", entries)
+	}
+}
+
+type fakeCommitter struct {
+	existing map[uint16]bool
+	created  []ct.Con
+	updated  []ct.Con
+}
+
+func (f *fakeCommitter) Create(t ct.Table, family ct.Family, c ct.Con) error {
+	if f.existing[*c.Origin.Proto.SrcPort] {
+		return unix.EEXIST
+	}
+	f.created = append(f.created, c)
+	return nil
+}
+
+func (f *fakeCommitter) Update(t ct.Table, family ct.Family, c ct.Con) error {
+	if c.Reply != nil {
+		return unix.ENOENT
+	}
+	f.updated = append(f.updated, c)
+	return nil
+}
+
+func TestCommit(t *testing.T) {
+	s := NewStandby(nil, &Config{})
+	for _, port := range []uint16{1, 2} {
+		c := testCon(port, 0x1, 0)
+		id := uint32(port)
+		c.ID = &id
+		key, _ := c.TupleKey()
+		s.cache[key] = c
+	}
+
+	f := &fakeCommitter{existing: map[uint16]bool{2: true}}
+	result := s.Commit(f)
+	if result.Created != 1 || result.Updated != 1 || len(result.Failed) != 0 {
+		t.Fatalf("unexpected result: %#v", result)
+	}
+	if f.created[0].ID != nil || f.created[0].Info != nil {
+		t.Fatalf("unexpected attributes of created entry: %#v", f.created[0])
+	}
+}
+
+func TestStandbyMerge(t *testing.T) {
+	s := NewStandby(nil, &Config{})
+	c := testCon(1, 0x1, 0)
+	state, wscale := uint8(2), uint8(7)
+	c.ProtoInfo = &ct.ProtoInfo{TCP: &ct.TCPInfo{State: &state, WScaleOrig: &wscale, WScaleRepl: &wscale}}
+	key, _ := c.TupleKey()
+	s.cache[key] = c
+
+	// the update carries only the new state of the TCP connection
+	update := testCon(1, 0x1, ct.NetlinkCtUpdate)
+	established := uint8(3)
+	update.ProtoInfo = &ct.ProtoInfo{TCP: &ct.TCPInfo{State: &established}}
+	m, err := entryMessage(nil, msgUpdate, update)
+	if err != nil {
+		t.Fatalf("could not encode entry: %v", err)
+	}
+	s.apply(m)
+
+	tcp := s.cache[key].ProtoInfo.TCP
+	if tcp == nil || tcp.State == nil || *tcp.State != established ||
+		tcp.WScaleOrig == nil || *tcp.WScaleOrig != wscale || tcp.WScaleRepl == nil || *tcp.WScaleRepl != wscale {
+		t.Fatalf("unexpected TCP state: %#v", tcp)
+	}
+}
@@ -0,0 +1,324 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	ct "github.com/florianl/go-conntrack"
+	"github.com/florianl/go-conntrack/internal/unix"
+)
+
+// StandbyStats contains statistics of the standby node.
+type StandbyStats struct {
+	Received uint64
+	Applied  uint64
+	Lost     uint64
+	Errors   uint64
+}
+
+// Committer creates and updates entries in a conntrack table. It is
+// implemented by conntrack.Nfct.
+type Committer interface {
+	Create(t ct.Table, f ct.Family, attributes ct.Con) error
+	Update(t ct.Table, f ct.Family, attributes ct.Con) error
+}
+
+// CommitResult contains the outcome of Commit.
+type CommitResult struct {
+	Created int
+	Updated int
+
+	// Failed contains the entries, that could not be committed, and the
+	// reason of their failure.
+	Failed []CommitError
+}
+
+// CommitError describes an entry, that could not be committed.
+type CommitError struct {
+	Entry ct.Con
+	Err   error
+}
+
+// Standby receives the events of the active node and keeps them in a cache.
+type Standby struct {
+	config Config
+	t      *transport
+
+	mu         sync.Mutex
+	synced     bool
+	expected   uint32
+	unacked    int
+	lastNack   time.Time
+	cache      map[ct.TupleKey]ct.Con
+	resyncSeen map[ct.TupleKey]struct{}
+	stats      StandbyStats
+}
+
+// NewStandby returns a Standby, that receives the events of the active node
+// over conn.
+func NewStandby(conn net.Conn, config *Config) *Standby {
+	s := &Standby{
+		config: *config,
+		t:      newTransport(conn),
+		cache:  make(map[ct.TupleKey]ct.Con),
+	}
+	s.config.setDefaults()
+	return s
+}
+
+// Run requests the complete table of the active node and applies the received
+// events to the cache, until ctx is done.
+func (s *Standby) Run(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		// interrupt a blocking receive
+		s.t.conn.SetReadDeadline(time.Now().Add(-1 * time.Second))
+	}()
+	go s.tick(ctx)
+
+	s.mu.Lock()
+	s.requestResync()
+	s.mu.Unlock()
+
+	for {
+		m, err := s.t.receive()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if opError, ok := err.(net.Error); ok && opError.Timeout() {
+				continue
+			}
+			if err == ErrMsgLength || err == ErrVersion {
+				s.config.Logger.Printf("dropping message: %v", err)
+				continue
+			}
+			return err
+		}
+		s.handle(m)
+	}
+}
+
+// Len returns the number of cached entries.
+func (s *Standby) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.cache)
+}
+
+// Entries returns all cached entries.
+func (s *Standby) Entries() []ct.Con {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := make([]ct.Con, 0, len(s.cache))
+	for _, c := range s.cache {
+		entries = append(entries, c)
+	}
+	return entries
+}
+
+// Stats returns the statistics of the standby node.
+func (s *Standby) Stats() StandbyStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// Commit writes the cached entries to the conntrack table of c. Entries, that
+// exist already, are updated.
+func (s *Standby) Commit(c Committer) CommitResult {
+	var result CommitResult
+	for _, entry := range s.Entries() {
+		attrs := commitAttributes(entry)
+		f := ct.IPv4
+		if entry.Origin.Src.To4() == nil {
+			f = ct.IPv6
+		}
+		err := c.Create(ct.Conntrack, f, attrs)
+		if err == nil {
+			result.Created++
+			continue
+		}
+		if errors.Is(err, unix.EEXIST) {
+			if err = c.Update(ct.Conntrack, f, updateAttributes(attrs)); err == nil {
+				result.Updated++
+				continue
+			}
+		}
+		result.Failed = append(result.Failed, CommitError{Entry: entry, Err: err})
+	}
+	return result
+}
+
+// commitAttributes returns the attributes of c, that can be set on creation.
+func commitAttributes(c ct.Con) ct.Con {
+	return ct.Con{
+		Origin:    c.Origin,
+		Reply:     c.Reply,
+		ProtoInfo: c.ProtoInfo,
+		Helper:    c.Helper,
+		NatSrc:    c.NatSrc,
+		Status:    c.Status,
+		Mark:      c.Mark,
+		Timeout:   c.Timeout,
+		Zone:      c.Zone,
+		Label:     c.Label,
+	}
+}
+
+// updateAttributes returns the attributes of c, that can be changed by an
+// update of an existing entry.
+func updateAttributes(c ct.Con) ct.Con {
+	c.Reply = nil
+	c.Helper = nil
+	c.NatSrc = nil
+	return c
+}
+
+func (s *Standby) handle(m message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Received++
+
+	switch {
+	case m.typ == msgAlive:
+		if !s.synced {
+			// The request of the complete table got lost.
+			s.requestResync()
+		} else if seqBefore(s.expected, m.seq) {
+			s.nack()
+		}
+		return
+	case !m.typ.sequenced():
+		s.config.Logger.Printf("unexpected message type: %d", m.typ)
+		return
+	}
+
+	switch {
+	case !s.synced || (m.typ == msgResyncBegin && seqBefore(s.expected, m.seq)):
+		// The complete table supersedes lost messages.
+		if s.synced {
+			s.stats.Lost += uint64(m.seq - s.expected)
+		}
+		s.synced = true
+		s.expected = m.seq
+	case seqBefore(m.seq, s.expected):
+		// duplicate of a retransmitted message
+		return
+	case m.seq != s.expected:
+		s.nack()
+		return
+	}
+
+	s.apply(m)
+	s.expected++
+	s.unacked++
+	if s.unacked >= s.config.QueueSize/2 {
+		s.ack()
+	}
+}
+
+// nack requests the retransmission of lost messages. Requests are limited
+// to one per RetransmitInterval. s.mu has to be held.
+func (s *Standby) nack() {
+	now := time.Now()
+	if now.Sub(s.lastNack) < s.config.RetransmitInterval {
+		return
+	}
+	s.lastNack = now
+	// Acknowledge the received messages as well, so they get dequeued.
+	s.ack()
+	if err := s.t.send(message{typ: msgNack, seq: s.expected}); err != nil {
+		s.config.Logger.Printf("could not send nack: %v", err)
+	}
+}
+
+// requestResync requests the complete table of the active node. Requests are
+// limited to one per RetransmitInterval. s.mu has to be held.
+func (s *Standby) requestResync() {
+	now := time.Now()
+	if now.Sub(s.lastNack) < s.config.RetransmitInterval {
+		return
+	}
+	s.lastNack = now
+	if err := s.t.send(message{typ: msgResync}); err != nil {
+		s.config.Logger.Printf("could not request resync: %v", err)
+	}
+}
+
+// ack acknowledges all received messages. s.mu has to be held.
+func (s *Standby) ack() {
+	if !s.synced {
+		return
+	}
+	s.unacked = 0
+	if err := s.t.send(message{typ: msgAck, seq: s.expected - 1}); err != nil {
+		s.config.Logger.Printf("could not send ack: %v", err)
+	}
+}
+
+// apply applies a message to the cache. s.mu has to be held.
+func (s *Standby) apply(m message) {
+	switch m.typ {
+	case msgResyncBegin:
+		s.resyncSeen = make(map[ct.TupleKey]struct{})
+		return
+	case msgResyncEnd:
+		if s.resyncSeen == nil {
+			return
+		}
+		for key := range s.cache {
+			if _, ok := s.resyncSeen[key]; !ok {
+				delete(s.cache, key)
+			}
+		}
+		s.resyncSeen = nil
+		return
+	}
+
+	c, err := ct.ParseAttributes(s.config.Logger, m.payload)
+	if err != nil {
+		s.stats.Errors++
+		s.config.Logger.Printf("could not parse entry: %v", err)
+		return
+	}
+	key, ok := c.TupleKey()
+	if !ok {
+		s.stats.Errors++
+		return
+	}
+	s.stats.Applied++
+
+	switch m.typ {
+	case msgDestroy:
+		delete(s.cache, key)
+	case msgNew:
+		s.cache[key] = c
+	case msgUpdate:
+		s.cache[key] = ct.MergeCon(s.cache[key], c)
+	}
+	if s.resyncSeen != nil && m.typ != msgDestroy {
+		s.resyncSeen[key] = struct{}{}
+	}
+}
+
+// tick acknowledges received messages every AckInterval.
+func (s *Standby) tick(ctx context.Context) {
+	ticker := time.NewTicker(s.config.AckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			if s.unacked > 0 {
+				s.ack()
+			}
+			s.mu.Unlock()
+		}
+	}
+}
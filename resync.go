@@ -0,0 +1,103 @@
+package conntrack
+
+import (
+	"context"
+
+	"github.com/florianl/go-conntrack/internal/unix"
+
+	"github.com/mdlayher/netlink"
+)
+
+// OverflowStats contains counters about overflows of the receive buffer of
+// a socket, that is subscribed to a Netlinkgroup.
+type OverflowStats struct {
+	// Overflows counts how often the kernel reported an overflow (ENOBUFS).
+	Overflows uint64
+
+	// Resyncs counts the dumps performed after an overflow.
+	Resyncs uint64
+
+	// ResyncErrors counts the dumps after an overflow that failed.
+	ResyncErrors uint64
+}
+
+// OverflowStats returns the counters about overflows of the receive buffer.
+func (nfct *Nfct) OverflowStats() OverflowStats {
+	nfct.statsMu.Lock()
+	defer nfct.statsMu.Unlock()
+	return nfct.stats
+}
+
+func (nfct *Nfct) countOverflow() {
+	nfct.statsMu.Lock()
+	nfct.stats.Overflows++
+	nfct.statsMu.Unlock()
+}
+
+// resync signals lost events to fn and, if configured, passes a fresh dump
+// of the table to fn. It returns true, if fn requested to stop.
+func (nfct *Nfct) resync(t Table, fn HookFunc) bool {
+	if fn(Con{Info: &InfoSource{Table: t, Overflow: true}}) != 0 {
+		return true
+	}
+	if !nfct.resyncDump {
+		return false
+	}
+
+	entries, err := nfct.resyncEntries(t)
+	nfct.statsMu.Lock()
+	if err != nil {
+		nfct.stats.ResyncErrors++
+	} else {
+		nfct.stats.Resyncs++
+	}
+	nfct.statsMu.Unlock()
+	if err != nil {
+		nfct.logger.Printf("could not resync after overflow: %v", err)
+		return false
+	}
+
+	for _, c := range entries {
+		if nfct.match != nil && !nfct.match.Match(c) {
+			continue
+		}
+		c.Info = &InfoSource{Table: t, Resync: true}
+		if fn(c) != 0 {
+			return true
+		}
+	}
+	return fn(Con{Info: &InfoSource{Table: t, ResyncDone: true}}) != 0
+}
+
+// resyncEntries dumps the table on a separate socket, as the socket of the
+// subscription would mix up events and the dump. The kernel does not apply the
+// filter of the subscription to the dump, so the entries are filtered here.
+func (nfct *Nfct) resyncEntries(t Table) ([]Con, error) {
+	req, err := dumpRequest(t, Family(unix.AF_UNSPEC))
+	if err != nil {
+		return nil, err
+	}
+	dumper, err := nfct.resyncOpen()
+	if err != nil {
+		return nil, err
+	}
+	defer dumper.Close()
+
+	mask := fieldMask(nfct.eventMask)
+	var entries []Con
+	err = dumper.request(context.Background(), req, func(msg netlink.Message) error {
+		if !nfct.filter.matchDumped(rawMessage(msg)) {
+			return nil
+		}
+		c := Con{}
+		if err := parseConnectionMsg(nfct.logger, &c, msg, int(t), int(msg.Header.Type)&0xF, mask); err != nil {
+			return err
+		}
+		if (Con{}) == c {
+			return nil
+		}
+		entries = append(entries, c)
+		return nil
+	})
+	return entries, err
+}
@@ -0,0 +1,129 @@
+package conntrack
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"syscall"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nltest"
+)
+
+func TestReceiveEventsOverflow(t *testing.T) {
+	// nfgen_family=AF_INET, version=NFNETLINK_V0, res_id=htons(0), CTA_ID=1
+	event := netlink.Message{
+		Header: netlink.Header{Type: netlink.HeaderType(1<<8 | ipctnlMsgCtNew)},
+		Data:   []byte{0x2, 0x0, 0x0, 0x0, 0x8, 0x0, ctaID, 0x0, 0x0, 0x0, 0x0, 0x1},
+	}
+	// nfgen_family=AF_INET, version=NFNETLINK_V0, res_id=htons(0), CTA_ID=2
+	dumped := netlink.Message{
+		Header: netlink.Header{Type: netlink.HeaderType(1<<8 | ipctnlMsgCtNew), Flags: netlink.Multi},
+		Data:   []byte{0x2, 0x0, 0x0, 0x0, 0x8, 0x0, ctaID, 0x0, 0x0, 0x0, 0x0, 0x2},
+	}
+	// nfgen_family=AF_INET, version=NFNETLINK_V0, res_id=htons(0), CTA_ID=3
+	filtered := netlink.Message{
+		Header: netlink.Header{Type: netlink.HeaderType(1<<8 | ipctnlMsgCtNew), Flags: netlink.Multi},
+		Data:   []byte{0x2, 0x0, 0x0, 0x0, 0x8, 0x0, ctaID, 0x0, 0x0, 0x0, 0x0, 0x3},
+	}
+	onlyID2, err := ParseFilter("id 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		resync       bool
+		resyncDump   bool
+		filter       FilterExpr
+		want         []InfoSource
+		wantStats    OverflowStats
+		wantReceives int
+	}{
+		{name: "stop on overflow", wantStats: OverflowStats{Overflows: 1}, wantReceives: 1},
+		{name: "overflow marker", resync: true,
+			want:      []InfoSource{{Table: Conntrack, Overflow: true}, {}},
+			wantStats: OverflowStats{Overflows: 1}, wantReceives: 2},
+		{name: "overflow with dump", resync: true, resyncDump: true,
+			want: []InfoSource{{Table: Conntrack, Overflow: true}, {Table: Conntrack, Resync: true},
+				{Table: Conntrack, ResyncDone: true}, {}},
+			wantStats: OverflowStats{Overflows: 1, Resyncs: 1}, wantReceives: 2},
+		{name: "overflow with filtered dump", resync: true, resyncDump: true, filter: onlyID2,
+			want: []InfoSource{{Table: Conntrack, Overflow: true}, {Table: Conntrack, Resync: true},
+				{Table: Conntrack, ResyncDone: true}, {}},
+			wantStats: OverflowStats{Overflows: 1, Resyncs: 1}, wantReceives: 2},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			logger := log.New(ioutil.Discard, "", 0)
+			var receives int
+			nfct := &Nfct{logger: logger, resyncOnOverflow: tc.resync, resyncDump: tc.resyncDump}
+			nfct.ctx, nfct.ctxCancel = context.WithCancel(context.Background())
+			defer nfct.ctxCancel()
+			AdjustWriteTimeout(nfct, func() error { return nil })
+			if tc.filter != nil {
+				filter, err := buildEventFilter(Conntrack, tc.filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				nfct.filter = filter
+			}
+			nfct.Con = nltest.Dial(func(reqs []netlink.Message) ([]netlink.Message, error) {
+				receives++
+				if receives == 1 {
+					return nil, syscall.ENOBUFS
+				}
+				return []netlink.Message{event}, nil
+			})
+			defer nfct.Con.Close()
+
+			nfct.resyncOpen = func() (*Nfct, error) {
+				dumper := &Nfct{logger: logger}
+				AdjustWriteTimeout(dumper, func() error { return nil })
+				dumper.Con = nltest.Dial(func(reqs []netlink.Message) ([]netlink.Message, error) {
+					if len(reqs) == 0 {
+						return nil, nil
+					}
+					seq := reqs[0].Header.Sequence
+					dumped.Header.Sequence, filtered.Header.Sequence = seq, seq
+					msgs := []netlink.Message{dumped, filtered}
+					if tc.filter == nil {
+						msgs = msgs[:1]
+					}
+					return append(msgs, netlink.Message{
+						Header: netlink.Header{Type: netlink.Done, Flags: netlink.Multi, Sequence: seq},
+						Data:   []byte{0, 0, 0, 0},
+					}), nil
+				})
+				return dumper, nil
+			}
+
+			var got []InfoSource
+			nfct.receiveEvents(Conntrack, func(*Con, netlink.Header) {}, func(c Con) int {
+				if c.Info == nil {
+					got = append(got, InfoSource{})
+					return 1
+				}
+				got = append(got, *c.Info)
+				return 0
+			})
+
+			if len(got) != len(tc.want) {
+				t.Fatalf("unexpected events:\n- want: %#v\n-  got: %#v", tc.want, got)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Fatalf("unexpected event %d:\n- want: %#v\n-  got: %#v", i, tc.want[i], got[i])
+				}
+			}
+			if stats := nfct.OverflowStats(); stats != tc.wantStats {
+				t.Fatalf("unexpected stats:\n- want: %#v\n-  got: %#v", tc.wantStats, stats)
+			}
+			if receives != tc.wantReceives {
+				t.Fatalf("unexpected number of receives: want %d, got %d", tc.wantReceives, receives)
+			}
+		})
+	}
+}
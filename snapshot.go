@@ -0,0 +1,393 @@
+package conntrack
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"time"
+)
+
+// The snapshot file format starts with a header of 24 bytes, followed by the
+// entries. All values are in network byte order.
+//
+//	0          6         8       9          10          18          22         24
+//	+----------+---------+-------+----------+-----------+-----------+----------+
+//	|  magic   | version | table | reserved |  created  |   count   | reserved |
+//	+----------+---------+-------+----------+-----------+-----------+----------+
+//
+// The reserved bytes are written as zero and ignored, when a snapshot is read.
+// Every entry is prefixed by its length as uint32 and contains the netlink
+// attributes of the entry, including the header with its family. An entry is
+// at most as large as a netlink message, that the kernel sends.
+const (
+	snapshotMagic      = "CTSNAP"
+	snapshotVersion    = 1
+	snapshotHeaderSize = 24
+)
+
+// Errors of snapshots
+var (
+	ErrSnapshotFormat  = errors.New("invalid snapshot format")
+	ErrSnapshotVersion = errors.New("unsupported snapshot version")
+)
+
+// Snapshot contains the entries of a conntrack table at a certain time.
+type Snapshot struct {
+	Table   Table
+	Created time.Time
+	Entries []Con
+}
+
+// Snapshot dumps the table t and returns the entries, for which filter
+// returns true. If filter is nil, all entries are included.
+func (nfct *Nfct) Snapshot(t Table, f Family, filter func(Con) bool) (*Snapshot, error) {
+	s := &Snapshot{Table: t, Created: time.Now()}
+	err := nfct.DumpFunc(context.Background(), t, f, func(c Con) error {
+		if filter == nil || filter(c) {
+			s.Entries = append(s.Entries, c)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// WriteTo writes the snapshot to w.
+func (s *Snapshot) WriteTo(w io.Writer) (int64, error) {
+	if s.Table != Conntrack && s.Table != Expected {
+		return 0, ErrUnknownCtTable
+	}
+	logger := log.New(ioutil.Discard, "", 0)
+
+	var n int64
+	bw := bufio.NewWriter(w)
+	header := make([]byte, snapshotHeaderSize)
+	copy(header, snapshotMagic)
+	binary.BigEndian.PutUint16(header[6:8], snapshotVersion)
+	header[8] = byte(s.Table)
+	binary.BigEndian.PutUint64(header[10:18], uint64(s.Created.UnixNano()))
+	binary.BigEndian.PutUint32(header[18:22], uint32(len(s.Entries)))
+	written, err := bw.Write(header)
+	n += int64(written)
+	if err != nil {
+		return n, err
+	}
+
+	length := make([]byte, 4)
+	for _, c := range s.Entries {
+		data, err := marshalSnapshotEntry(logger, s.Table, c)
+		if err != nil {
+			return n, err
+		}
+		binary.BigEndian.PutUint32(length, uint32(len(data)))
+		written, err := bw.Write(length)
+		n += int64(written)
+		if err != nil {
+			return n, err
+		}
+		written, err = bw.Write(data)
+		n += int64(written)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, bw.Flush()
+}
+
+// ReadSnapshot reads a snapshot, that was written by Snapshot.WriteTo.
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	logger := log.New(ioutil.Discard, "", 0)
+	br := bufio.NewReader(r)
+
+	header := make([]byte, snapshotHeaderSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:6], []byte(snapshotMagic)) {
+		return nil, ErrSnapshotFormat
+	}
+	if binary.BigEndian.Uint16(header[6:8]) != snapshotVersion {
+		return nil, ErrSnapshotVersion
+	}
+	s := &Snapshot{
+		Table:   Table(header[8]),
+		Created: time.Unix(0, int64(binary.BigEndian.Uint64(header[10:18]))),
+	}
+	if s.Table != Conntrack && s.Table != Expected {
+		return nil, ErrUnknownCtTable
+	}
+
+	count := binary.BigEndian.Uint32(header[18:22])
+	length := make([]byte, 4)
+	for i := uint32(0); i < count; i++ {
+		if _, err := io.ReadFull(br, length); err != nil {
+			return nil, err
+		}
+		size := binary.BigEndian.Uint32(length)
+		if size < 4 || size > receiveBufferSize {
+			return nil, ErrSnapshotFormat
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return nil, err
+		}
+		c := Con{}
+		var err error
+		if s.Table == Expected {
+			err = extractExpectAttributes(logger, &c, data)
+		} else {
+			err = extractAttributes(logger, &c, data)
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.Entries = append(s.Entries, c)
+	}
+	return s, nil
+}
+
+func marshalSnapshotEntry(logger *log.Logger, t Table, c Con) ([]byte, error) {
+	if t == Expected {
+		c = expectationAttributes(c)
+	} else {
+		c.Info = nil
+	}
+	return MarshalAttributes(logger, familyOf(c), c)
+}
+
+// familyOf returns the family of an entry based on its original tuple or
+// the master tuple of an expectation.
+func familyOf(c Con) Family {
+	tuple := c.Origin
+	if tuple == nil && c.Exp != nil {
+		tuple = c.Exp.Master
+	}
+	if tuple != nil && tuple.Src != nil && tuple.Src.To4() == nil {
+		return IPv6
+	}
+	return IPv4
+}
+
+// expectationAttributes returns the attributes of an expectation, as they are
+// expected by the kernel. Dumped expectations carry the master tuple in Origin.
+func expectationAttributes(c Con) Con {
+	exp := Exp{}
+	if c.Exp != nil {
+		exp = *c.Exp
+	}
+	if exp.Master == nil {
+		exp.Master = c.Origin
+	}
+	return Con{Exp: &exp}
+}
+
+// RemapFunc changes an entry before it is restored. Returning false skips
+// the entry. Nested values have to be replaced instead of being modified,
+// as they are shared with the snapshot.
+type RemapFunc func(c Con) (Con, bool)
+
+// RemapZone moves entries from zone from to zone to.
+func RemapZone(from, to uint16) RemapFunc {
+	return func(c Con) (Con, bool) {
+		zone := uint16(0)
+		if c.Zone != nil {
+			zone = *c.Zone
+		}
+		if zone == from {
+			c.Zone = &to
+		}
+		if c.Exp != nil && c.Exp.Zone != nil && *c.Exp.Zone == from {
+			exp := *c.Exp
+			exp.Zone = &to
+			c.Exp = &exp
+		}
+		return c, true
+	}
+}
+
+// RemapAddress replaces the address from with to in all tuples of an entry.
+func RemapAddress(from, to net.IP) RemapFunc {
+	remap := func(t *IPTuple) *IPTuple {
+		if t == nil {
+			return nil
+		}
+		tuple := *t
+		if tuple.Src != nil && tuple.Src.Equal(from) {
+			tuple.Src = &to
+		}
+		if tuple.Dst != nil && tuple.Dst.Equal(from) {
+			tuple.Dst = &to
+		}
+		return &tuple
+	}
+	return func(c Con) (Con, bool) {
+		c.Origin = remap(c.Origin)
+		c.Reply = remap(c.Reply)
+		if c.Exp != nil {
+			exp := *c.Exp
+			exp.Master = remap(exp.Master)
+			exp.Tuple = remap(exp.Tuple)
+			c.Exp = &exp
+		}
+		return c, true
+	}
+}
+
+// RestoreConfig contains options for Restore.
+type RestoreConfig struct {
+	// Family restricts the restore to IPv4 or IPv6 entries. If not set,
+	// entries of both families are restored.
+	Family Family
+
+	// Remap is applied to every entry in the given order.
+	Remap []RemapFunc
+}
+
+// RestoreResult contains the outcome of Restore.
+type RestoreResult struct {
+	Restored int
+	Skipped  int
+
+	// Failed contains the entries, that could not be restored, and the
+	// reason of their failure.
+	Failed []RestoreError
+}
+
+// RestoreError describes an entry, that could not be restored.
+type RestoreError struct {
+	Entry Con
+	Err   error
+}
+
+// Restore creates the entries of a snapshot. Expectations can only be
+// restored, if their master connections exist, so a snapshot of the
+// Conntrack table has to be restored before the one of the Expected table.
+func (nfct *Nfct) Restore(s *Snapshot, config RestoreConfig) (RestoreResult, error) {
+	var result RestoreResult
+	if s.Table != Conntrack && s.Table != Expected {
+		return result, ErrUnknownCtTable
+	}
+
+entries:
+	for _, entry := range s.Entries {
+		c := entry
+		for _, remap := range config.Remap {
+			var ok bool
+			if c, ok = remap(c); !ok {
+				result.Skipped++
+				continue entries
+			}
+		}
+		f := familyOf(c)
+		if config.Family != 0 && config.Family != f {
+			result.Skipped++
+			continue
+		}
+
+		var attrs Con
+		if s.Table == Expected {
+			attrs = expectationAttributes(c)
+			attrs.Exp.ID = nil
+		} else {
+			attrs = restoreAttributes(c)
+		}
+		if err := nfct.Create(s.Table, f, attrs); err != nil {
+			result.Failed = append(result.Failed, RestoreError{Entry: entry, Err: err})
+			continue
+		}
+		result.Restored++
+	}
+	return result, nil
+}
+
+// restoreAttributes returns the attributes of c, that can be set on creation.
+func restoreAttributes(c Con) Con {
+	attrs := Con{
+		Origin:     c.Origin,
+		Reply:      c.Reply,
+		ProtoInfo:  c.ProtoInfo,
+		Helper:     c.Helper,
+		NatSrc:     c.NatSrc,
+		NatDst:     c.NatDst,
+		SeqAdjOrig: c.SeqAdjOrig,
+		SeqAdjRepl: c.SeqAdjRepl,
+		Status:     c.Status,
+		Mark:       c.Mark,
+		Timeout:    c.Timeout,
+		Zone:       c.Zone,
+		Label:      c.Label,
+	}
+	if attrs.Helper != nil {
+		// The kernel does not accept the information of the helper.
+		attrs.Helper = &Helper{Name: attrs.Helper.Name}
+	}
+
+	// The kernel reports the translation of addresses only by the reply tuple.
+	if attrs.NatSrc == nil && attrs.NatDst == nil {
+		attrs.NatSrc, attrs.NatDst = natFromTuples(c.Origin, c.Reply)
+	}
+
+	if attrs.ProtoInfo != nil && attrs.ProtoInfo.TCP != nil {
+		// Dumped TCP flags come without a mask, which would leave the
+		// flags of the created entry unchanged.
+		tcp := *attrs.ProtoInfo.TCP
+		tcp.FlagsOrig = fullMask(tcp.FlagsOrig)
+		tcp.FlagsReply = fullMask(tcp.FlagsReply)
+		attrs.ProtoInfo = &ProtoInfo{TCP: &tcp}
+	}
+	return attrs
+}
+
+func fullMask(flags *TCPFlags) *TCPFlags {
+	if flags == nil || flags.Flags == nil {
+		return flags
+	}
+	mask := uint8(0xff)
+	return &TCPFlags{Flags: flags.Flags, Mask: &mask}
+}
+
+// natFromTuples derives the translation of addresses and ports from the
+// differences between the original and the reply tuple.
+func natFromTuples(origin, reply *IPTuple) (src, dst *Nat) {
+	if origin == nil || reply == nil {
+		return nil, nil
+	}
+	var origSrcPort, origDstPort, replySrcPort, replyDstPort *uint16
+	if origin.Proto != nil {
+		origSrcPort, origDstPort = origin.Proto.SrcPort, origin.Proto.DstPort
+	}
+	if reply.Proto != nil {
+		replySrcPort, replyDstPort = reply.Proto.SrcPort, reply.Proto.DstPort
+	}
+
+	if origin.Src != nil && reply.Dst != nil &&
+		(!origin.Src.Equal(*reply.Dst) || !equalPort(origSrcPort, replyDstPort)) {
+		src = &Nat{IPMin: reply.Dst, IPMax: reply.Dst}
+		if replyDstPort != nil {
+			src.Proto = &ProtoTuple{SrcPort: replyDstPort, DstPort: replyDstPort}
+		}
+	}
+	if origin.Dst != nil && reply.Src != nil &&
+		(!origin.Dst.Equal(*reply.Src) || !equalPort(origDstPort, replySrcPort)) {
+		dst = &Nat{IPMin: reply.Src, IPMax: reply.Src}
+		if replySrcPort != nil {
+			dst.Proto = &ProtoTuple{SrcPort: replySrcPort, DstPort: replySrcPort}
+		}
+	}
+	return src, dst
+}
+
+func equalPort(a, b *uint16) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -0,0 +1,179 @@
+package conntrack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/florianl/go-conntrack/internal/unix"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nltest"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	s := &Snapshot{
+		Table:   Conntrack,
+		Created: time.Unix(1600000000, 42),
+		Entries: []Con{testCon(40000), testCon(40001)},
+	}
+	var buf bytes.Buffer
+	n, err := s.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Fatalf("unexpected number of written bytes: %d", n)
+	}
+
+	got, err := ReadSnapshot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Table != Conntrack || !got.Created.Equal(s.Created) || len(got.Entries) != 2 {
+		t.Fatalf("unexpected snapshot: %#v", got)
+	}
+	c := got.Entries[1]
+	if *c.Origin.Proto.SrcPort != 40001 || !c.Reply.Src.Equal(net.ParseIP("10.0.0.2")) {
+		t.Fatalf("unexpected tuples: %v %v", c.Origin, c.Reply)
+	}
+	if *c.ProtoInfo.TCP.WScaleOrig != 7 || *c.ProtoInfo.TCP.FlagsOrig.Flags != 0x09 {
+		t.Fatalf("unexpected TCP information: %#v", c.ProtoInfo.TCP)
+	}
+	if *c.Helper.Name != "ftp" || *c.SeqAdjOrig.OffsetAfter != 1000 || *c.Zone != 1 ||
+		*c.Mark != 0x42 || *c.Timeout != 600 || !bytes.Equal(*c.Label, []byte{0x1, 0x0, 0x0, 0x0}) {
+		t.Fatalf("unexpected entry: %#v", c)
+	}
+
+	if _, err := ReadSnapshot(bytes.NewReader([]byte("CTSNAX" + string(make([]byte, 18))))); err != ErrSnapshotFormat {
+		t.Fatalf("unexpected error for invalid magic: %v", err)
+	}
+	header := make([]byte, snapshotHeaderSize)
+	copy(header, snapshotMagic)
+	binary.BigEndian.PutUint16(header[6:8], snapshotVersion+1)
+	if _, err := ReadSnapshot(bytes.NewReader(header)); err != ErrSnapshotVersion {
+		t.Fatalf("unexpected error for unknown version: %v", err)
+	}
+
+	// the length of an entry exceeds the size of a netlink message
+	binary.BigEndian.PutUint16(header[6:8], snapshotVersion)
+	header[8] = byte(Conntrack)
+	binary.BigEndian.PutUint32(header[18:22], 1)
+	entry := []byte{0xff, 0xff, 0xff, 0xff}
+	if _, err := ReadSnapshot(bytes.NewReader(append(header, entry...))); err != ErrSnapshotFormat {
+		t.Fatalf("unexpected error for oversized entry: %v", err)
+	}
+}
+
+func TestSnapshotExpected(t *testing.T) {
+	master := testCon(40000).Origin
+	src := net.ParseIP("192.0.2.1")
+	dst := net.ParseIP("192.0.2.2")
+	proto := uint8(6)
+	port := uint16(20)
+	timeout := uint32(30)
+	helper := "ftp"
+	id := uint32(7)
+
+	// dumped expectations carry the master tuple in Origin
+	s := &Snapshot{Table: Expected, Entries: []Con{{
+		Origin: master,
+		Exp: &Exp{
+			Tuple:      &IPTuple{Src: &src, Dst: &dst, Proto: &ProtoTuple{Number: &proto, DstPort: &port}},
+			Mask:       &IPTuple{Src: &src, Dst: &dst, Proto: &ProtoTuple{Number: &proto, DstPort: &port}},
+			Timeout:    &timeout,
+			HelperName: &helper,
+			ID:         &id,
+		},
+	}}}
+	var buf bytes.Buffer
+	if _, err := s.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadSnapshot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := got.Entries[0]
+	if c.Origin == nil || *c.Origin.Proto.SrcPort != 40000 {
+		t.Fatalf("unexpected master tuple: %v", c.Origin)
+	}
+	if c.Exp == nil || *c.Exp.Timeout != 30 || *c.Exp.HelperName != "ftp" || *c.Exp.Tuple.Proto.DstPort != 20 {
+		t.Fatalf("unexpected expectation: %#v", c.Exp)
+	}
+
+	attrs := expectationAttributes(c)
+	if attrs.Origin != nil || attrs.Exp.Master == nil {
+		t.Fatalf("master tuple was not moved: %#v", attrs)
+	}
+}
+
+func TestRestoreAttributes(t *testing.T) {
+	c := testCon(40000)
+	attrs := restoreAttributes(c)
+	if attrs.NatSrc != nil {
+		t.Fatalf("unexpected source NAT: %#v", attrs.NatSrc)
+	}
+	if attrs.NatDst == nil || !attrs.NatDst.IPMin.Equal(net.ParseIP("10.0.0.2")) || *attrs.NatDst.Proto.SrcPort != 8080 {
+		t.Fatalf("unexpected destination NAT: %#v", attrs.NatDst)
+	}
+	if *attrs.ProtoInfo.TCP.FlagsOrig.Mask != 0xff {
+		t.Fatalf("TCP flags are not masked")
+	}
+	if *c.ProtoInfo.TCP.FlagsOrig.Mask != 0 {
+		t.Fatalf("original entry was modified")
+	}
+
+	remapped, _ := RemapAddress(net.ParseIP("192.0.2.1"), net.ParseIP("198.51.100.1"))(c)
+	remapped, _ = RemapZone(1, 5)(remapped)
+	if !remapped.Origin.Src.Equal(net.ParseIP("198.51.100.1")) || !remapped.Reply.Dst.Equal(net.ParseIP("198.51.100.1")) {
+		t.Fatalf("address was not remapped: %v %v", remapped.Origin, remapped.Reply)
+	}
+	if *remapped.Zone != 5 || *c.Zone != 1 {
+		t.Fatalf("unexpected zones: %d %d", *remapped.Zone, *c.Zone)
+	}
+	if !c.Origin.Src.Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("original entry was modified")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	nfct := &Nfct{}
+	AdjustWriteTimeout(nfct, func() error { return nil })
+	nfct.Con = nltest.Dial(func(reqs []netlink.Message) ([]netlink.Message, error) {
+		if len(reqs) == 0 {
+			return nil, nil
+		}
+		code := int32(0)
+		// the second entry exists already
+		if bytes.Contains(reqs[0].Data, []byte{0x9c, 0x41}) {
+			code = -int32(unix.EEXIST)
+		}
+		data := make([]byte, 20)
+		binary.LittleEndian.PutUint32(data, uint32(code))
+		return []netlink.Message{{
+			Header: netlink.Header{Type: netlink.Error, Sequence: reqs[0].Header.Sequence},
+			Data:   data,
+		}}, nil
+	})
+	defer nfct.Con.Close()
+
+	s := &Snapshot{Table: Conntrack, Entries: []Con{testCon(40000), testCon(40001)}}
+	result, err := nfct.Restore(s, RestoreConfig{Family: IPv4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Restored != 1 || len(result.Failed) != 1 {
+		t.Fatalf("unexpected result: %#v", result)
+	}
+	if *result.Failed[0].Entry.Origin.Proto.SrcPort != 40001 || !errors.Is(result.Failed[0].Err, unix.EEXIST) {
+		t.Fatalf("unexpected failure: %#v", result.Failed[0])
+	}
+
+	result, err = nfct.Restore(s, RestoreConfig{Family: IPv6})
+	if err != nil || result.Skipped != 2 {
+		t.Fatalf("unexpected result for other family: %#v (%v)", result, err)
+	}
+}
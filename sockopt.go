@@ -0,0 +1,121 @@
+package conntrack
+
+import (
+	"github.com/florianl/go-conntrack/internal/unix"
+
+	"github.com/mdlayher/netlink"
+)
+
+// ReadBufferSize returns the effective size of the receive buffer of the
+// socket in bytes, as reported by the kernel.
+func (nfct *Nfct) ReadBufferSize() (int, error) {
+	return getBufferSize(nfct.Con, unix.SO_RCVBUF)
+}
+
+// WriteBufferSize returns the effective size of the send buffer of the
+// socket in bytes, as reported by the kernel.
+func (nfct *Nfct) WriteBufferSize() (int, error) {
+	return getBufferSize(nfct.Con, unix.SO_SNDBUF)
+}
+
+func (nfct *Nfct) applySocketOptions(config *Config) error {
+	if err := setSocketOptions(nfct.Con, config); err != nil {
+		return err
+	}
+	nfct.readBufferSize = config.ReadBufferSize
+	nfct.readBufferMaxSize = config.ReadBufferMaxSize
+	return nil
+}
+
+// setSocketOptions applies the buffer sizes and options of config to con.
+func setSocketOptions(con *netlink.Conn, config *Config) error {
+	if config.ReadBufferSize > 0 {
+		if err := setBufferSize(con, unix.SO_RCVBUFFORCE, unix.SO_RCVBUF, config.ReadBufferSize); err != nil {
+			return err
+		}
+	}
+	if config.WriteBufferSize > 0 {
+		if err := setBufferSize(con, unix.SO_SNDBUFFORCE, unix.SO_SNDBUF, config.WriteBufferSize); err != nil {
+			return err
+		}
+	}
+	if config.BroadcastError {
+		if err := con.SetOption(netlink.BroadcastError, true); err != nil {
+			return err
+		}
+	}
+	if config.NoENOBUFS {
+		if err := con.SetOption(netlink.NoENOBUFS, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// growReadBuffer doubles the size of the receive buffer up to readBufferMaxSize.
+func (nfct *Nfct) growReadBuffer() {
+	if nfct.readBufferMaxSize <= 0 {
+		return
+	}
+
+	size := nfct.readBufferSize
+	if size <= 0 {
+		current, err := nfct.ReadBufferSize()
+		if err != nil {
+			nfct.logger.Printf("could not get size of receive buffer: %v", err)
+			return
+		}
+		// The kernel reports twice the size that was set, to account for
+		// its bookkeeping overhead.
+		size = current / 2
+	}
+	if size >= nfct.readBufferMaxSize {
+		return
+	}
+
+	size *= 2
+	if size > nfct.readBufferMaxSize {
+		size = nfct.readBufferMaxSize
+	}
+	if err := setBufferSize(nfct.Con, unix.SO_RCVBUFFORCE, unix.SO_RCVBUF, size); err != nil {
+		nfct.logger.Printf("could not grow receive buffer: %v", err)
+		return
+	}
+	nfct.readBufferSize = size
+}
+
+// setBufferSize tries to set the buffer size with force first, as this
+// requires CAP_NET_ADMIN, and falls back to opt.
+func setBufferSize(con *netlink.Conn, force, opt, size int) error {
+	rc, err := con.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	if err := rc.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, force, size)
+		if sockErr != nil {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, opt, size)
+		}
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
+
+func getBufferSize(con *netlink.Conn, opt int) (int, error) {
+	rc, err := con.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var size int
+	var sockErr error
+	if err := rc.Control(func(fd uintptr) {
+		size, sockErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, opt)
+	}); err != nil {
+		return 0, err
+	}
+	return size, sockErr
+}
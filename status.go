@@ -0,0 +1,158 @@
+package conntrack
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/florianl/go-conntrack/internal/unix"
+	"golang.org/x/net/bpf"
+)
+
+// Status holds the bits of the status of a connection as defined in
+// include/uapi/linux/netfilter/nf_conntrack_common.h
+type Status uint32
+
+// Bits of Status
+const (
+	StatusExpected Status = 1 << iota
+	StatusSeenReply
+	StatusAssured
+	StatusConfirmed
+	StatusSrcNat
+	StatusDstNat
+	StatusSeqAdjust
+	StatusSrcNatDone
+	StatusDstNatDone
+	StatusDying
+	StatusFixedTimeout
+	StatusTemplate
+	StatusUntracked
+	StatusHelper
+	StatusOffload
+	StatusHWOffload
+
+	// StatusNatMask contains the bits of source and destination NAT.
+	StatusNatMask = StatusSrcNat | StatusDstNat
+)
+
+// String returns the names of the bits, that are set, separated by "|".
+func (s Status) String() string {
+	if s == 0 {
+		return "0"
+	}
+	var names []string
+	for bit := 0; bit < 32; bit++ {
+		if s&(1<<uint(bit)) != 0 {
+			names = append(names, statusBitName(bit))
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// Names of the bits of Status
+var statusBitNames = []string{
+	"EXPECTED",
+	"SEEN_REPLY",
+	"ASSURED",
+	"CONFIRMED",
+	"SRC_NAT",
+	"DST_NAT",
+	"SEQ_ADJUST",
+	"SRC_NAT_DONE",
+	"DST_NAT_DONE",
+	"DYING",
+	"FIXED_TIMEOUT",
+	"TEMPLATE",
+	"UNTRACKED",
+	"HELPER",
+	"OFFLOAD",
+	"HW_OFFLOAD",
+}
+
+func statusBitName(bit int) string {
+	if bit < len(statusBitNames) {
+		return statusBitNames[bit]
+	}
+	return strconv.Itoa(bit)
+}
+
+// TCPState is the state of a TCP connection as defined in
+// include/uapi/linux/netfilter/nf_conntrack_tcp.h
+type TCPState uint8
+
+// States of TCP connections
+const (
+	TCPStateNone TCPState = iota
+	TCPStateSynSent
+	TCPStateSynRecv
+	TCPStateEstablished
+	TCPStateFinWait
+	TCPStateCloseWait
+	TCPStateLastAck
+	TCPStateTimeWait
+	TCPStateClose
+	TCPStateSynSent2
+)
+
+// Names of the states of TCP connections
+var tcpStateNames = []string{
+	"NONE",
+	"SYN_SENT",
+	"SYN_RECV",
+	"ESTABLISHED",
+	"FIN_WAIT",
+	"CLOSE_WAIT",
+	"LAST_ACK",
+	"TIME_WAIT",
+	"CLOSE",
+	"SYN_SENT2",
+}
+
+// String returns the name of the state, e.g. ESTABLISHED, or its decimal
+// representation for unknown states.
+func (s TCPState) String() string {
+	if int(s) < len(tcpStateNames) {
+		return tcpStateNames[s]
+	}
+	return strconv.Itoa(int(s))
+}
+
+// statusExpr matches the status of a connection against a mask.
+type statusExpr struct {
+	mask Status
+	any  bool
+}
+
+// StatusAll returns an expression, that matches if all bits of mask are set
+// in the status of a connection.
+func StatusAll(mask Status) FilterExpr {
+	return statusExpr{mask: mask}
+}
+
+// StatusAny returns an expression, that matches if any bit of mask is set in
+// the status of a connection.
+func StatusAny(mask Status) FilterExpr {
+	return statusExpr{mask: mask, any: true}
+}
+
+// StatusNone returns an expression, that matches if no bit of mask is set in
+// the status of a connection.
+func StatusNone(mask Status) FilterExpr {
+	return Not(StatusAny(mask))
+}
+
+func (e statusExpr) compile(c *filterCompiler, t, f bpfLabel) error {
+	check, ok := c.checks[AttrStatus]
+	if !ok {
+		return ErrFilterAttributeNotImplemented
+	}
+	c.loadAttr(check, f)
+	c.loadValue(check, 0)
+	if e.any {
+		c.prog.jump(unix.BPF_JSET, uint32(e.mask), t, f)
+		return nil
+	}
+	c.prog.emit(bpf.RawInstruction{Op: unix.BPF_ALU | unix.BPF_AND | unix.BPF_K, K: uint32(e.mask)})
+	c.prog.jump(unix.BPF_JEQ, uint32(e.mask), t, f)
+	return nil
+}
@@ -0,0 +1,78 @@
+package conntrack
+
+import (
+	"testing"
+)
+
+func TestStatusString(t *testing.T) {
+	tests := []struct {
+		status Status
+		want   string
+	}{
+		{status: 0, want: "0"},
+		{status: StatusAssured, want: "ASSURED"},
+		{status: StatusSeenReply | StatusAssured | StatusDstNat, want: "SEEN_REPLY|ASSURED|DST_NAT"},
+		{status: StatusHWOffload | 1<<20, want: "HW_OFFLOAD|20"},
+	}
+	for _, tc := range tests {
+		if got := tc.status.String(); got != tc.want {
+			t.Fatalf("unexpected name of %#x: %s", uint32(tc.status), got)
+		}
+	}
+}
+
+func TestTCPStateString(t *testing.T) {
+	for state, want := range map[TCPState]string{
+		TCPStateNone:        "NONE",
+		TCPStateEstablished: "ESTABLISHED",
+		TCPStateSynSent2:    "SYN_SENT2",
+		42:                  "42",
+	} {
+		if got := state.String(); got != want {
+			t.Fatalf("unexpected name of state %d: %s", uint8(state), got)
+		}
+	}
+}
+
+func TestStatusExpr(t *testing.T) {
+	event := func(status Status) []byte {
+		c := testCon(40000)
+		bits := uint32(status)
+		c.Status = &bits
+		return eventMessage(t, c)
+	}
+	assured := event(StatusConfirmed | StatusSeenReply | StatusAssured)
+	dnat := event(StatusConfirmed | StatusDstNat)
+
+	tests := []struct {
+		name  string
+		expr  FilterExpr
+		event []byte
+		want  uint32
+	}{
+		{name: "all", expr: StatusAll(StatusSeenReply | StatusAssured), event: assured, want: bpfVerdictAccept},
+		{name: "not all", expr: StatusAll(StatusAssured | StatusDstNat), event: assured, want: bpfVerdictReject},
+		{name: "any", expr: StatusAny(StatusNatMask), event: dnat, want: bpfVerdictAccept},
+		{name: "not any", expr: StatusAny(StatusNatMask), event: assured, want: bpfVerdictReject},
+		{name: "none", expr: StatusNone(StatusNatMask), event: assured, want: bpfVerdictAccept},
+		{name: "not none", expr: StatusNone(StatusNatMask), event: dnat, want: bpfVerdictReject},
+		{name: "combined", expr: And(StatusAll(StatusDstNat), StatusNone(StatusAssured)), event: dnat, want: bpfVerdictAccept},
+		{name: "empty all", expr: StatusAll(0), event: dnat, want: bpfVerdictAccept},
+		{name: "empty any", expr: StatusAny(0), event: dnat, want: bpfVerdictReject},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			raw, err := compileFilterExpr(Conntrack, tc.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := runFilter(raw, tc.event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Fatalf("unexpected verdict %#x, filter:\n%s", got, fmtRawInstructions(raw))
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package conntrack
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// TupleKey identifies a connection by its original tuple and zone. It is
+// comparable and can therefore be used as key of a map.
+type TupleKey struct {
+	Src      [16]byte
+	Dst      [16]byte
+	L4Proto  uint8
+	SrcPort  uint16
+	DstPort  uint16
+	IcmpType uint8
+	IcmpCode uint8
+	IcmpID   uint16
+	Zone     uint16
+}
+
+// TupleKey returns the key of the connection based on its original tuple and
+// zone. It returns false, if the original tuple is not available.
+func (c Con) TupleKey() (TupleKey, bool) {
+	var key TupleKey
+	if c.Origin == nil || c.Origin.Src == nil || c.Origin.Dst == nil {
+		return key, false
+	}
+	key.Src = ipKey(*c.Origin.Src)
+	key.Dst = ipKey(*c.Origin.Dst)
+
+	if p := c.Origin.Proto; p != nil {
+		if p.Number != nil {
+			key.L4Proto = *p.Number
+		}
+		if p.SrcPort != nil {
+			key.SrcPort = *p.SrcPort
+		}
+		if p.DstPort != nil {
+			key.DstPort = *p.DstPort
+		}
+		if p.IcmpType != nil {
+			key.IcmpType = *p.IcmpType
+		} else if p.Icmpv6Type != nil {
+			key.IcmpType = *p.Icmpv6Type
+		}
+		if p.IcmpCode != nil {
+			key.IcmpCode = *p.IcmpCode
+		} else if p.Icmpv6Code != nil {
+			key.IcmpCode = *p.Icmpv6Code
+		}
+		if p.IcmpID != nil {
+			key.IcmpID = *p.IcmpID
+		} else if p.Icmpv6ID != nil {
+			key.IcmpID = *p.Icmpv6ID
+		}
+	}
+
+	if c.Zone != nil {
+		key.Zone = *c.Zone
+	} else if c.Origin.Zone != nil {
+		key.Zone = *c.Origin.Zone
+	}
+	return key, true
+}
+
+func ipKey(ip net.IP) [16]byte {
+	var key [16]byte
+	copy(key[:], ip.To16())
+	return key
+}
+
+// String returns a human readable representation of the key.
+func (k TupleKey) String() string {
+	src := net.IP(k.Src[:])
+	dst := net.IP(k.Dst[:])
+	var s string
+	switch k.L4Proto {
+	case 1, 58:
+		s = fmt.Sprintf("%s %s -> %s type %d code %d id %d", ProtoName(k.L4Proto), src, dst, k.IcmpType, k.IcmpCode, k.IcmpID)
+	default:
+		s = fmt.Sprintf("%s %s -> %s", ProtoName(k.L4Proto),
+			net.JoinHostPort(src.String(), strconv.Itoa(int(k.SrcPort))),
+			net.JoinHostPort(dst.String(), strconv.Itoa(int(k.DstPort))))
+	}
+	if k.Zone != 0 {
+		s += fmt.Sprintf(" zone %d", k.Zone)
+	}
+	return s
+}
+
+var protoNames = map[uint8]string{
+	1:   "icmp",
+	6:   "tcp",
+	17:  "udp",
+	33:  "dccp",
+	47:  "gre",
+	58:  "icmpv6",
+	132: "sctp",
+	136: "udplite",
+}
+
+// ProtoName returns the name of the layer 4 protocol proto, e.g. tcp, or its
+// decimal representation for unknown protocols.
+func ProtoName(proto uint8) string {
+	if name, ok := protoNames[proto]; ok {
+		return name
+	}
+	return strconv.Itoa(int(proto))
+}
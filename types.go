@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/florianl/go-conntrack/internal/unix"
@@ -64,9 +65,60 @@ type Config struct {
 	// AddConntrackInformation enriches Con and provides additional information of
 	// the Netlink/Conntrack origin.
 	AddConntrackInformation bool
+
+	// ResyncOnOverflow keeps Register and RegisterFiltered receiving events, if
+	// the receive buffer of the socket overflows (ENOBUFS). Instead of stopping,
+	// a Con with Info.Overflow set is passed to the HookFunc to signal that events
+	// have been lost.
+	ResyncOnOverflow bool
+
+	// ResyncDump performs a fresh Dump of the table after an overflow, so that
+	// consumers can reconcile their state. Every dumped entry is passed to the
+	// HookFunc with Info.Resync set, followed by a Con with Info.ResyncDone set.
+	// The dumped entries are filtered like the events of the subscription.
+	// ResyncDump only has an effect if ResyncOnOverflow is set.
+	ResyncDump bool
+
+	// ReadBufferSize sets the size of the receive buffer of the socket in bytes.
+	// If the process has the CAP_NET_ADMIN capability, SO_RCVBUFFORCE is used
+	// to exceed the limit of net.core.rmem_max.
+	ReadBufferSize int
+
+	// WriteBufferSize sets the size of the send buffer of the socket in bytes.
+	// If the process has the CAP_NET_ADMIN capability, SO_SNDBUFFORCE is used
+	// to exceed the limit of net.core.wmem_max.
+	WriteBufferSize int
+
+	// ReadBufferMaxSize enables the adaptive growth of the receive buffer.
+	// After each overflow the size of the receive buffer is doubled, until
+	// it reaches ReadBufferMaxSize bytes.
+	ReadBufferMaxSize int
+
+	// BroadcastError enables NETLINK_BROADCAST_ERROR, which reports errors
+	// on delivering events to this socket.
+	BroadcastError bool
+
+	// NoENOBUFS enables NETLINK_NO_ENOBUFS, which suppresses the reporting
+	// of receive buffer overflows. With NoENOBUFS set, lost events can not
+	// be detected and ResyncOnOverflow has no effect.
+	NoENOBUFS bool
+
+	// DecodeMask selects the attributes of the Conntrack table, that are
+	// decoded into Con by Dump, Query, Get and Register. Other attributes are
+	// skipped without being parsed. If not set, all attributes are decoded.
+	// With FieldRaw, the undecoded message is kept in Con.Raw.
+	DecodeMask Field
+
+	// MaxConcurrentRequests limits the number of requests, like Dump, Get or
+	// Update, that are processed in parallel by goroutines sharing an Nfct.
+	// Each of them uses its own socket in the same network namespace, which
+	// is opened on demand. If not set, requests are serialized on the socket
+	// of Nfct.
+	MaxConcurrentRequests int
 }
 
-// Nfct represents a conntrack handler
+// Nfct represents a conntrack handler. Requests are safe for concurrent use
+// by multiple goroutines.
 type Nfct struct {
 	// Con is the pure representation of a netlink socket
 	Con *netlink.Conn
@@ -78,12 +130,33 @@ type Nfct struct {
 	debug bool
 
 	setWriteTimeout func() error
+	writeTimeout    time.Duration
+
+	pool     *connPool
+	poolOnce sync.Once
 
 	ctx       context.Context
 	ctxCancel context.CancelFunc
 	shutdown  chan struct{}
 
 	addConntrackInformation bool
+
+	resyncOnOverflow bool
+	resyncDump       bool
+	resyncOpen       func() (*Nfct, error)
+
+	readBufferSize    int
+	readBufferMaxSize int
+
+	decodeMask Field
+	eventMask  Field
+	// filter of the events, that are received by receiveEvents
+	filter eventFilter
+	// match selects the events and resynced entries of RegisterMatching
+	match Predicate
+
+	statsMu sync.Mutex
+	stats   OverflowStats
 }
 
 // adjust the WriteTimeout (mostly for testing)
@@ -205,6 +278,8 @@ type Exp struct {
 type Nat struct {
 	IPMin *net.IP
 	IPMax *net.IP
+	// Proto contains the range of ports, that are used for the translation.
+	// SrcPort is the lower and DstPort the upper bound.
 	Proto *ProtoTuple
 }
 
@@ -219,6 +294,7 @@ type Con struct {
 	CounterReply  *Counter
 	Helper        *Helper
 	NatSrc        *Nat
+	NatDst        *Nat
 	SeqAdjOrig    *SeqAdj
 	SeqAdjRepl    *SeqAdj
 	ID            *uint32
@@ -234,6 +310,11 @@ type Con struct {
 	Exp           *Exp
 	Label         *[]byte
 	LabelMask     *[]byte
+
+	// Raw contains the undecoded message of the connection, if only a part
+	// of its attributes was decoded due to a DecodeMask, that contains
+	// FieldRaw. It can be decoded by ParseAttributes or Entry.Decode.
+	Raw *[]byte
 }
 
 // InfoSource provides further information from Netlink about a connection.
@@ -243,6 +324,17 @@ type InfoSource struct {
 
 	// NetlinkGroup this information originates from.
 	NetlinkGroup NetlinkGroup
+
+	// Overflow is set on an otherwise empty Con, if events have been lost
+	// because the receive buffer of the socket overflowed.
+	Overflow bool
+
+	// Resync is set, if the Con is the result of a Dump after an overflow.
+	Resync bool
+
+	// ResyncDone is set on an otherwise empty Con, once all entries of a
+	// Dump after an overflow have been passed on.
+	ResyncDone bool
 }
 
 // CPUStat contains various conntrack related per CPU statistics
@@ -267,6 +359,15 @@ type CPUStat struct {
 	ExpDelete *uint32
 }
 
+// GlobalStats contains global conntrack related statistics
+type GlobalStats struct {
+	// Number of entries in the table
+	Entries *uint32
+
+	// Maximum number of entries in the table - only available for Linux >= 5.1
+	MaxEntries *uint32
+}
+
 // Table specifies the subsystem of conntrack
 type Table int
 